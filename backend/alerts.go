@@ -0,0 +1,248 @@
+package main
+
+// Alerts: who hears about which printer events.
+//
+// Three kinds of subscriber, each opting in to the events it wants:
+//
+//   * owner   - the person a print belongs to, by the file naming convention.
+//     Their alerts land in an inbox anyone can read by name, and optionally go
+//     to a URL of their choosing (an ntfy.sh topic works well).
+//   * admin   - a named admin account, with an inbox behind the admin login.
+//   * webhook - any URL, sent the event as JSON.
+//
+// Subscriptions are managed by admins, since a webhook makes the server call
+// out to an address somebody typed in.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// Webhooks are posted by this many workers, from a queue this long, so a
+	// burst of events or a hung endpoint cannot pile up goroutines
+	webhookWorkers = 4
+	webhookBacklog = 256
+)
+
+// AlertSubscription is one subscriber's opt-in to a set of events.
+type AlertSubscription struct {
+	gorm.Model
+	Kind string `json:"kind"` // owner, admin, webhook
+	// The owner's name or the admin's username; empty for a plain webhook
+	Name string `json:"name" gorm:"index"`
+	// Where to POST the event. Required for webhooks, optional otherwise.
+	// Anyone with a webhook or ntfy URL can post to it, so it is encrypted
+	// like an access code.
+	URL string `json:"url" gorm:"serializer:secret"`
+	// Comma separated event types, e.g. "print_finished,print_failed"
+	Events string `json:"events"`
+}
+
+// Notification is an alert kept for an owner or admin to read later.
+type Notification struct {
+	gorm.Model
+	RecipientKind string     `json:"recipient_kind" gorm:"index"` // owner or admin
+	RecipientName string     `json:"recipient_name" gorm:"index"`
+	Type          string     `json:"type"`
+	PrinterID     string     `json:"printer_id"`
+	PrinterName   string     `json:"printer_name"`
+	FileName      string     `json:"file_name"`
+	JobID         *uint      `json:"job_id"`
+	Message       string     `json:"message"`
+	ReadAt        *time.Time `json:"read_at"`
+}
+
+// wants reports whether the subscription opted in to an event type.
+func (s AlertSubscription) wants(eventType string) bool {
+	for _, t := range strings.Split(s.Events, ",") {
+		if strings.TrimSpace(t) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether an event should reach this subscriber at all.
+// Owners only hear about their own prints; admins and webhooks hear everything
+// they opted in to.
+func (s AlertSubscription) matches(event PrinterEvent) bool {
+	if !s.wants(event.Type) {
+		return false
+	}
+	if s.Kind == "owner" {
+		return event.Owner != "" && strings.EqualFold(s.Name, event.Owner)
+	}
+	return true
+}
+
+// normalizeAlertSubscription checks and tidies a subscription from the admin
+// page before it is saved.
+func normalizeAlertSubscription(s *AlertSubscription) error {
+	s.Kind = strings.ToLower(strings.TrimSpace(s.Kind))
+	s.Name = strings.TrimSpace(s.Name)
+	s.URL = strings.TrimSpace(s.URL)
+
+	switch s.Kind {
+	case "owner":
+		if s.Name == "" {
+			return fmt.Errorf("an owner subscription needs the owner's name")
+		}
+		s.Name = normalizeOwner(s.Name)
+		if s.Name == "" {
+			return fmt.Errorf("an owner subscription needs the owner's name")
+		}
+	case "admin":
+		if s.Name == "" {
+			return fmt.Errorf("an admin subscription needs the admin's username")
+		}
+	case "webhook":
+		if s.URL == "" {
+			return fmt.Errorf("a webhook needs a URL")
+		}
+	default:
+		return fmt.Errorf("kind must be owner, admin or webhook")
+	}
+
+	if s.URL != "" {
+		parsed, err := url.Parse(s.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("the URL must be a full http:// or https:// address")
+		}
+	}
+
+	var events []string
+	for _, t := range strings.Split(s.Events, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !eventTypes[t] {
+			return fmt.Errorf("unknown event type %q", t)
+		}
+		events = append(events, t)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("choose at least one event to be alerted about")
+	}
+	s.Events = strings.Join(events, ",")
+	return nil
+}
+
+// alertDispatcher delivers printer events to the subscribers who asked for them.
+type alertDispatcher struct {
+	db       *gorm.DB
+	client   *http.Client
+	webhooks chan webhookDelivery
+}
+
+// webhookDelivery is one event waiting to be posted to one URL.
+type webhookDelivery struct {
+	target string
+	event  PrinterEvent
+}
+
+func newAlertDispatcher(db *gorm.DB) *alertDispatcher {
+	d := &alertDispatcher{
+		db:       db,
+		client:   &http.Client{Timeout: webhookTimeout},
+		webhooks: make(chan webhookDelivery, webhookBacklog),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go d.deliverWebhooks()
+	}
+	return d
+}
+
+// handle is the event bus subscriber.
+func (d *alertDispatcher) handle(event PrinterEvent) {
+	var subscriptions []AlertSubscription
+	if err := d.db.Find(&subscriptions).Error; err != nil {
+		log.Printf("alerts: could not load subscriptions: %v", err)
+		return
+	}
+
+	for _, s := range subscriptions {
+		if !s.matches(event) {
+			continue
+		}
+
+		if s.Kind == "owner" || s.Kind == "admin" {
+			note := Notification{
+				RecipientKind: s.Kind,
+				RecipientName: s.Name,
+				Type:          event.Type,
+				PrinterID:     event.PrinterID,
+				PrinterName:   event.PrinterName,
+				FileName:      event.FileName,
+				Message:       event.Message,
+			}
+			if event.JobID != 0 {
+				jobID := event.JobID
+				note.JobID = &jobID
+			}
+			if err := d.db.Create(&note).Error; err != nil {
+				log.Printf("alerts: could not store notification for %s %s: %v", s.Kind, s.Name, err)
+			}
+		}
+
+		if s.URL != "" {
+			d.queueWebhook(webhookDelivery{target: s.URL, event: event})
+		}
+	}
+}
+
+// queueWebhook hands a webhook to the workers. A slow endpoint must not hold
+// up everybody else's alerts, so when they are that far behind it is dropped.
+func (d *alertDispatcher) queueWebhook(delivery webhookDelivery) {
+	select {
+	case d.webhooks <- delivery:
+	default:
+		log.Printf("alerts: webhook queue full, dropped %s for %s", delivery.event.Type, delivery.event.PrinterName)
+	}
+}
+
+// deliverWebhooks is one worker, posting queued webhooks for good.
+func (d *alertDispatcher) deliverWebhooks() {
+	for delivery := range d.webhooks {
+		if err := d.post(delivery.target, delivery.event); err != nil {
+			log.Printf("alerts: webhook %s: %v", delivery.target, err)
+		}
+	}
+}
+
+// post sends one event as JSON.
+func (d *alertDispatcher) post(target string, event PrinterEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// ntfy.sh and similar services show this as the notification title
+	req.Header.Set("Title", event.Message)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+// Resumable uploads.
+//
+// A 150 MB plate sent in one request over the campus wifi often dies part way
+// and has to start again from nothing. A chunked upload instead stages the
+// file on the server a piece at a time:
+//
+//  1. POST /api/printers/:id/uploads with the name, size and SHA-256 opens a
+//     session and says how big a chunk may be.
+//  2. PUT /api/uploads/:token with Upload-Offset set sends the next chunk. A
+//     chunk at the wrong offset is refused with the offset the server has, so
+//     after a dropped connection the browser asks (GET) and carries on from
+//     there.
+//  3. POST /api/uploads/:token/complete checks the whole file against the hash
+//     and the same checks as a direct upload, then queues it for the printer
+//     as an upload job (see upload_jobs.go).
+//
+// GET /api/uploads/:token reports both legs: how much has reached the server,
+// and once the job is running, how much has reached the printer.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Small enough that a dropped chunk costs little on bad wifi
+const uploadChunkBytes = 8 * 1024 * 1024
+
+// UploadSession is an upload staged on the server: a chunked upload still
+// arriving, or any upload waiting for or on its way to the printer. The bytes
+// received so far are the staged file itself, so they survive a restart.
+type UploadSession struct {
+	gorm.Model
+	Token          string `gorm:"uniqueIndex"`
+	PrinterID      string `gorm:"index"`
+	FileName       string
+	Size           int64
+	SHA256         string
+	Owner          string
+	IgnoreFilament bool
+	OnConflict     string
+	ClientIP       string
+	SentBy         string
+	// "upload", "chunked" or "queue", for the upload history
+	Via        string
+	StagedFile string
+	Phase      string
+	Error      string
+	// Sends tried so far, when a queued job stops waiting for its printer,
+	// and when one that failed part way may be tried again
+	Attempts  int
+	ExpiresAt *time.Time
+	RetryAt   *time.Time
+	// The name it was stored under on the printer, once sent, and whether it
+	// was there already
+	SentName  string
+	Duplicate bool
+	Warnings  []string `gorm:"serializer:json"`
+}
+
+// UploadProgress is a session as the browser sees it.
+type UploadProgress struct {
+	Token     string `json:"token"`
+	PrinterID string `json:"printer_id"`
+	FileName  string `json:"file_name"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	// The server leg
+	Received int64 `json:"received"`
+	// The printer leg, while transferring, and as a percentage of the file
+	SentToPrinter int64      `json:"sent_to_printer"`
+	Percent       int        `json:"percent"`
+	Phase         string     `json:"phase"`
+	Error         string     `json:"error,omitempty"`
+	Attempts      int        `json:"attempts"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	SentName      string     `json:"sent_name,omitempty"`
+	Duplicate     bool       `json:"duplicate,omitempty"`
+	Warnings      []string   `json:"warnings,omitempty"`
+}
+
+// StartUpload is what the browser declares before sending any chunks.
+type StartUpload struct {
+	FileName       string
+	Size           int64
+	SHA256         string
+	Owner          string
+	IgnoreFilament bool
+	OnConflict     string
+	ClientIP       string
+	// The admin who sent it, for a file from the print queue
+	SentBy string
+}
+
+// Start opens a session. The name and size are checked now, so a file that
+// could never be sent is refused before any of it crosses the wifi.
+func (u *UploadJobs) Start(printerID string, req StartUpload) (UploadProgress, error) {
+	if err := u.checkStart(printerID, req); err != nil {
+		return UploadProgress{}, err
+	}
+	req.SHA256 = strings.ToLower(strings.TrimSpace(req.SHA256))
+	if decoded, err := hex.DecodeString(req.SHA256); err != nil || len(decoded) != sha256.Size {
+		return UploadProgress{}, fmt.Errorf("give the file's SHA-256 as 64 hex digits")
+	}
+	if err := u.checkRoom(printerID, req.Size); err != nil {
+		return UploadProgress{}, err
+	}
+
+	token, staged, file, err := u.stage()
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	file.Close()
+
+	session, err := u.create(token, printerID, req, "chunked", staged)
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	return u.progress(session), nil
+}
+
+// checkStart refuses an upload that could never be sent, whatever arrives.
+func (u *UploadJobs) checkStart(printerID string, req StartUpload) error {
+	if _, ok := u.printers.lookup(printerID); !ok {
+		return fmt.Errorf("unknown printer")
+	}
+	if _, err := sanitizeUploadName(req.FileName); err != nil {
+		return err
+	}
+	if req.Size <= 0 || req.Size > maxUploadBytes {
+		return fmt.Errorf("that file is %d MB. The limit is %d MB",
+			req.Size/(1024*1024), maxUploadBytes/(1024*1024))
+	}
+	if req.OnConflict != "" && req.OnConflict != ConflictSuffix && req.OnConflict != ConflictRefuse {
+		return fmt.Errorf("on_conflict is %q or %q", ConflictSuffix, ConflictRefuse)
+	}
+	return nil
+}
+
+// stage makes an empty staged file under a new token.
+func (u *UploadJobs) stage() (token, staged string, file *os.File, err error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", nil, fmt.Errorf("could not start the upload")
+	}
+	token = hex.EncodeToString(random)
+	staged = filepath.Join(u.dir, token)
+	file, err = os.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("could not start the upload")
+	}
+	return token, staged, file, nil
+}
+
+func (u *UploadJobs) create(token, printerID string, req StartUpload, via, staged string) (UploadSession, error) {
+	session := UploadSession{
+		Token:          token,
+		PrinterID:      printerID,
+		FileName:       req.FileName,
+		Size:           req.Size,
+		SHA256:         req.SHA256,
+		Owner:          req.Owner,
+		IgnoreFilament: req.IgnoreFilament,
+		OnConflict:     req.OnConflict,
+		ClientIP:       req.ClientIP,
+		SentBy:         req.SentBy,
+		Via:            via,
+		StagedFile:     staged,
+		Phase:          UploadReceiving,
+	}
+	if err := u.db.Create(&session).Error; err != nil {
+		os.Remove(staged)
+		return session, fmt.Errorf("could not start the upload")
+	}
+	return session, nil
+}
+
+func (u *UploadJobs) session(token string) (UploadSession, error) {
+	var session UploadSession
+	if err := u.db.Where("token = ?", token).First(&session).Error; err != nil {
+		return session, fmt.Errorf("that upload has expired or never existed - start again")
+	}
+	return session, nil
+}
+
+// received is how much of the file the server holds.
+func received(session UploadSession) int64 {
+	info, err := os.Stat(session.StagedFile)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (u *UploadJobs) progress(session UploadSession) UploadProgress {
+	view := UploadProgress{
+		Token:     session.Token,
+		PrinterID: session.PrinterID,
+		FileName:  session.FileName,
+		Size:      session.Size,
+		ChunkSize: uploadChunkBytes,
+		Received:  received(session),
+		Phase:     session.Phase,
+		Error:     session.Error,
+		Attempts:  session.Attempts,
+		ExpiresAt: session.ExpiresAt,
+		SentName:  session.SentName,
+		Duplicate: session.Duplicate,
+		Warnings:  session.Warnings,
+	}
+	u.mu.Lock()
+	if sent, ok := u.sending[session.Token]; ok {
+		view.SentToPrinter = sent.Load()
+	}
+	u.mu.Unlock()
+
+	switch {
+	case session.Phase == UploadDone:
+		view.SentToPrinter = session.Size
+	case session.Phase == UploadTransferring && session.Size > 0 && view.SentToPrinter >= session.Size:
+		// All of it has gone; the printer is being asked how much it kept
+		view.Phase = UploadVerifying
+	}
+	if session.Size > 0 {
+		view.Percent = int(view.SentToPrinter * 100 / session.Size)
+	}
+	return view
+}
+
+// Progress reports a session.
+func (u *UploadJobs) Progress(token string) (UploadProgress, error) {
+	session, err := u.session(token)
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	return u.progress(session), nil
+}
+
+// OffsetError is a chunk sent for the wrong place in the file. Received is
+// where the next chunk should start.
+type OffsetError struct {
+	Received int64
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("the server has %d bytes of this file - send from there", e.Received)
+}
+
+// WriteChunk appends one chunk at offset.
+func (u *UploadJobs) WriteChunk(token string, offset int64, chunk io.Reader) (UploadProgress, error) {
+	session, err := u.session(token)
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	if session.Phase != UploadReceiving {
+		return UploadProgress{}, fmt.Errorf("this upload has already been received")
+	}
+
+	// Read the chunk before taking the lock, so a slow connection does not
+	// hold up everyone else's
+	data, err := io.ReadAll(io.LimitReader(chunk, uploadChunkBytes+1))
+	if err != nil {
+		return UploadProgress{}, fmt.Errorf("the chunk did not arrive whole - send it again")
+	}
+
+	u.mu.Lock()
+	now, err := appendChunk(session.StagedFile, session.Size, offset, data)
+	u.mu.Unlock()
+	if err != nil {
+		return UploadProgress{}, err
+	}
+
+	// Touch the session so it does not expire while it is moving
+	u.db.Model(&session).Update("updated_at", time.Now())
+
+	view := u.progress(session)
+	view.Received = now
+	return view, nil
+}
+
+// appendChunk adds one chunk to a staged file of the given final size, and
+// returns how much of it is now held. Callers hold the lock.
+func appendChunk(staged string, size, offset int64, data []byte) (int64, error) {
+	if len(data) > uploadChunkBytes {
+		return 0, fmt.Errorf("chunks can be at most %d MB", uploadChunkBytes/(1024*1024))
+	}
+
+	info, err := os.Stat(staged)
+	if err != nil {
+		return 0, fmt.Errorf("the staged file is missing from the server - start the upload again")
+	}
+	have := info.Size()
+	if offset != have {
+		return have, &OffsetError{Received: have}
+	}
+	if have+int64(len(data)) > size {
+		return have, fmt.Errorf("that is more than the %d bytes declared", size)
+	}
+
+	file, err := os.OpenFile(staged, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return have, fmt.Errorf("could not store the chunk")
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// A half-written chunk is cut off so the offsets stay honest
+		os.Truncate(staged, have)
+		return have, fmt.Errorf("could not store the chunk")
+	}
+	return have + int64(len(data)), nil
+}
+
+// progressFile is the staged file on its way to the printer. The file's read
+// position is the progress: the upload checks read it from the start and
+// rewind, so only the real transfer leaves it moving forward.
+type progressFile struct {
+	*os.File
+	position *atomic.Int64
+}
+
+func (f progressFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.position.Add(int64(n))
+	return n, err
+}
+
+func (f progressFile) Seek(offset int64, whence int) (int64, error) {
+	at, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.position.Store(at)
+	}
+	return at, err
+}
+
+// verifyStagedFile checks the file is all there and is the one declared.
+func verifyStagedFile(session UploadSession) error {
+	have := received(session)
+	if have != session.Size {
+		return &OffsetError{Received: have}
+	}
+
+	file, err := os.Open(session.StagedFile)
+	if err != nil {
+		return fmt.Errorf("the staged file is missing from the server - start the upload again")
+	}
+	defer file.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return fmt.Errorf("could not read the staged file")
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != session.SHA256 {
+		return errors.New("the file arrived damaged - its SHA-256 does not match; start the upload again")
+	}
+	return nil
+}
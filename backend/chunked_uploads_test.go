@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAppendChunkResumes(t *testing.T) {
+	staged := filepath.Join(t.TempDir(), "staged")
+	if err := os.WriteFile(staged, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := appendChunk(staged, 10, 0, []byte("hello"))
+	if err != nil || have != 5 {
+		t.Fatalf("first chunk: %d, %v", have, err)
+	}
+
+	// A retry of the first chunk after a dropped answer is refused with
+	// where to carry on from
+	_, err = appendChunk(staged, 10, 0, []byte("hello"))
+	var offsetErr *OffsetError
+	if !errors.As(err, &offsetErr) || offsetErr.Received != 5 {
+		t.Fatalf("expected an offset error at 5, got %v", err)
+	}
+
+	if _, err := appendChunk(staged, 10, 5, []byte("world!")); err == nil {
+		t.Error("more than the declared size should be refused")
+	}
+	have, err = appendChunk(staged, 10, 5, []byte("world"))
+	if err != nil || have != 10 {
+		t.Fatalf("second chunk: %d, %v", have, err)
+	}
+	if contents, _ := os.ReadFile(staged); string(contents) != "helloworld" {
+		t.Errorf("staged %q", contents)
+	}
+}
+
+func TestVerifyStagedFile(t *testing.T) {
+	staged := filepath.Join(t.TempDir(), "staged")
+	os.WriteFile(staged, []byte("helloworld"), 0640)
+	sum := sha256.Sum256([]byte("helloworld"))
+	session := UploadSession{StagedFile: staged, Size: 10, SHA256: hex.EncodeToString(sum[:])}
+
+	if err := verifyStagedFile(session); err != nil {
+		t.Errorf("a whole, matching file: %v", err)
+	}
+
+	session.Size = 12
+	var offsetErr *OffsetError
+	if err := verifyStagedFile(session); !errors.As(err, &offsetErr) || offsetErr.Received != 10 {
+		t.Errorf("an incomplete file: %v", err)
+	}
+
+	session.Size = 10
+	session.SHA256 = strings.Repeat("0", 64)
+	if err := verifyStagedFile(session); err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Errorf("a damaged file: %v", err)
+	}
+}
+
+func TestProgressFileTracksTheSend(t *testing.T) {
+	staged := filepath.Join(t.TempDir(), "staged")
+	os.WriteFile(staged, []byte("helloworld"), 0640)
+	file, err := os.Open(staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	position := &atomic.Int64{}
+	sent := progressFile{File: file, position: position}
+
+	// The upload checks read the file and rewind it...
+	io.ReadAll(sent)
+	sent.Seek(0, io.SeekStart)
+	if position.Load() != 0 {
+		t.Errorf("rewinding should reset progress, at %d", position.Load())
+	}
+	// ...and only the real transfer moves it on
+	buffer := make([]byte, 4)
+	sent.Read(buffer)
+	if position.Load() != 4 {
+		t.Errorf("progress %d after 4 bytes", position.Load())
+	}
+}
+
+func TestStartChecksBeforeStaging(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{ID: "p1s", Name: "P1S"}}
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1s": p}}
+	u := NewUploadJobs(nil, m, t.TempDir())
+	digest := strings.Repeat("a", 64)
+
+	cases := []struct {
+		printer string
+		req     StartUpload
+	}{
+		{"nope", StartUpload{FileName: "a.3mf", Size: 10, SHA256: digest}},
+		{"p1s", StartUpload{FileName: "notes.txt", Size: 10, SHA256: digest}},
+		{"p1s", StartUpload{FileName: "a.3mf", Size: maxUploadBytes + 1, SHA256: digest}},
+		{"p1s", StartUpload{FileName: "a.3mf", Size: 0, SHA256: digest}},
+		{"p1s", StartUpload{FileName: "a.3mf", Size: 10, SHA256: "abc"}},
+	}
+	for _, c := range cases {
+		if _, err := u.Start(c.printer, c.req); err == nil {
+			t.Errorf("%s %+v should be refused", c.printer, c.req)
+		}
+	}
+}
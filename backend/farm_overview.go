@@ -0,0 +1,327 @@
+package main
+
+// The farm overview.
+//
+// GET /api/printers is every printer in full, which is right for the printers
+// page and far too much for a screen on the lab wall that only has to answer
+// "is anything free, and when will something be". GET /api/farm sums the
+// printers up: how many are in each state, when each will be idle and when
+// they all will, which one frees up next, how many faults are showing, what
+// filament is loaded across every AMS, and what is waiting in the queue.
+// ?format=compact gives the same thing as short ready-made lines that a
+// display can show without any logic of its own.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Farm states, coarser than the printers' own.
+const (
+	FarmPrinting    = "printing"
+	FarmPaused      = "paused"
+	FarmFinished    = "finished" // done, with the print still on the plate
+	FarmFailed      = "failed"
+	FarmIdle        = "idle"
+	FarmOffline     = "offline"
+	FarmMaintenance = "maintenance"
+)
+
+// farmStates is the order the states are shown in.
+var farmStates = []string{FarmPrinting, FarmPaused, FarmFinished, FarmFailed, FarmIdle, FarmOffline, FarmMaintenance}
+
+// FarmPrinter is one printer in the overview.
+type FarmPrinter struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Progress int    `json:"progress"`
+	FileName string `json:"file_name,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	// Minutes until it is idle; nil when it is offline and nobody can say
+	IdleInMinutes *int       `json:"idle_in_minutes"`
+	IdleAt        *time.Time `json:"idle_at"`
+	Faults        int        `json:"faults"`
+}
+
+// FarmFilament is one material and colour loaded somewhere in the farm.
+type FarmFilament struct {
+	Material string `json:"material"`
+	Color    string `json:"color"`
+	Slots    int    `json:"slots"`
+	// The printers it is loaded in
+	Printers []string `json:"printers"`
+	// Sum of the remaining percentages the printers report, so 250 is about
+	// two and a half spools; slots that do not know are left out
+	RemainPercent int `json:"remain_percent"`
+}
+
+// FarmQueue is the work waiting for a printer.
+type FarmQueue struct {
+	Waiting int `json:"waiting"`
+	// Sum of the waiting jobs' estimates, with the usual stand-in for those
+	// without one
+	Minutes int `json:"minutes"`
+	// When the last waiting job is expected to finish, if any printer can
+	// take them all
+	ClearsAt *time.Time `json:"clears_at"`
+}
+
+// FarmOverview is the whole farm at a glance.
+type FarmOverview struct {
+	At       time.Time      `json:"at"`
+	Printers int            `json:"printers"`
+	States   map[string]int `json:"states"`
+	// Minutes until every running job is done, and when
+	AllIdleInMinutes int            `json:"all_idle_in_minutes"`
+	AllIdleAt        time.Time      `json:"all_idle_at"`
+	NextFree         *FarmPrinter   `json:"next_free"`
+	ActiveFaults     int            `json:"active_faults"`
+	Filament         []FarmFilament `json:"filament"`
+	Queue            FarmQueue      `json:"queue"`
+	PrinterList      []FarmPrinter  `json:"printer_list"`
+}
+
+// farmState sorts a printer into one of the farm states.
+func farmState(status PrinterStatus) string {
+	switch {
+	case status.UnderMaintenance:
+		return FarmMaintenance
+	case !status.Online:
+		return FarmOffline
+	}
+	switch status.State {
+	case "RUNNING", "PREPARE", "SLICING":
+		return FarmPrinting
+	case "PAUSE":
+		return FarmPaused
+	case "FINISH":
+		return FarmFinished
+	case "FAILED":
+		return FarmFailed
+	}
+	return FarmIdle
+}
+
+// idleIn is how many minutes a printer needs before it is idle, or nil when
+// that cannot be known. A paused job is counted as if it carried on now.
+func idleIn(status PrinterStatus, state string) *int {
+	minutes := 0
+	switch state {
+	case FarmOffline, FarmMaintenance:
+		return nil
+	case FarmPrinting, FarmPaused:
+		minutes = status.RemainingMinutes
+	}
+	return &minutes
+}
+
+// startingUp reports whether a printer is heating or slicing ahead of a print.
+// It has no time remaining yet, which is not the same as being about to free
+// up, so it is never offered as the next free printer.
+func startingUp(status PrinterStatus) bool {
+	return status.State == "PREPARE" || status.State == "SLICING"
+}
+
+// buildFarmOverview sums up the printers and the waiting queue entries.
+func buildFarmOverview(statuses []PrinterStatus, waiting []PrintQueueEntry, now time.Time) FarmOverview {
+	overview := FarmOverview{
+		At:          now,
+		Printers:    len(statuses),
+		States:      map[string]int{},
+		AllIdleAt:   now,
+		Filament:    []FarmFilament{},
+		PrinterList: []FarmPrinter{},
+	}
+	for _, state := range farmStates {
+		overview.States[state] = 0
+	}
+
+	filament := map[string]*FarmFilament{}
+	// Rows that could be the next free printer
+	var candidates []int
+	for _, status := range statuses {
+		state := farmState(status)
+		overview.States[state]++
+		overview.ActiveFaults += len(status.Faults)
+
+		row := FarmPrinter{
+			ID:       status.ID,
+			Name:     status.Name,
+			State:    state,
+			Progress: status.Progress,
+			FileName: status.FileName,
+			Owner:    fileOwner(status.FileName),
+			Faults:   len(status.Faults),
+		}
+		if minutes := idleIn(status, state); minutes != nil {
+			at := now.Add(time.Duration(*minutes) * time.Minute)
+			row.IdleInMinutes = minutes
+			row.IdleAt = &at
+			if *minutes > overview.AllIdleInMinutes {
+				overview.AllIdleInMinutes = *minutes
+				overview.AllIdleAt = at
+			}
+		}
+		overview.PrinterList = append(overview.PrinterList, row)
+		if row.IdleInMinutes != nil && state != FarmFailed && !startingUp(status) {
+			candidates = append(candidates, len(overview.PrinterList)-1)
+		}
+
+		// Only a printer that is up says truthfully what it has loaded
+		if !status.Online {
+			continue
+		}
+		for _, slot := range loadedSlots(status) {
+			key := strings.ToUpper(slot.Material) + "|" + slot.Color
+			entry, ok := filament[key]
+			if !ok {
+				entry = &FarmFilament{Material: slot.Material, Color: slot.Color, Printers: []string{}}
+				filament[key] = entry
+			}
+			entry.Slots++
+			if slot.Remain > 0 {
+				entry.RemainPercent += slot.Remain
+			}
+			if n := len(entry.Printers); n == 0 || entry.Printers[n-1] != status.Name {
+				entry.Printers = append(entry.Printers, status.Name)
+			}
+		}
+	}
+
+	// Next free: the idle-soonest printer that can take work. A finished
+	// printer needs its plate cleared, so it counts as free now.
+	for _, i := range candidates {
+		row := &overview.PrinterList[i]
+		if overview.NextFree == nil || *row.IdleInMinutes < *overview.NextFree.IdleInMinutes {
+			overview.NextFree = row
+		}
+	}
+	if overview.NextFree != nil {
+		next := *overview.NextFree
+		overview.NextFree = &next
+	}
+
+	for _, entry := range filament {
+		overview.Filament = append(overview.Filament, *entry)
+	}
+	sort.Slice(overview.Filament, func(i, j int) bool {
+		a, b := overview.Filament[i], overview.Filament[j]
+		if a.Material != b.Material {
+			return a.Material < b.Material
+		}
+		return a.Color < b.Color
+	})
+
+	overview.Queue.Waiting = len(waiting)
+	for _, entry := range waiting {
+		minutes := entry.EstimatedMinutes
+		if minutes <= 0 {
+			minutes = defaultQueueJobMinutes
+		}
+		overview.Queue.Minutes += minutes
+	}
+	overview.Queue.ClearsAt = queueClearsAt(waiting, statuses, now)
+	return overview
+}
+
+// queueClearsAt is when the last waiting job should be done, going by the
+// queue's own plan; nil when some job has no printer that can take it.
+func queueClearsAt(waiting []PrintQueueEntry, statuses []PrinterStatus, now time.Time) *time.Time {
+	if len(waiting) == 0 {
+		return nil
+	}
+	var last time.Time
+	for _, view := range planQueue(waiting, statuses, now) {
+		if view.EstimatedStart == nil {
+			return nil
+		}
+		minutes := view.EstimatedMinutes
+		if minutes <= 0 {
+			minutes = defaultQueueJobMinutes
+		}
+		if done := view.EstimatedStart.Add(time.Duration(minutes) * time.Minute); done.After(last) {
+			last = done
+		}
+	}
+	return &last
+}
+
+// FarmCompact is the overview cut down to lines for a wall display.
+type FarmCompact struct {
+	At       string   `json:"at"`
+	Summary  string   `json:"summary"`
+	NextFree string   `json:"next_free"`
+	Queue    string   `json:"queue"`
+	Faults   int      `json:"faults"`
+	Printers []string `json:"printers"`
+}
+
+// shortMinutes is 75 as "1h15m".
+func shortMinutes(minutes int) string {
+	if minutes <= 0 {
+		return "now"
+	}
+	if minutes < 60 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+}
+
+// Compact renders the overview for a wall display.
+func (o FarmOverview) Compact() FarmCompact {
+	compact := FarmCompact{At: o.At.Format("15:04"), Faults: o.ActiveFaults, Printers: []string{}}
+
+	var parts []string
+	for _, state := range farmStates {
+		if n := o.States[state]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, state))
+		}
+	}
+	compact.Summary = strings.Join(parts, " · ")
+
+	switch {
+	case o.NextFree == nil:
+		compact.NextFree = "No printer available"
+	case *o.NextFree.IdleInMinutes == 0:
+		compact.NextFree = o.NextFree.Name + " is free now"
+	default:
+		compact.NextFree = fmt.Sprintf("%s free in %s (%s)", o.NextFree.Name,
+			shortMinutes(*o.NextFree.IdleInMinutes), o.NextFree.IdleAt.Format("15:04"))
+	}
+
+	switch {
+	case o.Queue.Waiting == 0:
+		compact.Queue = "Queue empty"
+	case o.Queue.ClearsAt != nil:
+		compact.Queue = fmt.Sprintf("%d waiting, clear by %s", o.Queue.Waiting, o.Queue.ClearsAt.Format("15:04"))
+	default:
+		compact.Queue = fmt.Sprintf("%d waiting", o.Queue.Waiting)
+	}
+
+	for _, row := range o.PrinterList {
+		line := row.Name + ": " + row.State
+		if row.State == FarmPrinting || row.State == FarmPaused {
+			line += fmt.Sprintf(" %d%%, %s left", row.Progress, shortMinutes(*row.IdleInMinutes))
+			if row.Owner != "" {
+				line += " (" + row.Owner + ")"
+			}
+		}
+		if row.Faults > 0 {
+			line += fmt.Sprintf(" ⚠ %d", row.Faults)
+		}
+		compact.Printers = append(compact.Printers, line)
+	}
+	return compact
+}
+
+// Farm is the overview of every printer and the waiting queue, as of now.
+func (q *PrintQueue) Farm() (FarmOverview, error) {
+	waiting, err := q.waiting()
+	if err != nil {
+		return FarmOverview{}, err
+	}
+	return buildFarmOverview(q.printers.Statuses(), waiting, time.Now()), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFarmOverview(t *testing.T) {
+	now := time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC)
+	pla := AMSSlot{Material: "PLA", Color: "#FFFFFF", Remain: 80}
+	statuses := []PrinterStatus{
+		{ID: "a", Name: "A", Online: true, State: "RUNNING", Progress: 40, RemainingMinutes: 95,
+			FileName: "srinath_bracket.gcode.3mf", Faults: []HMSFault{{Code: "0300_0100"}},
+			AMS: []AMSUnit{{Slots: []AMSSlot{pla, {Material: "PETG", Color: "#000000", Remain: -1}, {Empty: true}}}}},
+		{ID: "b", Name: "B", Online: true, State: "PAUSE", RemainingMinutes: 30,
+			ExternalSpool: &AMSSlot{Material: "PLA", Color: "#FFFFFF", Remain: 50}},
+		{ID: "c", Name: "C", Online: true, State: "FINISH"},
+		{ID: "d", Name: "D", Online: false, State: "RUNNING", RemainingMinutes: 500,
+			AMS: []AMSUnit{{Slots: []AMSSlot{pla}}}},
+		{ID: "e", Name: "E", Online: true, State: "IDLE", UnderMaintenance: true},
+	}
+	waiting := []PrintQueueEntry{{EstimatedMinutes: 60}, {}}
+
+	overview := buildFarmOverview(statuses, waiting, now)
+
+	wantStates := map[string]int{FarmPrinting: 1, FarmPaused: 1, FarmFinished: 1, FarmOffline: 1, FarmMaintenance: 1}
+	for state, n := range wantStates {
+		if overview.States[state] != n {
+			t.Errorf("%s: %d, want %d", state, overview.States[state], n)
+		}
+	}
+	if overview.States[FarmIdle] != 0 || overview.Printers != 5 {
+		t.Errorf("states %v of %d", overview.States, overview.Printers)
+	}
+
+	// The offline printer's last report cannot be trusted for any of this
+	if overview.AllIdleInMinutes != 95 || !overview.AllIdleAt.Equal(now.Add(95*time.Minute)) {
+		t.Errorf("all idle in %d at %s", overview.AllIdleInMinutes, overview.AllIdleAt)
+	}
+	if overview.PrinterList[3].IdleInMinutes != nil {
+		t.Error("an offline printer has no idle estimate")
+	}
+	if overview.NextFree == nil || overview.NextFree.ID != "c" {
+		t.Errorf("next free %+v", overview.NextFree)
+	}
+	// One only warming up has no time left yet, but is not about to be free
+	starting := append([]PrinterStatus{{ID: "f", Name: "F", Online: true, State: "PREPARE"}}, statuses...)
+	if next := buildFarmOverview(starting, nil, now).NextFree; next == nil || next.ID != "c" {
+		t.Errorf("next free with one preparing %+v", next)
+	}
+	if overview.ActiveFaults != 1 || overview.PrinterList[0].Owner != "srinath" {
+		t.Errorf("faults %d, owner %q", overview.ActiveFaults, overview.PrinterList[0].Owner)
+	}
+
+	if len(overview.Filament) != 2 {
+		t.Fatalf("filament %+v", overview.Filament)
+	}
+	white := overview.Filament[1]
+	if white.Material != "PLA" || white.Slots != 2 || white.RemainPercent != 130 || strings.Join(white.Printers, ",") != "A,B" {
+		t.Errorf("white PLA %+v", white)
+	}
+	if black := overview.Filament[0]; black.RemainPercent != 0 || black.Slots != 1 {
+		t.Errorf("a spool of unknown length should not count: %+v", black)
+	}
+
+	if overview.Queue.Waiting != 2 || overview.Queue.Minutes != 60+defaultQueueJobMinutes || overview.Queue.ClearsAt == nil {
+		t.Errorf("queue %+v", overview.Queue)
+	}
+}
+
+func TestFarmOverviewCompact(t *testing.T) {
+	now := time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC)
+	statuses := []PrinterStatus{
+		{ID: "a", Name: "A", Online: true, State: "RUNNING", Progress: 40, RemainingMinutes: 75,
+			FileName: "srinath_bracket.3mf", Faults: []HMSFault{{Code: "x"}}},
+		{ID: "b", Name: "B"},
+	}
+	compact := buildFarmOverview(statuses, nil, now).Compact()
+
+	if compact.Summary != "1 printing · 1 offline" {
+		t.Errorf("summary %q", compact.Summary)
+	}
+	if compact.NextFree != "A free in 1h15m (15:15)" {
+		t.Errorf("next free %q", compact.NextFree)
+	}
+	if compact.Queue != "Queue empty" || compact.At != "14:00" {
+		t.Errorf("queue %q at %q", compact.Queue, compact.At)
+	}
+	want := []string{"A: printing 40%, 1h15m left (srinath) ⚠ 1", "B: offline"}
+	if strings.Join(compact.Printers, "|") != strings.Join(want, "|") {
+		t.Errorf("lines %q", compact.Printers)
+	}
+
+	if compact := buildFarmOverview(statuses[1:], nil, now).Compact(); compact.NextFree != "No printer available" {
+		t.Errorf("with nothing up: %q", compact.NextFree)
+	}
+}
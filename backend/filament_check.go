@@ -0,0 +1,218 @@
+package main
+
+// Is the right filament loaded?
+//
+// A sliced file says which material and colour each of its filament slots
+// needs, and how many grams. The printer reports what is in every AMS tray and
+// on the external spool. Comparing the two before a file is sent catches the
+// PETG job heading for a printer full of PLA while the person is still at their
+// desk, not an hour later when the print fails.
+//
+// A missing material or a spool that is clearly too light refuses the upload;
+// the person can say they will load it themselves. A colour that is not loaded
+// is only a warning - near enough is often good enough for a bracket.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// assumedSpoolGrams turns the printer's percent remaining into grams. Bambu
+// spools, the only ones that report a percentage, hold 1 kg.
+const assumedSpoolGrams = 1000
+
+// Filament problems, from worst to mildest.
+const (
+	FilamentMissing = "missing" // no tray has the material
+	FilamentLow     = "low"     // it is loaded, but not enough of it
+	FilamentColour  = "colour"  // the material is loaded in another colour
+)
+
+// FilamentProblem is one filament a file needs that the printer cannot supply
+// as asked.
+type FilamentProblem struct {
+	Slot     int     `json:"slot"` // the slicer's slot number
+	Material string  `json:"material"`
+	Color    string  `json:"color"`
+	Grams    float64 `json:"grams"`
+	Problem  string  `json:"problem"`
+	Message  string  `json:"message"`
+}
+
+// blocking reports whether the problem should stop an upload.
+func (f FilamentProblem) blocking() bool {
+	return f.Problem == FilamentMissing || f.Problem == FilamentLow
+}
+
+// FilamentAlternative is another printer that has everything a file needs.
+type FilamentAlternative struct {
+	PrinterID   string `json:"printer_id"`
+	PrinterName string `json:"printer_name"`
+	State       string `json:"state"`
+}
+
+// FilamentError refuses an upload for want of filament, carrying enough for
+// the page to say what is missing and where to send the file instead.
+type FilamentError struct {
+	PrinterName  string                `json:"printer_name"`
+	Problems     []FilamentProblem     `json:"problems"`
+	Alternatives []FilamentAlternative `json:"alternatives"`
+}
+
+func (e *FilamentError) Error() string {
+	var messages []string
+	for _, problem := range e.Problems {
+		if problem.blocking() {
+			messages = append(messages, problem.Message)
+		}
+	}
+	text := fmt.Sprintf("%s cannot print this as loaded: %s", e.PrinterName, strings.Join(messages, "; "))
+	if len(e.Alternatives) > 0 {
+		var names []string
+		for _, alt := range e.Alternatives {
+			names = append(names, alt.PrinterName)
+		}
+		text += " - try " + strings.Join(names, " or ")
+	}
+	return text
+}
+
+// reportsFilament tells a printer that has said nothing about its spools apart
+// from one that has nothing loaded. Offline printers and those whose report
+// has not arrived yet are not judged.
+func reportsFilament(status PrinterStatus) bool {
+	return status.Online && (len(status.AMS) > 0 || status.ExternalSpool != nil)
+}
+
+// checkFilament compares what a file needs with what a printer has loaded.
+func checkFilament(status PrinterStatus, needed []SlicedFilament) []FilamentProblem {
+	if !reportsFilament(status) {
+		return nil
+	}
+
+	slots := loadedSlots(status)
+	var problems []FilamentProblem
+
+	for _, filament := range needed {
+		if filament.Type == "" {
+			continue
+		}
+		problem := FilamentProblem{
+			Slot:     filament.Slot,
+			Material: filament.Type,
+			Color:    filament.Color,
+			Grams:    filament.Grams,
+		}
+
+		var sameMaterial, sameColour []AMSSlot
+		for _, slot := range slots {
+			if !materialMatches(slot.Material, filament.Type) {
+				continue
+			}
+			sameMaterial = append(sameMaterial, slot)
+			if filament.Color == "" || strings.EqualFold(slot.Color, filament.Color) {
+				sameColour = append(sameColour, slot)
+			}
+		}
+
+		if len(sameMaterial) == 0 {
+			problem.Problem = FilamentMissing
+			problem.Message = fmt.Sprintf("no %s is loaded", filament.Type)
+			problems = append(problems, problem)
+			continue
+		}
+
+		candidates := sameColour
+		if len(candidates) == 0 {
+			candidates = sameMaterial
+			problem.Problem = FilamentColour
+			problem.Message = fmt.Sprintf("%s is loaded, but not in %s", filament.Type, filament.Color)
+		}
+
+		if !enoughLeft(candidates, filament.Grams) {
+			problem.Problem = FilamentLow
+			problem.Message = fmt.Sprintf("the %s loaded has less than the %.0f g this needs",
+				filament.Type, filament.Grams)
+		}
+
+		if problem.Problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+// enoughLeft reports whether any of the slots could supply grams. A spool the
+// printer cannot measure - third-party filament - is given the benefit of the
+// doubt.
+func enoughLeft(slots []AMSSlot, grams float64) bool {
+	for _, slot := range slots {
+		if slot.Remain < 0 {
+			return true
+		}
+		if float64(slot.Remain)*assumedSpoolGrams/100 >= grams {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBlockingProblem reports whether any problem should stop an upload.
+func hasBlockingProblem(problems []FilamentProblem) bool {
+	for _, problem := range problems {
+		if problem.blocking() {
+			return true
+		}
+	}
+	return false
+}
+
+// filamentAlternatives lists the other printers that could take a file as
+// they are loaded right now, free ones first. A printer under maintenance
+// cannot take anything, so it is never offered.
+func (m *PrinterManager) filamentAlternatives(excludeID string, meta *SliceMetadata, needed []SlicedFilament) []FilamentAlternative {
+	var free, busy []FilamentAlternative
+	for _, p := range m.list() {
+		if p.cfg.ID == excludeID || checkSliceCompatibility(p.sliceConfig(), meta) != nil {
+			continue
+		}
+		status := p.status()
+		if status.UnderMaintenance || !reportsFilament(status) || hasBlockingProblem(checkFilament(status, needed)) {
+			continue
+		}
+		alt := FilamentAlternative{PrinterID: p.cfg.ID, PrinterName: p.cfg.Name, State: status.State}
+		if readyForNextPrint(status) {
+			free = append(free, alt)
+		} else {
+			busy = append(busy, alt)
+		}
+	}
+	return append(free, busy...)
+}
+
+// checkLoadedFilament is the upload path's check: an error when the printer
+// cannot supply what the file needs, otherwise any warnings worth passing on.
+func (m *PrinterManager) checkLoadedFilament(p *printer, meta *SliceMetadata, ignore bool) ([]string, error) {
+	if meta == nil || len(meta.Plates) == 0 {
+		return nil, nil
+	}
+	// A multi-plate file is checked against the first plate, which is the
+	// one a plain start prints
+	needed := meta.Plates[0].Filaments
+	problems := checkFilament(p.status(), needed)
+
+	if hasBlockingProblem(problems) && !ignore {
+		return nil, &FilamentError{
+			PrinterName:  p.cfg.Name,
+			Problems:     problems,
+			Alternatives: m.filamentAlternatives(p.cfg.ID, meta, needed),
+		}
+	}
+
+	var warnings []string
+	for _, problem := range problems {
+		warnings = append(warnings, problem.Message)
+	}
+	return warnings, nil
+}
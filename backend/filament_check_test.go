@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckFilament(t *testing.T) {
+	status := queuePrinter("p1", "IDLE", 0,
+		AMSSlot{Material: "PLA Basic", Color: "#000000", Remain: 95},
+		AMSSlot{Material: "PETG HF", Color: "#FFFFFF", Remain: 5},
+		AMSSlot{Material: "ABS", Color: "#FF6A13", Remain: -1},
+	)
+
+	for _, c := range []struct {
+		name    string
+		needed  SlicedFilament
+		problem string
+	}{
+		{"loaded", SlicedFilament{Slot: 1, Type: "PLA", Color: "#000000", Grams: 100}, ""},
+		{"missing", SlicedFilament{Slot: 1, Type: "TPU", Color: "#000000", Grams: 10}, FilamentMissing},
+		{"other colour", SlicedFilament{Slot: 1, Type: "PLA", Color: "#FFFFFF", Grams: 10}, FilamentColour},
+		// 5% of a kilo is 50 g
+		{"too little", SlicedFilament{Slot: 1, Type: "PETG", Color: "#FFFFFF", Grams: 80}, FilamentLow},
+		{"just enough", SlicedFilament{Slot: 1, Type: "PETG", Color: "#FFFFFF", Grams: 40}, ""},
+		// Third-party spools cannot be measured, so they pass
+		{"unknown remain", SlicedFilament{Slot: 1, Type: "ABS", Color: "#FF6A13", Grams: 900}, ""},
+	} {
+		problems := checkFilament(status, []SlicedFilament{c.needed})
+		got := ""
+		if len(problems) > 0 {
+			got = problems[0].Problem
+		}
+		if got != c.problem {
+			t.Errorf("%s: problem = %q, want %q (%+v)", c.name, got, c.problem, problems)
+		}
+	}
+}
+
+func TestCheckFilamentSkipsSilentPrinters(t *testing.T) {
+	needed := []SlicedFilament{{Slot: 1, Type: "PLA", Grams: 10}}
+
+	offline := queuePrinter("p1", "IDLE", 0)
+	offline.Online = false
+	if problems := checkFilament(offline, needed); problems != nil {
+		t.Errorf("an offline printer should not be judged: %+v", problems)
+	}
+
+	// Online, but no AMS or spool report yet
+	quiet := PrinterStatus{ID: "p2", Online: true, State: "IDLE"}
+	if problems := checkFilament(quiet, needed); problems != nil {
+		t.Errorf("a printer that has said nothing should not be judged: %+v", problems)
+	}
+}
+
+func TestCheckLoadedFilamentSuggestsAlternatives(t *testing.T) {
+	ams := func(material, color string) string {
+		return `{"print":{"gcode_state":"IDLE","ams":{"tray_now":"255","ams":[{"id":"0","tray":[` +
+			`{"id":"0","tray_type":"` + material + `","tray_color":"` + color + `FF","remain":80}]}]}}}`
+	}
+	pla := &printer{cfg: PrinterConfig{ID: "pla", Name: "PLA printer", Model: "P1S", Nozzle: "0.4"}}
+	petg := &printer{cfg: PrinterConfig{ID: "petg", Name: "PETG printer", Model: "P1S", Nozzle: "0.4"}}
+	pla.applyReport([]byte(ams("PLA", "000000")))
+	petg.applyReport([]byte(ams("PETG", "FFFFFF")))
+
+	m := &PrinterManager{
+		printers: []*printer{pla, petg},
+		byID:     map[string]*printer{"pla": pla, "petg": petg},
+	}
+	meta := &SliceMetadata{PrinterModel: "P1S", Plates: []SlicedPlate{{
+		Index:     1,
+		Filaments: []SlicedFilament{{Slot: 1, Type: "PETG", Color: "#FFFFFF", Grams: 30}},
+	}}}
+
+	_, err := m.checkLoadedFilament(pla, meta, false)
+	var filamentErr *FilamentError
+	if !errors.As(err, &filamentErr) {
+		t.Fatalf("expected a filament error, got %v", err)
+	}
+	if len(filamentErr.Alternatives) != 1 || filamentErr.Alternatives[0].PrinterID != "petg" {
+		t.Errorf("expected the PETG printer as the alternative, got %+v", filamentErr.Alternatives)
+	}
+	if !strings.Contains(err.Error(), "PETG printer") {
+		t.Errorf("the message should name the alternative: %v", err)
+	}
+
+	// The sender says they will load it themselves
+	warnings, err := m.checkLoadedFilament(pla, meta, true)
+	if err != nil || len(warnings) != 1 {
+		t.Errorf("ignoring the check should pass with a warning, got %v / %v", warnings, err)
+	}
+
+	if warnings, err := m.checkLoadedFilament(petg, meta, false); err != nil || len(warnings) != 0 {
+		t.Errorf("the right printer should pass cleanly, got %v / %v", warnings, err)
+	}
+
+	// Nor is one under maintenance offered
+	petg.underMaintenance = true
+	_, err = m.checkLoadedFilament(pla, meta, false)
+	if !errors.As(err, &filamentErr) || len(filamentErr.Alternatives) != 0 {
+		t.Errorf("a printer under maintenance was offered: %v", err)
+	}
+}
+
+func TestQueueFitsChecksFileFilament(t *testing.T) {
+	status := queuePrinter("p1", "IDLE", 0, AMSSlot{Material: "PLA Basic", Color: "#000000", Remain: 90})
+
+	entry := PrintQueueEntry{Filaments: []SlicedFilament{{Slot: 1, Type: "PLA", Color: "#000000", Grams: 20}}}
+	if !queueFits(entry, status) {
+		t.Error("a loaded filament should fit")
+	}
+
+	entry.Filaments = append(entry.Filaments, SlicedFilament{Slot: 2, Type: "PETG", Grams: 5})
+	if queueFits(entry, status) {
+		t.Error("a file needing a second material that is not loaded should not fit")
+	}
+}
@@ -258,8 +258,18 @@ func main() {
 		log.Fatalf("failed to connect to database: %v", err)
 	}
 
+	secretKeys, err = loadSecretKeys()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	log.Println("Running database migrations...")
-	db.AutoMigrate(&Item{}, &Loan{}, &Admin{}, &Booking{}, &PrinterCredential{}, &PrintJob{})
+	db.AutoMigrate(&Item{}, &Loan{}, &Admin{}, &Booking{}, &PrinterCredential{}, &Printer{}, &PrintJob{},
+		&PrintJobAction{}, &UploadRecord{}, &UploadSession{}, &PrinterFault{}, &HMSDescription{}, &AlertSubscription{}, &Notification{},
+		&PrinterAvailabilityEvent{}, &PrinterCertificate{},
+		&PrintQueueEntry{}, &SlicedFile{}, &Spool{}, &SpoolUsage{},
+		&OwnerGroup{},
+		&MaintenanceTask{}, &MaintenanceLog{}, &MaintenanceMode{})
 
 	// Approvals were removed. Bring records created under the old flow into the
 	// new states so nothing is stranded in a status the app no longer uses.
@@ -278,6 +288,10 @@ func main() {
 		}); res.RowsAffected > 0 {
 		log.Printf("Migrated %d pending return requests to 'returned'", res.RowsAffected)
 	}
+	// Printer access codes and other secrets, encrypted under SECRET_KEY
+	if err := migrateSecrets(db, secretKeys); err != nil {
+		log.Fatalf("Could not encrypt stored secrets: %v", err)
+	}
 	log.Println("Migrations complete.")
 
 	// Create uploads directory if it doesn't exist
@@ -328,6 +342,20 @@ func main() {
 
 	// Connect to the lab's 3D printers, if any are configured
 	printers := loadPrinterManager(db)
+	printers.Subscribe(newAlertDispatcher(db).handle)
+
+	// Filament stock, taken down as prints end
+	spools := NewSpoolInventory(db, printers)
+	printers.Subscribe(spools.handle)
+	printers.AnnounceOrphanedJobs()
+
+	// Files on their way to a printer, sent whole or a chunk at a time. Kept
+	// out of ./uploads, which is served publicly.
+	uploadJobs := NewUploadJobs(db, printers, "./upload-staging")
+	go uploadJobs.Run()
+
+	// Sliced files waiting for a free printer; also kept out of ./uploads
+	queue := NewPrintQueue(db, printers, uploadJobs, "./print-queue")
 
 	sessions := newSessionStore()
 
@@ -610,6 +638,10 @@ func main() {
 		// because avoiding a wifi switch is the whole point - but it only
 		// *uploads*. Starting the print still needs somebody at the machine
 		// who can see the plate is clear.
+		//
+		// The file is checked now and sent in the background, so a printer
+		// that is off just means the job waits; the answer is the job to
+		// follow at GET /uploads/:token.
 		api.POST("/printers/:id/files", func(c *gin.Context) {
 			file, err := c.FormFile("file")
 			if err != nil {
@@ -631,19 +663,125 @@ func main() {
 			}
 			defer opened.Close()
 
-			name, err := printers.UploadFile(c.Param("id"), file.Filename, opened)
+			progress, err := uploadJobs.Submit(c.Param("id"), StartUpload{
+				FileName:       file.Filename,
+				Size:           file.Size,
+				Owner:          c.PostForm("owner"),
+				IgnoreFilament: c.PostForm("ignore_filament") == "true",
+				OnConflict:     c.PostForm("on_conflict"),
+				ClientIP:       c.ClientIP(),
+			}, opened)
 			if err != nil {
+				// Say what is missing and which printers have it, so the
+				// page can offer to send it there instead
+				var filamentErr *FilamentError
+				if errors.As(err, &filamentErr) {
+					c.JSON(409, gin.H{
+						"error":        err.Error(),
+						"problems":     filamentErr.Problems,
+						"alternatives": filamentErr.Alternatives,
+					})
+					return
+				}
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
 
-			log.Printf("printer %s: received upload %s", c.Param("id"), name)
+			c.JSON(202, progress)
+		})
 
-			c.JSON(200, gin.H{
-				"message": fmt.Sprintf(
-					"%s sent. Start it from the printer's screen.", name),
-				"file_name": name,
+		// Resumable uploads for files too big to trust to one request; see
+		// chunked_uploads.go for the protocol
+		api.POST("/printers/:id/uploads", func(c *gin.Context) {
+			var req struct {
+				FileName       string `json:"file_name" binding:"required"`
+				Size           int64  `json:"size" binding:"required"`
+				SHA256         string `json:"sha256" binding:"required"`
+				Owner          string `json:"owner"`
+				IgnoreFilament bool   `json:"ignore_filament"`
+				OnConflict     string `json:"on_conflict"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": "Give the file's name, size and SHA-256"})
+				return
+			}
+			progress, err := uploadJobs.Start(c.Param("id"), StartUpload{
+				FileName:       req.FileName,
+				Size:           req.Size,
+				SHA256:         req.SHA256,
+				Owner:          req.Owner,
+				IgnoreFilament: req.IgnoreFilament,
+				OnConflict:     req.OnConflict,
+				ClientIP:       c.ClientIP(),
 			})
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(201, progress)
+		})
+
+		// Both legs: to the server, then as a job to the printer
+		api.GET("/uploads/:token", func(c *gin.Context) {
+			progress, err := uploadJobs.Progress(c.Param("token"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, progress)
+		})
+
+		// One chunk, as the raw request body, at the offset in Upload-Offset
+		api.PUT("/uploads/:token", func(c *gin.Context) {
+			offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+			if err != nil || offset < 0 {
+				c.JSON(400, gin.H{"error": "Set Upload-Offset to where this chunk starts"})
+				return
+			}
+			progress, err := uploadJobs.WriteChunk(c.Param("token"), offset, c.Request.Body)
+			if err != nil {
+				var offsetErr *OffsetError
+				if errors.As(err, &offsetErr) {
+					c.JSON(409, gin.H{"error": err.Error(), "received": offsetErr.Received})
+					return
+				}
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, progress)
+		})
+
+		// Check the hash and queue the file for the printer. Also retries a
+		// job that failed.
+		api.POST("/uploads/:token/complete", func(c *gin.Context) {
+			progress, err := uploadJobs.Complete(c.Param("token"))
+			if err != nil {
+				var filamentErr *FilamentError
+				var offsetErr *OffsetError
+				switch {
+				case errors.As(err, &filamentErr):
+					c.JSON(409, gin.H{
+						"error":        err.Error(),
+						"problems":     filamentErr.Problems,
+						"alternatives": filamentErr.Alternatives,
+					})
+				case errors.As(err, &offsetErr):
+					c.JSON(409, gin.H{"error": err.Error(), "received": offsetErr.Received})
+				default:
+					c.JSON(400, gin.H{"error": err.Error()})
+				}
+				return
+			}
+
+			c.JSON(202, progress)
+		})
+
+		api.DELETE("/uploads/:token", func(c *gin.Context) {
+			if err := uploadJobs.Cancel(c.Param("token")); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"message": "Upload cancelled"})
 		})
 
 		// What is already on the printer, so people can confirm their file
@@ -657,6 +795,96 @@ func main() {
 			c.JSON(200, files)
 		})
 
+		// Plate preview of a file sent through the site
+		api.GET("/printers/:id/files/:name/thumbnail", func(c *gin.Context) {
+			thumbnail, ok := printers.Thumbnail(c.Param("id"), c.Param("name"))
+			if !ok {
+				c.JSON(404, gin.H{"error": "No preview for that file"})
+				return
+			}
+			c.Header("Cache-Control", "max-age=300")
+			c.Data(200, "image/png", thumbnail)
+		})
+
+		// --- PRINT QUEUE ---
+
+		// The farm at a glance, for the lab's wall display;
+		// ?format=compact for ready-made lines
+		api.GET("/farm", func(c *gin.Context) {
+			overview, err := queue.Farm()
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to build the farm overview"})
+				return
+			}
+			if c.Query("format") == "compact" {
+				c.JSON(200, overview.Compact())
+				return
+			}
+			c.JSON(200, overview)
+		})
+
+		// Everything waiting, with position, the printer it would go to and
+		// when it is expected to start
+		api.GET("/print-queue", func(c *gin.Context) {
+			views, err := queue.View()
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to retrieve the print queue"})
+				return
+			}
+			c.JSON(200, views)
+		})
+
+		// Submit a sliced file to the queue rather than to one printer. Open
+		// to anyone, like a direct upload; an admin dispatches it.
+		api.POST("/print-queue", func(c *gin.Context) {
+			file, err := c.FormFile("file")
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Choose a sliced file to queue"})
+				return
+			}
+
+			if file.Size > maxUploadBytes {
+				c.JSON(400, gin.H{"error": fmt.Sprintf(
+					"That file is %d MB. The limit is %d MB.",
+					file.Size/(1024*1024), maxUploadBytes/(1024*1024))})
+				return
+			}
+
+			req := QueueRequest{
+				Owner:     c.PostForm("owner"),
+				PrinterID: c.PostForm("printer_id"),
+				Material:  c.PostForm("material"),
+				Color:     c.PostForm("color"),
+			}
+			if v := c.PostForm("estimated_minutes"); v != "" {
+				minutes, err := strconv.Atoi(v)
+				if err != nil || minutes < 0 {
+					c.JSON(400, gin.H{"error": "Estimated minutes must be a whole number"})
+					return
+				}
+				req.EstimatedMinutes = minutes
+			}
+
+			opened, err := file.Open()
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Could not read the uploaded file"})
+				return
+			}
+			defer opened.Close()
+
+			entry, warnings, err := queue.Submit(file.Filename, opened, req)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(200, gin.H{
+				"message":  fmt.Sprintf("%s is in the queue. An admin will send it to a free printer.", entry.FileName),
+				"entry":    entry,
+				"warnings": warnings,
+			})
+		})
+
 		// --- MOTION CAPTURE LAB BOOKINGS ---
 
 		// List bookings in a time range (defaults to the next 8 weeks)
@@ -1025,7 +1253,185 @@ func main() {
 					c.JSON(400, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(200, gin.H{"message": "Stop command sent to the printer"})
+				c.JSON(200, gin.H{"message": "The printer has stopped the print"})
+			})
+
+			// Start a file that is already on the printer. For an admin
+			// standing at the machine: it must be idle or finished, and they
+			// confirm the plate is clear.
+			admin.POST("/printers/:id/start", func(c *gin.Context) {
+				type StartRequest struct {
+					FileName     string `json:"file_name" binding:"required"`
+					Plate        int    `json:"plate"`
+					AMSMapping   []int  `json:"ams_mapping"`
+					BedLevelling *bool  `json:"bed_levelling"`
+					PlateClear   bool   `json:"plate_clear"`
+				}
+
+				var req StartRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Choose a file to print"})
+					return
+				}
+
+				opts := StartPrintOptions{Plate: req.Plate, AMSMapping: req.AMSMapping, BedLevelling: true}
+				if opts.Plate == 0 {
+					opts.Plate = 1
+				}
+				if req.BedLevelling != nil {
+					opts.BedLevelling = *req.BedLevelling
+				}
+
+				name, err := printers.StartPrint(c.Param("id"), req.FileName, opts, currentAdmin(c).Name, req.PlateClear)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": fmt.Sprintf("The printer has accepted %s", name)})
+			})
+
+			// --- PRINTER MAINTENANCE ---
+
+			// Every printer's tasks, how close each is to due, and whether
+			// it is out of service
+			admin.GET("/maintenance", func(c *gin.Context) {
+				all, err := printers.Maintenance()
+				if err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve maintenance"})
+					return
+				}
+				c.JSON(200, all)
+			})
+
+			admin.POST("/maintenance/tasks", func(c *gin.Context) {
+				var task MaintenanceTask
+				if err := c.ShouldBindJSON(&task); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid task data"})
+					return
+				}
+				task, err := printers.AddMaintenanceTask(task)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Task added", "task": task})
+			})
+
+			// Give a printer the standard task list
+			admin.POST("/maintenance/tasks/defaults", func(c *gin.Context) {
+				type DefaultsRequest struct {
+					PrinterID string `json:"printer_id" binding:"required"`
+				}
+
+				var req DefaultsRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Choose a printer"})
+					return
+				}
+				added, err := printers.AddDefaultMaintenanceTasks(req.PrinterID)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": fmt.Sprintf("%d tasks added", len(added)), "tasks": added})
+			})
+
+			admin.DELETE("/maintenance/tasks/:id", func(c *gin.Context) {
+				var task MaintenanceTask
+				if err := db.First(&task, c.Param("id")).Error; err != nil {
+					c.JSON(404, gin.H{"error": "Maintenance task not found"})
+					return
+				}
+				if err := db.Delete(&task).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to delete the task"})
+					return
+				}
+				printers.refreshMaintenance()
+				c.JSON(200, gin.H{"message": "Task deleted"})
+			})
+
+			// Mark a task done, which starts its count again
+			admin.POST("/maintenance/tasks/:id/done", func(c *gin.Context) {
+				type DoneRequest struct {
+					Note string `json:"note"`
+				}
+
+				var req DoneRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid data"})
+					return
+				}
+				taskID, err := strconv.Atoi(c.Param("id"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid task ID"})
+					return
+				}
+
+				entry, err := printers.CompleteMaintenanceTask(uint(taskID), currentAdmin(c).Name, req.Note)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Logged", "entry": entry})
+			})
+
+			// Who did what to which printer, newest first
+			admin.GET("/maintenance/log", func(c *gin.Context) {
+				var entries []MaintenanceLog
+				query := db.Order("done_at DESC").Limit(200)
+				if id := c.Query("printer_id"); id != "" {
+					query = query.Where("printer_id = ?", id)
+				}
+				if err := query.Find(&entries).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve the maintenance log"})
+					return
+				}
+				c.JSON(200, entries)
+			})
+
+			// Log unplanned work, such as clearing a jam
+			admin.POST("/maintenance/log", func(c *gin.Context) {
+				type LogRequest struct {
+					PrinterID string `json:"printer_id" binding:"required"`
+					TaskName  string `json:"task_name" binding:"required"`
+					Note      string `json:"note"`
+				}
+
+				var req LogRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Printer and what was done are required"})
+					return
+				}
+				entry, err := printers.LogMaintenance(req.PrinterID, req.TaskName, currentAdmin(c).Name, req.Note)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Logged", "entry": entry})
+			})
+
+			// Take a printer out of service, or put it back
+			admin.POST("/printers/:id/maintenance-mode", func(c *gin.Context) {
+				type ModeRequest struct {
+					On   bool   `json:"on"`
+					Note string `json:"note"`
+				}
+
+				var req ModeRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid data"})
+					return
+				}
+				mode, err := printers.SetMaintenanceMode(c.Param("id"), req.On, currentAdmin(c).Name, req.Note)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				message := "Printer back in service"
+				if mode.On {
+					message = "Printer taken out of service"
+				}
+				c.JSON(200, gin.H{"message": message, "mode": mode})
 			})
 
 			// Tidy up old plates - deleting other people's files is an
@@ -1038,13 +1444,87 @@ func main() {
 				c.JSON(200, gin.H{"message": "File deleted from the printer"})
 			})
 
+			// Browse the printer's card beyond the top folder: cache/,
+			// timelapse/ and the rest
+			admin.GET("/printers/:id/browse", func(c *gin.Context) {
+				entries, err := printers.Browse(c.Param("id"), c.Query("path"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, entries)
+			})
+
+			// Copy a file back off the printer
+			admin.GET("/printers/:id/download", func(c *gin.Context) {
+				name, size, contents, err := printers.Download(c.Param("id"), c.Query("path"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				defer contents.Close()
+				c.DataFromReader(200, size, "application/octet-stream", contents, map[string]string{
+					"Content-Disposition": fmt.Sprintf("attachment; filename=%q", name),
+				})
+			})
+
+			admin.POST("/printers/:id/files/rename", func(c *gin.Context) {
+				var req struct {
+					Path string `json:"path" binding:"required"`
+					Name string `json:"name" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Give the file and its new name"})
+					return
+				}
+				name, err := printers.RenameFile(c.Param("id"), req.Path, req.Name)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "File renamed to " + name, "name": name})
+			})
+
+			// How full the card is, folder by folder
+			admin.GET("/printers/:id/storage", func(c *gin.Context) {
+				usage, err := printers.StorageUsage(c.Param("id"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, usage)
+			})
+
+			// Clear out old plates in one go. dry_run lists what would go.
+			admin.POST("/printers/:id/files/cleanup", func(c *gin.Context) {
+				var req struct {
+					Folder string `json:"folder"`
+					Days   int    `json:"days" binding:"required"`
+					DryRun bool   `json:"dry_run"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Give an age in days"})
+					return
+				}
+				result, err := printers.CleanupFiles(c.Param("id"), CleanupOptions{
+					Folder: req.Folder,
+					Days:   req.Days,
+					DryRun: req.DryRun,
+				})
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, result)
+			})
+
 			// Pause the current job - reversible, unlike stop
 			admin.POST("/printers/:id/pause", func(c *gin.Context) {
 				if err := printers.Pause(c.Param("id"), currentAdmin(c).Name); err != nil {
 					c.JSON(400, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(200, gin.H{"message": "Pause command sent to the printer"})
+				c.JSON(200, gin.H{"message": "The printer has paused"})
 			})
 
 			// Resume a paused job
@@ -1053,7 +1533,7 @@ func main() {
 					c.JSON(400, gin.H{"error": err.Error()})
 					return
 				}
-				c.JSON(200, gin.H{"message": "Resume command sent to the printer"})
+				c.JSON(200, gin.H{"message": "The printer has resumed"})
 			})
 
 			// Chamber light. Harmless in itself, but it commands hardware, so
@@ -1069,7 +1549,7 @@ func main() {
 					return
 				}
 
-				if err := printers.SetLight(c.Param("id"), *req.On); err != nil {
+				if err := printers.SetLight(c.Param("id"), currentAdmin(c).Name, *req.On); err != nil {
 					c.JSON(400, gin.H{"error": err.Error()})
 					return
 				}
@@ -1081,35 +1561,146 @@ func main() {
 				c.JSON(200, gin.H{"message": "Chamber light turned " + state})
 			})
 
-			// The automatic print log
-			admin.GET("/print-jobs", func(c *gin.Context) {
-				var jobs []PrintJob
-				query := db.Order("started_at DESC").Limit(200)
-				if id := c.Query("printer_id"); id != "" {
-					query = query.Where("printer_id = ?", id)
+			// Nozzle and bed targets. Either may be left out.
+			admin.POST("/printers/:id/temperature", func(c *gin.Context) {
+				var req struct {
+					Nozzle *float64 `json:"nozzle"`
+					Bed    *float64 `json:"bed"`
 				}
-				if err := query.Find(&jobs).Error; err != nil {
-					c.JSON(500, gin.H{"error": "Failed to retrieve print jobs"})
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid request"})
 					return
 				}
-				c.JSON(200, jobs)
+				if err := printers.SetTemperature(c.Param("id"), currentAdmin(c).Name, req.Nozzle, req.Bed); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "The printer has accepted the temperature"})
 			})
 
-			// Print log as CSV
-			admin.GET("/export-print-jobs-csv", func(c *gin.Context) {
-				var jobs []PrintJob
-				if err := db.Order("started_at DESC").Find(&jobs).Error; err != nil {
-					c.JSON(500, gin.H{"error": "Failed to retrieve print jobs"})
+			// Part, aux or chamber fan, as a percentage
+			admin.POST("/printers/:id/fan", func(c *gin.Context) {
+				var req struct {
+					Fan   string `json:"fan" binding:"required"`
+					Speed *int   `json:"speed" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Specify a fan and a speed"})
+					return
+				}
+				if err := printers.SetFan(c.Param("id"), currentAdmin(c).Name, req.Fan, *req.Speed); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
 					return
 				}
+				c.JSON(200, gin.H{"message": "The printer has accepted the fan speed"})
+			})
 
-				c.Header("Content-Type", "text/csv")
+			// Speed profile of the running print
+			admin.POST("/printers/:id/speed", func(c *gin.Context) {
+				var req struct {
+					Profile string `json:"profile" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Specify a speed profile"})
+					return
+				}
+				if err := printers.SetSpeedProfile(c.Param("id"), currentAdmin(c).Name, req.Profile); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "The printer has accepted the speed profile"})
+			})
+
+			// One line of G-code from the allow-list in printer_commands.go
+			admin.POST("/printers/:id/gcode", func(c *gin.Context) {
+				var req struct {
+					Line string `json:"line" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Specify a line of G-code"})
+					return
+				}
+				sent, err := printers.SendGcode(c.Param("id"), currentAdmin(c).Name, req.Line)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "The printer has accepted the command", "sent": sent})
+			})
+
+			// Everything admins have sent to a printer
+			admin.GET("/printers/:id/actions", func(c *gin.Context) {
+				actions, err := printers.Actions(c.Param("id"), 0)
+				if err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve actions"})
+					return
+				}
+				c.JSON(200, actions)
+			})
+
+			// The automatic print log
+			admin.GET("/print-jobs", func(c *gin.Context) {
+				var jobs []PrintJob
+				query := db.Order("started_at DESC").Limit(200)
+				if id := c.Query("printer_id"); id != "" {
+					query = query.Where("printer_id = ?", id)
+				}
+				if owner := normalizeOwner(c.Query("owner")); owner != "" {
+					query = query.Where("owner = ?", owner)
+				}
+				if err := query.Find(&jobs).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve print jobs"})
+					return
+				}
+				c.JSON(200, jobs)
+			})
+
+			// Who sent what, and whether it was ever printed
+			admin.GET("/uploads", func(c *gin.Context) {
+				records, err := printers.Uploads(UploadFilter{
+					PrinterID: c.Query("printer_id"),
+					Owner:     c.Query("owner"),
+					Outcome:   c.Query("outcome"),
+					Printed:   c.Query("printed"),
+				})
+				if err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve uploads"})
+					return
+				}
+				c.JSON(200, records)
+			})
+
+			// What admins sent to a printer during one job
+			admin.GET("/print-jobs/:id/actions", func(c *gin.Context) {
+				jobID, err := strconv.Atoi(c.Param("id"))
+				if err != nil || jobID <= 0 {
+					c.JSON(400, gin.H{"error": "Invalid print job ID"})
+					return
+				}
+				actions, err := printers.Actions("", uint(jobID))
+				if err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve actions"})
+					return
+				}
+				c.JSON(200, actions)
+			})
+
+			// Print log as CSV
+			admin.GET("/export-print-jobs-csv", func(c *gin.Context) {
+				var jobs []PrintJob
+				if err := db.Order("started_at DESC").Find(&jobs).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve print jobs"})
+					return
+				}
+
+				c.Header("Content-Type", "text/csv")
 				c.Header("Content-Disposition", "attachment; filename=print_jobs.csv")
 
 				writer := csv.NewWriter(c.Writer)
 				defer writer.Flush()
-				writer.Write([]string{"ID", "Printer", "File", "Started", "Ended",
-					"Minutes", "Result", "Stopped By", "Last Percent"})
+				writer.Write([]string{"ID", "Printer", "File", "Owner", "Started", "Ended",
+					"Minutes", "Result", "Stopped By", "Last Percent", "Started By",
+					"Estimated Minutes", "Filament (g)"})
 
 				for _, job := range jobs {
 					minutes := ""
@@ -1122,22 +1713,543 @@ func main() {
 						strconv.Itoa(int(job.ID)),
 						job.PrinterName,
 						job.FileName,
+						jobOwner(job),
 						job.StartedAt.Local().Format("2006-01-02 15:04:05"),
 						ended,
 						minutes,
 						job.Result,
 						job.StoppedBy,
 						strconv.Itoa(job.LastPercent),
+						job.StartedBy,
+						strconv.Itoa(job.EstimatedMinutes),
+						strconv.FormatFloat(job.FilamentGrams, 'f', 1, 64),
 					})
 				}
 			})
 
+			// Printing per owner or per group: ?by=owner|group, ?from= and
+			// ?to= as dates (the last 30 days by default)
+			admin.GET("/print-usage", func(c *gin.Context) {
+				from, to, err := parseReportRange(c.Query("from"), c.Query("to"), time.Now())
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				rows, err := UsageReport(db, c.Query("by"), from, to)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"from": from, "to": to, "rows": rows})
+			})
+
+			admin.GET("/export-print-usage-csv", func(c *gin.Context) {
+				from, to, err := parseReportRange(c.Query("from"), c.Query("to"), time.Now())
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				rows, err := UsageReport(db, c.Query("by"), from, to)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.Header("Content-Type", "text/csv")
+				c.Header("Content-Disposition", "attachment; filename=print_usage.csv")
+
+				writer := csv.NewWriter(c.Writer)
+				defer writer.Flush()
+				writer.Write(usageCSVHeader)
+				for _, row := range rows {
+					writer.Write(usageCSVRow(row))
+				}
+			})
+
+			// Utilisation and reliability per printer: ?from= and ?to= as
+			// dates, ?period=day|week|month for a breakdown
+			admin.GET("/printer-analytics", func(c *gin.Context) {
+				from, to, err := parseReportRange(c.Query("from"), c.Query("to"), time.Now())
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				report, err := printers.PrinterAnalyticsReport(from, to, c.Query("period"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, report)
+			})
+
+			// Every time a printer dropped off, came back, had its access
+			// code rejected or lost its camera: ?printer_id=, ?from= and
+			// ?to= as dates
+			admin.GET("/printer-availability", func(c *gin.Context) {
+				from, to, err := parseReportRange(c.Query("from"), c.Query("to"), time.Now())
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				events, err := printers.AvailabilityEvents(c.Query("printer_id"), from, to)
+				if err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve the availability log"})
+					return
+				}
+				c.JSON(200, events)
+			})
+
+			// Uptime per printer from that log, with whether the outages
+			// look like the network or the printer being switched off
+			admin.GET("/printer-uptime", func(c *gin.Context) {
+				from, to, err := parseReportRange(c.Query("from"), c.Query("to"), time.Now())
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				reports, err := printers.Uptime(c.Query("printer_id"), from, to)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, reports)
+			})
+
+			// Which group each print owner belongs to
+			admin.GET("/print-owners", func(c *gin.Context) {
+				var owners []OwnerGroup
+				if err := db.Order("group_name, owner").Find(&owners).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve owner groups"})
+					return
+				}
+				c.JSON(200, owners)
+			})
+
+			// Put an owner in a group; an empty group takes them out
+			admin.PUT("/print-owners/:owner", func(c *gin.Context) {
+				type GroupRequest struct {
+					Group string `json:"group"`
+				}
+
+				var req GroupRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid group data"})
+					return
+				}
+
+				owner := normalizeOwner(c.Param("owner"))
+				if owner == "" {
+					c.JSON(400, gin.H{"error": "Say whose group to set"})
+					return
+				}
+				group := normalizeGroupName(req.Group)
+
+				if group == "" {
+					if err := db.Unscoped().Where("owner = ?", owner).Delete(&OwnerGroup{}).Error; err != nil {
+						c.JSON(500, gin.H{"error": "Failed to update the group"})
+						return
+					}
+					c.JSON(200, gin.H{"message": fmt.Sprintf("%s is no longer in a group", owner)})
+					return
+				}
+
+				var record OwnerGroup
+				db.Unscoped().Where("owner = ?", owner).First(&record)
+				record.Owner = owner
+				record.GroupName = group
+				record.DeletedAt = gorm.DeletedAt{}
+				if err := db.Unscoped().Save(&record).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to update the group"})
+					return
+				}
+				c.JSON(200, gin.H{"message": fmt.Sprintf("%s is in %s", owner, group), "owner": record})
+			})
+
+			// HMS fault history, newest first. ?open=true leaves out faults
+			// that have cleared; ?unacknowledged=true those an admin has seen.
+			admin.GET("/printer-faults", func(c *gin.Context) {
+				var faults []PrinterFault
+				query := db.Order("first_seen_at DESC").Limit(200)
+				if id := c.Query("printer_id"); id != "" {
+					query = query.Where("printer_id = ?", id)
+				}
+				if c.Query("open") == "true" {
+					query = query.Where("cleared_at IS NULL")
+				}
+				if c.Query("unacknowledged") == "true" {
+					query = query.Where("acknowledged_at IS NULL")
+				}
+				if err := query.Find(&faults).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve printer faults"})
+					return
+				}
+				c.JSON(200, faults)
+			})
+
+			// Acknowledge a fault, with a note on what was done about it
+			admin.POST("/printer-faults/:id/acknowledge", func(c *gin.Context) {
+				type AcknowledgeRequest struct {
+					Note string `json:"note"`
+				}
+
+				var req AcknowledgeRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid acknowledgement data"})
+					return
+				}
+
+				faultID, err := strconv.Atoi(c.Param("id"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid fault ID"})
+					return
+				}
+
+				fault, err := printers.AcknowledgeFault(uint(faultID), currentAdmin(c).Name, req.Note)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Fault acknowledged", "fault": fault})
+			})
+
+			// Replace HMS descriptions with a newer table - either a flat
+			// {"HMS_...": "text"} object or the list Bambu publishes.
+			admin.PUT("/hms-codes", func(c *gin.Context) {
+				raw, err := c.GetRawData()
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Could not read the code table"})
+					return
+				}
+
+				count, err := printers.UpdateHMSDescriptions(raw)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": fmt.Sprintf("%d HMS descriptions updated", count)})
+			})
+
+			// Send a queued file to a printer. The admin confirms the plate
+			// is clear; printer_id may be left out to take the suggestion.
+			admin.POST("/print-queue/:id/dispatch", func(c *gin.Context) {
+				type DispatchRequest struct {
+					PrinterID      string `json:"printer_id"`
+					PlateClear     bool   `json:"plate_clear"`
+					IgnoreFilament bool   `json:"ignore_filament"`
+				}
+
+				var req DispatchRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid dispatch data"})
+					return
+				}
+
+				entryID, err := strconv.Atoi(c.Param("id"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid queue entry ID"})
+					return
+				}
+
+				entry, job, err := queue.Dispatch(uint(entryID), req.PrinterID, currentAdmin(c).Name,
+					req.PlateClear, req.IgnoreFilament)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+
+				c.JSON(202, gin.H{
+					"message": fmt.Sprintf("%s is on its way to %s. Start it from the printer's screen once it is there.",
+						entry.FileName, entry.DispatchedTo),
+					"entry": entry,
+					"job":   job,
+				})
+			})
+
+			// Take a file out of the queue
+			admin.DELETE("/print-queue/:id", func(c *gin.Context) {
+				entryID, err := strconv.Atoi(c.Param("id"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid queue entry ID"})
+					return
+				}
+				if err := queue.Cancel(uint(entryID)); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Removed from the queue"})
+			})
+
+			// --- FILAMENT SPOOLS ---
+
+			// Every spool, or ?printer_id= for those loaded in one printer
+			admin.GET("/spools", func(c *gin.Context) {
+				var list []Spool
+				query := db.Order("material ASC, id ASC")
+				if id := c.Query("printer_id"); id != "" {
+					query = query.Where("printer_id = ?", id)
+				}
+				if err := query.Find(&list).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve spools"})
+					return
+				}
+				c.JSON(200, list)
+			})
+
+			// Grams left and value per material, with the low ones flagged
+			admin.GET("/spools/stock", func(c *gin.Context) {
+				stock, err := spools.Stock()
+				if err != nil {
+					c.JSON(500, gin.H{"error": "Failed to total the spools"})
+					return
+				}
+				c.JSON(200, stock)
+			})
+
+			admin.POST("/spools", func(c *gin.Context) {
+				var spool Spool
+				if err := c.ShouldBindJSON(&spool); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid spool data"})
+					return
+				}
+				// Loading goes through the assign endpoint
+				spool.ID, spool.PrinterID, spool.Tray = 0, "", nil
+				if spool.RemainingGrams == 0 {
+					spool.RemainingGrams = spool.InitialGrams
+				}
+				if err := normalizeSpool(&spool); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				if err := db.Create(&spool).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to save the spool"})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Spool added", "spool": spool})
+			})
+
+			// Correct a spool's details, e.g. after weighing it
+			admin.PUT("/spools/:id", func(c *gin.Context) {
+				var spool Spool
+				if err := db.First(&spool, c.Param("id")).Error; err != nil {
+					c.JSON(404, gin.H{"error": "Spool not found"})
+					return
+				}
+
+				var req Spool
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid spool data"})
+					return
+				}
+				spool.Brand = req.Brand
+				spool.Material = req.Material
+				spool.Color = req.Color
+				spool.InitialGrams = req.InitialGrams
+				spool.RemainingGrams = req.RemainingGrams
+				spool.Cost = req.Cost
+				spool.Location = req.Location
+				if err := normalizeSpool(&spool); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				if err := db.Save(&spool).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to save the spool"})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Spool updated", "spool": spool})
+			})
+
+			// Load a spool into a printer's tray, or unload it with no
+			// printer_id
+			admin.POST("/spools/:id/assign", func(c *gin.Context) {
+				type AssignRequest struct {
+					PrinterID string `json:"printer_id"`
+					Tray      int    `json:"tray"`
+				}
+
+				var req AssignRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid assignment"})
+					return
+				}
+
+				spoolID, err := strconv.Atoi(c.Param("id"))
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid spool ID"})
+					return
+				}
+
+				spool, err := spools.Assign(uint(spoolID), req.PrinterID, req.Tray)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Spool assigned", "spool": spool})
+			})
+
+			admin.DELETE("/spools/:id", func(c *gin.Context) {
+				var spool Spool
+				if err := db.First(&spool, c.Param("id")).Error; err != nil {
+					c.JSON(404, gin.H{"error": "Spool not found"})
+					return
+				}
+				if err := db.Delete(&spool).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to delete the spool"})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Spool deleted"})
+			})
+
+			// Alert subscriptions: who hears about which printer events
+			admin.GET("/alert-subscriptions", func(c *gin.Context) {
+				var subscriptions []AlertSubscription
+				if err := db.Order("kind, name").Find(&subscriptions).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve alert subscriptions"})
+					return
+				}
+				c.JSON(200, subscriptions)
+			})
+
+			admin.POST("/alert-subscriptions", func(c *gin.Context) {
+				type SubscriptionRequest struct {
+					Kind   string   `json:"kind" binding:"required"`
+					Name   string   `json:"name"`
+					URL    string   `json:"url"`
+					Events []string `json:"events" binding:"required"`
+				}
+
+				var req SubscriptionRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Kind and events are required"})
+					return
+				}
+
+				subscription := AlertSubscription{
+					Kind:   req.Kind,
+					Name:   req.Name,
+					URL:    req.URL,
+					Events: strings.Join(req.Events, ","),
+				}
+				if err := normalizeAlertSubscription(&subscription); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+
+				if subscription.Kind == "admin" {
+					var existing Admin
+					if err := db.Where("username = ?", subscription.Name).First(&existing).Error; err != nil {
+						c.JSON(400, gin.H{"error": "No admin has that username"})
+						return
+					}
+				}
+
+				if err := db.Create(&subscription).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to save the subscription"})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Subscription saved", "subscription": subscription})
+			})
+
+			admin.DELETE("/alert-subscriptions/:id", func(c *gin.Context) {
+				var subscription AlertSubscription
+				if err := db.First(&subscription, c.Param("id")).Error; err != nil {
+					c.JSON(404, gin.H{"error": "Subscription not found"})
+					return
+				}
+				if err := db.Delete(&subscription).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to delete the subscription"})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Subscription deleted"})
+			})
+
+			// The logged-in admin's own alerts, or with ?owner= those for one
+			// print owner, by the name their files start with. Owners have no
+			// login, so their alerts are only shown here or sent to their URL.
+			admin.GET("/notifications", func(c *gin.Context) {
+				kind, name := "admin", currentAdmin(c).Username
+				if c.Query("owner") != "" {
+					kind, name = "owner", normalizeOwner(c.Query("owner"))
+					if name == "" {
+						c.JSON(400, gin.H{"error": "Say whose notifications to show"})
+						return
+					}
+				}
+
+				var notes []Notification
+				if err := db.Where("recipient_kind = ? AND recipient_name = ?", kind, name).
+					Order("created_at DESC").Limit(100).Find(&notes).Error; err != nil {
+					c.JSON(500, gin.H{"error": "Failed to retrieve notifications"})
+					return
+				}
+				c.JSON(200, notes)
+			})
+
+			admin.POST("/notifications/:id/read", func(c *gin.Context) {
+				res := db.Model(&Notification{}).
+					Where("id = ? AND recipient_kind = ? AND recipient_name = ?",
+						c.Param("id"), "admin", currentAdmin(c).Username).
+					Update("read_at", time.Now())
+				if res.Error != nil {
+					c.JSON(500, gin.H{"error": "Failed to update the notification"})
+					return
+				}
+				if res.RowsAffected == 0 {
+					c.JSON(404, gin.H{"error": "Notification not found"})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Marked as read"})
+			})
+
+			// The printers themselves: added, changed and removed without a
+			// restart. Access codes are write-only.
+			admin.GET("/printers", func(c *gin.Context) {
+				c.JSON(200, printers.PrinterSettings())
+			})
+
+			admin.POST("/printers", func(c *gin.Context) {
+				var req PrinterConfigRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid printer details"})
+					return
+				}
+				cfg, err := printers.CreatePrinter(req.config())
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(201, gin.H{"message": "Printer added. Connecting...", "id": cfg.ID})
+			})
+
+			admin.PUT("/printers/:id", func(c *gin.Context) {
+				var req PrinterConfigRequest
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Invalid printer details"})
+					return
+				}
+				if _, err := printers.UpdatePrinter(c.Param("id"), req.config()); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Printer updated. Reconnecting..."})
+			})
+
+			admin.DELETE("/printers/:id", func(c *gin.Context) {
+				if err := printers.DeletePrinter(c.Param("id")); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Printer removed"})
+			})
+
 			// Update a printer's access code. Printers regenerate their code
 			// when LAN mode is toggled, and this avoids editing .env and
-			// restarting the site to recover.
+			// restarting the site to recover. The code is tried on the
+			// printer first; "check" says whether it was accepted, rejected
+			// or could not be tested, which save_untested overrides.
 			admin.PUT("/printers/:id/access-code", func(c *gin.Context) {
 				type AccessCodeRequest struct {
-					AccessCode string `json:"access_code" binding:"required"`
+					AccessCode   string `json:"access_code" binding:"required"`
+					SaveUntested bool   `json:"save_untested"`
 				}
 
 				var req AccessCodeRequest
@@ -1146,14 +2258,46 @@ func main() {
 					return
 				}
 
-				if err := printers.UpdateAccessCode(c.Param("id"), req.AccessCode); err != nil {
+				check, err := printers.UpdateAccessCode(c.Param("id"), req.AccessCode, req.SaveUntested)
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error(), "check": check})
+					return
+				}
+
+				message := "Access code accepted by the printer and saved. Reconnecting..."
+				if check.Result != AccessCodeAccepted {
+					message = "Access code saved without testing it. Reconnecting to the printer..."
+				}
+				c.JSON(200, gin.H{"message": message, "check": check})
+			})
+
+			// The certificate pinned for a printer, and a different one it
+			// has presented since
+			admin.GET("/printers/:id/certificate", func(c *gin.Context) {
+				view, err := printers.Certificate(c.Param("id"))
+				if err != nil {
 					c.JSON(400, gin.H{"error": err.Error()})
 					return
 				}
+				c.JSON(200, view)
+			})
 
-				c.JSON(200, gin.H{
-					"message": "Access code updated. Reconnecting to the printer...",
-				})
+			// Trust the certificate a replaced or reset printer now presents.
+			// The fingerprint must be the one waiting, as checked on the
+			// printer itself.
+			admin.POST("/printers/:id/certificate/accept", func(c *gin.Context) {
+				var req struct {
+					Fingerprint string `json:"fingerprint" binding:"required"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(400, gin.H{"error": "Give the fingerprint being accepted"})
+					return
+				}
+				if err := printers.AcceptCertificate(c.Param("id"), req.Fingerprint, currentAdmin(c).Name); err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+				c.JSON(200, gin.H{"message": "Certificate accepted. Reconnecting to the printer..."})
 			})
 
 			// Delete any Motion Capture Lab booking
@@ -0,0 +1,403 @@
+package main
+
+// Printer maintenance.
+//
+// Each printer has a list of recurring jobs - clean the carbon rods, swap the
+// nozzle, replace the PTFE tube - each due after so many print hours, so many
+// prints or so many days, whichever comes first. Hours and prints are counted
+// from the print log since the task was last done. Doing one is logged with
+// who did it, and the printer's status card shows when something is due or
+// overdue.
+//
+// An admin can also take a printer out of service while they work on it.
+// Uploads, admin starts and the queue all leave it alone until it is back.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// A task is due once this share of any of its intervals is used up
+	maintenanceDueShare = 0.9
+	// How often the status cards' maintenance summary is recalculated
+	maintenanceRefreshInterval = 5 * time.Minute
+)
+
+// Maintenance states, from best to worst.
+const (
+	MaintenanceOK      = "ok"
+	MaintenanceDue     = "due"
+	MaintenanceOverdue = "overdue"
+)
+
+// MaintenanceTask is one recurring job on one printer. A zero interval is not
+// used; at least one must be set.
+type MaintenanceTask struct {
+	gorm.Model
+	PrinterID     string  `json:"printer_id" gorm:"index"`
+	Name          string  `json:"name"`
+	IntervalHours float64 `json:"interval_hours"`
+	IntervalJobs  int     `json:"interval_jobs"`
+	IntervalDays  int     `json:"interval_days"`
+	// Counting starts here: when it was last done, or when the task was added
+	LastDoneAt time.Time `json:"last_done_at"`
+	Notes      string    `json:"notes"`
+}
+
+// MaintenanceLog is one piece of work done on a printer, planned or not.
+type MaintenanceLog struct {
+	gorm.Model
+	PrinterID string    `json:"printer_id" gorm:"index"`
+	TaskID    *uint     `json:"task_id"`
+	TaskName  string    `json:"task_name"`
+	DoneBy    string    `json:"done_by"`
+	DoneAt    time.Time `json:"done_at"`
+	Note      string    `json:"note"`
+}
+
+// MaintenanceMode records a printer taken out of service, so it stays out
+// across a restart.
+type MaintenanceMode struct {
+	gorm.Model
+	PrinterID string    `json:"printer_id" gorm:"uniqueIndex"`
+	On        bool      `json:"on"`
+	By        string    `json:"by"`
+	Note      string    `json:"note"`
+	Since     time.Time `json:"since"`
+}
+
+// TaskStatus is a task with how far along it is.
+type TaskStatus struct {
+	MaintenanceTask
+	HoursSince float64 `json:"hours_since"`
+	JobsSince  int     `json:"jobs_since"`
+	DaysSince  int     `json:"days_since"`
+	// The largest share of any interval used, 1 meaning exactly due
+	Used  float64 `json:"used"`
+	State string  `json:"state"`
+}
+
+// defaultMaintenanceTasks are starting points for a new printer, to be tuned
+// to how hard the lab's machines work.
+var defaultMaintenanceTasks = []MaintenanceTask{
+	{Name: "Clean carbon rods", IntervalHours: 100, IntervalDays: 30},
+	{Name: "Lubricate Z lead screws", IntervalHours: 300, IntervalDays: 90},
+	{Name: "Check and clean nozzle", IntervalHours: 200, IntervalJobs: 150},
+	{Name: "Replace PTFE tube", IntervalHours: 1000, IntervalDays: 365},
+}
+
+// normalizeMaintenanceTask checks and tidies a task from the admin page.
+func normalizeMaintenanceTask(t *MaintenanceTask) error {
+	t.Name = strings.TrimSpace(t.Name)
+	t.Notes = strings.TrimSpace(t.Notes)
+	if t.Name == "" {
+		return fmt.Errorf("give the task a name")
+	}
+	if t.IntervalHours < 0 || t.IntervalJobs < 0 || t.IntervalDays < 0 {
+		return fmt.Errorf("intervals cannot be negative")
+	}
+	if t.IntervalHours == 0 && t.IntervalJobs == 0 && t.IntervalDays == 0 {
+		return fmt.Errorf("set at least one interval: print hours, prints or days")
+	}
+	return nil
+}
+
+// taskStatus judges a task against the printer's jobs since it was last done.
+func taskStatus(task MaintenanceTask, jobs []PrintJob, now time.Time) TaskStatus {
+	status := TaskStatus{MaintenanceTask: task}
+
+	for _, job := range jobs {
+		if job.PrinterID != task.PrinterID || job.StartedAt.Before(task.LastDoneAt) {
+			continue
+		}
+		// Only the live job is open; ones a restart cut off are closed at start
+		end := now
+		if job.EndedAt != nil {
+			end = *job.EndedAt
+		}
+		status.HoursSince += end.Sub(job.StartedAt).Hours()
+		status.JobsSince++
+	}
+	status.DaysSince = int(now.Sub(task.LastDoneAt).Hours() / 24)
+
+	if task.IntervalHours > 0 {
+		status.Used = status.HoursSince / task.IntervalHours
+	}
+	if task.IntervalJobs > 0 {
+		if used := float64(status.JobsSince) / float64(task.IntervalJobs); used > status.Used {
+			status.Used = used
+		}
+	}
+	if task.IntervalDays > 0 {
+		days := now.Sub(task.LastDoneAt).Hours() / 24
+		if used := days / float64(task.IntervalDays); used > status.Used {
+			status.Used = used
+		}
+	}
+
+	switch {
+	case status.Used >= 1:
+		status.State = MaintenanceOverdue
+	case status.Used >= maintenanceDueShare:
+		status.State = MaintenanceDue
+	default:
+		status.State = MaintenanceOK
+	}
+	return status
+}
+
+// worstMaintenance is the printer's overall state, and the tasks behind it.
+func worstMaintenance(tasks []TaskStatus) (string, []string) {
+	state := MaintenanceOK
+	var names []string
+	for _, t := range tasks {
+		switch t.State {
+		case MaintenanceOverdue:
+			state = MaintenanceOverdue
+			names = append(names, t.Name)
+		case MaintenanceDue:
+			if state == MaintenanceOK {
+				state = MaintenanceDue
+			}
+			names = append(names, t.Name)
+		}
+	}
+	return state, names
+}
+
+// PrinterMaintenance is one printer's tasks and service state.
+type PrinterMaintenance struct {
+	PrinterID   string          `json:"printer_id"`
+	PrinterName string          `json:"printer_name"`
+	State       string          `json:"state"`
+	Tasks       []TaskStatus    `json:"tasks"`
+	Mode        MaintenanceMode `json:"mode"`
+}
+
+// Maintenance works out every printer's tasks.
+func (m *PrinterManager) Maintenance() ([]PrinterMaintenance, error) {
+	if m.db == nil {
+		return []PrinterMaintenance{}, nil
+	}
+
+	var tasks []MaintenanceTask
+	if err := m.db.Order("name ASC").Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	var modes []MaintenanceMode
+	if err := m.db.Find(&modes).Error; err != nil {
+		return nil, err
+	}
+
+	// Only the jobs since the oldest task's last service matter
+	since := time.Now()
+	for _, t := range tasks {
+		if t.LastDoneAt.Before(since) {
+			since = t.LastDoneAt
+		}
+	}
+	var jobs []PrintJob
+	if len(tasks) > 0 {
+		if err := m.db.Where("started_at >= ?", since).Find(&jobs).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	result := make([]PrinterMaintenance, 0, 0)
+	for _, p := range m.list() {
+		pm := PrinterMaintenance{PrinterID: p.cfg.ID, PrinterName: p.cfg.Name, Tasks: []TaskStatus{}}
+		for _, t := range tasks {
+			if t.PrinterID == p.cfg.ID {
+				pm.Tasks = append(pm.Tasks, taskStatus(t, jobs, now))
+			}
+		}
+		sort.SliceStable(pm.Tasks, func(i, j int) bool { return pm.Tasks[i].Used > pm.Tasks[j].Used })
+		pm.State, _ = worstMaintenance(pm.Tasks)
+		for _, mode := range modes {
+			if mode.PrinterID == p.cfg.ID {
+				pm.Mode = mode
+			}
+		}
+		result = append(result, pm)
+	}
+	return result, nil
+}
+
+// refreshMaintenance copies each printer's maintenance summary onto it, for
+// the status cards.
+func (m *PrinterManager) refreshMaintenance() {
+	all, err := m.Maintenance()
+	if err != nil {
+		log.Printf("maintenance: could not work out what is due: %v", err)
+		return
+	}
+	for _, pm := range all {
+		p, ok := m.lookup(pm.PrinterID)
+		if !ok {
+			continue
+		}
+		state, due := worstMaintenance(pm.Tasks)
+		p.mu.Lock()
+		p.maintenance = state
+		p.maintenanceDue = due
+		p.underMaintenance = pm.Mode.On
+		p.maintenanceNote = pm.Mode.Note
+		p.mu.Unlock()
+	}
+}
+
+// watchMaintenance keeps the summaries current as print hours add up.
+func (m *PrinterManager) watchMaintenance() {
+	m.refreshMaintenance()
+	ticker := time.NewTicker(maintenanceRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.refreshMaintenance()
+	}
+}
+
+// inService reports whether new work may be sent to the printer.
+func (p *printer) inService() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.underMaintenance {
+		return nil
+	}
+	if p.maintenanceNote != "" {
+		return fmt.Errorf("%s is under maintenance (%s) - choose another printer", p.cfg.Name, p.maintenanceNote)
+	}
+	return fmt.Errorf("%s is under maintenance - choose another printer", p.cfg.Name)
+}
+
+// AddMaintenanceTask adds a recurring task, counted from now.
+func (m *PrinterManager) AddMaintenanceTask(task MaintenanceTask) (MaintenanceTask, error) {
+	if _, ok := m.lookup(task.PrinterID); !ok {
+		return task, fmt.Errorf("unknown printer")
+	}
+	if err := normalizeMaintenanceTask(&task); err != nil {
+		return task, err
+	}
+	task.ID = 0
+	task.LastDoneAt = time.Now()
+	if err := m.db.Create(&task).Error; err != nil {
+		return task, fmt.Errorf("could not save the task")
+	}
+	m.refreshMaintenance()
+	return task, nil
+}
+
+// AddDefaultMaintenanceTasks gives a printer the standard list, skipping any
+// task it already has by name.
+func (m *PrinterManager) AddDefaultMaintenanceTasks(printerID string) ([]MaintenanceTask, error) {
+	if _, ok := m.lookup(printerID); !ok {
+		return nil, fmt.Errorf("unknown printer")
+	}
+	var existing []MaintenanceTask
+	if err := m.db.Where("printer_id = ?", printerID).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, t := range existing {
+		have[strings.ToLower(t.Name)] = true
+	}
+
+	var added []MaintenanceTask
+	for _, t := range defaultMaintenanceTasks {
+		if have[strings.ToLower(t.Name)] {
+			continue
+		}
+		t.PrinterID = printerID
+		t.LastDoneAt = time.Now()
+		if err := m.db.Create(&t).Error; err != nil {
+			return added, fmt.Errorf("could not save the tasks")
+		}
+		added = append(added, t)
+	}
+	m.refreshMaintenance()
+	return added, nil
+}
+
+// CompleteMaintenanceTask logs a task as done and starts its count again.
+func (m *PrinterManager) CompleteMaintenanceTask(id uint, adminName, note string) (MaintenanceLog, error) {
+	var entry MaintenanceLog
+	var task MaintenanceTask
+	if err := m.db.First(&task, id).Error; err != nil {
+		return entry, fmt.Errorf("maintenance task not found")
+	}
+
+	now := time.Now()
+	entry = MaintenanceLog{
+		PrinterID: task.PrinterID,
+		TaskID:    &task.ID,
+		TaskName:  task.Name,
+		DoneBy:    adminName,
+		DoneAt:    now,
+		Note:      strings.TrimSpace(note),
+	}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+		return tx.Model(&task).Update("last_done_at", now).Error
+	})
+	if err != nil {
+		return entry, fmt.Errorf("could not log the task")
+	}
+
+	m.refreshMaintenance()
+	return entry, nil
+}
+
+// LogMaintenance records unplanned work - a repair, a jam cleared.
+func (m *PrinterManager) LogMaintenance(printerID, taskName, adminName, note string) (MaintenanceLog, error) {
+	entry := MaintenanceLog{
+		PrinterID: printerID,
+		TaskName:  strings.TrimSpace(taskName),
+		DoneBy:    adminName,
+		DoneAt:    time.Now(),
+		Note:      strings.TrimSpace(note),
+	}
+	if _, ok := m.lookup(printerID); !ok {
+		return entry, fmt.Errorf("unknown printer")
+	}
+	if entry.TaskName == "" {
+		return entry, fmt.Errorf("say what was done")
+	}
+	if err := m.db.Create(&entry).Error; err != nil {
+		return entry, fmt.Errorf("could not log the work")
+	}
+	return entry, nil
+}
+
+// SetMaintenanceMode takes a printer out of service or puts it back.
+func (m *PrinterManager) SetMaintenanceMode(printerID string, on bool, adminName, note string) (MaintenanceMode, error) {
+	var mode MaintenanceMode
+	if _, ok := m.lookup(printerID); !ok {
+		return mode, fmt.Errorf("unknown printer")
+	}
+
+	m.db.Where("printer_id = ?", printerID).First(&mode)
+	mode.PrinterID = printerID
+	mode.On = on
+	mode.By = adminName
+	mode.Note = strings.TrimSpace(note)
+	mode.Since = time.Now()
+	if err := m.db.Save(&mode).Error; err != nil {
+		return mode, fmt.Errorf("could not save the printer's service state")
+	}
+
+	if on {
+		log.Printf("printer %s: taken out of service by %s", printerID, adminName)
+	} else {
+		log.Printf("printer %s: back in service (%s)", printerID, adminName)
+	}
+	m.refreshMaintenance()
+	return mode, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskStatus(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	lastDone := now.AddDate(0, 0, -10)
+
+	job := func(printerID string, daysAgo int, hours float64) PrintJob {
+		start := now.AddDate(0, 0, -daysAgo)
+		end := start.Add(time.Duration(hours * float64(time.Hour)))
+		return PrintJob{PrinterID: printerID, StartedAt: start, EndedAt: &end}
+	}
+	jobs := []PrintJob{
+		job("p1", 12, 50), // before the last service
+		job("p1", 8, 30),
+		job("p1", 3, 15),
+		job("p2", 2, 40), // another printer
+	}
+
+	byHours := taskStatus(MaintenanceTask{PrinterID: "p1", IntervalHours: 100, LastDoneAt: lastDone}, jobs, now)
+	if byHours.HoursSince != 45 || byHours.JobsSince != 2 || byHours.DaysSince != 10 {
+		t.Errorf("unexpected counts: %+v", byHours)
+	}
+	if byHours.State != MaintenanceOK {
+		t.Errorf("45 of 100 hours should be ok, got %s", byHours.State)
+	}
+
+	// Whichever interval is furthest along decides
+	byJobs := taskStatus(MaintenanceTask{PrinterID: "p1", IntervalHours: 100, IntervalJobs: 2, LastDoneAt: lastDone}, jobs, now)
+	if byJobs.State != MaintenanceOverdue || byJobs.Used != 1 {
+		t.Errorf("2 of 2 prints should be overdue, got %s (%v)", byJobs.State, byJobs.Used)
+	}
+
+	byDays := taskStatus(MaintenanceTask{PrinterID: "p1", IntervalDays: 11, LastDoneAt: lastDone}, jobs, now)
+	if byDays.State != MaintenanceDue {
+		t.Errorf("10 of 11 days should be due, got %s", byDays.State)
+	}
+
+	// A running job counts up to now
+	running := PrintJob{PrinterID: "p1", StartedAt: now.Add(-5 * time.Hour)}
+	if s := taskStatus(MaintenanceTask{PrinterID: "p1", IntervalHours: 100, LastDoneAt: lastDone},
+		[]PrintJob{running}, now); s.HoursSince != 5 {
+		t.Errorf("running job hours = %v, want 5", s.HoursSince)
+	}
+}
+
+func TestWorstMaintenance(t *testing.T) {
+	tasks := []TaskStatus{
+		{MaintenanceTask: MaintenanceTask{Name: "Rods"}, State: MaintenanceDue},
+		{MaintenanceTask: MaintenanceTask{Name: "Nozzle"}, State: MaintenanceOK},
+		{MaintenanceTask: MaintenanceTask{Name: "PTFE"}, State: MaintenanceOverdue},
+	}
+	state, names := worstMaintenance(tasks)
+	if state != MaintenanceOverdue || strings.Join(names, ",") != "Rods,PTFE" {
+		t.Errorf("got %s %v", state, names)
+	}
+
+	if state, names := worstMaintenance(nil); state != MaintenanceOK || names != nil {
+		t.Errorf("no tasks should be ok, got %s %v", state, names)
+	}
+}
+
+func TestNormalizeMaintenanceTask(t *testing.T) {
+	task := MaintenanceTask{Name: "  Clean rods ", IntervalHours: 100}
+	if err := normalizeMaintenanceTask(&task); err != nil || task.Name != "Clean rods" {
+		t.Errorf("unexpected result: %+v / %v", task, err)
+	}
+	if err := normalizeMaintenanceTask(&MaintenanceTask{Name: "Rods"}); err == nil {
+		t.Error("expected an error for a task with no interval")
+	}
+	if err := normalizeMaintenanceTask(&MaintenanceTask{Name: "Rods", IntervalDays: -1}); err == nil {
+		t.Error("expected an error for a negative interval")
+	}
+}
+
+func TestUnderMaintenanceBlocksWork(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{ID: "p1", Name: "3DP-01"}}
+	if err := p.inService(); err != nil {
+		t.Fatalf("a printer should start in service: %v", err)
+	}
+
+	p.underMaintenance = true
+	p.maintenanceNote = "new hotend"
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1": p}}
+
+	if _, err := m.UploadFile("p1", "srinath_part.3mf", strings.NewReader("x"), UploadOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "new hotend") {
+		t.Errorf("uploads should be refused with the reason, got %v", err)
+	}
+	if _, err := m.StartPrint("p1", "srinath_part.3mf", StartPrintOptions{Plate: 1}, "admin", true); err == nil {
+		t.Error("starts should be refused")
+	}
+
+	status := queuePrinter("p1", "IDLE", 0)
+	status.UnderMaintenance = true
+	if queueFits(PrintQueueEntry{}, status) {
+		t.Error("the queue should skip a printer under maintenance")
+	}
+}
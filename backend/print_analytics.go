@@ -0,0 +1,294 @@
+package main
+
+// How hard the printers work.
+//
+// Everything here is worked out from the print log: how much of a period each
+// printer spent printing, how its jobs ended, how long they ran, how long it
+// goes between failures and which hours of the day are busiest. That is enough
+// for a dashboard, and for the case that the lab needs another machine (or
+// that one of them needs a service).
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxAnalyticsBuckets keeps a daily breakdown over several years from turning
+// into one enormous response.
+const maxAnalyticsBuckets = 400
+
+// PrinterAnalytics is one printer, or the whole farm, over one window.
+type PrinterAnalytics struct {
+	PrinterID   string `json:"printer_id"`
+	PrinterName string `json:"printer_name"`
+	Jobs        int    `json:"jobs"`
+	Finished    int    `json:"finished"`
+	Failed      int    `json:"failed"`
+	Stopped     int    `json:"stopped"`
+	Interrupted int    `json:"interrupted"`
+	Running     int    `json:"running"`
+	// Printing time inside the window; a job that spans the edge counts
+	// only the part inside it
+	PrintingHours float64 `json:"printing_hours"`
+	IdleHours     float64 `json:"idle_hours"`
+	// Share of the window spent printing, 0-1
+	Utilisation       float64 `json:"utilisation"`
+	AverageJobMinutes float64 `json:"average_job_minutes"`
+	// Printing hours per failed print. Absent until something has failed.
+	MTBFHours *float64 `json:"mtbf_hours"`
+	// Hours printed in each hour of the day, 0 = midnight to 1am, local time
+	BusiestHours [24]float64 `json:"busiest_hours"`
+}
+
+// AnalyticsBucket is every printer over one day, week or month.
+type AnalyticsBucket struct {
+	Start    time.Time          `json:"start"`
+	End      time.Time          `json:"end"`
+	Farm     PrinterAnalytics   `json:"farm"`
+	Printers []PrinterAnalytics `json:"printers"`
+}
+
+// AnalyticsReport covers a whole period, optionally broken down.
+type AnalyticsReport struct {
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Period   string             `json:"period,omitempty"`
+	Farm     PrinterAnalytics   `json:"farm"`
+	Printers []PrinterAnalytics `json:"printers"`
+	Buckets  []AnalyticsBucket  `json:"buckets,omitempty"`
+}
+
+// analyticsBuckets splits [from, to) into calendar days, weeks (from Monday)
+// or months. An empty period means no breakdown.
+func analyticsBuckets(from, to time.Time, period string) ([][2]time.Time, error) {
+	var start time.Time
+	var next func(time.Time) time.Time
+
+	switch period {
+	case "":
+		return nil, nil
+	case "day":
+		start = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "week":
+		start = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	case "month":
+		start = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, from.Location())
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		return nil, fmt.Errorf("period must be day, week or month")
+	}
+
+	var buckets [][2]time.Time
+	for t := start; t.Before(to); t = next(t) {
+		if len(buckets) == maxAnalyticsBuckets {
+			return nil, fmt.Errorf("that is too many %ss - pick a longer period or a shorter range", period)
+		}
+		// The first and last buckets are cut to the range asked for
+		lo, hi := t, next(t)
+		if lo.Before(from) {
+			lo = from
+		}
+		if hi.After(to) {
+			hi = to
+		}
+		buckets = append(buckets, [2]time.Time{lo, hi})
+	}
+	return buckets, nil
+}
+
+// jobSpan is the part of a job inside [from, to). A job still running is taken
+// to run until now; jobs left running by an earlier run of the server are
+// closed at start, so only live ones are open.
+func jobSpan(job PrintJob, from, to, now time.Time) (time.Time, time.Time, bool) {
+	start, end := job.StartedAt, now
+	if job.EndedAt != nil {
+		end = *job.EndedAt
+	}
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	return start, end, end.After(start)
+}
+
+// addBusyHours spreads a span of printing over the hours of the day it fell in.
+func addBusyHours(hours *[24]float64, start, end time.Time) {
+	for t := start; t.Before(end); {
+		local := t.Local()
+		hourEnd := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, time.Local).
+			Add(time.Hour)
+		if hourEnd.After(end) {
+			hourEnd = end
+		}
+		hours[local.Hour()] += hourEnd.Sub(t).Hours()
+		t = hourEnd
+	}
+}
+
+// analyzeWindow works out one printer's figures from its jobs. A job counts
+// towards the window it started in; its printing time counts wherever it fell.
+func analyzeWindow(id, name string, jobs []PrintJob, from, to, now time.Time) PrinterAnalytics {
+	a := PrinterAnalytics{PrinterID: id, PrinterName: name}
+	var endedMinutes float64
+	var ended int
+
+	for _, job := range jobs {
+		start, end, inside := jobSpan(job, from, to, now)
+		if inside {
+			a.PrintingHours += end.Sub(start).Hours()
+			addBusyHours(&a.BusiestHours, start, end)
+		}
+
+		if job.StartedAt.Before(from) || !job.StartedAt.Before(to) {
+			continue
+		}
+		a.Jobs++
+		switch job.Result {
+		case "finished":
+			a.Finished++
+		case "failed":
+			a.Failed++
+		case "stopped":
+			a.Stopped++
+		case "interrupted":
+			a.Interrupted++
+		case "running":
+			a.Running++
+		}
+		if job.EndedAt != nil {
+			endedMinutes += job.EndedAt.Sub(job.StartedAt).Minutes()
+			ended++
+		}
+	}
+
+	capacity := to.Sub(from).Hours()
+	if capacity > 0 {
+		a.Utilisation = a.PrintingHours / capacity
+		a.IdleHours = capacity - a.PrintingHours
+		if a.IdleHours < 0 {
+			a.IdleHours = 0
+		}
+	}
+	if ended > 0 {
+		a.AverageJobMinutes = endedMinutes / float64(ended)
+	}
+	if a.Failed > 0 {
+		mtbf := a.PrintingHours / float64(a.Failed)
+		a.MTBFHours = &mtbf
+	}
+	return a
+}
+
+// combineAnalytics adds printers up into the farm's figures. Utilisation is
+// the farm's printing time over all the printers' time together.
+func combineAnalytics(printers []PrinterAnalytics, window time.Duration) PrinterAnalytics {
+	farm := PrinterAnalytics{PrinterID: "farm", PrinterName: "All printers"}
+	var jobMinutes float64
+	var ended int
+	for _, p := range printers {
+		farm.Jobs += p.Jobs
+		farm.Finished += p.Finished
+		farm.Failed += p.Failed
+		farm.Stopped += p.Stopped
+		farm.Interrupted += p.Interrupted
+		farm.Running += p.Running
+		farm.PrintingHours += p.PrintingHours
+		farm.IdleHours += p.IdleHours
+		for h := range p.BusiestHours {
+			farm.BusiestHours[h] += p.BusiestHours[h]
+		}
+		n := p.Finished + p.Failed + p.Stopped + p.Interrupted
+		jobMinutes += p.AverageJobMinutes * float64(n)
+		ended += n
+	}
+	if capacity := window.Hours() * float64(len(printers)); capacity > 0 {
+		farm.Utilisation = farm.PrintingHours / capacity
+	}
+	if ended > 0 {
+		farm.AverageJobMinutes = jobMinutes / float64(ended)
+	}
+	if farm.Failed > 0 {
+		mtbf := farm.PrintingHours / float64(farm.Failed)
+		farm.MTBFHours = &mtbf
+	}
+	return farm
+}
+
+// analyzePrinters builds the report from the jobs that touch the range. Every
+// configured printer appears even with nothing printed - an idle machine is
+// the point of the exercise - as does any printer found only in the log.
+func analyzePrinters(configs []PrinterConfig, jobs []PrintJob, from, to, now time.Time, period string) (AnalyticsReport, error) {
+	report := AnalyticsReport{From: from, To: to, Period: period}
+
+	buckets, err := analyticsBuckets(from, to, period)
+	if err != nil {
+		return report, err
+	}
+
+	names := map[string]string{}
+	var ids []string
+	for _, cfg := range configs {
+		if _, ok := names[cfg.ID]; !ok {
+			names[cfg.ID] = cfg.Name
+			ids = append(ids, cfg.ID)
+		}
+	}
+	byPrinter := map[string][]PrintJob{}
+	for _, job := range jobs {
+		if _, ok := names[job.PrinterID]; !ok {
+			names[job.PrinterID] = job.PrinterName
+			ids = append(ids, job.PrinterID)
+		}
+		byPrinter[job.PrinterID] = append(byPrinter[job.PrinterID], job)
+	}
+	sort.SliceStable(ids, func(i, j int) bool { return names[ids[i]] < names[ids[j]] })
+
+	window := func(lo, hi time.Time) ([]PrinterAnalytics, PrinterAnalytics) {
+		printers := make([]PrinterAnalytics, 0, len(ids))
+		for _, id := range ids {
+			printers = append(printers, analyzeWindow(id, names[id], byPrinter[id], lo, hi, now))
+		}
+		return printers, combineAnalytics(printers, hi.Sub(lo))
+	}
+
+	report.Printers, report.Farm = window(from, to)
+	for _, b := range buckets {
+		printers, farm := window(b[0], b[1])
+		report.Buckets = append(report.Buckets, AnalyticsBucket{Start: b[0], End: b[1], Farm: farm, Printers: printers})
+	}
+	return report, nil
+}
+
+// PrinterAnalyticsReport loads the log for a range and analyses it. A future
+// end is cut to now, so a half-finished week is not shown as mostly idle.
+func (m *PrinterManager) PrinterAnalyticsReport(from, to time.Time, period string) (AnalyticsReport, error) {
+	now := time.Now()
+	if to.After(now) {
+		to = now
+	}
+	if !from.Before(to) {
+		return AnalyticsReport{}, fmt.Errorf("that range has not happened yet")
+	}
+
+	if m.db == nil {
+		return AnalyticsReport{}, fmt.Errorf("print history is not available")
+	}
+
+	var jobs []PrintJob
+	if err := m.db.Where("started_at < ? AND (ended_at IS NULL OR ended_at > ?)", to, from).
+		Order("started_at ASC").Find(&jobs).Error; err != nil {
+		return AnalyticsReport{}, err
+	}
+
+	configs := make([]PrinterConfig, 0, 0)
+	for _, p := range m.list() {
+		configs = append(configs, p.cfg)
+	}
+	return analyzePrinters(configs, jobs, from, to, now, period)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func analyticsJob(printerID, result string, start time.Time, hours float64) PrintJob {
+	job := PrintJob{PrinterID: printerID, PrinterName: printerID, Result: result, StartedAt: start}
+	if result != "running" {
+		end := start.Add(time.Duration(hours * float64(time.Hour)))
+		job.EndedAt = &end
+	}
+	return job
+}
+
+func TestAnalyzePrinters(t *testing.T) {
+	day := time.Date(2026, 10, 5, 0, 0, 0, 0, time.Local)
+	from, to := day, day.AddDate(0, 0, 2)
+	now := to.Add(time.Hour)
+
+	jobs := []PrintJob{
+		analyticsJob("a", "finished", day.Add(9*time.Hour), 6),
+		analyticsJob("a", "failed", day.Add(20*time.Hour), 6), // runs past midnight
+		analyticsJob("a", "finished", day.Add(36*time.Hour), 12),
+		// Started before the range: its time counts, the job itself does not
+		analyticsJob("b", "stopped", day.Add(-2*time.Hour), 4),
+	}
+	configs := []PrinterConfig{{ID: "a", Name: "A"}, {ID: "b", Name: "B"}, {ID: "c", Name: "C"}}
+
+	report, err := analyzePrinters(configs, jobs, from, to, now, "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Printers) != 3 {
+		t.Fatalf("every configured printer should appear, got %d", len(report.Printers))
+	}
+
+	a := report.Printers[0]
+	if a.Jobs != 3 || a.Finished != 2 || a.Failed != 1 {
+		t.Errorf("unexpected counts: %+v", a)
+	}
+	if a.PrintingHours != 24 || a.IdleHours != 24 || a.Utilisation != 0.5 {
+		t.Errorf("unexpected time: printing %v, idle %v, utilisation %v", a.PrintingHours, a.IdleHours, a.Utilisation)
+	}
+	if a.AverageJobMinutes != 8*60 {
+		t.Errorf("average job = %v minutes, want 480", a.AverageJobMinutes)
+	}
+	if a.MTBFHours == nil || *a.MTBFHours != 24 {
+		t.Errorf("MTBF = %v, want 24 hours", a.MTBFHours)
+	}
+	// 09:00-15:00, 20:00-02:00 and 12:00-24:00 the next day
+	if a.BusiestHours[12] != 2 || a.BusiestHours[1] != 1 || a.BusiestHours[5] != 0 {
+		t.Errorf("unexpected busiest hours: %v", a.BusiestHours)
+	}
+
+	b := report.Printers[1]
+	if b.Jobs != 0 || b.PrintingHours != 2 || b.MTBFHours != nil {
+		t.Errorf("unexpected printer b: %+v", b)
+	}
+	if c := report.Printers[2]; c.Jobs != 0 || c.Utilisation != 0 || c.IdleHours != 48 {
+		t.Errorf("an idle printer should show as idle: %+v", c)
+	}
+
+	if report.Farm.Jobs != 3 || report.Farm.PrintingHours != 26 {
+		t.Errorf("unexpected farm totals: %+v", report.Farm)
+	}
+	if got, want := report.Farm.Utilisation, 26.0/(48*3); got != want {
+		t.Errorf("farm utilisation = %v, want %v", got, want)
+	}
+
+	if len(report.Buckets) != 2 {
+		t.Fatalf("expected 2 daily buckets, got %d", len(report.Buckets))
+	}
+	// The failed job started on the first day, so it counts there, but its
+	// last two hours fell on the second
+	first, second := report.Buckets[0].Printers[0], report.Buckets[1].Printers[0]
+	if first.Jobs != 2 || first.PrintingHours != 10 || second.Jobs != 1 || second.PrintingHours != 14 {
+		t.Errorf("unexpected daily split: %+v / %+v", first, second)
+	}
+}
+
+func TestAnalyzeRunningJobCountsUntilNow(t *testing.T) {
+	day := time.Date(2026, 10, 5, 0, 0, 0, 0, time.Local)
+	jobs := []PrintJob{analyticsJob("a", "running", day.Add(10*time.Hour), 0)}
+
+	report, err := analyzePrinters(nil, jobs, day, day.AddDate(0, 0, 1), day.Add(13*time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := report.Printers[0]; p.Running != 1 || p.PrintingHours != 3 || p.AverageJobMinutes != 0 {
+		t.Errorf("unexpected running job figures: %+v", p)
+	}
+	if report.Buckets != nil {
+		t.Error("no period should mean no breakdown")
+	}
+}
+
+func TestAnalyticsBuckets(t *testing.T) {
+	// A Wednesday to the Wednesday after next
+	from := time.Date(2026, 10, 7, 0, 0, 0, 0, time.Local)
+	to := time.Date(2026, 10, 21, 0, 0, 0, 0, time.Local)
+
+	weeks, err := analyticsBuckets(from, to, "week")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wed-Sun, a full week, then Mon-Tue
+	if len(weeks) != 3 || !weeks[0][0].Equal(from) || weeks[1][0].Weekday() != time.Monday ||
+		!weeks[2][1].Equal(to) {
+		t.Errorf("unexpected weeks: %v", weeks)
+	}
+
+	months, err := analyticsBuckets(from, to.AddDate(0, 2, 0), "month")
+	if err != nil || len(months) != 3 {
+		t.Errorf("unexpected months: %v (%v)", months, err)
+	}
+
+	if _, err := analyticsBuckets(from, to, "fortnight"); err == nil {
+		t.Error("expected an error for an unknown period")
+	}
+	if _, err := analyticsBuckets(from, from.AddDate(5, 0, 0), "day"); err == nil {
+		t.Error("expected an error for too many buckets")
+	}
+}
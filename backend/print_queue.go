@@ -0,0 +1,488 @@
+package main
+
+// The print queue.
+//
+// Instead of picking a printer and then hoping somebody is at it, people submit
+// a sliced file to the queue - optionally tied to one printer, or to a material
+// and colour that has to be loaded. The file waits on the server. The queue
+// suggests the next free printer that fits, and an admin standing in the lab
+// confirms the plate is clear and dispatches it, which hands it to an upload
+// job like any other upload, so a slow printer does not hold up the queue.
+// Starting the print is still done at the printer's screen.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// defaultQueueJobMinutes stands in for a job whose length nobody gave, so the
+// entries behind it still get an estimate.
+const defaultQueueJobMinutes = 90
+
+// PrintQueueEntry is one sliced file waiting for a printer.
+type PrintQueueEntry struct {
+	gorm.Model
+	FileName  string `json:"file_name"` // sanitised, as it will land on the printer
+	Owner     string `json:"owner"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Where the file waits on the server until it is dispatched
+	StagedFile string `json:"-"`
+	// What the submitter asked for; empty means any
+	PrinterID        string `json:"printer_id"`
+	Material         string `json:"material"`
+	Color            string `json:"color"`
+	EstimatedMinutes int    `json:"estimated_minutes"`
+	// What the sliced file itself needs, read from it on submission
+	Filaments []SlicedFilament `json:"filaments" gorm:"serializer:json"`
+	// queued, dispatched or cancelled
+	Status       string     `json:"status" gorm:"index;default:'queued'"`
+	DispatchedTo string     `json:"dispatched_to"`
+	DispatchedBy string     `json:"dispatched_by"`
+	DispatchedAt *time.Time `json:"dispatched_at"`
+	// The upload job sending it, to follow at /api/uploads/:token
+	UploadToken string `json:"upload_token"`
+	// The last dispatch attempt's failure, cleared on success
+	Error string `json:"error"`
+}
+
+// QueueView is an entry as the queue page shows it.
+type QueueView struct {
+	PrintQueueEntry
+	Position int `json:"position"`
+	// A printer that is free right now and fits, if there is one
+	SuggestedPrinterID string `json:"suggested_printer_id"`
+	// When a fitting printer is expected to be free for it; nil when no
+	// configured printer can take it at all
+	EstimatedStart *time.Time `json:"estimated_start"`
+}
+
+// normalizeColor accepts "#ff6a13", "FF6A13" or Bambu's "FF6A13FF" and returns
+// the "#RRGGBB" form AMS slots are reported in.
+func normalizeColor(raw string) string {
+	raw = strings.TrimPrefix(strings.TrimSpace(raw), "#")
+	if raw == "" {
+		return ""
+	}
+	return trayColor(raw)
+}
+
+// materialMatches reports whether a loaded material satisfies a request. Asking
+// for "PLA" is satisfied by "PLA Basic" or "PLA Matte", but not by "PLA-CF".
+func materialMatches(loaded, wanted string) bool {
+	loaded = strings.ToUpper(strings.TrimSpace(loaded))
+	wanted = strings.ToUpper(strings.TrimSpace(wanted))
+	if wanted == "" {
+		return true
+	}
+	return loaded == wanted || strings.HasPrefix(loaded, wanted+" ")
+}
+
+// loadedSlots is every filament position on a printer with something in it.
+func loadedSlots(status PrinterStatus) []AMSSlot {
+	var slots []AMSSlot
+	for _, unit := range status.AMS {
+		for _, slot := range unit.Slots {
+			if !slot.Empty {
+				slots = append(slots, slot)
+			}
+		}
+	}
+	if status.ExternalSpool != nil && !status.ExternalSpool.Empty {
+		slots = append(slots, *status.ExternalSpool)
+	}
+	return slots
+}
+
+// hasFilament reports whether a printer has the requested material and colour
+// loaded somewhere.
+func hasFilament(status PrinterStatus, material, color string) bool {
+	if material == "" && color == "" {
+		return true
+	}
+	for _, slot := range loadedSlots(status) {
+		if !materialMatches(slot.Material, material) {
+			continue
+		}
+		if color != "" && !strings.EqualFold(slot.Color, color) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// queueFits reports whether a printer can take an entry at all, ignoring
+// whether it is busy.
+func queueFits(entry PrintQueueEntry, status PrinterStatus) bool {
+	if !status.Online || status.AccessCodeProblem || status.UnderMaintenance {
+		return false
+	}
+	if entry.PrinterID != "" && entry.PrinterID != status.ID {
+		return false
+	}
+	if !hasFilament(status, entry.Material, entry.Color) {
+		return false
+	}
+	return !hasBlockingProblem(checkFilament(status, entry.Filaments))
+}
+
+// readyForNextPrint reports whether a printer is done with whatever it had.
+// FINISH still has the last print on the plate, which is what the admin's
+// "plate is clear" confirmation is for.
+func readyForNextPrint(status PrinterStatus) bool {
+	return status.Online && (status.State == "IDLE" || status.State == "FINISH")
+}
+
+// planQueue works out positions, suggestions and start estimates by walking the
+// queue in order and giving each entry the fitting printer that frees up first.
+func planQueue(entries []PrintQueueEntry, statuses []PrinterStatus, now time.Time) []QueueView {
+	freeAt := make(map[string]time.Time, len(statuses))
+	for _, status := range statuses {
+		if readyForNextPrint(status) {
+			freeAt[status.ID] = now
+		} else if status.Online {
+			freeAt[status.ID] = now.Add(time.Duration(status.RemainingMinutes) * time.Minute)
+		}
+	}
+
+	views := make([]QueueView, 0, len(entries))
+	for i, entry := range entries {
+		view := QueueView{PrintQueueEntry: entry, Position: i + 1}
+
+		var chosen *PrinterStatus
+		for j := range statuses {
+			status := &statuses[j]
+			at, known := freeAt[status.ID]
+			if !known || !queueFits(entry, *status) {
+				continue
+			}
+			if chosen == nil || at.Before(freeAt[chosen.ID]) {
+				chosen = status
+			}
+		}
+
+		if chosen != nil {
+			start := freeAt[chosen.ID]
+			view.EstimatedStart = &start
+			if !start.After(now) && readyForNextPrint(*chosen) {
+				view.SuggestedPrinterID = chosen.ID
+			}
+
+			minutes := entry.EstimatedMinutes
+			if minutes <= 0 {
+				minutes = defaultQueueJobMinutes
+			}
+			freeAt[chosen.ID] = start.Add(time.Duration(minutes) * time.Minute)
+		}
+
+		views = append(views, view)
+	}
+	return views
+}
+
+// PrintQueue holds submitted files until an admin sends them to a printer.
+type PrintQueue struct {
+	db       *gorm.DB
+	printers *PrinterManager
+	uploads  *UploadJobs
+	dir      string
+	// Dispatch is one at a time, so a double click cannot send a file twice
+	mu sync.Mutex
+}
+
+// NewPrintQueue stores waiting files under dir and sends dispatched ones
+// through uploads.
+func NewPrintQueue(db *gorm.DB, printers *PrinterManager, uploads *UploadJobs, dir string) *PrintQueue {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Printf("Warning: could not create the print queue directory: %v", err)
+	}
+	return &PrintQueue{db: db, printers: printers, uploads: uploads, dir: dir}
+}
+
+// QueueRequest is what a submitter tells the queue along with the file.
+type QueueRequest struct {
+	Owner            string
+	PrinterID        string
+	Material         string
+	Color            string
+	EstimatedMinutes int
+}
+
+// Submit stages a file and adds it to the end of the queue. The warnings say
+// when no printer has the filament it needs loaded yet; the file still waits.
+func (q *PrintQueue) Submit(originalName string, contents io.Reader, req QueueRequest) (PrintQueueEntry, []string, error) {
+	var entry PrintQueueEntry
+
+	name, err := sanitizeUploadName(originalName)
+	if err != nil {
+		return entry, nil, err
+	}
+
+	if req.PrinterID != "" {
+		if _, ok := q.printers.lookup(req.PrinterID); !ok {
+			return entry, nil, fmt.Errorf("unknown printer")
+		}
+	}
+
+	owner := normalizeOwner(req.Owner)
+	if owner == "" {
+		owner = fileOwner(name)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return entry, nil, fmt.Errorf("could not store the file")
+	}
+	staged := filepath.Join(q.dir, fmt.Sprintf("%d-%s", time.Now().Unix(), hex.EncodeToString(suffix)))
+
+	out, err := os.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return entry, nil, fmt.Errorf("could not store the file")
+	}
+	size, err := io.Copy(out, contents)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(staged)
+		return entry, nil, fmt.Errorf("could not store the file: %w", err)
+	}
+
+	meta, err := q.checkStagedFile(staged, req.PrinterID)
+	if err != nil {
+		os.Remove(staged)
+		return entry, nil, err
+	}
+	if meta != nil && req.EstimatedMinutes == 0 {
+		seconds, _ := meta.totals()
+		req.EstimatedMinutes = (seconds + 59) / 60
+	}
+
+	entry = PrintQueueEntry{
+		FileName:         name,
+		Owner:            owner,
+		SizeBytes:        size,
+		StagedFile:       staged,
+		PrinterID:        req.PrinterID,
+		Material:         strings.TrimSpace(req.Material),
+		Color:            normalizeColor(req.Color),
+		EstimatedMinutes: req.EstimatedMinutes,
+		Status:           "queued",
+	}
+	if meta != nil && len(meta.Plates) > 0 {
+		entry.Filaments = meta.Plates[0].Filaments
+	}
+	if err := q.db.Create(&entry).Error; err != nil {
+		os.Remove(staged)
+		return entry, nil, fmt.Errorf("could not add the file to the queue")
+	}
+
+	log.Printf("print queue: %s queued %s", owner, name)
+	return entry, q.filamentWarnings(entry), nil
+}
+
+// filamentWarnings says when nothing the entry may go to has its filament
+// loaded, so the submitter knows to ask for a spool change.
+func (q *PrintQueue) filamentWarnings(entry PrintQueueEntry) []string {
+	if len(entry.Filaments) == 0 {
+		return nil
+	}
+
+	var problems []FilamentProblem
+	for _, status := range q.printers.Statuses() {
+		if entry.PrinterID != "" && entry.PrinterID != status.ID {
+			continue
+		}
+		if !reportsFilament(status) {
+			continue
+		}
+		found := checkFilament(status, entry.Filaments)
+		if !hasBlockingProblem(found) {
+			return nil
+		}
+		if problems == nil {
+			problems = found
+		}
+	}
+
+	var warnings []string
+	for _, problem := range problems {
+		if problem.blocking() {
+			warnings = append(warnings, "no printer has it loaded right now: "+problem.Message)
+		}
+	}
+	return warnings
+}
+
+// checkStagedFile reads a staged file's slice metadata and refuses it when no
+// printer it may go to could run it: the pinned one if there is one, otherwise
+// any configured printer.
+func (q *PrintQueue) checkStagedFile(staged, printerID string) (*SliceMetadata, error) {
+	f, err := os.Open(staged)
+	if err != nil {
+		return nil, fmt.Errorf("could not store the file")
+	}
+	defer f.Close()
+
+	meta, _, err := inspectUpload(f)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+
+	if printerID != "" {
+		p, ok := q.printers.lookup(printerID)
+		if !ok {
+			return meta, fmt.Errorf("unknown printer")
+		}
+		return meta, checkSliceCompatibility(p.sliceConfig(), meta)
+	}
+	var firstErr error
+	for _, p := range q.printers.list() {
+		err := checkSliceCompatibility(p.sliceConfig(), meta)
+		if err == nil {
+			return meta, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return meta, firstErr
+}
+
+// waiting returns the queued entries in submission order.
+func (q *PrintQueue) waiting() ([]PrintQueueEntry, error) {
+	var entries []PrintQueueEntry
+	err := q.db.Where("status = ?", "queued").Order("created_at ASC, id ASC").Find(&entries).Error
+	return entries, err
+}
+
+// View is the queue as everyone sees it: position, suggested printer and
+// estimated start for every waiting file.
+func (q *PrintQueue) View() ([]QueueView, error) {
+	entries, err := q.waiting()
+	if err != nil {
+		return nil, err
+	}
+	return planQueue(entries, q.printers.Statuses(), time.Now()), nil
+}
+
+// Dispatch hands a queued file to an upload job for a printer and returns the
+// job. printerID may be empty to take the queue's suggestion. The admin must
+// have confirmed the plate is clear, and may send it regardless of the
+// filament check when they are loading the spool themselves.
+func (q *PrintQueue) Dispatch(id uint, printerID, adminName string, plateClear, ignoreFilament bool) (PrintQueueEntry, UploadProgress, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var entry PrintQueueEntry
+	if !plateClear {
+		return entry, UploadProgress{}, fmt.Errorf("confirm the build plate is clear before dispatching")
+	}
+
+	if err := q.db.First(&entry, id).Error; err != nil {
+		return entry, UploadProgress{}, fmt.Errorf("queue entry not found")
+	}
+	if entry.Status != "queued" {
+		return entry, UploadProgress{}, fmt.Errorf("that file is no longer waiting (%s)", entry.Status)
+	}
+
+	views, err := q.View()
+	if err != nil {
+		return entry, UploadProgress{}, fmt.Errorf("could not read the queue")
+	}
+	if printerID == "" {
+		for _, view := range views {
+			if view.ID == entry.ID {
+				printerID = view.SuggestedPrinterID
+			}
+		}
+		if printerID == "" {
+			return entry, UploadProgress{}, fmt.Errorf("no suitable printer is free for this file yet")
+		}
+	}
+
+	var target *PrinterStatus
+	for _, status := range q.printers.Statuses() {
+		if status.ID == printerID {
+			status := status
+			target = &status
+		}
+	}
+	if target == nil {
+		return entry, UploadProgress{}, fmt.Errorf("unknown printer")
+	}
+	fits := entry
+	if ignoreFilament {
+		fits.Material, fits.Color, fits.Filaments = "", "", nil
+	}
+	if !queueFits(fits, *target) {
+		return entry, UploadProgress{}, fmt.Errorf("%s does not fit this file - check the printer and the filament it asked for", target.Name)
+	}
+	if !readyForNextPrint(*target) {
+		return entry, UploadProgress{}, fmt.Errorf("%s is not free (state: %s)", target.Name, target.State)
+	}
+
+	contents, err := os.Open(entry.StagedFile)
+	if err != nil {
+		return entry, UploadProgress{}, fmt.Errorf("the queued file is missing from the server - ask for it to be sent again")
+	}
+	defer contents.Close()
+
+	// Only staging happens here; the job sends it to the printer afterwards
+	job, err := q.uploads.SubmitFromQueue(printerID, StartUpload{
+		FileName:       entry.FileName,
+		Size:           entry.SizeBytes,
+		Owner:          entry.Owner,
+		IgnoreFilament: ignoreFilament,
+		SentBy:         adminName,
+	}, contents)
+	if err != nil {
+		q.db.Model(&entry).Update("error", err.Error())
+		return entry, UploadProgress{}, err
+	}
+
+	now := time.Now()
+	entry.Status = "dispatched"
+	entry.DispatchedTo = printerID
+	entry.DispatchedBy = adminName
+	entry.DispatchedAt = &now
+	entry.UploadToken = job.Token
+	entry.Error = ""
+	if err := q.db.Save(&entry).Error; err != nil {
+		log.Printf("print queue: %s was handed to upload %s but the queue could not be updated: %v", entry.FileName, job.Token, err)
+	}
+	os.Remove(entry.StagedFile)
+
+	log.Printf("print queue: %s dispatched %s to %s", adminName, entry.FileName, printerID)
+	return entry, job, nil
+}
+
+// Cancel takes a file out of the queue and deletes it from the server.
+func (q *PrintQueue) Cancel(id uint) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var entry PrintQueueEntry
+	if err := q.db.First(&entry, id).Error; err != nil {
+		return fmt.Errorf("queue entry not found")
+	}
+	if entry.Status != "queued" {
+		return fmt.Errorf("that file is no longer waiting (%s)", entry.Status)
+	}
+
+	if err := q.db.Model(&entry).Update("status", "cancelled").Error; err != nil {
+		return fmt.Errorf("could not cancel the entry")
+	}
+	os.Remove(entry.StagedFile)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+// Queue planning is pure: given what is waiting and what the printers report,
+// who goes where and when. That is what these tests pin down; the staging and
+// dispatch around it are thin wrappers over the database and the upload path.
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaterialMatches(t *testing.T) {
+	for _, c := range []struct {
+		loaded, wanted string
+		want           bool
+	}{
+		{"PLA Basic", "PLA", true},
+		{"PLA", "pla", true},
+		{"PLA Matte", "PLA Matte", true},
+		{"PLA-CF", "PLA", false},
+		{"PETG HF", "PLA", false},
+		{"anything", "", true},
+	} {
+		if got := materialMatches(c.loaded, c.wanted); got != c.want {
+			t.Errorf("materialMatches(%q, %q) = %v, want %v", c.loaded, c.wanted, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeColor(t *testing.T) {
+	for input, want := range map[string]string{
+		"#ff6a13":  "#FF6A13",
+		"FF6A13":   "#FF6A13",
+		"FF6A13FF": "#FF6A13",
+		"":         "",
+		"#abc":     "",
+	} {
+		if got := normalizeColor(input); got != want {
+			t.Errorf("normalizeColor(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func queuePrinter(id, state string, remaining int, slots ...AMSSlot) PrinterStatus {
+	return PrinterStatus{
+		ID:               id,
+		Name:             id,
+		Online:           true,
+		State:            state,
+		RemainingMinutes: remaining,
+		AMS:              []AMSUnit{{Slots: slots}},
+	}
+}
+
+func TestPlanQueueSuggestsIdlePrinterAndEstimates(t *testing.T) {
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	statuses := []PrinterStatus{
+		queuePrinter("busy", "RUNNING", 30, AMSSlot{Material: "PLA Basic", Color: "#000000"}),
+		queuePrinter("free", "IDLE", 0, AMSSlot{Material: "PETG HF", Color: "#FFFFFF"}),
+	}
+	entries := []PrintQueueEntry{
+		{FileName: "a.3mf", EstimatedMinutes: 60},
+		{FileName: "b.3mf", EstimatedMinutes: 20},
+		{FileName: "c.3mf", Material: "PLA"},
+	}
+
+	views := planQueue(entries, statuses, now)
+	if len(views) != 3 {
+		t.Fatalf("expected 3 views, got %d", len(views))
+	}
+
+	// First in line gets the printer that is free now
+	if views[0].Position != 1 || views[0].SuggestedPrinterID != "free" {
+		t.Errorf("first entry should go to the idle printer: %+v", views[0])
+	}
+	if !views[0].EstimatedStart.Equal(now) {
+		t.Errorf("first entry should start now, got %v", views[0].EstimatedStart)
+	}
+
+	// Second waits for the busy printer's job to end in 30 minutes, which is
+	// sooner than the free printer finishing the first entry's hour
+	if views[1].SuggestedPrinterID != "" {
+		t.Errorf("nothing is free for the second entry yet: %+v", views[1])
+	}
+	if want := now.Add(30 * time.Minute); !views[1].EstimatedStart.Equal(want) {
+		t.Errorf("second entry start = %v, want %v", views[1].EstimatedStart, want)
+	}
+
+	// Third needs PLA, which only the busy printer has, behind the second
+	if want := now.Add(50 * time.Minute); !views[2].EstimatedStart.Equal(want) {
+		t.Errorf("third entry start = %v, want %v", views[2].EstimatedStart, want)
+	}
+}
+
+func TestPlanQueueRespectsRestrictions(t *testing.T) {
+	now := time.Now()
+	statuses := []PrinterStatus{
+		queuePrinter("p1", "IDLE", 0, AMSSlot{Material: "PLA Basic", Color: "#000000"}),
+		queuePrinter("p2", "FINISH", 0, AMSSlot{Material: "PLA Basic", Color: "#FF6A13"}),
+	}
+	offline := queuePrinter("p3", "IDLE", 0)
+	offline.Online = false
+	statuses = append(statuses, offline)
+
+	views := planQueue([]PrintQueueEntry{
+		{FileName: "orange.3mf", Material: "PLA", Color: "#FF6A13"},
+		{FileName: "pinned.3mf", PrinterID: "p1"},
+		{FileName: "nylon.3mf", Material: "PA"},
+		{FileName: "offline.3mf", PrinterID: "p3"},
+	}, statuses, now)
+
+	if views[0].SuggestedPrinterID != "p2" {
+		t.Errorf("orange PLA is only on p2: %+v", views[0])
+	}
+	if views[1].SuggestedPrinterID != "p1" {
+		t.Errorf("a pinned entry must go to its printer: %+v", views[1])
+	}
+	if views[2].EstimatedStart != nil || views[2].SuggestedPrinterID != "" {
+		t.Errorf("nobody has PA loaded, so there is no estimate: %+v", views[2])
+	}
+	if views[3].EstimatedStart != nil {
+		t.Errorf("an offline printer cannot be planned for: %+v", views[3])
+	}
+}
+
+func TestHasFilamentChecksExternalSpool(t *testing.T) {
+	status := PrinterStatus{ExternalSpool: &AMSSlot{Material: "TPU", Color: "#0078BF"}}
+	if !hasFilament(status, "TPU", "#0078bf") {
+		t.Error("the external spool counts as loaded filament")
+	}
+	if hasFilament(status, "PLA", "") {
+		t.Error("PLA is not loaded")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+// Who printed what.
+//
+// Every print job carries its owner: the name given when it was sent through
+// the site, or else the part of the file name before the first underscore.
+// Owners can be put in groups (a lab, a project, a course) by an admin. The
+// reports here add up hours, grams, results and cost per owner or per group,
+// for the same period a lab head would be asked about.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// unknownOwner labels jobs whose file name follows no convention.
+const unknownOwner = "(unknown)"
+
+// defaultReportDays is the period a report covers when none is given.
+const defaultReportDays = 30
+
+// OwnerGroup puts a print owner in a group for the reports.
+type OwnerGroup struct {
+	gorm.Model
+	Owner     string `json:"owner" gorm:"uniqueIndex"`
+	GroupName string `json:"group"`
+}
+
+// UsageRow is one owner's or group's printing over a period.
+type UsageRow struct {
+	Name        string  `json:"name"`
+	Jobs        int     `json:"jobs"`
+	Finished    int     `json:"finished"`
+	Failed      int     `json:"failed"`
+	Stopped     int     `json:"stopped"`
+	Interrupted int     `json:"interrupted"`
+	Hours       float64 `json:"hours"`
+	Grams       float64 `json:"grams"`
+	Cost        float64 `json:"cost"`
+	// Finished out of finished, failed and stopped; interrupted jobs were
+	// cut short by the printer moving on and say nothing either way
+	SuccessRate float64 `json:"success_rate"`
+}
+
+// parseReportRange reads a report period from from/to query values, plain
+// dates in the server's timezone with to inclusive. Either may be left out:
+// the default is the last 30 days up to now.
+func parseReportRange(fromRaw, toRaw string, now time.Time) (time.Time, time.Time, error) {
+	to := now
+	if toRaw != "" {
+		day, err := time.ParseInLocation("2006-01-02", toRaw, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("dates must look like 2026-08-20")
+		}
+		to = day.AddDate(0, 0, 1)
+	}
+
+	from := to.AddDate(0, 0, -defaultReportDays)
+	if fromRaw != "" {
+		day, err := time.ParseInLocation("2006-01-02", fromRaw, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("dates must look like 2026-08-20")
+		}
+		from = day
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("the start date must be before the end date")
+	}
+	return from, to, nil
+}
+
+// summarizeUsage adds jobs up under whatever key keyOf gives them. cost
+// prices a job's filament. Only jobs that have ended are counted. Rows come
+// back busiest first.
+func summarizeUsage(jobs []PrintJob, keyOf func(PrintJob) string, cost func(PrintJob, float64) float64) []UsageRow {
+	byKey := map[string]*UsageRow{}
+	for _, job := range jobs {
+		if job.EndedAt == nil {
+			continue
+		}
+
+		key := keyOf(job)
+		row, ok := byKey[key]
+		if !ok {
+			row = &UsageRow{Name: key}
+			byKey[key] = row
+		}
+
+		row.Jobs++
+		switch job.Result {
+		case "finished":
+			row.Finished++
+		case "failed":
+			row.Failed++
+		case "stopped":
+			row.Stopped++
+		case "interrupted":
+			row.Interrupted++
+		}
+		row.Hours += job.EndedAt.Sub(job.StartedAt).Hours()
+
+		var grams float64
+		for _, filament := range jobUsage(job) {
+			grams += filament.Grams
+		}
+		row.Grams += grams
+		row.Cost += cost(job, grams)
+	}
+
+	rows := make([]UsageRow, 0, len(byKey))
+	for _, row := range byKey {
+		if judged := row.Finished + row.Failed + row.Stopped; judged > 0 {
+			row.SuccessRate = float64(row.Finished) / float64(judged)
+		}
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Hours != rows[j].Hours {
+			return rows[i].Hours > rows[j].Hours
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	return rows
+}
+
+// usageKey picks how jobs are added up: by owner, or by the owner's group.
+// Owners in no group are reported under their own name.
+func usageKey(by string, groups map[string]string) (func(PrintJob) string, error) {
+	ownerOf := func(job PrintJob) string {
+		if owner := jobOwner(job); owner != "" {
+			return owner
+		}
+		return unknownOwner
+	}
+
+	switch by {
+	case "", "owner":
+		return ownerOf, nil
+	case "group":
+		return func(job PrintJob) string {
+			owner := ownerOf(job)
+			if group, ok := groups[owner]; ok {
+				return group
+			}
+			return owner
+		}, nil
+	}
+	return nil, fmt.Errorf("reports are by owner or by group")
+}
+
+// UsageReport totals printing by owner or group over a period. Filament is
+// priced from the spools each job was taken off, or at the average price of
+// the lab's spools where the job was not matched to one.
+func UsageReport(db *gorm.DB, by string, from, to time.Time) ([]UsageRow, error) {
+	var owners []OwnerGroup
+	if err := db.Find(&owners).Error; err != nil {
+		return nil, err
+	}
+	groups := map[string]string{}
+	for _, o := range owners {
+		groups[o.Owner] = o.GroupName
+	}
+
+	keyOf, err := usageKey(by, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []PrintJob
+	if err := db.Where("started_at >= ? AND started_at < ? AND ended_at IS NOT NULL", from, to).
+		Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	// What each job cost off the spools it was drawn from
+	var drawn []struct {
+		PrintJobID uint
+		Cost       float64
+	}
+	if err := db.Table("spool_usages").
+		Select("spool_usages.print_job_id, SUM(spool_usages.grams * spools.cost / NULLIF(spools.initial_grams, 0)) AS cost").
+		Joins("JOIN spools ON spools.id = spool_usages.spool_id").
+		Where("spool_usages.deleted_at IS NULL").
+		Group("spool_usages.print_job_id").
+		Scan(&drawn).Error; err != nil {
+		return nil, err
+	}
+	jobCosts := map[uint]float64{}
+	for _, d := range drawn {
+		jobCosts[d.PrintJobID] = d.Cost
+	}
+
+	var average struct {
+		Cost  float64
+		Grams float64
+	}
+	db.Model(&Spool{}).Select("COALESCE(SUM(cost), 0) AS cost, COALESCE(SUM(initial_grams), 0) AS grams").
+		Scan(&average)
+	perGram := 0.0
+	if average.Grams > 0 {
+		perGram = average.Cost / average.Grams
+	}
+
+	return summarizeUsage(jobs, keyOf, func(job PrintJob, grams float64) float64 {
+		if cost, ok := jobCosts[job.ID]; ok {
+			return cost
+		}
+		return grams * perGram
+	}), nil
+}
+
+// usageCSVRow formats a row for the CSV export.
+func usageCSVRow(row UsageRow) []string {
+	return []string{
+		row.Name,
+		fmt.Sprint(row.Jobs),
+		fmt.Sprint(row.Finished),
+		fmt.Sprint(row.Failed),
+		fmt.Sprint(row.Stopped),
+		fmt.Sprint(row.Interrupted),
+		fmt.Sprintf("%.1f", row.Hours),
+		fmt.Sprintf("%.0f", row.Grams),
+		fmt.Sprintf("%.2f", row.Cost),
+		fmt.Sprintf("%.0f%%", row.SuccessRate*100),
+	}
+}
+
+// usageCSVHeader matches usageCSVRow.
+var usageCSVHeader = []string{"Name", "Jobs", "Finished", "Failed", "Stopped", "Interrupted",
+	"Hours", "Filament (g)", "Estimated Cost", "Success Rate"}
+
+// normalizeGroupName tidies a group name from the admin page.
+func normalizeGroupName(raw string) string {
+	return strings.Join(strings.Fields(raw), " ")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func usageJob(owner, file, result string, hours float64, grams float64, percent int) PrintJob {
+	start := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	end := start.Add(time.Duration(hours * float64(time.Hour)))
+	return PrintJob{
+		Owner:       owner,
+		FileName:    file,
+		Result:      result,
+		StartedAt:   start,
+		EndedAt:     &end,
+		LastPercent: percent,
+		Filaments:   []SlicedFilament{{Type: "PLA", Grams: grams}},
+	}
+}
+
+func TestSummarizeUsageByOwner(t *testing.T) {
+	running := usageJob("srinath", "srinath_x.3mf", "running", 0, 10, 0)
+	running.EndedAt = nil
+
+	jobs := []PrintJob{
+		usageJob("srinath", "srinath_a.3mf", "finished", 2, 50, 100),
+		usageJob("srinath", "srinath_b.3mf", "failed", 1, 40, 50),
+		// Recorded before owners were stored, so read off the file name
+		usageJob("", "Ravi_c.3mf", "finished", 4, 100, 100),
+		usageJob("", "bracket.3mf", "interrupted", 0.5, 0, 10),
+		running,
+	}
+
+	keyOf, err := usageKey("owner", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := summarizeUsage(jobs, keyOf, func(_ PrintJob, grams float64) float64 { return grams * 2 })
+
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 owners, got %+v", rows)
+	}
+	// Busiest first
+	if rows[0].Name != "ravi" || rows[1].Name != "srinath" || rows[2].Name != unknownOwner {
+		t.Errorf("unexpected order: %+v", rows)
+	}
+
+	srinath := rows[1]
+	if srinath.Jobs != 2 || srinath.Finished != 1 || srinath.Failed != 1 {
+		t.Errorf("unexpected counts: %+v", srinath)
+	}
+	if srinath.Hours != 3 {
+		t.Errorf("hours = %v, want 3", srinath.Hours)
+	}
+	// All of the finished job, half of the failed one
+	if srinath.Grams != 70 || srinath.Cost != 140 {
+		t.Errorf("grams/cost = %v/%v, want 70/140", srinath.Grams, srinath.Cost)
+	}
+	if srinath.SuccessRate != 0.5 {
+		t.Errorf("success rate = %v, want 0.5", srinath.SuccessRate)
+	}
+
+	// Interrupted jobs are counted but not judged
+	if rows[2].Interrupted != 1 || rows[2].SuccessRate != 0 {
+		t.Errorf("unexpected unknown-owner row: %+v", rows[2])
+	}
+}
+
+func TestSummarizeUsageByGroup(t *testing.T) {
+	jobs := []PrintJob{
+		usageJob("srinath", "", "finished", 1, 10, 100),
+		usageJob("ravi", "", "finished", 1, 10, 100),
+		usageJob("guest", "", "finished", 1, 10, 100),
+	}
+	keyOf, err := usageKey("group", map[string]string{"srinath": "Drones", "ravi": "Drones"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := summarizeUsage(jobs, keyOf, func(PrintJob, float64) float64 { return 0 })
+
+	if len(rows) != 2 || rows[0].Name != "Drones" || rows[0].Jobs != 2 || rows[1].Name != "guest" {
+		t.Errorf("unexpected groups: %+v", rows)
+	}
+
+	if _, err := usageKey("printer", nil); err == nil {
+		t.Error("expected an error for an unknown grouping")
+	}
+}
+
+func TestParseReportRange(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, time.Local)
+
+	from, to, err := parseReportRange("", "", now)
+	if err != nil || !to.Equal(now) || !from.Equal(now.AddDate(0, 0, -30)) {
+		t.Errorf("unexpected default range: %v - %v (%v)", from, to, err)
+	}
+
+	from, to, err = parseReportRange("2026-09-01", "2026-09-30", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The end date is inclusive
+	if !from.Equal(time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)) ||
+		!to.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("unexpected range: %v - %v", from, to)
+	}
+
+	if _, _, err := parseReportRange("2026-09-30", "2026-09-01", now); err == nil {
+		t.Error("expected an error for a backwards range")
+	}
+	if _, _, err := parseReportRange("last week", "", now); err == nil {
+		t.Error("expected an error for an unreadable date")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+// Testing an access code before it is saved.
+//
+// An access code pasted with a typo used to be saved and applied at once,
+// which took the printer offline and left the bad code behind for the next
+// restart. A new code is now tried first, on a connection of its own, the
+// same two ways the site uses it: the camera handshake, where the printer
+// hangs up on a wrong code, and an MQTT connect, which the printer refuses
+// with "not authorised". Only a code the printer accepts is saved. A printer
+// that cannot be reached leaves the code untested, and it is only saved if the
+// admin says so.
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Access code check results, overall and for each connection.
+const (
+	AccessCodeAccepted    = "accepted"
+	AccessCodeRejected    = "rejected"
+	AccessCodeUnreachable = "unreachable"
+	// The printer is not a Bambu, whose API key is saved as given
+	AccessCodeNotTested = "not_tested"
+	// The camera is not the JPEG stream, so only MQTT was tried
+	AccessCodeSkipped = "skipped"
+)
+
+// How long each test waits for the printer
+const accessCodeCheckTimeout = 10 * time.Second
+
+// AccessCodeCheck is what the printer made of a candidate code.
+type AccessCodeCheck struct {
+	Result string `json:"result"`
+	Camera string `json:"camera"`
+	MQTT   string `json:"mqtt"`
+	// Why a connection could not be tested, when one could not
+	Detail string `json:"detail,omitempty"`
+}
+
+// checkCameraCode tries the camera handshake with code. A printer that sends
+// a frame header has taken the code; one that hangs up without a byte has not.
+func (p *printer) checkCameraCode(code string) (string, error) {
+	dialer := &net.Dialer{Timeout: accessCodeCheckTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", p.cameraAddress(), p.tlsConfig())
+	if err != nil {
+		return AccessCodeUnreachable, fmt.Errorf("camera: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(cameraAuthPacket("bblp", code)); err != nil {
+		return AccessCodeUnreachable, fmt.Errorf("camera: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(accessCodeCheckTimeout)); err != nil {
+		return AccessCodeUnreachable, fmt.Errorf("camera: %w", err)
+	}
+
+	header := make([]byte, cameraHeaderSize)
+	_, err = io.ReadFull(conn, header)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return AccessCodeRejected, nil
+	case err != nil:
+		return AccessCodeUnreachable, fmt.Errorf("camera sent nothing: %w", err)
+	}
+	if size := binary.LittleEndian.Uint32(header[0:4]); size == 0 || size > 8*1024*1024 {
+		return AccessCodeRejected, nil
+	}
+	return AccessCodeAccepted, nil
+}
+
+// checkMQTTCode connects to the printer's broker with code, under a client id
+// of its own so the running session is not thrown off.
+func (p *printer) checkMQTTCode(code string) (string, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(p.brokerURL())
+	opts.SetClientID(fmt.Sprintf("rrc-inventory-%s-check", p.cfg.ID))
+	opts.SetUsername("bblp")
+	opts.SetPassword(code)
+	opts.SetTLSConfig(p.tlsConfig())
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectTimeout(accessCodeCheckTimeout)
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(accessCodeCheckTimeout + 2*time.Second) {
+		return AccessCodeUnreachable, fmt.Errorf("mqtt: no answer")
+	}
+	err := token.Error()
+	switch {
+	case err == nil:
+		client.Disconnect(250)
+		return AccessCodeAccepted, nil
+	case errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) || errors.Is(err, packets.ErrorRefusedNotAuthorised):
+		return AccessCodeRejected, nil
+	}
+	return AccessCodeUnreachable, fmt.Errorf("mqtt: %w", err)
+}
+
+// checkAccessCode tries code on the camera and MQTT at once. The broker's
+// answer is explicit, so it decides when there is one; the camera hanging up
+// is only inferred, so it decides only when the broker could not be reached.
+func (p *printer) checkAccessCode(code string) AccessCodeCheck {
+	type outcome struct {
+		result string
+		err    error
+	}
+	camera := make(chan outcome, 1)
+	if p.capabilities().Camera == CameraJPEG {
+		go func() {
+			result, err := p.checkCameraCode(code)
+			camera <- outcome{result, err}
+		}()
+	} else {
+		camera <- outcome{result: AccessCodeSkipped}
+	}
+	result, err := p.checkMQTTCode(code)
+	broker := outcome{result, err}
+	cam := <-camera
+
+	check := AccessCodeCheck{Camera: cam.result, MQTT: broker.result, Result: broker.result}
+	if broker.result == AccessCodeUnreachable && cam.result != AccessCodeSkipped {
+		check.Result = cam.result
+	}
+	if check.Result == AccessCodeUnreachable {
+		var details []string
+		for _, o := range []outcome{broker, cam} {
+			if o.err != nil {
+				details = append(details, o.err.Error())
+			}
+		}
+		check.Detail = strings.Join(details, "; ")
+	}
+	return check
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mockBroker answers one MQTT CONNECT per connection: accepted when the
+// packet carries code, "not authorised" otherwise.
+func mockBroker(t *testing.T, cert tls.Certificate, code string) int {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if _, err := reader.ReadByte(); err != nil {
+					return
+				}
+				length, err := binary.ReadUvarint(reader)
+				if err != nil {
+					return
+				}
+				packet := make([]byte, length)
+				if _, err := io.ReadFull(reader, packet); err != nil {
+					return
+				}
+				rc := byte(5)
+				if bytes.Contains(packet, []byte(code)) {
+					rc = 0
+				}
+				conn.Write([]byte{0x20, 0x02, 0x00, rc})
+				reader.ReadByte() //nolint:errcheck // wait for the client to leave
+			}(conn)
+		}
+	}()
+	return listenerPort(listener)
+}
+
+// mockCameraGate sends a frame header for the right code and hangs up on any
+// other, as the printer does.
+func mockCameraGate(t *testing.T, cert tls.Certificate, code string) int {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			auth := make([]byte, cameraAuthSize)
+			if _, err := readFullBytes(conn, auth); err == nil && bytes.Equal(auth, cameraAuthPacket("bblp", code)) {
+				header := make([]byte, cameraHeaderSize)
+				binary.LittleEndian.PutUint32(header[0:4], 20_000)
+				conn.Write(header)
+			}
+			conn.Close()
+		}
+	}()
+	return listenerPort(listener)
+}
+
+func listenerPort(listener net.Listener) int {
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// closedPort is a port nothing is listening on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := listenerPort(listener)
+	listener.Close()
+	return port
+}
+
+func TestCheckAccessCode(t *testing.T) {
+	cert := selfSignedCert(t)
+	p := &printer{cfg: PrinterConfig{ID: "p1", Name: "P1", Host: "127.0.0.1", Model: "P1S"}}
+	p.mqttPort = mockBroker(t, cert, "89a8541a")
+	p.cameraPort = mockCameraGate(t, cert, "89a8541a")
+
+	if check := p.checkAccessCode("89a8541a"); check.Result != AccessCodeAccepted || check.Camera != AccessCodeAccepted {
+		t.Errorf("the right code gave %+v", check)
+	}
+	if check := p.checkAccessCode("12345678"); check.Result != AccessCodeRejected || check.Camera != AccessCodeRejected {
+		t.Errorf("a wrong code gave %+v", check)
+	}
+
+	// With the broker down the camera still tells
+	p.mqttPort = closedPort(t)
+	if check := p.checkAccessCode("12345678"); check.Result != AccessCodeRejected || check.MQTT != AccessCodeUnreachable {
+		t.Errorf("a wrong code on the camera alone gave %+v", check)
+	}
+
+	p.cameraPort = closedPort(t)
+	check := p.checkAccessCode("89a8541a")
+	if check.Result != AccessCodeUnreachable || !strings.Contains(check.Detail, "camera") {
+		t.Errorf("a switched-off printer gave %+v", check)
+	}
+
+	// An X1's camera is not the JPEG stream, so only MQTT is tried
+	x1 := &printer{cfg: PrinterConfig{ID: "x1", Name: "X1", Host: "127.0.0.1", Model: "X1C"}}
+	x1.mqttPort = mockBroker(t, cert, "89a8541a")
+	if check := x1.checkAccessCode("89a8541a"); check.Result != AccessCodeAccepted || check.Camera != AccessCodeSkipped {
+		t.Errorf("an X1 gave %+v", check)
+	}
+}
+
+func TestUpdateAccessCodeOnlySavesWhatWasTested(t *testing.T) {
+	cert := selfSignedCert(t)
+	p := &printer{cfg: PrinterConfig{ID: "p1", Name: "P1", Host: "127.0.0.1", Model: "P1S", AccessCode: "old"}}
+	p.mqttPort = mockBroker(t, cert, "89a8541a")
+	p.cameraPort = mockCameraGate(t, cert, "89a8541a")
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1": p}}
+
+	if _, err := m.UpdateAccessCode("p1", "12345678", true); err == nil || p.accessCode() != "old" {
+		t.Errorf("a rejected code was saved: %v, %q", err, p.accessCode())
+	}
+	if check, err := m.UpdateAccessCode("p1", " 89a8541a ", false); err != nil || check.Result != AccessCodeAccepted || p.accessCode() != "89a8541a" {
+		t.Errorf("the right code: %+v, %v, %q", check, err, p.accessCode())
+	}
+
+	p.mqttPort, p.cameraPort = closedPort(t), closedPort(t)
+	if check, err := m.UpdateAccessCode("p1", "abcdefgh", false); err == nil || check.Result != AccessCodeUnreachable || p.accessCode() != "89a8541a" {
+		t.Errorf("an untested code was saved: %+v, %v", check, err)
+	}
+	if _, err := m.UpdateAccessCode("p1", "abcdefgh", true); err != nil || p.accessCode() != "abcdefgh" {
+		t.Errorf("save_untested: %v, %q", err, p.accessCode())
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+// Knowing a command worked.
+//
+// MQTT accepting a message only means it reached the printer's broker. The
+// printer answers each command on its report topic with the same sequence_id
+// and a result - "success", or "failed" with a reason - so publishCommand
+// waits for that answer before saying a command worked. Pause, resume and stop
+// then also wait for the state they should lead to, since a printer can accept
+// a pause and take a while to actually stop moving.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// How long the printer has to answer a command
+	commandAckTimeout = 10 * time.Second
+	// How long a pause, resume or stop has to show in the printer's state.
+	// HTTP printers are only polled every few seconds, and a pause waits for
+	// the current move to finish.
+	stateChangeTimeout = 30 * time.Second
+	stateCheckInterval = 500 * time.Millisecond
+)
+
+// errUnconfirmed is a command sent but never answered. Some older firmware
+// does not answer everything, so callers that can see the result in the
+// printer's state check that instead.
+var errUnconfirmed = errors.New("the printer did not confirm the command")
+
+// sequenceID is a command's sequence_id, which printers send back as a string
+// or a number depending on the firmware.
+type sequenceID string
+
+func (s *sequenceID) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*s = sequenceID(text)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	*s = sequenceID(number.String())
+	return nil
+}
+
+// commandReply is a printer's answer to a command, found in the "print" or
+// "system" part of a report.
+type commandReply struct {
+	Command    string     `json:"command"`
+	SequenceID sequenceID `json:"sequence_id"`
+	Result     string     `json:"result"`
+	Reason     string     `json:"reason"`
+}
+
+// err turns the answer into the error the admin sees, or nil for success.
+func (r commandReply) err() error {
+	if strings.EqualFold(r.Result, "success") {
+		return nil
+	}
+	reason := r.Reason
+	if reason == "" || strings.EqualFold(reason, "success") {
+		reason = strings.ToLower(r.Result)
+	}
+	return fmt.Errorf("the printer refused the %s: %s", strings.ReplaceAll(r.Command, "_", " "), reason)
+}
+
+// commandSequence reads the sequence_id out of an outgoing command, or returns
+// "" for a command that has none.
+func commandSequence(payload string) string {
+	var command map[string]struct {
+		SequenceID sequenceID `json:"sequence_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &command); err != nil {
+		return ""
+	}
+	for _, body := range command {
+		if body.SequenceID != "" {
+			return string(body.SequenceID)
+		}
+	}
+	return ""
+}
+
+// expectReply registers for the answer to a command about to be sent. It is
+// registered before sending so that a quick answer is not missed.
+func (p *printer) expectReply(seq string) chan commandReply {
+	if seq == "" {
+		return nil
+	}
+	reply := make(chan commandReply, 1)
+	p.mu.Lock()
+	if p.pending == nil {
+		p.pending = make(map[string]chan commandReply)
+	}
+	p.pending[seq] = reply
+	p.mu.Unlock()
+	return reply
+}
+
+func (p *printer) forgetReply(seq string) {
+	p.mu.Lock()
+	delete(p.pending, seq)
+	p.mu.Unlock()
+}
+
+// awaitReply waits for the answer registered by expectReply.
+func (p *printer) awaitReply(reply chan commandReply) error {
+	if reply == nil {
+		return nil
+	}
+	timeout := p.ackTimeout
+	if timeout == 0 {
+		timeout = commandAckTimeout
+	}
+	select {
+	case answer := <-reply:
+		return answer.err()
+	case <-time.After(timeout):
+		return fmt.Errorf("%w within %s", errUnconfirmed, timeout)
+	}
+}
+
+// acknowledgeLocked hands an answer in a report to whoever sent the command.
+// Answers to commands sent from elsewhere - Bambu Studio, the printer's own
+// screen - are ignored. Called with the lock held.
+func (p *printer) acknowledgeLocked(answer *commandReply) {
+	// Status pushes carry the printer's own sequence ids, and no result
+	if answer == nil || answer.SequenceID == "" || answer.Result == "" || answer.Command == "push_status" {
+		return
+	}
+	reply, ok := p.pending[string(answer.SequenceID)]
+	if !ok {
+		return
+	}
+	delete(p.pending, string(answer.SequenceID))
+	reply <- *answer
+}
+
+// stateReader is a polled driver, which can be asked for its state rather than
+// waiting for the next poll.
+type stateReader interface {
+	state() (driverState, error)
+}
+
+// awaitState waits until the printer reports a state that reached accepts, and
+// explains what it is doing instead if it never does.
+func (p *printer) awaitState(action string, reached func(state string) bool) error {
+	timeout := p.settleTimeout
+	if timeout == 0 {
+		timeout = stateChangeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	reader, polled := p.protocol().(stateReader)
+	for {
+		if polled {
+			if s, err := reader.state(); err == nil {
+				p.applyState(s)
+			}
+		}
+
+		p.mu.RLock()
+		state := strings.ToUpper(p.state)
+		p.mu.RUnlock()
+
+		if reached(state) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the printer took the %s but still reports %s after %s", action, state, timeout)
+		}
+		time.Sleep(stateCheckInterval)
+	}
+}
+
+// confirm checks a pause, resume or stop went through: the printer's answer if
+// it gave one, and the state it should lead to either way.
+func (p *printer) confirm(action string, sent error, reached func(state string) bool) error {
+	if sent != nil && !errors.Is(sent, errUnconfirmed) {
+		return sent
+	}
+	if err := p.awaitState(action, reached); err != nil {
+		if sent != nil {
+			return sent
+		}
+		return err
+	}
+	return nil
+}
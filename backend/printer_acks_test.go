@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// sentToken is a publish the broker has already taken.
+type sentToken struct{}
+
+func (sentToken) Wait() bool                     { return true }
+func (sentToken) WaitTimeout(time.Duration) bool { return true }
+func (sentToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (sentToken) Error() error { return nil }
+
+// answeringClient stands in for the MQTT connection. Each command published is
+// handed to answer, which plays the printer.
+type answeringClient struct {
+	mqtt.Client
+	answer func(payload string)
+}
+
+func (c *answeringClient) IsConnected() bool { return true }
+
+func (c *answeringClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	go c.answer(payload.(string))
+	return sentToken{}
+}
+
+func answeringPrinter(answer func(p *printer, seq, payload string)) *printer {
+	p := &printer{
+		cfg:           PrinterConfig{ID: "mock", Name: "mock", Serial: "01P00A000000000"},
+		state:         "RUNNING",
+		lastReport:    time.Now(),
+		ackTimeout:    200 * time.Millisecond,
+		settleTimeout: time.Second,
+	}
+	p.client = &answeringClient{answer: func(payload string) {
+		answer(p, commandSequence(payload), payload)
+	}}
+	return p
+}
+
+func TestCommandSequence(t *testing.T) {
+	cases := map[string]string{
+		`{"print":{"sequence_id":"12","command":"pause"}}`:   "12",
+		`{"system":{"sequence_id":"7","command":"ledctrl"}}`: "7",
+		`{"print":{"sequence_id":3,"command":"stop"}}`:       "3",
+		`{"pushing":{"command":"pushall"}}`:                  "",
+		`not json`:                                           "",
+	}
+	for payload, want := range cases {
+		if got := commandSequence(payload); got != want {
+			t.Errorf("commandSequence(%s) = %q, want %q", payload, got, want)
+		}
+	}
+}
+
+func TestPauseWaitsForAnswerAndState(t *testing.T) {
+	p := answeringPrinter(func(p *printer, seq, payload string) {
+		p.applyReport([]byte(fmt.Sprintf(
+			`{"print":{"command":"pause","sequence_id":"%s","result":"success","gcode_state":"PAUSE"}}`, seq)))
+	})
+	if err := p.pause("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("%d commands still waiting", len(p.pending))
+	}
+	if p.lastActionBy != "admin" {
+		t.Errorf("the pause was not recorded")
+	}
+}
+
+func TestRefusedCommandReportsReason(t *testing.T) {
+	p := answeringPrinter(func(p *printer, seq, payload string) {
+		p.applyReport([]byte(fmt.Sprintf(
+			`{"print":{"command":"stop","sequence_id":"%s","result":"failed","reason":"printer is busy"}}`, seq)))
+	})
+	err := p.stop("admin")
+	if err == nil || !strings.Contains(err.Error(), "printer is busy") {
+		t.Fatalf("expected the printer's reason, got %v", err)
+	}
+	if p.lastActionBy != "" {
+		t.Error("a refused stop should not be credited to anyone")
+	}
+}
+
+func TestAnswersToOtherCommandsAreIgnored(t *testing.T) {
+	p := answeringPrinter(func(p *printer, seq, payload string) {
+		// A status push and an answer to somebody else's command
+		p.applyReport([]byte(`{"print":{"command":"push_status","sequence_id":"` + seq + `","gcode_state":"RUNNING"}}`))
+		p.applyReport([]byte(`{"print":{"command":"pause","sequence_id":"9999","result":"failed"}}`))
+	})
+	if err := p.setLight(true); err == nil || !strings.Contains(err.Error(), "did not confirm") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestLightAnsweredInSystem(t *testing.T) {
+	p := answeringPrinter(func(p *printer, seq, payload string) {
+		p.applyReport([]byte(`{"system":{"command":"ledctrl","sequence_id":` + seq + `,"result":"success"}}`))
+	})
+	if err := p.setLight(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnansweredPauseCheckedByState(t *testing.T) {
+	// Firmware that never answers, but does pause
+	p := answeringPrinter(func(p *printer, seq, payload string) {
+		p.applyReport([]byte(`{"print":{"gcode_state":"PAUSE"}}`))
+	})
+	if err := p.pause("admin"); err != nil {
+		t.Fatalf("a pause that shows in the state should count: %v", err)
+	}
+
+	// An answer, but the printer carries on
+	p = answeringPrinter(func(p *printer, seq, payload string) {
+		p.applyReport([]byte(`{"print":{"command":"pause","sequence_id":"` + seq + `","result":"success"}}`))
+	})
+	if err := p.pause("admin"); err == nil || !strings.Contains(err.Error(), "still reports RUNNING") {
+		t.Errorf("expected the state check to fail, got %v", err)
+	}
+}
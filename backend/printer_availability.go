@@ -0,0 +1,330 @@
+package main
+
+// Availability history and uptime.
+//
+// status() only knows whether the last report is recent, so an outage used to
+// leave nothing behind once the printer was back. The availability watcher now
+// writes a PrinterAvailabilityEvent for every change it sees - a printer going
+// quiet or coming back, its access code being rejected or accepted again, its
+// camera dropping out while the printer is up - and the uptime report is worked
+// out from that log.
+//
+// The log only knows what this server saw: it starts each printer's record
+// with its state at the first check after a restart, and time the server was
+// down counts as whatever was last seen.
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Availability event kinds.
+const (
+	AvailabilityOnline        = "online"
+	AvailabilityOffline       = "offline"
+	AvailabilityAuthFailed    = "auth_failed"
+	AvailabilityAuthRestored  = "auth_restored"
+	AvailabilityCameraOffline = "camera_offline"
+	AvailabilityCameraOnline  = "camera_online"
+)
+
+const (
+	// An outage shorter than this looks like the network rather than somebody
+	// switching the printer off
+	shortOutageLimit = 15 * time.Minute
+	// This many short outages in a report makes a printer's connection flaky
+	flakyOutageCount = 3
+	// An outage at least this long is a printer that was switched off
+	longOutageLimit = 4 * time.Hour
+)
+
+// PrinterAvailabilityEvent is one change in whether a printer could be
+// reached.
+type PrinterAvailabilityEvent struct {
+	gorm.Model
+	PrinterID   string    `json:"printer_id" gorm:"index"`
+	PrinterName string    `json:"printer_name"`
+	Kind        string    `json:"kind" gorm:"index"`
+	At          time.Time `json:"at" gorm:"index"`
+	Detail      string    `json:"detail"`
+}
+
+// availability is what the watcher last saw of a printer.
+type availability struct {
+	Online     bool
+	AuthFailed bool
+	Camera     bool
+	// A camera_offline has been logged and not yet answered by camera_online
+	CameraDown bool
+}
+
+// availabilityChanges compares a printer's state with the last check and
+// returns the events to log, with the state to compare the next check with.
+// The first check after a start logs where the printer stands. The camera
+// only counts while the printer is up, since a printer that is switched off
+// takes its camera with it.
+func availabilityChanges(prev availability, seen bool, status PrinterStatus) ([]string, availability) {
+	now := availability{
+		Online:     status.Online,
+		AuthFailed: status.AccessCodeProblem,
+		Camera:     status.CameraOnline,
+		CameraDown: prev.CameraDown && !status.CameraOnline,
+	}
+
+	var kinds []string
+	if !seen {
+		kinds = append(kinds, AvailabilityOffline)
+		if now.Online {
+			kinds[0] = AvailabilityOnline
+		}
+		if now.AuthFailed {
+			kinds = append(kinds, AvailabilityAuthFailed)
+		}
+		return kinds, now
+	}
+
+	switch {
+	case prev.Online && !now.Online:
+		kinds = append(kinds, AvailabilityOffline)
+	case !prev.Online && now.Online:
+		kinds = append(kinds, AvailabilityOnline)
+	}
+	switch {
+	case !prev.AuthFailed && now.AuthFailed:
+		kinds = append(kinds, AvailabilityAuthFailed)
+	case prev.AuthFailed && !now.AuthFailed:
+		kinds = append(kinds, AvailabilityAuthRestored)
+	}
+	switch {
+	case prev.Online && now.Online && prev.Camera && !now.Camera:
+		kinds = append(kinds, AvailabilityCameraOffline)
+		now.CameraDown = true
+	case prev.CameraDown && now.Camera:
+		kinds = append(kinds, AvailabilityCameraOnline)
+	}
+	return kinds, now
+}
+
+func availabilityDetail(kind string) string {
+	switch kind {
+	case AvailabilityOffline:
+		return fmt.Sprintf("no report for %s", statusStaleAfter)
+	case AvailabilityAuthFailed:
+		return "the printer rejected the access code"
+	case AvailabilityCameraOffline:
+		return fmt.Sprintf("no camera frame for %s", cameraStaleAfter)
+	}
+	return ""
+}
+
+// recordAvailability writes one event to the log.
+func (m *PrinterManager) recordAvailability(p *printer, kind, detail string, at time.Time) {
+	if m.db == nil {
+		return
+	}
+	event := PrinterAvailabilityEvent{PrinterID: p.cfg.ID, PrinterName: p.cfg.Name, Kind: kind, At: at, Detail: detail}
+	if err := m.db.Create(&event).Error; err != nil {
+		log.Printf("printer %s: could not record %s: %v", p.cfg.ID, kind, err)
+	}
+}
+
+// AvailabilityEvents lists the log between from and to, newest first.
+// printerID may be empty for every printer.
+func (m *PrinterManager) AvailabilityEvents(printerID string, from, to time.Time) ([]PrinterAvailabilityEvent, error) {
+	events := []PrinterAvailabilityEvent{}
+	if m.db == nil {
+		return events, nil
+	}
+	query := m.db.Where("at >= ? AND at < ?", from, to).Order("at DESC").Limit(1000)
+	if printerID != "" {
+		query = query.Where("printer_id = ?", printerID)
+	}
+	err := query.Find(&events).Error
+	return events, err
+}
+
+// UptimeReport is how reachable one printer was over a stretch of time.
+type UptimeReport struct {
+	PrinterID   string    `json:"printer_id"`
+	PrinterName string    `json:"printer_name"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	// The part of the stretch the log covers; before a printer's first event
+	// nothing is known about it
+	KnownMinutes      int     `json:"known_minutes"`
+	OnlineMinutes     int     `json:"online_minutes"`
+	OfflineMinutes    int     `json:"offline_minutes"`
+	AuthFailedMinutes int     `json:"auth_failed_minutes"`
+	UptimePercent     float64 `json:"uptime_percent"`
+	// Outages, how many of them were short, and the longest; one still going
+	// counts up to the end of the stretch
+	Outages              int `json:"outages"`
+	ShortOutages         int `json:"short_outages"`
+	LongestOutageMinutes int `json:"longest_outage_minutes"`
+	CameraOutages        int `json:"camera_outages"`
+	// steady, flaky_network, switched_off, access_code or unknown
+	Diagnosis string `json:"diagnosis"`
+}
+
+// computeUptime works a report out of a printer's events, oldest first. The
+// events may start before from, to carry in the state the printer was in.
+func computeUptime(events []PrinterAvailabilityEvent, from, to time.Time) UptimeReport {
+	report := UptimeReport{From: from, To: to}
+
+	var known, online, authFailed bool
+	var up, down, auth time.Duration
+	var outageStart time.Time
+	var longest time.Duration
+	cursor := from
+
+	account := func(until time.Time) {
+		if until.After(to) {
+			until = to
+		}
+		if !until.After(cursor) {
+			return
+		}
+		span := until.Sub(cursor)
+		if known {
+			if online {
+				up += span
+			} else {
+				down += span
+			}
+			if authFailed {
+				auth += span
+			}
+		}
+		cursor = until
+	}
+	closeOutage := func(end time.Time) {
+		length := end.Sub(outageStart)
+		report.Outages++
+		if length < shortOutageLimit {
+			report.ShortOutages++
+		}
+		if length > longest {
+			longest = length
+		}
+	}
+
+	for _, event := range events {
+		if !event.At.Before(to) {
+			break
+		}
+		account(event.At)
+		switch event.Kind {
+		case AvailabilityOnline:
+			if known && !online && event.At.After(from) {
+				closeOutage(event.At)
+			}
+			known, online = true, true
+		case AvailabilityOffline:
+			if !known || online {
+				outageStart = event.At
+			}
+			known, online = true, false
+		case AvailabilityAuthFailed:
+			authFailed = true
+		case AvailabilityAuthRestored:
+			authFailed = false
+		case AvailabilityCameraOffline:
+			if !event.At.Before(from) {
+				report.CameraOutages++
+			}
+		}
+	}
+	account(to)
+	if known && !online {
+		closeOutage(to)
+	}
+
+	report.OnlineMinutes = int(up.Minutes())
+	report.OfflineMinutes = int(down.Minutes())
+	report.AuthFailedMinutes = int(auth.Minutes())
+	report.KnownMinutes = int((up + down).Minutes())
+	report.LongestOutageMinutes = int(longest.Minutes())
+	if total := up + down; total > 0 {
+		report.UptimePercent = float64(int(up*1000/total)) / 10
+	}
+	report.Diagnosis = diagnoseUptime(report, auth, longest)
+	return report
+}
+
+// diagnoseUptime puts a name to the pattern of outages: many short ones are
+// the network, a long one is somebody switching the printer off.
+func diagnoseUptime(report UptimeReport, auth, longest time.Duration) string {
+	switch {
+	case report.KnownMinutes == 0:
+		return "unknown"
+	case auth > 0 && report.AuthFailedMinutes*2 >= report.OfflineMinutes:
+		return "access_code"
+	case report.ShortOutages >= flakyOutageCount:
+		return "flaky_network"
+	case longest >= longOutageLimit:
+		return "switched_off"
+	}
+	return "steady"
+}
+
+// Uptime reports every printer - or just printerID - between from and to.
+// The future is not counted.
+func (m *PrinterManager) Uptime(printerID string, from, to time.Time) ([]UptimeReport, error) {
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+	if printerID != "" {
+		if _, ok := m.lookup(printerID); !ok {
+			return nil, fmt.Errorf("unknown printer")
+		}
+	}
+
+	reports := []UptimeReport{}
+	for _, p := range m.list() {
+		if printerID != "" && p.cfg.ID != printerID {
+			continue
+		}
+		events, err := m.availabilityFor(p.cfg.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		report := computeUptime(events, from, to)
+		report.PrinterID = p.cfg.ID
+		report.PrinterName = p.cfg.Name
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// availabilityFor is a printer's events between from and to, oldest first,
+// led by the last reachability and access-code events before from so the
+// report knows what state the stretch began in.
+func (m *PrinterManager) availabilityFor(printerID string, from, to time.Time) ([]PrinterAvailabilityEvent, error) {
+	var events []PrinterAvailabilityEvent
+	if m.db == nil {
+		return events, nil
+	}
+
+	for _, kinds := range [][]string{
+		{AvailabilityOnline, AvailabilityOffline},
+		{AvailabilityAuthFailed, AvailabilityAuthRestored},
+	} {
+		var before PrinterAvailabilityEvent
+		err := m.db.Where("printer_id = ? AND kind IN ? AND at < ?", printerID, kinds, from).
+			Order("at DESC").First(&before).Error
+		if err == nil {
+			events = append(events, before)
+		}
+	}
+	if len(events) == 2 && events[1].At.Before(events[0].At) {
+		events[0], events[1] = events[1], events[0]
+	}
+
+	var within []PrinterAvailabilityEvent
+	err := m.db.Where("printer_id = ? AND at >= ? AND at < ?", printerID, from, to).
+		Order("at ASC, id ASC").Find(&within).Error
+	return append(events, within...), err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityChanges(t *testing.T) {
+	// The first look at a printer records where it stands
+	kinds, last := availabilityChanges(availability{}, false, PrinterStatus{AccessCodeProblem: true})
+	if strings.Join(kinds, ",") != "offline,auth_failed" {
+		t.Errorf("first check logged %v", kinds)
+	}
+
+	steps := []struct {
+		status PrinterStatus
+		want   string
+	}{
+		{PrinterStatus{AccessCodeProblem: true}, ""},
+		{PrinterStatus{Online: true}, "online,auth_restored"},
+		{PrinterStatus{Online: true, CameraOnline: true}, ""},
+		{PrinterStatus{Online: true}, "camera_offline"},
+		{PrinterStatus{Online: true}, ""},
+		{PrinterStatus{Online: true, CameraOnline: true}, "camera_online"},
+		// Switching the printer off takes the camera with it - one event
+		{PrinterStatus{}, "offline"},
+		{PrinterStatus{Online: true, CameraOnline: true}, "online"},
+	}
+	for i, step := range steps {
+		kinds, last = availabilityChanges(last, true, step.status)
+		if got := strings.Join(kinds, ","); got != step.want {
+			t.Errorf("step %d logged %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestComputeUptime(t *testing.T) {
+	from := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	at := func(hours, minutes int) time.Time {
+		return from.Add(time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute)
+	}
+	event := func(kind string, when time.Time) PrinterAvailabilityEvent {
+		return PrinterAvailabilityEvent{Kind: kind, At: when}
+	}
+
+	// Online since yesterday, then three blips on a bad port
+	flaky := computeUptime([]PrinterAvailabilityEvent{
+		event(AvailabilityOnline, from.Add(-time.Hour)),
+		event(AvailabilityOffline, at(1, 0)), event(AvailabilityOnline, at(1, 5)),
+		event(AvailabilityOffline, at(5, 0)), event(AvailabilityOnline, at(5, 3)),
+		event(AvailabilityOffline, at(9, 0)), event(AvailabilityOnline, at(9, 10)),
+		event(AvailabilityCameraOffline, at(10, 0)),
+	}, from, to)
+	if flaky.Outages != 3 || flaky.ShortOutages != 3 || flaky.OfflineMinutes != 18 || flaky.KnownMinutes != 24*60 {
+		t.Errorf("flaky: %+v", flaky)
+	}
+	if flaky.Diagnosis != "flaky_network" || flaky.LongestOutageMinutes != 10 || flaky.CameraOutages != 1 {
+		t.Errorf("flaky: %+v", flaky)
+	}
+	if flaky.UptimePercent != 98.7 {
+		t.Errorf("uptime %v", flaky.UptimePercent)
+	}
+
+	// Switched off on Friday evening and still off: the outage runs from
+	// before the stretch to its end
+	weekend := computeUptime([]PrinterAvailabilityEvent{
+		event(AvailabilityOffline, from.Add(-6*time.Hour)),
+	}, from, to)
+	if weekend.Outages != 1 || weekend.LongestOutageMinutes != 30*60 || weekend.UptimePercent != 0 || weekend.Diagnosis != "switched_off" {
+		t.Errorf("weekend: %+v", weekend)
+	}
+
+	// Reachable but refusing the access code for most of the day
+	code := computeUptime([]PrinterAvailabilityEvent{
+		event(AvailabilityOnline, at(0, 0)),
+		event(AvailabilityOffline, at(2, 0)), event(AvailabilityAuthFailed, at(2, 0)),
+		event(AvailabilityOnline, at(20, 0)), event(AvailabilityAuthRestored, at(20, 0)),
+	}, from, to)
+	if code.AuthFailedMinutes != 18*60 || code.Diagnosis != "access_code" {
+		t.Errorf("access code: %+v", code)
+	}
+
+	// Monitoring started at noon: the morning is unknown, not down
+	late := computeUptime([]PrinterAvailabilityEvent{event(AvailabilityOnline, at(12, 0))}, from, to)
+	if late.KnownMinutes != 12*60 || late.UptimePercent != 100 || late.Diagnosis != "steady" {
+		t.Errorf("late start: %+v", late)
+	}
+	if none := computeUptime(nil, from, to); none.Diagnosis != "unknown" {
+		t.Errorf("no log: %+v", none)
+	}
+}
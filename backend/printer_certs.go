@@ -0,0 +1,291 @@
+package main
+
+// Printer certificate pinning.
+//
+// Bambu printers present a certificate no public CA has signed, so the status,
+// camera and file connections cannot check it the usual way - and not checking
+// it at all would let anybody on the printer network pose as a printer and
+// collect its access code. Instead the certificate is trusted on first use:
+// the first time the backend talks to a printer, the certificate's SHA-256
+// fingerprint is recorded, and from then on only that certificate is accepted.
+//
+// A printer that turns up with a different certificate is refused. Its status
+// carries a certificate_warning until an admin, having checked the printer
+// really was replaced or re-flashed, accepts the new fingerprint.
+//
+// When PRINTER_CA_FILE names a PEM bundle - Bambu's device CA, say - a chain
+// that verifies against it is trusted without a pin, as long as the
+// certificate is issued to the printer's serial number.
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PrinterCertificate is the certificate pinned for one printer, and one it
+// has presented since that does not match.
+type PrinterCertificate struct {
+	gorm.Model
+	PrinterID   string `json:"printer_id" gorm:"uniqueIndex"`
+	Fingerprint string `json:"fingerprint"`
+	Subject     string `json:"subject"`
+	// Who accepted it; empty for a certificate trusted on first use
+	AcceptedBy string    `json:"accepted_by"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	// A different certificate the printer presented, waiting for an admin
+	Pending        string     `json:"pending"`
+	PendingSubject string     `json:"pending_subject"`
+	PendingSince   *time.Time `json:"pending_since"`
+}
+
+// certFingerprint is the SHA-256 of a certificate, as colon-separated hex the
+// way browsers and openssl show it.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	encoded := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(encoded); i += 2 {
+		pairs = append(pairs, encoded[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// CertificateChangedError is a printer presenting a certificate other than
+// the pinned one.
+type CertificateChangedError struct {
+	PrinterName string
+	Pinned      string
+	Presented   string
+}
+
+func (e *CertificateChangedError) Error() string {
+	return fmt.Sprintf("%s presented a different TLS certificate than before (%s) - "+
+		"refusing to connect until an admin accepts it", e.PrinterName, e.Presented)
+}
+
+// printerCAs is the optional PRINTER_CA_FILE bundle, read once.
+var printerCAs = struct {
+	once sync.Once
+	pool *x509.CertPool
+}{}
+
+func printerCAPool() *x509.CertPool {
+	printerCAs.once.Do(func() {
+		path := os.Getenv("PRINTER_CA_FILE")
+		if path == "" {
+			return
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Ignoring PRINTER_CA_FILE: %v", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Printf("Ignoring PRINTER_CA_FILE: no certificates in %s", path)
+			return
+		}
+		printerCAs.pool = pool
+	})
+	return printerCAs.pool
+}
+
+// verifiedByCA reports whether the chain checks out against the configured
+// CA and is issued to this printer. Printers are reached by address, which
+// the certificate does not name, so the serial stands in for the host name.
+func verifiedByCA(pool *x509.CertPool, chain []*x509.Certificate, serial string) bool {
+	if pool == nil || len(chain) == 0 || serial == "" {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil && strings.EqualFold(chain[0].Subject.CommonName, serial)
+}
+
+// tlsConfig is what every connection to the printer uses. The usual checks
+// are replaced by checkCertificate, since a printer's certificate never
+// names the address it is reached at.
+func (p *printer) tlsConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true, // #nosec G402 - verified by checkCertificate
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return p.checkCertificate(state.PeerCertificates)
+		},
+	}
+}
+
+// checkCertificate accepts the pinned certificate, pins the first one seen,
+// and refuses any other.
+func (p *printer) checkCertificate(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("%s presented no certificate", p.cfg.Name)
+	}
+	if verifiedByCA(printerCAPool(), chain, p.cfg.Serial) {
+		return nil
+	}
+	presented := certFingerprint(chain[0])
+	subject := chain[0].Subject.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case p.certPin == "":
+		p.certPin = presented
+		p.certPending = ""
+		log.Printf("printer %s: trusting its certificate %s from now on", p.cfg.Name, presented)
+		p.saveCertificateLocked(map[string]interface{}{
+			"fingerprint": presented, "subject": subject, "accepted_by": "",
+			"accepted_at": time.Now(), "pending": "", "pending_subject": "", "pending_since": nil,
+		})
+		return nil
+	case presented == p.certPin:
+		return nil
+	}
+
+	if p.certPending != presented {
+		now := time.Now()
+		p.certPending = presented
+		p.certPendingSince = now
+		log.Printf("printer %s: REFUSED a changed certificate %s (pinned %s)", p.cfg.Name, presented, p.certPin)
+		p.saveCertificateLocked(map[string]interface{}{
+			"pending": presented, "pending_subject": subject, "pending_since": &now,
+		})
+	}
+	return &CertificateChangedError{PrinterName: p.cfg.Name, Pinned: p.certPin, Presented: presented}
+}
+
+// saveCertificateLocked writes the printer's certificate row, creating it
+// the first time.
+func (p *printer) saveCertificateLocked(fields map[string]interface{}) {
+	if p.jobs == nil {
+		return
+	}
+	record := PrinterCertificate{PrinterID: p.cfg.ID}
+	err := p.jobs.Where("printer_id = ?", p.cfg.ID).FirstOrCreate(&record).Error
+	if err == nil {
+		err = p.jobs.Model(&record).Updates(fields).Error
+	}
+	if err != nil {
+		log.Printf("printer %s: could not save its certificate: %v", p.cfg.Name, err)
+	}
+}
+
+// loadCertificate reads the pin saved for the printer, if any.
+func (p *printer) loadCertificate() {
+	if p.jobs == nil {
+		return
+	}
+	var record PrinterCertificate
+	if err := p.jobs.Where("printer_id = ?", p.cfg.ID).First(&record).Error; err != nil {
+		return
+	}
+	p.certPin = record.Fingerprint
+	p.certPending = record.Pending
+	if record.PendingSince != nil {
+		p.certPendingSince = *record.PendingSince
+	}
+}
+
+// certificateWarningLocked is the warning the status carries while a changed
+// certificate waits for an admin.
+func (p *printer) certificateWarningLocked() string {
+	if p.certPending == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s has presented a different TLS certificate since %s, so the site is not connecting to it. "+
+		"If the printer was replaced or reset, an admin can accept the new certificate; otherwise something "+
+		"on the network may be posing as the printer.", p.cfg.Name, p.certPendingSince.Format("2 Jan 15:04"))
+}
+
+// --- manager wrappers ---------------------------------------------------
+
+// PrinterCertificateView is a printer's certificate state for admins.
+type PrinterCertificateView struct {
+	PrinterID    string     `json:"printer_id"`
+	Pinned       string     `json:"pinned"`
+	Pending      string     `json:"pending,omitempty"`
+	PendingSince *time.Time `json:"pending_since,omitempty"`
+	// Whether PRINTER_CA_FILE is set, in which case a verifying chain needs
+	// no pin
+	CAConfigured bool `json:"ca_configured"`
+}
+
+// Certificate reports what is pinned for a printer and what is waiting.
+func (m *PrinterManager) Certificate(id string) (PrinterCertificateView, error) {
+	p, ok := m.lookup(id)
+	if !ok {
+		return PrinterCertificateView{}, fmt.Errorf("unknown printer")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	view := PrinterCertificateView{
+		PrinterID:    id,
+		Pinned:       p.certPin,
+		Pending:      p.certPending,
+		CAConfigured: printerCAPool() != nil,
+	}
+	if p.certPending != "" {
+		since := p.certPendingSince
+		view.PendingSince = &since
+	}
+	return view, nil
+}
+
+// AcceptCertificate pins the certificate a printer presented instead of the
+// old one. The fingerprint must be the one waiting, so an admin cannot accept
+// something other than what they checked.
+func (m *PrinterManager) AcceptCertificate(id, fingerprint, adminName string) error {
+	p, ok := m.lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown printer")
+	}
+
+	p.mu.Lock()
+	pending := p.certPending
+	if pending == "" {
+		p.mu.Unlock()
+		return fmt.Errorf("%s has not presented a new certificate", p.cfg.Name)
+	}
+	if !strings.EqualFold(strings.TrimSpace(fingerprint), pending) {
+		p.mu.Unlock()
+		return fmt.Errorf("that is not the certificate %s presented - it was %s", p.cfg.Name, pending)
+	}
+	p.certPin = pending
+	p.certPending = ""
+	p.saveCertificateLocked(map[string]interface{}{
+		"fingerprint": pending, "accepted_by": adminName, "accepted_at": time.Now(),
+		"subject": gorm.Expr("pending_subject"), "pending": "", "pending_subject": "", "pending_since": nil,
+	})
+	p.mu.Unlock()
+
+	log.Printf("printer %s: certificate %s accepted by %s", p.cfg.Name, pending, adminName)
+	// Reconnect now rather than at the next retry
+	p.setAccessCode(p.accessCode())
+	return nil
+}
+
+// forgetCertificate drops a removed printer's pin, so whatever is added under
+// its id later starts afresh.
+func (m *PrinterManager) forgetCertificate(id string) {
+	if m.db != nil {
+		m.db.Unscoped().Where("printer_id = ?", id).Delete(&PrinterCertificate{})
+	}
+}
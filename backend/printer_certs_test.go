@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsPrinter serves cert and completes the handshake with whoever connects.
+func tlsPrinter(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake() //nolint:errcheck // the client decides
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dialPrinter(p *printer, address string) error {
+	conn, err := tls.Dial("tcp", address, p.tlsConfig())
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+func TestCertificatePinnedOnFirstUse(t *testing.T) {
+	original := tlsPrinter(t, selfSignedCert(t))
+	impostor := tlsPrinter(t, selfSignedCert(t))
+
+	p := &printer{cfg: PrinterConfig{ID: "p1", Name: "P1"}}
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1": p}}
+
+	if err := dialPrinter(p, original); err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+	pinned := p.certPin
+	if pinned == "" || p.status().CertificateWarning != "" {
+		t.Fatalf("pinned %q, warning %q", pinned, p.status().CertificateWarning)
+	}
+	if err := dialPrinter(p, original); err != nil {
+		t.Fatalf("the pinned certificate was refused: %v", err)
+	}
+
+	err := dialPrinter(p, impostor)
+	var changed *CertificateChangedError
+	if !errors.As(err, &changed) {
+		t.Fatalf("a different certificate gave %v", err)
+	}
+	if p.status().CertificateWarning == "" || p.certPin != pinned {
+		t.Error("a changed certificate should warn and keep the pin")
+	}
+
+	if err := m.AcceptCertificate("p1", "AA:BB", "admin"); err == nil {
+		t.Error("accepted a fingerprint the printer never presented")
+	}
+	view, _ := m.Certificate("p1")
+	if err := m.AcceptCertificate("p1", strings.ToLower(view.Pending), "admin"); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if err := dialPrinter(p, impostor); err != nil {
+		t.Errorf("the accepted certificate was refused: %v", err)
+	}
+	if p.status().CertificateWarning != "" {
+		t.Error("the warning should clear once accepted")
+	}
+	if err := dialPrinter(p, original); err == nil {
+		t.Error("the old certificate should no longer be trusted")
+	}
+}
+
+func TestVerifiedByCA(t *testing.T) {
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Device CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	leafTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "01P00A411600279"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, _ := x509.CreateCertificate(rand.Reader, &leafTemplate, ca, &key.PublicKey, caKey)
+	leaf, _ := x509.ParseCertificate(leafDER)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	chain := []*x509.Certificate{leaf}
+
+	if !verifiedByCA(pool, chain, "01P00A411600279") {
+		t.Error("a certificate signed by the CA for this serial should be trusted")
+	}
+	if verifiedByCA(pool, chain, "01P00C580301739") {
+		t.Error("another printer's certificate should not be")
+	}
+	self, _ := x509.ParseCertificate(selfSignedCert(t).Certificate[0])
+	if verifiedByCA(pool, []*x509.Certificate{self}, "mock-printer") {
+		t.Error("a self-signed certificate should not chain to the CA")
+	}
+	if verifiedByCA(nil, chain, "01P00A411600279") {
+		t.Error("without a CA nothing is verified")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+// Fixing a job from a desk.
+//
+// Beyond pause, resume and stop, an admin can change the nozzle and bed
+// targets, the part, aux and chamber fans, the speed profile, and send a
+// single line of G-code from a short list of harmless commands. Each one is
+// checked against what the printer is doing first, and every command an admin
+// sends - these and the older ones - is written to the action history of the
+// job it was sent during, so the print log shows who did what to a print.
+//
+// These ride on Bambu's MQTT commands; printers on other drivers do not list
+// them in their capabilities and are refused.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// More printer commands, as listed in PrinterCapabilities.
+const (
+	CommandTemperature = "temperature"
+	CommandFan         = "fan"
+	CommandSpeed       = "speed"
+	CommandGcode       = "gcode"
+)
+
+const (
+	maxNozzleTemp = 300
+	maxBedTemp    = 110
+	// Below this, a running print stops extruding and the nozzle can jam
+	minPrintingNozzleTemp = 170
+)
+
+// PrintJobAction is one command an admin sent to a printer. PrintJobID is set
+// when a job was running at the time.
+type PrintJobAction struct {
+	gorm.Model
+	PrinterID  string    `json:"printer_id" gorm:"index"`
+	PrintJobID *uint     `json:"print_job_id" gorm:"index"`
+	Admin      string    `json:"admin"`
+	Action     string    `json:"action"`
+	Detail     string    `json:"detail"`
+	At         time.Time `json:"at"`
+}
+
+// logAction writes a command to the history, against the running job if
+// there is one.
+func (p *printer) logAction(adminName, action, detail string) {
+	p.logActionOn(p.currentJobID(), adminName, action, detail)
+}
+
+// currentJobID is the id of the job being tracked, if any.
+func (p *printer) currentJobID() *uint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.currentJob == nil || p.currentJob.ID == 0 {
+		return nil
+	}
+	id := p.currentJob.ID
+	return &id
+}
+
+// logActionOn writes a command to the history against a given job, for a
+// command that ends the job before it can be logged.
+func (p *printer) logActionOn(jobID *uint, adminName, action, detail string) {
+	p.mu.RLock()
+	db := p.jobs
+	p.mu.RUnlock()
+
+	if detail == "" {
+		log.Printf("printer %s: %s requested by %s", p.cfg.Name, action, adminName)
+	} else {
+		log.Printf("printer %s: %s %s requested by %s", p.cfg.Name, action, detail, adminName)
+	}
+	if db == nil {
+		return
+	}
+	entry := PrintJobAction{
+		PrinterID:  p.cfg.ID,
+		PrintJobID: jobID,
+		Admin:      adminName,
+		Action:     action,
+		Detail:     strings.TrimSpace(detail),
+		At:         time.Now(),
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("printer %s: could not record the %s: %v", p.cfg.Name, action, err)
+	}
+}
+
+// printing reports whether a job is under way, paused or not.
+func (p *printer) printing() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	state := strings.ToUpper(p.state)
+	return state == "RUNNING" || state == "PAUSE" || state == "PREPARE"
+}
+
+// ready checks a printer can take one of these commands at all.
+func (p *printer) ready(command string) error {
+	if err := p.supports(command); err != nil {
+		return err
+	}
+	return p.reachable()
+}
+
+// sendGcode sends G-code lines through the printer's gcode_line command.
+func (p *printer) sendGcode(lines ...string) error {
+	command, err := json.Marshal(map[string]interface{}{
+		"print": map[string]string{
+			"sequence_id": strconv.Itoa(p.nextSequence()),
+			"command":     "gcode_line",
+			"param":       strings.Join(lines, "\n") + "\n",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return p.publishCommand(string(command))
+}
+
+// --- temperatures -------------------------------------------------------------
+
+// temperatureGcode checks new targets and builds the commands for them. Either
+// may be nil to leave it alone.
+func temperatureGcode(nozzle, bed *float64, printing bool) ([]string, error) {
+	if nozzle == nil && bed == nil {
+		return nil, fmt.Errorf("give a nozzle or bed temperature")
+	}
+
+	var lines []string
+	if nozzle != nil {
+		if *nozzle < 0 || *nozzle > maxNozzleTemp {
+			return nil, fmt.Errorf("the nozzle can be set from 0 to %d °C", maxNozzleTemp)
+		}
+		if printing && *nozzle < minPrintingNozzleTemp {
+			return nil, fmt.Errorf("a printing nozzle cannot go below %d °C - stop the print first", minPrintingNozzleTemp)
+		}
+		lines = append(lines, fmt.Sprintf("M104 S%.0f", *nozzle))
+	}
+	if bed != nil {
+		if *bed < 0 || *bed > maxBedTemp {
+			return nil, fmt.Errorf("the bed can be set from 0 to %d °C", maxBedTemp)
+		}
+		lines = append(lines, fmt.Sprintf("M140 S%.0f", *bed))
+	}
+	return lines, nil
+}
+
+// --- fans -------------------------------------------------------------------
+
+// Bambu's fan numbering for M106.
+var printerFans = map[string]int{"part": 1, "aux": 2, "chamber": 3}
+
+// fanGcode checks a fan setting and builds the command for it. The aux and
+// chamber fans are only on enclosed printers.
+func fanGcode(fan string, percentage int, caps PrinterCapabilities) (string, error) {
+	index, ok := printerFans[fan]
+	if !ok {
+		return "", fmt.Errorf("fan must be part, aux or chamber")
+	}
+	if fan != "part" && !caps.Enclosed {
+		return "", fmt.Errorf("this printer has no %s fan", fan)
+	}
+	if percentage < 0 || percentage > 100 {
+		return "", fmt.Errorf("fan speed is a percentage, 0 to 100")
+	}
+	return fmt.Sprintf("M106 P%d S%d", index, (percentage*255+50)/100), nil
+}
+
+// --- speed profile ----------------------------------------------------------
+
+// speedProfiles are Bambu's four speed levels.
+var speedProfiles = map[string]int{"silent": 1, "standard": 2, "sport": 3, "ludicrous": 4}
+
+// --- G-code console ---------------------------------------------------------
+
+// allowedGcode is everything the console will send: temperatures, fans, and
+// the speed and flow factors. Nothing that moves the toolhead, homes, waits or
+// changes saved settings.
+var allowedGcode = map[string]bool{
+	"M104": true, // nozzle target
+	"M140": true, // bed target
+	"M106": true, // fan speed
+	"M107": true, // fan off
+	"M220": true, // speed factor
+	"M221": true, // flow factor
+}
+
+// printingOnlyGcode only make sense on a job in progress.
+var printingOnlyGcode = map[string]bool{"M220": true, "M221": true}
+
+// gcodeNumber is a plain decimal. ParseFloat also takes NAN, INF and hex
+// floats, which slip past every range check and which the firmware reads as 0.
+var gcodeNumber = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+// parseConsoleGcode checks one console line and returns it tidied. Every
+// parameter must be a letter followed by a plain number, which is sent as the
+// number it was read as rather than as typed.
+func parseConsoleGcode(line string, printing bool) (string, error) {
+	if strings.ContainsAny(line, "\r\n") {
+		return "", fmt.Errorf("send one line at a time")
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(strings.ToUpper(line))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("the line is empty")
+	}
+
+	code := fields[0]
+	if !allowedGcode[code] {
+		return "", fmt.Errorf("%s is not allowed from the site - only M104, M140, M106, M107, M220 and M221", code)
+	}
+	if printingOnlyGcode[code] && !printing {
+		return "", fmt.Errorf("%s only applies to a print in progress", code)
+	}
+
+	clean := []string{code}
+	for _, param := range fields[1:] {
+		if len(param) < 2 || param[0] < 'A' || param[0] > 'Z' || !gcodeNumber.MatchString(param[1:]) {
+			return "", fmt.Errorf("%q is not a parameter", param)
+		}
+		value, err := strconv.ParseFloat(param[1:], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", fmt.Errorf("%q is not a parameter", param)
+		}
+		param = param[:1] + strconv.FormatFloat(value, 'f', -1, 64)
+		clean = append(clean, param)
+		// The dedicated endpoints' limits apply here too
+		switch {
+		case code == "M104" && param[0] == 'S' && (value < 0 || value > maxNozzleTemp),
+			code == "M140" && param[0] == 'S' && (value < 0 || value > maxBedTemp),
+			code == "M106" && param[0] == 'S' && (value < 0 || value > 255):
+			return "", fmt.Errorf("%s is out of range", param)
+		case code == "M104" && param[0] == 'S' && printing && value < minPrintingNozzleTemp:
+			return "", fmt.Errorf("a printing nozzle cannot go below %d °C - stop the print first", minPrintingNozzleTemp)
+		case (code == "M220" || code == "M221") && param[0] == 'S' && (value < 10 || value > 300):
+			return "", fmt.Errorf("%s is out of range - 10 to 300%%", param)
+		}
+	}
+	return strings.Join(clean, " "), nil
+}
+
+// --- manager wrappers ---------------------------------------------------
+
+// SetTemperature changes the nozzle and/or bed target.
+func (m *PrinterManager) SetTemperature(id, adminName string, nozzle, bed *float64) error {
+	p, ok := m.lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown printer")
+	}
+	if err := p.ready(CommandTemperature); err != nil {
+		return err
+	}
+	lines, err := temperatureGcode(nozzle, bed, p.printing())
+	if err != nil {
+		return err
+	}
+	if err := p.sendGcode(lines...); err != nil {
+		return err
+	}
+	p.logAction(adminName, "temperature", strings.Join(lines, " "))
+	return nil
+}
+
+// SetFan sets one fan's speed as a percentage.
+func (m *PrinterManager) SetFan(id, adminName, fan string, percentage int) error {
+	p, ok := m.lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown printer")
+	}
+	if err := p.ready(CommandFan); err != nil {
+		return err
+	}
+	line, err := fanGcode(fan, percentage, p.capabilities())
+	if err != nil {
+		return err
+	}
+	if err := p.sendGcode(line); err != nil {
+		return err
+	}
+	p.logAction(adminName, "fan", fmt.Sprintf("%s fan %d%%", fan, percentage))
+	return nil
+}
+
+// SetSpeedProfile switches a running print between Bambu's speed levels.
+func (m *PrinterManager) SetSpeedProfile(id, adminName, profile string) error {
+	p, ok := m.lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown printer")
+	}
+	level, ok := speedProfiles[strings.ToLower(profile)]
+	if !ok {
+		return fmt.Errorf("profile must be silent, standard, sport or ludicrous")
+	}
+	if err := p.ready(CommandSpeed); err != nil {
+		return err
+	}
+	if !p.printing() {
+		return fmt.Errorf("the speed profile only applies to a print in progress")
+	}
+
+	payload := fmt.Sprintf(`{"print":{"sequence_id":"%d","command":"print_speed","param":"%d"}}`, p.nextSequence(), level)
+	if err := p.publishCommand(payload); err != nil {
+		return err
+	}
+	p.logAction(adminName, "speed", strings.ToLower(profile))
+	return nil
+}
+
+// SendGcode sends one line from the console's allow-list. It returns the line
+// as sent.
+func (m *PrinterManager) SendGcode(id, adminName, line string) (string, error) {
+	p, ok := m.lookup(id)
+	if !ok {
+		return "", fmt.Errorf("unknown printer")
+	}
+	if err := p.ready(CommandGcode); err != nil {
+		return "", err
+	}
+	clean, err := parseConsoleGcode(line, p.printing())
+	if err != nil {
+		return "", err
+	}
+	if err := p.sendGcode(clean); err != nil {
+		return "", err
+	}
+	p.logAction(adminName, "gcode", clean)
+	return clean, nil
+}
+
+// Actions lists what admins have sent to printers, newest first: for one
+// job, or for one printer when jobID is zero.
+func (m *PrinterManager) Actions(printerID string, jobID uint) ([]PrintJobAction, error) {
+	actions := []PrintJobAction{}
+	if m.db == nil {
+		return actions, nil
+	}
+	query := m.db.Order("at DESC").Limit(500)
+	if jobID != 0 {
+		query = query.Where("print_job_id = ?", jobID)
+	} else {
+		query = query.Where("printer_id = ?", printerID)
+	}
+	err := query.Find(&actions).Error
+	return actions, err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemperatureGcode(t *testing.T) {
+	nozzle, bed := 220.0, 60.0
+	lines, err := temperatureGcode(&nozzle, &bed, false)
+	if err != nil || strings.Join(lines, "|") != "M104 S220|M140 S60" {
+		t.Fatalf("lines = %v, %v", lines, err)
+	}
+
+	if _, err := temperatureGcode(nil, nil, false); err == nil {
+		t.Error("an empty request should be refused")
+	}
+	hot := 350.0
+	if _, err := temperatureGcode(&hot, nil, false); err == nil {
+		t.Error("350 °C should be out of range")
+	}
+	hotBed := 120.0
+	if _, err := temperatureGcode(nil, &hotBed, false); err == nil {
+		t.Error("a 120 °C bed should be out of range")
+	}
+
+	// Cooling the nozzle is fine when idle, not mid-print
+	off := 0.0
+	if _, err := temperatureGcode(&off, nil, false); err != nil {
+		t.Errorf("turning the nozzle off while idle: %v", err)
+	}
+	if _, err := temperatureGcode(&off, nil, true); err == nil {
+		t.Error("turning the nozzle off mid-print should be refused")
+	}
+}
+
+func TestFanGcode(t *testing.T) {
+	enclosed := capabilitiesFor("P1S", false)
+	open := capabilitiesFor("A1", false)
+
+	cases := []struct {
+		fan     string
+		percent int
+		caps    PrinterCapabilities
+		want    string
+	}{
+		{"part", 100, open, "M106 P1 S255"},
+		{"part", 50, open, "M106 P1 S128"},
+		{"aux", 0, enclosed, "M106 P2 S0"},
+		{"chamber", 20, enclosed, "M106 P3 S51"},
+	}
+	for _, c := range cases {
+		got, err := fanGcode(c.fan, c.percent, c.caps)
+		if err != nil || got != c.want {
+			t.Errorf("fanGcode(%s, %d) = %q, %v; want %q", c.fan, c.percent, got, err, c.want)
+		}
+	}
+
+	if _, err := fanGcode("chamber", 50, open); err == nil {
+		t.Error("an open-frame printer has no chamber fan")
+	}
+	if _, err := fanGcode("exhaust", 50, enclosed); err == nil {
+		t.Error("unknown fans should be refused")
+	}
+	if _, err := fanGcode("part", 101, enclosed); err == nil {
+		t.Error("101% should be refused")
+	}
+}
+
+func TestParseConsoleGcode(t *testing.T) {
+	allowed := []struct {
+		line     string
+		printing bool
+		want     string
+	}{
+		{"m104 s215", false, "M104 S215"},
+		{"  M140   S55 ; warm the bed", false, "M140 S55"},
+		{"M106 P1 S255", false, "M106 P1 S255"},
+		{"M107", false, "M107"},
+		{"M220 S120", true, "M220 S120"},
+		{"M221 S95", true, "M221 S95"},
+		{"M104 S0215.50", false, "M104 S215.5"},
+	}
+	for _, c := range allowed {
+		got, err := parseConsoleGcode(c.line, c.printing)
+		if err != nil || got != c.want {
+			t.Errorf("parseConsoleGcode(%q) = %q, %v; want %q", c.line, got, err, c.want)
+		}
+	}
+
+	refused := []struct {
+		line     string
+		printing bool
+	}{
+		{"G28", false},                 // homing
+		{"G1 X10 Y10", false},          // motion
+		{"M500", false},                // saves settings
+		{"M104 S200\nG28", false},      // a second line
+		{"M104 S200 ; ok\nG28", false}, // a second line behind a comment
+		{"M104 S400", false},           // too hot
+		{"M104 S100", true},            // too cold mid-print
+		{"M140 S150", false},           // bed too hot
+		{"M106 S300", false},           // beyond 255
+		{"M220 S150", false},           // nothing printing
+		{"M221 S5", true},              // absurd flow
+		{"M104 SABC", false},           // not a number
+		{"M104 220", false},            // no letter
+		{"M104 SNAN", true},            // NaN passes every comparison
+		{"M220 SNAN", true},            // and is read as S0
+		{"M220 S0X1P4", true},          // a hex float
+		{"M106 SINF", false},           // infinity
+		{"M140 S1E2", false},           // an exponent
+		{"; just a comment", false},    // nothing to send
+		{"", false},                    // empty
+	}
+	for _, c := range refused {
+		if got, err := parseConsoleGcode(c.line, c.printing); err == nil {
+			t.Errorf("parseConsoleGcode(%q, printing=%v) = %q, want an error", c.line, c.printing, got)
+		}
+	}
+}
+
+func TestRemoteCommandsCheckThePrinter(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{ID: "p1s", Name: "P1S", Serial: "01P00A000000000"}, state: "IDLE"}
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1s": p}}
+
+	// Idle: no speed profile or M220, and nothing at all while unreachable
+	if err := m.SetSpeedProfile("p1s", "admin", "sport"); err == nil {
+		t.Error("an unreachable printer should be refused")
+	}
+	p.lastReport = time.Now()
+	if err := m.SetSpeedProfile("p1s", "admin", "sport"); err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Errorf("speed on an idle printer: %v", err)
+	}
+	if err := m.SetSpeedProfile("p1s", "admin", "turbo"); err == nil {
+		t.Error("unknown profiles should be refused")
+	}
+
+	// Reachable by report but with no MQTT client, so sending fails
+	nozzle := 200.0
+	if err := m.SetTemperature("p1s", "admin", &nozzle, nil); err == nil {
+		t.Error("sending without a connection should fail")
+	}
+	if _, err := m.SendGcode("p1s", "admin", "G28"); err == nil {
+		t.Error("G28 should be refused")
+	}
+	if err := m.SetFan("nope", "admin", "part", 50); err == nil {
+		t.Error("unknown printers should be refused")
+	}
+
+	// Other drivers do not take these commands
+	octo := &printer{cfg: PrinterConfig{ID: "octo", Name: "Octo", Driver: DriverOctoPrint}, state: "RUNNING", lastReport: time.Now()}
+	octo.driver = newPrinterDriver(octo)
+	m = &PrinterManager{printers: []*printer{octo}, byID: map[string]*printer{"octo": octo}}
+	if err := m.SetTemperature("octo", "admin", &nozzle, nil); err == nil || !strings.Contains(err.Error(), "does not support") {
+		t.Errorf("temperature on OctoPrint: %v", err)
+	}
+}
+
+func TestStopIsCreditedToWhoeverStoppedIt(t *testing.T) {
+	printState := "printing"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/printer/objects/query", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"result":{"status":{
+			"print_stats":{"state":"`+printState+`","filename":"srinath_bracket.gcode","print_duration":60},
+			"virtual_sdcard":{"progress":0.1}}}}`)
+	})
+	mux.HandleFunc("/printer/print/cancel", func(w http.ResponseWriter, r *http.Request) {
+		printState = "cancelled"
+		io.WriteString(w, `{"result":"ok"}`)
+	})
+
+	var actions []PrintJobAction
+	p := httpTestPrinter(t, DriverMoonraker, mux)
+	p.cfg.AccessCode = ""
+	p.jobs = dryRunDB(t, func(action PrintJobAction) { actions = append(actions, action) })
+
+	state, err := p.driver.(*moonrakerDriver).state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.applyState(state)
+	job := p.currentJob
+	if job == nil {
+		t.Fatal("the running print was not tracked")
+	}
+	job.ID = 7
+	// Somebody else paused it a minute ago
+	p.recordAction("asha")
+
+	if err := p.stop("srinath"); err != nil {
+		t.Fatal(err)
+	}
+	if job.Result != "stopped" || job.StoppedBy != "srinath" {
+		t.Errorf("job closed as %s by %q", job.Result, job.StoppedBy)
+	}
+	if len(actions) != 1 || actions[0].PrintJobID == nil || *actions[0].PrintJobID != 7 {
+		t.Errorf("the stop was logged as %+v", actions)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+// Printer drivers.
+//
+// Everything above this layer - the status cards, the print log, the queue,
+// alerts, maintenance - works on the state kept in printer and does not care
+// how it got there. A driver is the part that talks to the machine: it keeps
+// that state current, and carries out file operations and commands. Bambu
+// printers use MQTT, FTPS and the camera socket in printers.go and
+// printer_files.go; OctoPrint, Moonraker (Klipper) and PrusaLink are polled
+// over HTTP and translated into the same states, so their prints are logged
+// exactly like a Bambu's.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Drivers, as named in a printer's settings.
+const (
+	DriverBambu     = "bambu"
+	DriverOctoPrint = "octoprint"
+	DriverMoonraker = "moonraker"
+	DriverPrusaLink = "prusalink"
+)
+
+var printerDrivers = map[string]bool{
+	DriverBambu:     true,
+	DriverOctoPrint: true,
+	DriverMoonraker: true,
+	DriverPrusaLink: true,
+}
+
+const (
+	// How often HTTP printers are asked for their state and a camera frame
+	httpPollInterval = 5 * time.Second
+	httpTimeout      = 15 * time.Second
+	// Where OctoPrint and Moonraker installs usually serve a webcam still
+	defaultSnapshotPath = "/webcam/?action=snapshot"
+)
+
+// PrinterDriver is one way of talking to a printer. Run keeps the printer's
+// status and camera frame current; the rest act on the machine. Callers have
+// already checked that a command makes sense in the printer's state.
+type PrinterDriver interface {
+	Run(done <-chan struct{})
+	Capabilities(model string, amsFitted bool) PrinterCapabilities
+	Upload(name string, contents io.Reader) error
+	ListFiles() ([]PrinterFile, error)
+	DeleteFile(name string) error
+	Pause() error
+	Resume() error
+	Stop() error
+	SetLight(on bool) error
+}
+
+// newPrinterDriver picks the driver a printer's settings ask for.
+func newPrinterDriver(p *printer) PrinterDriver {
+	switch p.cfg.Driver {
+	case DriverOctoPrint:
+		return &octoPrintDriver{httpPrinter: newHTTPPrinter(p)}
+	case DriverMoonraker:
+		return &moonrakerDriver{httpPrinter: newHTTPPrinter(p)}
+	case DriverPrusaLink:
+		return &prusaLinkDriver{httpPrinter: newHTTPPrinter(p)}
+	default:
+		return bambuDriver{p: p}
+	}
+}
+
+// protocol is the printer's driver. Printers built directly, as the tests do,
+// are Bambus.
+func (p *printer) protocol() PrinterDriver {
+	if p.driver == nil {
+		return bambuDriver{p: p}
+	}
+	return p.driver
+}
+
+// --- Bambu ----------------------------------------------------------------
+
+// bambuDriver is the original MQTT, FTPS and camera socket code.
+type bambuDriver struct {
+	p *printer
+}
+
+func (d bambuDriver) Run(done <-chan struct{}) {
+	go d.p.runCamera()
+	d.p.runStatus()
+}
+
+func (d bambuDriver) Capabilities(model string, amsFitted bool) PrinterCapabilities {
+	return capabilitiesFor(model, amsFitted)
+}
+
+func (d bambuDriver) Upload(name string, contents io.Reader) error {
+	return d.p.UploadFile(name, contents)
+}
+
+func (d bambuDriver) ListFiles() ([]PrinterFile, error) { return d.p.ListFiles() }
+
+func (d bambuDriver) DeleteFile(name string) error { return d.p.DeleteFile(name) }
+
+func (d bambuDriver) Pause() error {
+	return d.p.publishCommand(fmt.Sprintf(`{"print":{"sequence_id":"%d","command":"pause"}}`, d.p.nextSequence()))
+}
+
+func (d bambuDriver) Resume() error {
+	return d.p.publishCommand(fmt.Sprintf(`{"print":{"sequence_id":"%d","command":"resume"}}`, d.p.nextSequence()))
+}
+
+func (d bambuDriver) Stop() error {
+	return d.p.publishCommand(fmt.Sprintf(`{"print":{"sequence_id":"%d","command":"stop"}}`, d.p.nextSequence()))
+}
+
+func (d bambuDriver) SetLight(on bool) error {
+	mode := "off"
+	if on {
+		mode = "on"
+	}
+	return d.p.publishCommand(fmt.Sprintf(
+		`{"system":{"sequence_id":"%d","command":"ledctrl","led_node":"%s","led_mode":"%s","led_on_time":500,"led_off_time":500,"loop_times":0,"interval_time":0}}`,
+		d.p.nextSequence(), d.p.capabilities().Lights[0], mode))
+}
+
+// --- shared state for polled printers --------------------------------------
+
+// driverState is one poll of an HTTP printer, already in Bambu's terms: IDLE,
+// PREPARE, RUNNING, PAUSE, FINISH or FAILED.
+type driverState struct {
+	State            string
+	Progress         int
+	RemainingMinutes int
+	FileName         string
+	NozzleTemp       float64
+	BedTemp          float64
+	ChamberTemp      float64
+}
+
+// applyState is applyReport for printers that are polled rather than
+// reporting themselves. The print log follows the same state changes.
+func (p *printer) applyState(s driverState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped() {
+		return
+	}
+	p.lastReport = time.Now()
+	// An answer at all means the key was accepted
+	p.authFailed = false
+
+	previousState := p.state
+	p.state = s.State
+	p.progress = s.Progress
+	p.remaining = s.RemainingMinutes
+	p.fileName = s.FileName
+	p.gcodeFile = s.FileName
+	p.nozzleTemp = s.NozzleTemp
+	p.bedTemp = s.BedTemp
+	p.chamberTemp = s.ChamberTemp
+
+	p.trackJobLocked(previousState)
+}
+
+// setFrame stores a camera still fetched over HTTP. Anything that is not a
+// JPEG - a login page, an error - is ignored.
+func (p *printer) setFrame(frame []byte) {
+	if len(frame) < 4 || frame[0] != 0xFF || frame[1] != 0xD8 {
+		return
+	}
+	p.mu.Lock()
+	p.lastFrame = frame
+	p.lastFrameAt = time.Now()
+	p.frameVersion++
+	p.mu.Unlock()
+}
+
+// pollCapabilities is what every HTTP printer supports. None of them has a
+// light the site knows how to switch, or a start the site is allowed to send.
+func pollCapabilities(camera string) PrinterCapabilities {
+	return PrinterCapabilities{
+		Camera:   camera,
+		Lights:   []string{},
+		Commands: []string{CommandPause, CommandResume, CommandStop},
+	}
+}
+
+// --- HTTP plumbing -----------------------------------------------------------
+
+// httpPrinter is what the HTTP drivers share: the address, the API key and the
+// polling loop.
+type httpPrinter struct {
+	p      *printer
+	client *http.Client
+}
+
+func newHTTPPrinter(p *printer) httpPrinter {
+	return httpPrinter{p: p, client: &http.Client{Timeout: httpTimeout}}
+}
+
+// url joins a path onto the printer's address. The host setting may be a bare
+// address or a full URL, for a printer behind HTTPS or on another port.
+func (h httpPrinter) url(path string) string {
+	base := h.p.cfg.Host
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+// do sends one request with the API key and decodes a JSON answer into out,
+// when out is given.
+func (h httpPrinter) do(method, path string, body io.Reader, contentType string, out interface{}) error {
+	req, err := http.NewRequest(method, h.url(path), body)
+	if err != nil {
+		return err
+	}
+	if key := h.p.accessCode(); key != "" {
+		req.Header.Set("X-Api-Key", key)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("printer is not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		h.p.setAuthFailed(true)
+		return fmt.Errorf("the printer rejected our API key")
+	}
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("the printer answered %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("could not read the printer's answer: %w", err)
+	}
+	return nil
+}
+
+// snapshot fetches one camera still.
+func (h httpPrinter) snapshot(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, h.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if key := h.p.accessCode(); key != "" {
+		req.Header.Set("X-Api-Key", key)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("camera answered %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+}
+
+// uploadMultipart streams a file as the "file" field of a form, with any
+// extra fields, which is how OctoPrint and Moonraker take uploads.
+func (h httpPrinter) uploadMultipart(path, name string, contents io.Reader, fields map[string]string) error {
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		err := func() error {
+			for key, value := range fields {
+				if err := form.WriteField(key, value); err != nil {
+					return err
+				}
+			}
+			part, err := form.CreateFormFile("file", name)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(part, contents); err != nil {
+				return err
+			}
+			return form.Close()
+		}()
+		writer.CloseWithError(err)
+	}()
+
+	if err := h.do(http.MethodPost, path, reader, form.FormDataContentType(), nil); err != nil {
+		reader.CloseWithError(err)
+		return fmt.Errorf("the printer refused the file: %w", err)
+	}
+	return nil
+}
+
+// poll runs until done closes, applying each state and camera frame. A printer
+// that stops answering goes stale and shows as offline, as a Bambu does.
+func (h httpPrinter) poll(done <-chan struct{}, state func() (driverState, error), frame func() ([]byte, error)) {
+	failing := false
+	for {
+		s, err := state()
+		switch {
+		case err != nil && !failing:
+			log.Printf("printer %s: %v", h.p.cfg.Name, err)
+			failing = true
+		case err == nil:
+			if failing {
+				log.Printf("printer %s: answering again", h.p.cfg.Name)
+			}
+			failing = false
+			h.p.applyState(s)
+		}
+
+		if frame != nil && err == nil {
+			if jpeg, err := frame(); err == nil {
+				h.p.setFrame(jpeg)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(httpPollInterval):
+		}
+	}
+}
+
+// onlyGcode refuses the Bambu formats, which other printers cannot print.
+func onlyGcode(name string) error {
+	_, suffix, _ := splitUploadSuffix(name)
+	if strings.ToLower(suffix) != ".gcode" {
+		return fmt.Errorf("this printer only takes plain .gcode files")
+	}
+	return nil
+}
+
+// percent turns a 0-1 fraction into a whole percentage.
+func percent(fraction float64) int {
+	return int(fraction*100 + 0.5)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// httpTestPrinter points a printer using one of the HTTP drivers at a stand-in
+// server.
+func httpTestPrinter(t *testing.T, driver string, handler http.Handler) *printer {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	p := &printer{cfg: PrinterConfig{ID: "mock", Name: "mock", Host: server.URL, AccessCode: "secret", Driver: driver}}
+	p.driver = newPrinterDriver(p)
+	// Stand-ins change state as soon as they are told to
+	p.settleTimeout = 2 * time.Second
+	return p
+}
+
+// requireKey fails any request without the API key, as the real services do.
+func requireKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func TestNewPrinterDriver(t *testing.T) {
+	for driver, want := range map[string]string{
+		"":              "main.bambuDriver",
+		DriverBambu:     "main.bambuDriver",
+		DriverOctoPrint: "*main.octoPrintDriver",
+		DriverMoonraker: "*main.moonrakerDriver",
+		DriverPrusaLink: "*main.prusaLinkDriver",
+	} {
+		p := &printer{cfg: PrinterConfig{Driver: driver}}
+		if got := fmt.Sprintf("%T", newPrinterDriver(p)); got != want {
+			t.Errorf("driver %q gave %s, want %s", driver, got, want)
+		}
+	}
+}
+
+func TestApplyStateTracksLikeAReport(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{Name: "mock", Driver: DriverMoonraker}}
+	p.driver = newPrinterDriver(p)
+
+	p.applyState(driverState{State: "RUNNING", Progress: 40, RemainingMinutes: 30, FileName: "srinath_bracket.gcode", NozzleTemp: 215})
+	status := p.status()
+	if !status.Online || status.State != "RUNNING" || status.Progress != 40 || status.NozzleTemp != 215 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	if status.Capabilities.Camera != CameraSnapshot || len(status.Capabilities.Lights) != 0 {
+		t.Errorf("unexpected capabilities: %+v", status.Capabilities)
+	}
+	if err := p.setLight(true); err == nil {
+		t.Error("expected an error switching a light the driver does not have")
+	}
+	if _, err := (&PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"": p}}).
+		StartPrint("", "srinath_bracket.gcode", StartPrintOptions{}, "admin", true); err == nil {
+		t.Error("only Bambus can be started from the site")
+	}
+}
+
+func TestOnlyGcode(t *testing.T) {
+	if err := onlyGcode("part.gcode"); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"part.3mf", "part.gcode.3mf"} {
+		if err := onlyGcode(name); err == nil {
+			t.Errorf("%s should be refused", name)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+// Printer events.
+//
+// The printer code already notices when a print ends or a fault appears; this
+// turns those moments into typed events that anything else in the backend can
+// subscribe to. Emitting never blocks the MQTT handler - events are queued and
+// handed to subscribers from a goroutine of their own.
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types. These strings are also what alert subscriptions opt in to.
+const (
+	EventPrintFinished  = "print_finished"
+	EventPrintFailed    = "print_failed"
+	EventPrintStopped   = "print_stopped"
+	EventHMSFault       = "hms_fault"
+	EventPrinterOffline = "printer_offline"
+	// Not tied to one printer: the spool inventory is running out
+	EventFilamentLow = "filament_low"
+	// A job nobody saw end, for the spool inventory. Not worth an alert, so
+	// no subscription can ask for it.
+	EventPrintInterrupted = "print_interrupted"
+)
+
+// eventTypes is every event a subscription may ask for.
+var eventTypes = map[string]bool{
+	EventPrintFinished:  true,
+	EventPrintFailed:    true,
+	EventPrintStopped:   true,
+	EventHMSFault:       true,
+	EventPrinterOffline: true,
+	EventFilamentLow:    true,
+}
+
+// availabilityCheckInterval is how often printers are checked for having gone
+// quiet. Offline is judged by statusStaleAfter, so this only sets how soon
+// after that the event goes out.
+const availabilityCheckInterval = 30 * time.Second
+
+// PrinterEvent is one thing worth telling somebody about.
+type PrinterEvent struct {
+	Type        string    `json:"type"`
+	PrinterID   string    `json:"printer_id"`
+	PrinterName string    `json:"printer_name"`
+	FileName    string    `json:"file_name,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	JobID       uint      `json:"job_id,omitempty"`
+	Fault       *HMSFault `json:"fault,omitempty"`
+	Message     string    `json:"message"`
+	At          time.Time `json:"at"`
+}
+
+// eventBus fans events out to subscribers. A nil bus swallows everything, so
+// printers built without a manager (as in tests) need no special casing.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []func(PrinterEvent)
+	queue       chan PrinterEvent
+}
+
+func newEventBus() *eventBus {
+	b := &eventBus{queue: make(chan PrinterEvent, 256)}
+	go b.run()
+	return b
+}
+
+// Subscribe registers fn to be called with every event, in order.
+func (b *eventBus) Subscribe(fn func(PrinterEvent)) {
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, fn)
+	b.mu.Unlock()
+}
+
+// publish queues an event. Safe to call with a printer's lock held.
+func (b *eventBus) publish(event PrinterEvent) {
+	if b == nil {
+		return
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	select {
+	case b.queue <- event:
+	default:
+		// Subscribers are badly behind; better to lose an alert than to
+		// stall status updates for every printer
+		log.Printf("printer %s: event queue full, dropped %s", event.PrinterName, event.Type)
+	}
+}
+
+func (b *eventBus) run() {
+	for event := range b.queue {
+		b.mu.RLock()
+		subscribers := append([]func(PrinterEvent){}, b.subscribers...)
+		b.mu.RUnlock()
+
+		for _, fn := range subscribers {
+			fn(event)
+		}
+	}
+}
+
+// fileOwner reads whose print a file is from the naming convention in the
+// printer guidelines: the owner's name comes first, before an underscore
+// ("srinath_bracket.3mf"). Returns "" for files that do not follow it.
+func fileOwner(fileName string) string {
+	base, _, ok := splitUploadSuffix(fileName)
+	if !ok {
+		base = fileName
+	}
+	owner, _, found := strings.Cut(base, "_")
+	if !found {
+		return ""
+	}
+	return normalizeOwner(owner)
+}
+
+// normalizeOwner makes one spelling of a person's name out of the many that
+// turn up: "Srinath", "srinath " and "SRINATH" are the same owner, and an email
+// address counts as the name before the @. Letters, digits, dots and dashes are
+// kept, spaces become dashes, anything else is dropped.
+func normalizeOwner(raw string) string {
+	raw, _, _ = strings.Cut(raw, "@")
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(raw)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-.")
+}
+
+// jobOwner is whose a job is, for jobs recorded before the owner was stored.
+func jobOwner(job PrintJob) string {
+	if job.Owner != "" {
+		return job.Owner
+	}
+	return fileOwner(job.FileName)
+}
+
+// jobEventTypes maps a closed job's result to the event it raises.
+var jobEventTypes = map[string]string{
+	"finished":    EventPrintFinished,
+	"failed":      EventPrintFailed,
+	"stopped":     EventPrintStopped,
+	"interrupted": EventPrintInterrupted,
+}
+
+// emitJobEventLocked announces a job that has just ended. Called with the lock
+// held, from closeJobLocked.
+func (p *printer) emitJobEventLocked(job *PrintJob) {
+	eventType, ok := jobEventTypes[job.Result]
+	if !ok {
+		return
+	}
+
+	message := fmt.Sprintf("%s: %s %s", p.cfg.Name, job.FileName, job.Result)
+	if job.StoppedBy != "" {
+		message += " by " + job.StoppedBy
+	}
+
+	p.events.publish(PrinterEvent{
+		Type:        eventType,
+		PrinterID:   p.cfg.ID,
+		PrinterName: p.cfg.Name,
+		FileName:    job.FileName,
+		Owner:       jobOwner(*job),
+		JobID:       job.ID,
+		Message:     message,
+		At:          *job.EndedAt,
+	})
+}
+
+// emitFaultEventLocked announces a new fault, when it is bad enough to need
+// somebody. Called with the lock held.
+func (p *printer) emitFaultEventLocked(record *PrinterFault) {
+	if record.Severity != "fatal" && record.Severity != "serious" {
+		return
+	}
+
+	fault := HMSFault{
+		Code:        record.Code,
+		Severity:    record.Severity,
+		Description: record.Description,
+		URL:         "https://wiki.bambulab.com/en/hms/" + record.Code,
+	}
+	message := fmt.Sprintf("%s: %s fault %s", p.cfg.Name, record.Severity, record.Code)
+	if record.Description != "" {
+		message += " - " + record.Description
+	}
+
+	event := PrinterEvent{
+		Type:        EventHMSFault,
+		PrinterID:   p.cfg.ID,
+		PrinterName: p.cfg.Name,
+		FileName:    record.FileName,
+		Owner:       fileOwner(record.FileName),
+		Fault:       &fault,
+		Message:     message,
+		At:          record.FirstSeenAt,
+	}
+	if record.PrintJobID != nil {
+		event.JobID = *record.PrintJobID
+	}
+	p.events.publish(event)
+}
+
+// Subscribe registers fn for every printer event.
+func (m *PrinterManager) Subscribe(fn func(PrinterEvent)) {
+	if m.events == nil {
+		return
+	}
+	m.events.Subscribe(fn)
+}
+
+// watchAvailability raises printer_offline when a printer that was reporting
+// goes quiet, and logs every change in whether the printers can be reached
+// (see printer_availability.go). Printers that were never seen are not
+// announced - they are simply switched off.
+func (m *PrinterManager) watchAvailability() {
+	last := make(map[string]availability)
+	ticker := time.NewTicker(availabilityCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.checkAvailability(last)
+	}
+}
+
+// checkAvailability compares every printer against the last check.
+func (m *PrinterManager) checkAvailability(last map[string]availability) {
+	now := time.Now()
+	for _, p := range m.list() {
+		status := p.status()
+		prev, seen := last[p.cfg.ID]
+		if seen && prev.Online && !status.Online {
+			p.events.publish(PrinterEvent{
+				Type:        EventPrinterOffline,
+				PrinterID:   p.cfg.ID,
+				PrinterName: p.cfg.Name,
+				Message: fmt.Sprintf("%s stopped reporting - it may be switched off or off the network",
+					p.cfg.Name),
+			})
+		}
+
+		kinds, next := availabilityChanges(prev, seen, status)
+		for _, kind := range kinds {
+			at := now
+			// It went quiet when it last reported, not when that was noticed
+			if seenAt := p.lastReportAt(); kind == AvailabilityOffline && !seenAt.IsZero() {
+				at = seenAt
+			}
+			m.recordAvailability(p, kind, availabilityDetail(kind), at)
+		}
+		last[p.cfg.ID] = next
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+// Events and alerts. The bus is exercised the way the printer uses it, and the
+// webhook delivery runs against a local HTTP server standing in for ntfy.sh or
+// similar.
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestFileOwner(t *testing.T) {
+	for name, want := range map[string]string{
+		"srinath_bracket.gcode.3mf": "srinath",
+		"Srinath_bracket.3mf":       "srinath",
+		"bracket.3mf":               "",
+		"":                          "",
+		"SRINATH!_bracket.3mf":      "srinath",
+		"_bracket.3mf":              "",
+	} {
+		if got := fileOwner(name); got != want {
+			t.Errorf("fileOwner(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNormalizeOwner(t *testing.T) {
+	for raw, want := range map[string]string{
+		" Srinath ":    "srinath",
+		"Srinath K":    "srinath-k",
+		"a.kumar":      "a.kumar",
+		"<script>":     "script",
+		"--":           "",
+		"ravi_teja@ii": "raviteja",
+	} {
+		if got := normalizeOwner(raw); got != want {
+			t.Errorf("normalizeOwner(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func waitForEvent(t *testing.T, events <-chan PrinterEvent) PrinterEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event was published")
+		return PrinterEvent{}
+	}
+}
+
+func subscribedPrinter() (*printer, <-chan PrinterEvent) {
+	bus := newEventBus()
+	events := make(chan PrinterEvent, 10)
+	bus.Subscribe(func(event PrinterEvent) { events <- event })
+	return &printer{cfg: PrinterConfig{ID: "p1", Name: "mock"}, events: bus}, events
+}
+
+// Only faults that need somebody are announced; an info-level one is noise.
+func TestSeriousFaultRaisesEvent(t *testing.T) {
+	p, events := subscribedPrinter()
+
+	// 0x00040001 is info, 0x00020001 serious
+	p.applyReport([]byte(`{"print":{"hms":[{"attr":117448704,"code":262145}]}}`))
+	p.applyReport([]byte(`{"print":{"hms":[
+		{"attr":117448704,"code":262145},
+		{"attr":117448704,"code":131073}
+	]}}`))
+
+	event := waitForEvent(t, events)
+	if event.Type != EventHMSFault || event.Fault == nil {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if event.Fault.Code != "HMS_0700_2000_0002_0001" || event.Fault.Severity != "serious" {
+		t.Errorf("wrong fault announced: %+v", event.Fault)
+	}
+
+	select {
+	case extra := <-events:
+		t.Errorf("the info fault should not have been announced: %+v", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Jobs nobody saw end still reach the spool inventory, once it is listening,
+// but nobody can be alerted about them
+func TestOrphanedJobsAreAnnounced(t *testing.T) {
+	p, events := subscribedPrinter()
+	end := time.Now()
+	m := &PrinterManager{events: p.events, orphanedJobs: []PrintJob{
+		{Model: gorm.Model{ID: 7}, PrinterName: "mock", FileName: "asha_bracket.3mf", Result: "interrupted", EndedAt: &end},
+	}}
+
+	m.AnnounceOrphanedJobs()
+	event := waitForEvent(t, events)
+	if event.Type != EventPrintInterrupted || event.JobID != 7 || event.Owner != "asha" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if jobResultFor(event.Type) != "interrupted" {
+		t.Error("the spool inventory would not take the job off its spools")
+	}
+	if eventTypes[EventPrintInterrupted] {
+		t.Error("interrupted jobs are not worth an alert")
+	}
+
+	m.AnnounceOrphanedJobs()
+	select {
+	case extra := <-events:
+		t.Errorf("orphans should be announced once, got %+v", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPrinterGoingQuietRaisesOffline(t *testing.T) {
+	p, events := subscribedPrinter()
+	var logged []PrinterAvailabilityEvent
+	db := dryRunDB(t, nil)
+	db.Callback().Create().After("gorm:create").Register("test:availability", func(tx *gorm.DB) {
+		if event, ok := tx.Statement.Dest.(*PrinterAvailabilityEvent); ok {
+			logged = append(logged, *event)
+		}
+	})
+	m := &PrinterManager{printers: []*printer{p}, db: db}
+
+	p.applyReport([]byte(`{"print":{"gcode_state":"IDLE"}}`))
+	last := map[string]availability{}
+	m.checkAvailability(last)
+
+	lastReport := time.Now().Add(-statusStaleAfter - time.Minute)
+	p.mu.Lock()
+	p.lastReport = lastReport
+	p.mu.Unlock()
+	m.checkAvailability(last)
+
+	if event := waitForEvent(t, events); event.Type != EventPrinterOffline {
+		t.Errorf("expected printer_offline, got %+v", event)
+	}
+	// The outage runs from the last report, not from when it was noticed
+	if n := len(logged); n != 2 || logged[1].Kind != AvailabilityOffline || !logged[1].At.Equal(lastReport) {
+		t.Errorf("logged %+v", logged)
+	}
+
+	// Still offline next time round is not a new event
+	m.checkAvailability(last)
+	select {
+	case extra := <-events:
+		t.Errorf("offline should be announced once, got %+v", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlertSubscriptionMatching(t *testing.T) {
+	finished := PrinterEvent{Type: EventPrintFinished, Owner: "srinath"}
+
+	owner := AlertSubscription{Kind: "owner", Name: "srinath", Events: "print_finished,print_failed"}
+	if !owner.matches(finished) {
+		t.Error("an owner should hear about their own finished print")
+	}
+	someoneElse := AlertSubscription{Kind: "owner", Name: "priya", Events: "print_finished"}
+	if someoneElse.matches(finished) {
+		t.Error("an owner must not hear about other people's prints")
+	}
+	notOptedIn := AlertSubscription{Kind: "admin", Name: "admin", Events: "hms_fault"}
+	if notOptedIn.matches(finished) {
+		t.Error("a subscriber should only get the events they opted in to")
+	}
+	webhook := AlertSubscription{Kind: "webhook", URL: "https://example.org", Events: "print_finished"}
+	if !webhook.matches(finished) {
+		t.Error("a webhook should get every event it opted in to")
+	}
+}
+
+func TestNormalizeAlertSubscription(t *testing.T) {
+	s := AlertSubscription{Kind: " Owner ", Name: "Srinath", Events: "print_finished, hms_fault"}
+	if err := normalizeAlertSubscription(&s); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Kind != "owner" || s.Name != "srinath" || s.Events != "print_finished,hms_fault" {
+		t.Errorf("not normalised: %+v", s)
+	}
+
+	for _, bad := range []AlertSubscription{
+		{Kind: "owner", Events: "print_finished"},
+		{Kind: "webhook", Events: "print_finished"},
+		{Kind: "webhook", URL: "file:///etc/passwd", Events: "print_finished"},
+		{Kind: "admin", Name: "admin", Events: "print_exploded"},
+		{Kind: "admin", Name: "admin", Events: ""},
+		{Kind: "pigeon", Name: "x", Events: "print_finished"},
+	} {
+		if err := normalizeAlertSubscription(&bad); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan PrinterEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event PrinterEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("content type = %q", r.Header.Get("Content-Type"))
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	d := &alertDispatcher{client: server.Client()}
+	event := PrinterEvent{Type: EventPrintFailed, PrinterName: "mock", Message: "mock: bracket failed"}
+	if err := d.post(server.URL, event); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+
+	got := <-received
+	if got.Type != EventPrintFailed || got.Message != event.Message {
+		t.Errorf("webhook got %+v", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := d.post(failing.URL, event); err == nil {
+		t.Error("a failing endpoint should be reported")
+	}
+}
+
+// Webhooks wait for a worker rather than each getting a goroutine, and a
+// backlog that is full drops rather than blocks the event bus
+func TestWebhookQueue(t *testing.T) {
+	d := &alertDispatcher{webhooks: make(chan webhookDelivery, 1)}
+	event := PrinterEvent{Type: EventPrintFailed, PrinterName: "mock"}
+
+	done := make(chan struct{})
+	go func() {
+		d.queueWebhook(webhookDelivery{target: "https://example.org/a", event: event})
+		d.queueWebhook(webhookDelivery{target: "https://example.org/b", event: event})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queueing a webhook blocked")
+	}
+
+	if n := len(d.webhooks); n != 1 {
+		t.Fatalf("%d webhooks queued", n)
+	}
+	if queued := <-d.webhooks; queued.target != "https://example.org/a" {
+		t.Errorf("kept %s rather than the first", queued.target)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+// HMS fault history.
+//
+// The printer only ever reports the faults it has *now*; once one clears it is
+// gone from the report. Each occurrence is kept here instead - when it first
+// appeared, when it was last seen, when it cleared, and which print was running
+// - so a fault that came and went overnight still leaves a trace for whoever
+// opens the lab in the morning.
+//
+// Codes are turned into words from a table bundled with the backend. Bambu adds
+// codes with each firmware, so admins can upload a newer table; uploaded
+// entries are stored and win over the bundled ones.
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// faultSeenSaveInterval limits how often a fault that is still present has its
+// last-seen time written back. Reports arrive every second or so while
+// printing; the history does not need that resolution.
+const faultSeenSaveInterval = time.Minute
+
+// PrinterFault is one occurrence of an HMS fault: from the report it first
+// appeared in to the report it was gone from.
+type PrinterFault struct {
+	gorm.Model
+	PrinterID   string     `json:"printer_id" gorm:"index"`
+	PrinterName string     `json:"printer_name"`
+	Code        string     `json:"code" gorm:"index"`
+	Severity    string     `json:"severity"`
+	Description string     `json:"description"`
+	FirstSeenAt time.Time  `json:"first_seen_at"`
+	LastSeenAt  time.Time  `json:"last_seen_at"`
+	ClearedAt   *time.Time `json:"cleared_at"`
+	// The print that was running when the fault appeared, if any
+	PrintJobID *uint  `json:"print_job_id" gorm:"index"`
+	FileName   string `json:"file_name"`
+	// An admin confirming they have seen it, and what they did about it
+	AcknowledgedBy  string     `json:"acknowledged_by"`
+	AcknowledgedAt  *time.Time `json:"acknowledged_at"`
+	AcknowledgeNote string     `json:"acknowledge_note"`
+}
+
+// HMSDescription is one entry of an uploaded code table. It overrides the
+// bundled text for the same code.
+type HMSDescription struct {
+	gorm.Model
+	Code string `gorm:"uniqueIndex"`
+	Text string
+}
+
+//go:embed hms_codes.json
+var bundledHMSCodes []byte
+
+// hmsDescriptions maps a normalised code to its text.
+var hmsDescriptions = struct {
+	sync.RWMutex
+	byCode map[string]string
+}{byCode: map[string]string{}}
+
+func init() {
+	table, err := parseHMSTable(bundledHMSCodes)
+	if err != nil {
+		log.Printf("Bundled HMS code table is unreadable: %v", err)
+		return
+	}
+	mergeHMSDescriptions(table)
+}
+
+// normalizeHMSCode reduces the ways a code gets written - "HMS_0300_0100_0001_0001",
+// "0300_0100_0001_0001", Bambu's own "0300010000010001" - to one key.
+func normalizeHMSCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	code = strings.TrimPrefix(code, "HMS_")
+	code = strings.ReplaceAll(code, "_", "")
+	code = strings.ReplaceAll(code, "-", "")
+	if len(code) != 16 {
+		return ""
+	}
+	for _, r := range code {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'F') {
+			return ""
+		}
+	}
+	return code
+}
+
+// parseHMSTable reads a code table in either of two shapes: a flat
+// {"HMS_0300_0100_0001_0001": "text"} object, or the list Bambu publishes for
+// its apps, {"data":{"device_hms":{"en":[{"ecode":"...","intro":"..."}]}}}.
+func parseHMSTable(raw []byte) (map[string]string, error) {
+	var published struct {
+		Data struct {
+			DeviceHMS struct {
+				EN []struct {
+					Ecode string `json:"ecode"`
+					Intro string `json:"intro"`
+				} `json:"en"`
+			} `json:"device_hms"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &published); err == nil && len(published.Data.DeviceHMS.EN) > 0 {
+		table := make(map[string]string, len(published.Data.DeviceHMS.EN))
+		for _, entry := range published.Data.DeviceHMS.EN {
+			if key := normalizeHMSCode(entry.Ecode); key != "" && strings.TrimSpace(entry.Intro) != "" {
+				table[key] = strings.TrimSpace(entry.Intro)
+			}
+		}
+		return table, nil
+	}
+
+	var flat map[string]string
+	if err := json.Unmarshal(raw, &flat); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of code to description: %w", err)
+	}
+
+	table := make(map[string]string, len(flat))
+	for code, text := range flat {
+		key := normalizeHMSCode(code)
+		if key == "" {
+			return nil, fmt.Errorf("%q is not an HMS code", code)
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			table[key] = text
+		}
+	}
+	return table, nil
+}
+
+func mergeHMSDescriptions(table map[string]string) {
+	hmsDescriptions.Lock()
+	defer hmsDescriptions.Unlock()
+	for code, text := range table {
+		hmsDescriptions.byCode[code] = text
+	}
+}
+
+// describeHMS returns the human-readable text for a code, or "" when the table
+// does not know it - the wiki link still works for those.
+func describeHMS(code string) string {
+	hmsDescriptions.RLock()
+	defer hmsDescriptions.RUnlock()
+	return hmsDescriptions.byCode[normalizeHMSCode(code)]
+}
+
+// loadHMSDescriptions applies the table uploaded by an admin, if any, on top of
+// the bundled one.
+func loadHMSDescriptions(db *gorm.DB) {
+	var saved []HMSDescription
+	if err := db.Find(&saved).Error; err != nil || len(saved) == 0 {
+		return
+	}
+	table := make(map[string]string, len(saved))
+	for _, entry := range saved {
+		table[entry.Code] = entry.Text
+	}
+	mergeHMSDescriptions(table)
+	log.Printf("Loaded %d HMS descriptions saved from the admin page", len(saved))
+}
+
+// --- recording occurrences ---------------------------------------------
+
+// recordFaultsLocked opens a history row for every fault that is new in this
+// report, keeps the last-seen time of those still present, and closes the ones
+// that have gone. Called with the lock held, before the job tracker runs, so a
+// fault that arrives with the FAILED state is still tied to the failed job.
+func (p *printer) recordFaultsLocked(current []HMSFault, now time.Time) {
+	if p.openFaults == nil {
+		p.openFaults = make(map[string]*PrinterFault)
+		// Faults still open from before a restart carry on rather than being
+		// recorded a second time
+		if p.jobs != nil {
+			var open []PrinterFault
+			p.jobs.Where("printer_id = ? AND cleared_at IS NULL", p.cfg.ID).Find(&open)
+			for i := range open {
+				p.openFaults[open[i].Code] = &open[i]
+			}
+		}
+	}
+
+	present := make(map[string]bool, len(current))
+	for _, fault := range current {
+		present[fault.Code] = true
+
+		if record, ok := p.openFaults[fault.Code]; ok {
+			record.LastSeenAt = now
+			// Only the column this owns: an admin may have acknowledged
+			// the fault since it was loaded
+			if p.jobs != nil && now.Sub(record.UpdatedAt) >= faultSeenSaveInterval {
+				p.jobs.Model(record).Update("last_seen_at", now)
+			}
+			continue
+		}
+
+		record := &PrinterFault{
+			PrinterID:   p.cfg.ID,
+			PrinterName: p.cfg.Name,
+			Code:        fault.Code,
+			Severity:    fault.Severity,
+			Description: fault.Description,
+			FirstSeenAt: now,
+			LastSeenAt:  now,
+		}
+		if p.currentJob != nil {
+			jobID := p.currentJob.ID
+			record.PrintJobID = &jobID
+			record.FileName = p.currentJob.FileName
+		}
+		if p.jobs != nil {
+			if err := p.jobs.Create(record).Error; err != nil {
+				log.Printf("printer %s: could not record fault %s: %v", p.cfg.Name, fault.Code, err)
+			}
+		}
+		p.openFaults[fault.Code] = record
+		log.Printf("printer %s: HMS fault %s (%s)", p.cfg.Name, fault.Code, fault.Severity)
+		p.emitFaultEventLocked(record)
+	}
+
+	for code, record := range p.openFaults {
+		if present[code] {
+			continue
+		}
+		cleared := now
+		record.ClearedAt = &cleared
+		if p.jobs != nil {
+			p.jobs.Model(record).Update("cleared_at", cleared)
+		}
+		delete(p.openFaults, code)
+	}
+}
+
+// --- manager wrappers ---------------------------------------------------
+
+// AcknowledgeFault marks a recorded fault as seen by an admin, with a note on
+// what was done about it.
+func (m *PrinterManager) AcknowledgeFault(id uint, adminName, note string) (PrinterFault, error) {
+	var fault PrinterFault
+	if m.db == nil {
+		return fault, fmt.Errorf("fault history is not available")
+	}
+	if err := m.db.First(&fault, id).Error; err != nil {
+		return fault, fmt.Errorf("fault not found")
+	}
+
+	now := time.Now()
+	fault.AcknowledgedBy = adminName
+	fault.AcknowledgedAt = &now
+	fault.AcknowledgeNote = strings.TrimSpace(note)
+	// The printer may be saving when it was last seen, or that it cleared,
+	// at the same time
+	err := m.db.Model(&fault).Updates(map[string]interface{}{
+		"acknowledged_by":  fault.AcknowledgedBy,
+		"acknowledged_at":  fault.AcknowledgedAt,
+		"acknowledge_note": fault.AcknowledgeNote,
+	}).Error
+	if err != nil {
+		return fault, fmt.Errorf("could not save the acknowledgement: %w", err)
+	}
+	return fault, nil
+}
+
+// UpdateHMSDescriptions stores an uploaded code table and applies it straight
+// away. Returns how many codes it described.
+func (m *PrinterManager) UpdateHMSDescriptions(raw []byte) (int, error) {
+	table, err := parseHMSTable(raw)
+	if err != nil {
+		return 0, err
+	}
+	if len(table) == 0 {
+		return 0, fmt.Errorf("the table has no descriptions in it")
+	}
+
+	if m.db != nil {
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			for code, text := range table {
+				entry := HMSDescription{Code: code, Text: text}
+				if err := tx.Where(HMSDescription{Code: code}).
+					Assign(HMSDescription{Text: text}).
+					FirstOrCreate(&entry).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("could not save the code table: %w", err)
+		}
+	}
+
+	mergeHMSDescriptions(table)
+	return len(table), nil
+}
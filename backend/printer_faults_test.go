@@ -0,0 +1,146 @@
+package main
+
+// The fault history is the part of HMS handling a printer cannot give us: the
+// printer forgets a fault the moment it clears. These tests pin down when an
+// occurrence opens and closes, without a real database behind it.
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestNormalizeHMSCode(t *testing.T) {
+	for input, want := range map[string]string{
+		"HMS_0300_0100_0001_0001": "0300010000010001",
+		"0300_0100_0001_0001":     "0300010000010001",
+		"0300010000010001":        "0300010000010001",
+		"hms_0c00_0300_0003_0008": "0C00030000030008",
+		"HMS_0300_0100":           "",
+		"HMS_0300_0100_0001_000Z": "",
+		"":                        "",
+	} {
+		if got := normalizeHMSCode(input); got != want {
+			t.Errorf("normalizeHMSCode(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestBundledHMSTableDescribesCodes(t *testing.T) {
+	if describeHMS("HMS_0700_2000_0002_0001") == "" {
+		t.Error("the bundled table should describe a run-out AMS slot")
+	}
+	if got := describeHMS("HMS_0FFF_FFFF_FFFF_FFFF"); got != "" {
+		t.Errorf("an unknown code should have no description, got %q", got)
+	}
+}
+
+// Admins upload either a flat object or the list Bambu publishes for its apps.
+func TestParseHMSTableFormats(t *testing.T) {
+	flat, err := parseHMSTable([]byte(`{"HMS_0300_0400_0002_0001":"Part fan stopped."}`))
+	if err != nil {
+		t.Fatalf("flat table: %v", err)
+	}
+	if flat["0300040000020001"] != "Part fan stopped." {
+		t.Errorf("flat table not read: %v", flat)
+	}
+
+	published, err := parseHMSTable([]byte(`{"data":{"device_hms":{"en":[
+		{"ecode":"0300040000020001","intro":"Part fan stopped."},
+		{"ecode":"junk","intro":"ignored"}
+	]}}}`))
+	if err != nil {
+		t.Fatalf("published table: %v", err)
+	}
+	if len(published) != 1 || published["0300040000020001"] != "Part fan stopped." {
+		t.Errorf("published table not read: %v", published)
+	}
+
+	if _, err := parseHMSTable([]byte(`{"not a code":"text"}`)); err == nil {
+		t.Error("expected an error for a key that is not an HMS code")
+	}
+	if _, err := parseHMSTable([]byte(`not json`)); err == nil {
+		t.Error("expected an error for garbage")
+	}
+}
+
+func TestFaultHistoryOpensAndClears(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{ID: "p1", Name: "mock"}}
+
+	p.applyReport([]byte(`{"print":{"hms":[
+		{"attr":117448704,"code":131073}
+	]}}`))
+
+	status := p.status()
+	if len(status.Faults) != 1 {
+		t.Fatalf("expected one live fault, got %+v", status.Faults)
+	}
+	if status.Faults[0].Description == "" {
+		t.Error("the live fault should carry its description")
+	}
+
+	p.mu.RLock()
+	record, ok := p.openFaults[status.Faults[0].Code]
+	p.mu.RUnlock()
+	if !ok {
+		t.Fatal("a new fault should open a history record")
+	}
+	if record.FirstSeenAt.IsZero() || record.ClearedAt != nil {
+		t.Errorf("open record has the wrong timestamps: %+v", record)
+	}
+
+	// The same fault again is the same occurrence, not a new one
+	p.applyReport([]byte(`{"print":{"hms":[{"attr":117448704,"code":131073}]}}`))
+	p.mu.RLock()
+	again := p.openFaults[status.Faults[0].Code]
+	p.mu.RUnlock()
+	if again != record {
+		t.Error("a fault still present must not open a second record")
+	}
+
+	// A report without the hms field says nothing about faults
+	p.applyReport([]byte(`{"print":{"nozzle_temper":200}}`))
+	if record.ClearedAt != nil {
+		t.Error("a report without hms must not clear anything")
+	}
+
+	// An empty list means it has cleared
+	p.applyReport([]byte(`{"print":{"hms":[]}}`))
+	if record.ClearedAt == nil {
+		t.Error("the fault should be marked cleared")
+	}
+	p.mu.RLock()
+	remaining := len(p.openFaults)
+	p.mu.RUnlock()
+	if remaining != 0 {
+		t.Errorf("cleared faults should leave no open records, got %d", remaining)
+	}
+}
+
+// Refreshing when a fault was last seen writes only that, so it cannot undo
+// an acknowledgement saved in the meantime
+func TestFaultLastSeenLeavesTheAcknowledgement(t *testing.T) {
+	db := dryRunDB(t, nil)
+	var updates []string
+	db.Callback().Update().After("gorm:update").Register("test:faults", func(tx *gorm.DB) {
+		updates = append(updates, tx.Statement.SQL.String())
+	})
+	code := "HMS_0700_2000_0002_0001"
+	p := &printer{cfg: PrinterConfig{ID: "p1", Name: "mock"}, jobs: db, openFaults: map[string]*PrinterFault{
+		code: {Model: gorm.Model{ID: 3, UpdatedAt: time.Now().Add(-time.Hour)}, Code: code},
+	}}
+
+	p.applyReport([]byte(`{"print":{"hms":[{"attr":117448704,"code":131073}]}}`))
+	p.applyReport([]byte(`{"print":{"hms":[]}}`))
+
+	if len(updates) != 2 {
+		t.Fatalf("expected the last-seen and cleared updates, got %q", updates)
+	}
+	for _, sql := range updates {
+		if strings.Contains(sql, "acknowledge") {
+			t.Errorf("wrote the acknowledgement back: %s", sql)
+		}
+	}
+}
@@ -10,10 +10,10 @@ package main
 // This deliberately only *uploads*. Nothing here starts a print: somebody
 // walks to the machine, checks the plate is clear, and picks the file on the
 // screen. That keeps a human in the loop for the one action that can crash a
-// toolhead into somebody else's finished print.
+// toolhead into somebody else's finished print. The admin-only start in
+// printer_start.go keeps that human too - it needs the plate confirmed clear.
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io"
 	"path"
@@ -128,12 +128,10 @@ func (p *printer) connectFTP() (*ftp.ServerConn, error) {
 		ftp.DialWithTimeout(ftpTimeout),
 	}
 
-	// Printers use implicit TLS with a self-signed certificate. Tests run
-	// against a plain server, so this is switchable.
+	// Printers use implicit TLS with a self-signed certificate, pinned like
+	// the others. Tests run against a plain server, so this is switchable.
 	if !p.ftpPlaintext {
-		options = append(options, ftp.DialWithTLS(&tls.Config{
-			InsecureSkipVerify: true, // #nosec G402 - self-signed printer cert
-		}))
+		options = append(options, ftp.DialWithTLS(p.tlsConfig()))
 	}
 
 	conn, err := ftp.Dial(p.ftpAddress(), options...)
@@ -187,25 +185,44 @@ func (p *printer) UploadFile(name string, contents io.Reader) error {
 	}
 
 	if stored != counted.n {
-		if delErr := conn.Delete(name); delErr != nil {
-			return fmt.Errorf(
-				"only %d of %d bytes reached the printer, and the partial file "+
-					"could not be removed - delete %s from the printer before printing: %w",
-				stored, counted.n, name, delErr)
-		}
-		return fmt.Errorf(
-			"only %d of %d bytes reached the printer, so the file was removed - please send it again",
-			stored, counted.n)
+		partial := &PartialUploadError{Name: name, Stored: stored, Sent: counted.n}
+		partial.DeleteErr = conn.Delete(name)
+		return partial
 	}
 
 	return nil
 }
 
+// PartialUploadError is an upload that did not all arrive. The partial file is
+// removed when possible, so the upload history can say which happened.
+type PartialUploadError struct {
+	Name         string
+	Stored, Sent int64
+	// Why the partial file could not be removed, when it could not
+	DeleteErr error
+}
+
+func (e *PartialUploadError) Error() string {
+	if e.DeleteErr != nil {
+		return fmt.Sprintf(
+			"only %d of %d bytes reached the printer, and the partial file "+
+				"could not be removed - delete %s from the printer before printing: %v",
+			e.Stored, e.Sent, e.Name, e.DeleteErr)
+	}
+	return fmt.Sprintf(
+		"only %d of %d bytes reached the printer, so the file was removed - please send it again",
+		e.Stored, e.Sent)
+}
+
+func (e *PartialUploadError) Unwrap() error { return e.DeleteErr }
+
 // PrinterFile is one file already on a printer.
 type PrinterFile struct {
 	Name string `json:"name"`
 	Size uint64 `json:"size"`
 	Time string `json:"time"`
+	// What the slicer said about it, for files uploaded through the site
+	Sliced *SlicedFile `json:"sliced,omitempty"`
 }
 
 // ListFiles reports the printable files already on the printer.
@@ -287,40 +304,181 @@ func (p *printer) isPrinting(name string) bool {
 
 // --- manager wrappers ---------------------------------------------------
 
-func (m *PrinterManager) UploadFile(id, name string, contents io.Reader) (string, error) {
-	p, ok := m.byID[id]
+// UploadOptions are the choices a sender makes alongside the file.
+type UploadOptions struct {
+	// Whose print it is. Empty falls back to the file name's owner part.
+	Owner string
+	// Send it even though the filament it needs is not loaded, because the
+	// sender is about to load it
+	IgnoreFilament bool
+	// Who sent it and from where, for the upload history. SentBy is the
+	// admin when it went through the queue; uploads from the page are
+	// anonymous apart from the owner and address.
+	SentBy   string
+	ClientIP string
+	Via      string
+	// What to do when somebody else's file already has the name:
+	// ConflictSuffix (the default) or ConflictRefuse
+	OnConflict string
+	// The size and SHA-256 when they are already known - a staged upload has
+	// been checked against them - so the file is not read an extra time
+	Size   int64
+	SHA256 string
+}
+
+// UploadResult is what a successful upload reports back.
+type UploadResult struct {
+	FileName string   `json:"file_name"`
+	Warnings []string `json:"warnings,omitempty"`
+	// The same file was already on the printer, so nothing was sent
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+func (m *PrinterManager) UploadFile(id, name string, contents io.Reader, opts UploadOptions) (result UploadResult, err error) {
+	p, ok := m.lookup(id)
+	if !ok {
+		return result, fmt.Errorf("unknown printer")
+	}
+
+	// Every attempt past this point is written to the upload history, refused
+	// or not
+	record := newUploadRecord(id, name, opts)
+	defer func() { m.saveUploadRecord(record, err) }()
+
+	safe, err := sanitizeUploadName(name)
+	if err != nil {
+		return result, err
+	}
+	record.FileName = safe
+	record.Owner = uploadOwner(safe, opts)
+
+	meta, thumbnail, warnings, err := m.checkUpload(p, safe, contents, opts)
+	if err != nil {
+		return result, err
+	}
+
+	// Without the printer's file list there is no telling whose file would
+	// be overwritten, so nothing is sent
+	files, err := p.protocol().ListFiles()
+	if err != nil {
+		return result, fmt.Errorf("could not list the files on %s to check the name is free: %w", p.cfg.Name, err)
+	}
+
+	hashed := record.hash(contents)
+	place, err := m.placeUpload(p, files, safe, record.Owner, record.SHA256, record.Size, opts.OnConflict)
+	if err != nil {
+		record.Outcome = UploadRefused
+		return result, err
+	}
+	record.FileName = place.Name
+	if place.Duplicate {
+		record.Outcome = UploadDuplicate
+		return UploadResult{FileName: place.Name, Warnings: warnings, Duplicate: true}, nil
+	}
+	if place.Renamed {
+		warnings = append(warnings, fmt.Sprintf(
+			"%s already has somebody else's %s, so yours was saved as %s", p.cfg.Name, safe, place.Name))
+	}
+
+	if err := p.protocol().Upload(place.Name, hashed); err != nil {
+		return result, err
+	}
+	record.finishHash(hashed)
+
+	m.saveSlicedFile(newSlicedFile(id, place.Name, record.Owner, meta, thumbnail))
+	return UploadResult{FileName: place.Name, Warnings: warnings}, nil
+}
+
+// PrecheckUpload runs the checks UploadFile would, without sending anything,
+// so a file that is going to be refused is refused while its sender is still
+// there rather than when a background send gets to it. A refusal goes in the
+// upload history; the file is rewound either way.
+func (m *PrinterManager) PrecheckUpload(id, name string, contents io.ReadSeeker, opts UploadOptions) (warnings []string, err error) {
+	p, ok := m.lookup(id)
 	if !ok {
-		return "", fmt.Errorf("unknown printer")
+		return nil, fmt.Errorf("unknown printer")
 	}
 
+	record := newUploadRecord(id, name, opts)
+	defer func() {
+		if err != nil {
+			m.saveUploadRecord(record, err)
+		}
+	}()
+
 	safe, err := sanitizeUploadName(name)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	record.FileName = safe
+	record.Owner = uploadOwner(safe, opts)
+
+	_, _, warnings, err = m.checkUpload(p, safe, contents, opts)
+	if _, seekErr := contents.Seek(0, io.SeekStart); err == nil && seekErr != nil {
+		err = fmt.Errorf("could not read the uploaded file")
+	}
+	return warnings, err
+}
+
+// uploadOwner is whose file it is: the sender's say, or else the owner part
+// of the name.
+func uploadOwner(safe string, opts UploadOptions) string {
+	if owner := normalizeOwner(opts.Owner); owner != "" {
+		return owner
+	}
+	return fileOwner(safe)
+}
+
+// checkUpload is everything that can turn a file away before it is sent:
+// the printer being out of service or busy with a file of that name, and the
+// file itself not suiting it.
+func (m *PrinterManager) checkUpload(p *printer, safe string, contents io.Reader, opts UploadOptions) (*SliceMetadata, []byte, []string, error) {
+	if err := p.inService(); err != nil {
+		return nil, nil, nil, err
 	}
 
 	if p.isPrinting(safe) {
-		return "", fmt.Errorf(
+		return nil, nil, nil, fmt.Errorf(
 			"%s is printing right now - rename your file or wait for it to finish", safe)
 	}
 
-	if err := p.UploadFile(safe, contents); err != nil {
-		return "", err
+	meta, thumbnail, err := inspectUpload(contents)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkSliceCompatibility(p.sliceConfig(), meta); err != nil {
+		return nil, nil, nil, err
+	}
+	warnings, err := m.checkLoadedFilament(p, meta, opts.IgnoreFilament)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	return safe, nil
+	return meta, thumbnail, warnings, nil
 }
 
 func (m *PrinterManager) ListFiles(id string) ([]PrinterFile, error) {
-	p, ok := m.byID[id]
+	p, ok := m.lookup(id)
 	if !ok {
 		return nil, fmt.Errorf("unknown printer")
 	}
-	return p.ListFiles()
+
+	files, err := p.protocol().ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	sliced := m.slicedFiles(id)
+	for i := range files {
+		if record, ok := sliced[files[i].Name]; ok {
+			files[i].Sliced = &record
+		}
+	}
+	return files, nil
 }
 
 func (m *PrinterManager) DeleteFile(id, name string) error {
-	p, ok := m.byID[id]
+	p, ok := m.lookup(id)
 	if !ok {
 		return fmt.Errorf("unknown printer")
 	}
-	return p.DeleteFile(name)
+	return p.protocol().DeleteFile(name)
 }
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
 )
 
 func ftpTestAddr(t *testing.T) string {
@@ -28,3 +34,52 @@ func splitHostPort(t *testing.T, addr string) (string, int) {
 	}
 	return parts[0], port
 }
+
+// dryRunPool stands in for a database connection. It can open transactions,
+// but every statement sent through it fails, so a dry-run database never
+// needs it and any other shows what happens when the database is down.
+type dryRunPool struct{}
+
+func (*dryRunPool) PrepareContext(context.Context, string) (*sql.Stmt, error) {
+	return nil, fmt.Errorf("dry run")
+}
+func (*dryRunPool) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, fmt.Errorf("dry run")
+}
+func (*dryRunPool) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, fmt.Errorf("dry run")
+}
+func (*dryRunPool) QueryRowContext(context.Context, string, ...interface{}) *sql.Row { return nil }
+func (p *dryRunPool) BeginTx(context.Context, *sql.TxOptions) (gorm.ConnPool, error) {
+	return p, nil
+}
+func (*dryRunPool) Commit() error   { return nil }
+func (*dryRunPool) Rollback() error { return nil }
+
+// dryRunDB is a database that builds statements without running them, so job
+// tracking can be followed without a server. Every command logged is passed
+// to logged.
+func dryRunDB(t *testing.T, logged func(PrintJobAction)) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: &dryRunPool{}}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Callback().Create().After("gorm:create").Register("test:actions", func(tx *gorm.DB) {
+		if action, ok := tx.Statement.Dest.(*PrintJobAction); ok && logged != nil {
+			logged(*action)
+		}
+	})
+	return db
+}
+
+// failingDB is a database whose every query fails.
+func failingDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: &dryRunPool{}}), &gorm.Config{DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
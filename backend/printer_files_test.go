@@ -179,13 +179,13 @@ func TestManagerUploadPath(t *testing.T) {
 
 	// A browser sends the whole path on some platforms; the manager must
 	// reduce it to a bare name before it reaches the printer
-	name, err := m.UploadFile("printer-1", "C:\\Users\\srinath\\Desktop\\srinath bracket.3mf",
-		bytes.NewReader([]byte("plate")))
+	result, err := m.UploadFile("printer-1", "C:\\Users\\srinath\\Desktop\\srinath bracket.3mf",
+		bytes.NewReader([]byte("plate")), UploadOptions{})
 	if err != nil {
 		t.Fatalf("upload through the manager failed: %v", err)
 	}
-	if name != "srinath_bracket.3mf" {
-		t.Errorf("stored name = %q, want srinath_bracket.3mf", name)
+	if result.FileName != "srinath_bracket.3mf" {
+		t.Errorf("stored name = %q, want srinath_bracket.3mf", result.FileName)
 	}
 
 	files, err := m.ListFiles("printer-1")
@@ -210,12 +210,12 @@ func TestManagerUploadPath(t *testing.T) {
 	}
 
 	// Unknown printers must be refused rather than panicking
-	if _, err := m.UploadFile("nope", "x.3mf", bytes.NewReader(nil)); err == nil {
+	if _, err := m.UploadFile("nope", "x.3mf", bytes.NewReader(nil), UploadOptions{}); err == nil {
 		t.Error("expected an error for an unknown printer")
 	}
 
 	// The wrong sort of file never reaches the printer at all
-	if _, err := m.UploadFile("printer-1", "notes.txt", bytes.NewReader(nil)); err == nil {
+	if _, err := m.UploadFile("printer-1", "notes.txt", bytes.NewReader(nil), UploadOptions{}); err == nil {
 		t.Error("expected .txt to be refused")
 	}
 }
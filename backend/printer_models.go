@@ -0,0 +1,213 @@
+package main
+
+// What each printer model can do.
+//
+// The printer code grew up around the lab's P1S: a JPEG camera on port 6000, a
+// chamber light and an enclosure. Other Bambu models differ. The X1 series
+// streams its camera over RTSP instead, the A1s are open-frame with no chamber
+// and no light, and the P1P has no enclosure. Each printer's model is taken
+// from its settings when an admin has given one, otherwise from its serial
+// number, otherwise from what the printer says in answer to get_version.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Camera transports.
+const (
+	CameraJPEG     = "jpeg"     // the port-6000 JPEG stream of the P1 and A1 series
+	CameraRTSP     = "rtsp"     // the X1 series, which the site cannot show
+	CameraSnapshot = "snapshot" // a webcam still fetched over HTTP
+	CameraNone     = "none"
+)
+
+// Printer commands, as listed in PrinterCapabilities.
+const (
+	CommandPrint  = "print"
+	CommandPause  = "pause"
+	CommandResume = "resume"
+	CommandStop   = "stop"
+	CommandLight  = "light"
+)
+
+// PrinterCapabilities is what the site can show and send for one printer.
+type PrinterCapabilities struct {
+	Camera string `json:"camera"`
+	// An enclosed printer; only the X1 series measures the chamber temperature
+	Enclosed    bool     `json:"enclosed"`
+	ChamberTemp bool     `json:"chamber_temp"`
+	Lights      []string `json:"lights"`
+	// Whether an AMS is fitted, as the printer last reported
+	AMS      bool     `json:"ams"`
+	Commands []string `json:"commands"`
+}
+
+// modelProfile is the fixed part of a model's capabilities.
+type modelProfile struct {
+	camera      string
+	enclosed    bool
+	chamberTemp bool
+	lights      []string
+}
+
+// printerModels is keyed by normalizeModel.
+var printerModels = map[string]modelProfile{
+	"X1":     {camera: CameraRTSP, enclosed: true, chamberTemp: true, lights: []string{"chamber_light"}},
+	"X1C":    {camera: CameraRTSP, enclosed: true, chamberTemp: true, lights: []string{"chamber_light"}},
+	"X1E":    {camera: CameraRTSP, enclosed: true, chamberTemp: true, lights: []string{"chamber_light"}},
+	"P1S":    {camera: CameraJPEG, enclosed: true, lights: []string{"chamber_light"}},
+	"P1P":    {camera: CameraJPEG, lights: []string{"chamber_light"}},
+	"A1":     {camera: CameraJPEG},
+	"A1MINI": {camera: CameraJPEG},
+}
+
+// unknownModel is used until the model is known. It is what the site always
+// assumed, and shows whatever temperatures the printer sends.
+var unknownModel = modelProfile{camera: CameraJPEG, enclosed: true, chamberTemp: true, lights: []string{"chamber_light"}}
+
+// serialPrefixes are the first three characters of Bambu serial numbers.
+var serialPrefixes = map[string]string{
+	"00M": "X1C",
+	"03W": "X1E",
+	"01S": "P1P",
+	"01P": "P1S",
+	"030": "A1 mini",
+	"039": "A1",
+}
+
+// modelFromSerial guesses the model from a serial number, or returns "".
+func modelFromSerial(serial string) string {
+	if len(serial) < 3 {
+		return ""
+	}
+	return serialPrefixes[strings.ToUpper(serial[:3])]
+}
+
+// productNames maps the product_name in a get_version answer to a model, most
+// specific first.
+var productNames = []struct{ name, model string }{
+	{"X1 CARBON", "X1C"},
+	{"X1E", "X1E"},
+	{"X1", "X1"},
+	{"P1S", "P1S"},
+	{"P1P", "P1P"},
+	{"A1 MINI", "A1 mini"},
+	{"A1", "A1"},
+}
+
+// versionModule is one entry of a get_version answer.
+type versionModule struct {
+	Name        string `json:"name"`
+	ProductName string `json:"product_name"`
+	SN          string `json:"sn"`
+}
+
+// modelFromVersion reads the model out of a get_version answer, or returns "".
+func modelFromVersion(modules []versionModule) string {
+	for _, module := range modules {
+		name := strings.ToUpper(module.ProductName)
+		for _, product := range productNames {
+			if strings.Contains(name, product.name) {
+				return product.model
+			}
+		}
+	}
+	// Older firmware leaves product_name out; the main board's serial will do
+	for _, module := range modules {
+		if model := modelFromSerial(module.SN); model != "" {
+			return model
+		}
+	}
+	return ""
+}
+
+// knownModel reports whether the site has a profile for a model name.
+func knownModel(model string) bool {
+	_, ok := printerModels[normalizeModel(model)]
+	return ok
+}
+
+// capabilitiesFor builds a model's capabilities.
+func capabilitiesFor(model string, amsFitted bool) PrinterCapabilities {
+	profile, ok := printerModels[normalizeModel(model)]
+	if !ok {
+		profile = unknownModel
+	}
+
+	caps := PrinterCapabilities{
+		Camera:      profile.camera,
+		Enclosed:    profile.enclosed,
+		ChamberTemp: profile.chamberTemp,
+		Lights:      append([]string{}, profile.lights...),
+		AMS:         amsFitted,
+		Commands:    []string{CommandPrint, CommandPause, CommandResume, CommandStop},
+	}
+	if len(caps.Lights) > 0 {
+		caps.Commands = append(caps.Commands, CommandLight)
+	}
+	caps.Commands = append(caps.Commands, CommandTemperature, CommandFan, CommandSpeed, CommandGcode)
+	return caps
+}
+
+// modelLocked is the printer's model: as configured, as reported, or as its
+// serial suggests. Empty when none of them knows. Callers hold p.mu.
+func (p *printer) modelLocked() string {
+	if p.cfg.Model != "" {
+		return p.cfg.Model
+	}
+	if p.reportedModel != "" {
+		return p.reportedModel
+	}
+	return modelFromSerial(p.cfg.Serial)
+}
+
+func (p *printer) model() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.modelLocked()
+}
+
+func (p *printer) capabilitiesLocked() PrinterCapabilities {
+	return p.protocol().Capabilities(p.modelLocked(), len(p.amsUnits) > 0)
+}
+
+func (p *printer) capabilities() PrinterCapabilities {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.capabilitiesLocked()
+}
+
+// sliceConfig is the printer's settings with the model filled in, for checking
+// uploads against.
+func (p *printer) sliceConfig() PrinterConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cfg := p.cfg
+	cfg.Model = p.modelLocked()
+	return cfg
+}
+
+// needsVersion reports whether the printer should be asked what it is.
+func (p *printer) needsVersion() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg.Model == "" && p.reportedModel == ""
+}
+
+// supports checks a command against the printer's capabilities.
+func (p *printer) supports(command string) error {
+	for _, c := range p.capabilities().Commands {
+		if c == command {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not support that (%s)", p.cfg.Name, describeModel(p.model()))
+}
+
+func describeModel(model string) string {
+	if model == "" {
+		return "unknown model"
+	}
+	return model
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestModelDetection(t *testing.T) {
+	if got := modelFromSerial("01P00A411600279"); got != "P1S" {
+		t.Errorf("P1S serial read as %q", got)
+	}
+	if got := modelFromSerial("XYZ"); got != "" {
+		t.Errorf("unknown serial read as %q", got)
+	}
+
+	modules := []versionModule{{Name: "ota", ProductName: "Bambu Lab A1 mini"}}
+	if got := modelFromVersion(modules); got != "A1 mini" {
+		t.Errorf("A1 mini read as %q", got)
+	}
+	modules = []versionModule{{Name: "ota", ProductName: "Bambu Lab X1 Carbon"}}
+	if got := modelFromVersion(modules); got != "X1C" {
+		t.Errorf("X1 Carbon read as %q", got)
+	}
+	// No product name: fall back to a module's serial
+	modules = []versionModule{{Name: "mc", SN: "03W00X123456789"}}
+	if got := modelFromVersion(modules); got != "X1E" {
+		t.Errorf("X1E serial read as %q", got)
+	}
+}
+
+func TestCapabilitiesFor(t *testing.T) {
+	x1 := capabilitiesFor("X1C", true)
+	if x1.Camera != CameraRTSP || !x1.ChamberTemp || !x1.AMS {
+		t.Errorf("unexpected X1C capabilities: %+v", x1)
+	}
+
+	a1 := capabilitiesFor("A1 mini", false)
+	if a1.Camera != CameraJPEG || a1.Enclosed || len(a1.Lights) != 0 {
+		t.Errorf("unexpected A1 mini capabilities: %+v", a1)
+	}
+	for _, c := range a1.Commands {
+		if c == CommandLight {
+			t.Error("an A1 has no light to switch")
+		}
+	}
+
+	// Until the model is known, assume what the site always did
+	if unknown := capabilitiesFor("", false); unknown.Camera != CameraJPEG || len(unknown.Lights) != 1 {
+		t.Errorf("unexpected fallback capabilities: %+v", unknown)
+	}
+}
+
+func TestGetVersionSetsModel(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{Name: "3DP-04", Serial: "unknown"}}
+	if !p.needsVersion() || p.model() != "" {
+		t.Fatal("the model should start unknown")
+	}
+
+	p.applyReport([]byte(`{"info":{"command":"get_version","module":[
+		{"name":"ota","product_name":"Bambu Lab P1P","sn":"01S00C123456789"}
+	]}}`))
+
+	status := p.status()
+	if status.Model != "P1P" || status.Capabilities.Enclosed || p.needsVersion() {
+		t.Errorf("unexpected status after get_version: %+v", status)
+	}
+	if cfg := p.sliceConfig(); cfg.Model != "P1P" {
+		t.Errorf("uploads should be checked against the detected model, got %q", cfg.Model)
+	}
+
+	// A configured model wins over the printer's answer
+	p.cfg.Model = "P1S"
+	if p.model() != "P1S" {
+		t.Errorf("configured model ignored: %q", p.model())
+	}
+}
+
+func TestChamberTempOnlyWhereMeasured(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{Name: "3DP-04", Model: "P1S"}}
+	p.applyReport([]byte(`{"print":{"chamber_temper":5}}`))
+	if status := p.status(); status.ChamberTemp != 0 || status.Capabilities.ChamberTemp {
+		t.Errorf("a P1S has no chamber sensor: %+v", status)
+	}
+}
+
+func TestLightRefusedWithoutOne(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{Name: "3DP-04", Model: "A1"}}
+	if err := p.setLight(true); err == nil {
+		t.Error("expected an error switching the light on an A1")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+// Moonraker, the API in front of Klipper. One objects query gives the job, its
+// progress and the temperatures; files live under the "gcodes" root.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type moonrakerDriver struct {
+	httpPrinter
+}
+
+func (d *moonrakerDriver) Run(done <-chan struct{}) {
+	d.poll(done, d.state, func() ([]byte, error) { return d.snapshot(defaultSnapshotPath) })
+}
+
+func (d *moonrakerDriver) Capabilities(string, bool) PrinterCapabilities {
+	return pollCapabilities(CameraSnapshot)
+}
+
+// moonrakerStates maps Klipper's print_stats state. A cancelled job leaves the
+// printer idle, which the print log reads as stopped.
+var moonrakerStates = map[string]string{
+	"standby":   "IDLE",
+	"printing":  "RUNNING",
+	"paused":    "PAUSE",
+	"complete":  "FINISH",
+	"cancelled": "IDLE",
+	"error":     "FAILED",
+}
+
+func (d *moonrakerDriver) state() (driverState, error) {
+	var answer struct {
+		Result struct {
+			Status struct {
+				PrintStats struct {
+					State         string  `json:"state"`
+					Filename      string  `json:"filename"`
+					PrintDuration float64 `json:"print_duration"`
+				} `json:"print_stats"`
+				VirtualSDCard struct {
+					Progress float64 `json:"progress"`
+				} `json:"virtual_sdcard"`
+				Extruder struct {
+					Temperature float64 `json:"temperature"`
+				} `json:"extruder"`
+				HeaterBed struct {
+					Temperature float64 `json:"temperature"`
+				} `json:"heater_bed"`
+			} `json:"status"`
+		} `json:"result"`
+	}
+	path := "/printer/objects/query?print_stats&virtual_sdcard&extruder&heater_bed"
+	if err := d.do(http.MethodGet, path, nil, "", &answer); err != nil {
+		return driverState{}, err
+	}
+
+	status := answer.Result.Status
+	s := driverState{
+		State:      moonrakerStates[status.PrintStats.State],
+		FileName:   status.PrintStats.Filename,
+		Progress:   percent(status.VirtualSDCard.Progress),
+		NozzleTemp: status.Extruder.Temperature,
+		BedTemp:    status.HeaterBed.Temperature,
+	}
+	if s.State == "" {
+		s.State = "IDLE"
+	}
+	// Klipper does not estimate the time left; scale what has elapsed
+	if progress := status.VirtualSDCard.Progress; s.State == "RUNNING" && progress > 0 {
+		elapsed := status.PrintStats.PrintDuration
+		s.RemainingMinutes = int((elapsed/progress - elapsed) / 60)
+	}
+	return s, nil
+}
+
+func (d *moonrakerDriver) Upload(name string, contents io.Reader) error {
+	if err := onlyGcode(name); err != nil {
+		return err
+	}
+	return d.uploadMultipart("/server/files/upload", name, contents, map[string]string{"root": "gcodes"})
+}
+
+func (d *moonrakerDriver) ListFiles() ([]PrinterFile, error) {
+	var listing struct {
+		Result []struct {
+			Path     string  `json:"path"`
+			Modified float64 `json:"modified"`
+			Size     uint64  `json:"size"`
+		} `json:"result"`
+	}
+	if err := d.do(http.MethodGet, "/server/files/list?root=gcodes", nil, "", &listing); err != nil {
+		return nil, fmt.Errorf("could not list the printer's files: %w", err)
+	}
+
+	files := make([]PrinterFile, 0, len(listing.Result))
+	for _, f := range listing.Result {
+		files = append(files, PrinterFile{
+			Name: f.Path,
+			Size: f.Size,
+			Time: time.Unix(int64(f.Modified), 0).Local().Format("2006-01-02 15:04"),
+		})
+	}
+	return files, nil
+}
+
+func (d *moonrakerDriver) DeleteFile(name string) error {
+	safe, err := sanitizeUploadName(name)
+	if err != nil {
+		return err
+	}
+	if err := d.do(http.MethodDelete, "/server/files/gcodes/"+url.PathEscape(safe), nil, "", nil); err != nil {
+		return fmt.Errorf("could not delete %s: %w", safe, err)
+	}
+	return nil
+}
+
+func (d *moonrakerDriver) Pause() error {
+	return d.do(http.MethodPost, "/printer/print/pause", nil, "", nil)
+}
+
+func (d *moonrakerDriver) Resume() error {
+	return d.do(http.MethodPost, "/printer/print/resume", nil, "", nil)
+}
+
+func (d *moonrakerDriver) Stop() error {
+	return d.do(http.MethodPost, "/printer/print/cancel", nil, "", nil)
+}
+
+func (d *moonrakerDriver) SetLight(bool) error {
+	return fmt.Errorf("Klipper lights are macros the site does not know")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMoonrakerDriver(t *testing.T) {
+	var posted []string
+	var uploadRoot, deleted string
+	printState := "printing"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/printer/objects/query", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"result":{"status":{
+			"print_stats":{"state":"`+printState+`","filename":"srinath_bracket.gcode","print_duration":1800},
+			"virtual_sdcard":{"progress":0.25},
+			"extruder":{"temperature":240.2},
+			"heater_bed":{"temperature":80}}}}`)
+	})
+	for _, action := range []string{"pause", "resume", "cancel"} {
+		after := map[string]string{"pause": "paused", "resume": "printing", "cancel": "cancelled"}[action]
+		mux.HandleFunc("/printer/print/"+action, func(w http.ResponseWriter, r *http.Request) {
+			posted = append(posted, r.URL.Path)
+			printState = after
+			io.WriteString(w, `{"result":"ok"}`)
+		})
+	}
+	mux.HandleFunc("/server/files/upload", func(w http.ResponseWriter, r *http.Request) {
+		uploadRoot = r.FormValue("root")
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/server/files/list", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"result":[{"path":"srinath_bracket.gcode","modified":1760000000.5,"size":2048}]}`)
+	})
+	mux.HandleFunc("/server/files/gcodes/", func(w http.ResponseWriter, r *http.Request) {
+		deleted = strings.TrimPrefix(r.URL.Path, "/server/files/gcodes/")
+		io.WriteString(w, `{"result":{}}`)
+	})
+
+	// Moonraker is usually run without a key
+	p := httpTestPrinter(t, DriverMoonraker, mux)
+	p.cfg.AccessCode = ""
+	driver := p.driver.(*moonrakerDriver)
+
+	state, err := driver.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A quarter done after 30 minutes leaves 90
+	if state.State != "RUNNING" || state.Progress != 25 || state.RemainingMinutes != 90 || state.NozzleTemp != 240.2 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+	p.applyState(state)
+
+	if err := p.pause("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.resume("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.stop("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(posted, ",") != "/printer/print/pause,/printer/print/resume,/printer/print/cancel" {
+		t.Errorf("unexpected commands: %v", posted)
+	}
+
+	printState = "complete"
+	if state, _ := driver.state(); state.State != "FINISH" {
+		t.Errorf("a complete job read as %s", state.State)
+	}
+
+	if err := driver.Upload("srinath_clip.gcode", strings.NewReader("G28")); err != nil || uploadRoot != "gcodes" {
+		t.Errorf("unexpected upload: root %q (%v)", uploadRoot, err)
+	}
+	if err := driver.Upload("srinath_clip.3mf", strings.NewReader("PK")); err == nil {
+		t.Error("a 3mf should be refused")
+	}
+	files, err := driver.ListFiles()
+	if err != nil || len(files) != 1 || files[0].Size != 2048 {
+		t.Errorf("unexpected files: %+v (%v)", files, err)
+	}
+	if err := driver.DeleteFile("srinath_bracket.gcode"); err != nil || deleted != "srinath_bracket.gcode" {
+		t.Errorf("unexpected delete: %q (%v)", deleted, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+// OctoPrint, as run on a Raspberry Pi next to a Prusa or Ender. Status comes
+// from /api/printer and /api/job, files live in OctoPrint's local storage, and
+// the webcam still is whatever the install serves at the usual path.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type octoPrintDriver struct {
+	httpPrinter
+}
+
+func (d *octoPrintDriver) Run(done <-chan struct{}) {
+	d.poll(done, d.state, func() ([]byte, error) { return d.snapshot(defaultSnapshotPath) })
+}
+
+func (d *octoPrintDriver) Capabilities(string, bool) PrinterCapabilities {
+	return pollCapabilities(CameraSnapshot)
+}
+
+// state reads the printer and the job. OctoPrint answers 409 for the printer
+// when it has lost its serial connection, which counts as offline.
+func (d *octoPrintDriver) state() (driverState, error) {
+	var printer struct {
+		Temperature map[string]struct {
+			Actual float64 `json:"actual"`
+		} `json:"temperature"`
+		State struct {
+			Flags struct {
+				Printing   bool `json:"printing"`
+				Pausing    bool `json:"pausing"`
+				Paused     bool `json:"paused"`
+				Cancelling bool `json:"cancelling"`
+				Error      bool `json:"error"`
+			} `json:"flags"`
+		} `json:"state"`
+	}
+	if err := d.do(http.MethodGet, "/api/printer", nil, "", &printer); err != nil {
+		return driverState{}, err
+	}
+
+	var job struct {
+		Job struct {
+			File struct {
+				Name string `json:"name"`
+			} `json:"file"`
+		} `json:"job"`
+		Progress struct {
+			Completion    *float64 `json:"completion"`
+			PrintTimeLeft *int     `json:"printTimeLeft"`
+		} `json:"progress"`
+	}
+	if err := d.do(http.MethodGet, "/api/job", nil, "", &job); err != nil {
+		return driverState{}, err
+	}
+
+	s := driverState{
+		FileName:    job.Job.File.Name,
+		NozzleTemp:  printer.Temperature["tool0"].Actual,
+		BedTemp:     printer.Temperature["bed"].Actual,
+		ChamberTemp: printer.Temperature["chamber"].Actual,
+	}
+	if job.Progress.Completion != nil {
+		s.Progress = int(*job.Progress.Completion + 0.5)
+	}
+	if job.Progress.PrintTimeLeft != nil {
+		s.RemainingMinutes = *job.Progress.PrintTimeLeft / 60
+	}
+
+	flags := printer.State.Flags
+	switch {
+	case flags.Error:
+		s.State = "FAILED"
+	case flags.Paused || flags.Pausing:
+		s.State = "PAUSE"
+	case flags.Printing || flags.Cancelling:
+		s.State = "RUNNING"
+	case s.FileName != "" && s.Progress >= 100:
+		// OctoPrint keeps the last job loaded; at 100% it finished
+		s.State = "FINISH"
+	default:
+		s.State = "IDLE"
+	}
+	return s, nil
+}
+
+func (d *octoPrintDriver) Upload(name string, contents io.Reader) error {
+	if err := onlyGcode(name); err != nil {
+		return err
+	}
+	return d.uploadMultipart("/api/files/local", name, contents, nil)
+}
+
+func (d *octoPrintDriver) ListFiles() ([]PrinterFile, error) {
+	var listing struct {
+		Files []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+			Size uint64 `json:"size"`
+			Date int64  `json:"date"`
+		} `json:"files"`
+	}
+	if err := d.do(http.MethodGet, "/api/files/local", nil, "", &listing); err != nil {
+		return nil, fmt.Errorf("could not list the printer's files: %w", err)
+	}
+
+	files := make([]PrinterFile, 0, len(listing.Files))
+	for _, f := range listing.Files {
+		if f.Type != "machinecode" {
+			continue
+		}
+		files = append(files, PrinterFile{
+			Name: f.Name,
+			Size: f.Size,
+			Time: time.Unix(f.Date, 0).Local().Format("2006-01-02 15:04"),
+		})
+	}
+	return files, nil
+}
+
+func (d *octoPrintDriver) DeleteFile(name string) error {
+	safe, err := sanitizeUploadName(name)
+	if err != nil {
+		return err
+	}
+	if err := d.do(http.MethodDelete, "/api/files/local/"+url.PathEscape(safe), nil, "", nil); err != nil {
+		return fmt.Errorf("could not delete %s: %w", safe, err)
+	}
+	return nil
+}
+
+func (d *octoPrintDriver) command(body string) error {
+	return d.do(http.MethodPost, "/api/job", strings.NewReader(body), "application/json", nil)
+}
+
+func (d *octoPrintDriver) Pause() error {
+	return d.command(`{"command":"pause","action":"pause"}`)
+}
+
+func (d *octoPrintDriver) Resume() error {
+	return d.command(`{"command":"pause","action":"resume"}`)
+}
+
+func (d *octoPrintDriver) Stop() error {
+	return d.command(`{"command":"cancel"}`)
+}
+
+func (d *octoPrintDriver) SetLight(bool) error {
+	return fmt.Errorf("OctoPrint has no light the site can switch")
+}
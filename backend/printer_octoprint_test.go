@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// octoPrintStandIn answers like OctoPrint mid-print and records what it is
+// sent.
+type octoPrintStandIn struct {
+	commands []string
+	uploaded string
+	deleted  string
+	paused   bool
+	stopped  bool
+}
+
+func (o *octoPrintStandIn) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/printer", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		flags := `"printing":true,"paused":false`
+		switch {
+		case o.stopped:
+			flags = `"printing":false,"paused":false`
+		case o.paused:
+			flags = `"printing":false,"paused":true`
+		}
+		io.WriteString(w, `{"temperature":{"tool0":{"actual":214.8},"bed":{"actual":60.1}},
+			"state":{"text":"Printing","flags":{`+flags+`}}}`)
+	}))
+	mux.HandleFunc("/api/job", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body, _ := io.ReadAll(r.Body)
+			o.commands = append(o.commands, string(body))
+			o.paused = strings.Contains(string(body), `"pause"`)
+			o.stopped = strings.Contains(string(body), `"cancel"`)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		io.WriteString(w, `{"job":{"file":{"name":"srinath_bracket.gcode"}},
+			"progress":{"completion":42.4,"printTimeLeft":1800},"state":"Printing"}`)
+	}))
+	mux.HandleFunc("/api/files/local", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			contents, _ := io.ReadAll(file)
+			o.uploaded = header.Filename + ":" + string(contents)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		io.WriteString(w, `{"files":[
+			{"name":"srinath_bracket.gcode","type":"machinecode","size":1234,"date":1760000000},
+			{"name":"models","type":"folder"}]}`)
+	}))
+	mux.HandleFunc("/api/files/local/", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		o.deleted = strings.TrimPrefix(r.URL.Path, "/api/files/local/")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return mux
+}
+
+func TestOctoPrintDriver(t *testing.T) {
+	standIn := &octoPrintStandIn{}
+	p := httpTestPrinter(t, DriverOctoPrint, standIn.handler())
+	driver := p.driver.(*octoPrintDriver)
+
+	state, err := driver.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.applyState(state)
+	status := p.status()
+	if status.State != "RUNNING" || status.Progress != 42 || status.RemainingMinutes != 30 ||
+		status.FileName != "srinath_bracket.gcode" || status.NozzleTemp != 214.8 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// Each command is confirmed by reading the state back
+	if err := p.pause("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if state := p.status().State; state != "PAUSE" {
+		t.Errorf("a paused job read as %s", state)
+	}
+	if err := p.stop("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if len(standIn.commands) != 2 || !strings.Contains(standIn.commands[0], `"pause"`) ||
+		!strings.Contains(standIn.commands[1], `"cancel"`) {
+		t.Errorf("unexpected commands: %v", standIn.commands)
+	}
+
+	if err := driver.Upload("srinath_clip.gcode", strings.NewReader("G28")); err != nil {
+		t.Fatal(err)
+	}
+	if standIn.uploaded != "srinath_clip.gcode:G28" {
+		t.Errorf("unexpected upload: %q", standIn.uploaded)
+	}
+
+	files, err := driver.ListFiles()
+	if err != nil || len(files) != 1 || files[0].Name != "srinath_bracket.gcode" || files[0].Size != 1234 {
+		t.Errorf("unexpected files: %+v (%v)", files, err)
+	}
+	if err := driver.DeleteFile("srinath_bracket.gcode"); err != nil || standIn.deleted != "srinath_bracket.gcode" {
+		t.Errorf("unexpected delete: %q (%v)", standIn.deleted, err)
+	}
+}
+
+func TestOctoPrintRejectedKey(t *testing.T) {
+	p := httpTestPrinter(t, DriverOctoPrint, (&octoPrintStandIn{}).handler())
+	p.cfg.AccessCode = "wrong"
+
+	if _, err := p.driver.(*octoPrintDriver).state(); err == nil {
+		t.Fatal("expected an error with the wrong key")
+	}
+	if !p.status().AccessCodeProblem {
+		t.Error("a rejected key should show as an access code problem")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+// PrusaLink, built into the MK4, MINI and XL firmware. Version 1 of its API
+// gives the printer and job together; files go on the USB stick. PrusaLink
+// has no camera of its own - Prusa's cameras report to Prusa Connect instead.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type prusaLinkDriver struct {
+	httpPrinter
+}
+
+func (d *prusaLinkDriver) Run(done <-chan struct{}) {
+	d.poll(done, d.state, nil)
+}
+
+func (d *prusaLinkDriver) Capabilities(string, bool) PrinterCapabilities {
+	return pollCapabilities(CameraNone)
+}
+
+// prusaLinkStates maps PrusaLink's printer state. ATTENTION is a print held
+// up waiting for someone, such as a filament runout, so it reads as paused.
+var prusaLinkStates = map[string]string{
+	"IDLE":      "IDLE",
+	"READY":     "IDLE",
+	"BUSY":      "PREPARE",
+	"PRINTING":  "RUNNING",
+	"PAUSED":    "PAUSE",
+	"ATTENTION": "PAUSE",
+	"FINISHED":  "FINISH",
+	"STOPPED":   "IDLE",
+	"ERROR":     "FAILED",
+}
+
+type prusaLinkStatus struct {
+	Printer struct {
+		State      string  `json:"state"`
+		TempNozzle float64 `json:"temp_nozzle"`
+		TempBed    float64 `json:"temp_bed"`
+	} `json:"printer"`
+	Job *struct {
+		ID            int     `json:"id"`
+		Progress      float64 `json:"progress"`
+		TimeRemaining int     `json:"time_remaining"`
+	} `json:"job"`
+}
+
+func (d *prusaLinkDriver) status() (prusaLinkStatus, error) {
+	var status prusaLinkStatus
+	err := d.do(http.MethodGet, "/api/v1/status", nil, "", &status)
+	return status, err
+}
+
+func (d *prusaLinkDriver) state() (driverState, error) {
+	status, err := d.status()
+	if err != nil {
+		return driverState{}, err
+	}
+
+	s := driverState{
+		State:      prusaLinkStates[status.Printer.State],
+		NozzleTemp: status.Printer.TempNozzle,
+		BedTemp:    status.Printer.TempBed,
+	}
+	if s.State == "" {
+		s.State = "IDLE"
+	}
+
+	if status.Job != nil {
+		s.Progress = int(status.Job.Progress + 0.5)
+		s.RemainingMinutes = status.Job.TimeRemaining / 60
+
+		// The file name is only in the job itself
+		var job struct {
+			File struct {
+				Name        string `json:"name"`
+				DisplayName string `json:"display_name"`
+			} `json:"file"`
+		}
+		if err := d.do(http.MethodGet, "/api/v1/job", nil, "", &job); err == nil {
+			s.FileName = job.File.DisplayName
+			if s.FileName == "" {
+				s.FileName = job.File.Name
+			}
+		}
+	}
+	return s, nil
+}
+
+func (d *prusaLinkDriver) Upload(name string, contents io.Reader) error {
+	if err := onlyGcode(name); err != nil {
+		return err
+	}
+	// PrusaLink takes the file as the whole body, and refuses to overwrite
+	// unless asked
+	req, err := http.NewRequest(http.MethodPut, d.url("/api/v1/files/usb/"+url.PathEscape(name)), contents)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", d.p.accessCode())
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Overwrite-File", "?1")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("printer is not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		d.p.setAuthFailed(true)
+		return fmt.Errorf("the printer rejected our API key")
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the printer refused the file: %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *prusaLinkDriver) ListFiles() ([]PrinterFile, error) {
+	var listing struct {
+		Children []struct {
+			Name        string `json:"name"`
+			DisplayName string `json:"display_name"`
+			Type        string `json:"type"`
+			Size        uint64 `json:"size"`
+			Timestamp   int64  `json:"m_timestamp"`
+		} `json:"children"`
+	}
+	if err := d.do(http.MethodGet, "/api/v1/files/usb/", nil, "", &listing); err != nil {
+		return nil, fmt.Errorf("could not list the printer's files: %w", err)
+	}
+
+	files := make([]PrinterFile, 0, len(listing.Children))
+	for _, f := range listing.Children {
+		if f.Type == "FOLDER" {
+			continue
+		}
+		// The stick is FAT, so Name is an 8.3 alias; the long name is what
+		// was uploaded
+		name := f.DisplayName
+		if name == "" {
+			name = f.Name
+		}
+		files = append(files, PrinterFile{
+			Name: name,
+			Size: f.Size,
+			Time: time.Unix(f.Timestamp, 0).Local().Format("2006-01-02 15:04"),
+		})
+	}
+	return files, nil
+}
+
+func (d *prusaLinkDriver) DeleteFile(name string) error {
+	safe, err := sanitizeUploadName(name)
+	if err != nil {
+		return err
+	}
+	if err := d.do(http.MethodDelete, "/api/v1/files/usb/"+url.PathEscape(safe), nil, "", nil); err != nil {
+		return fmt.Errorf("could not delete %s: %w", safe, err)
+	}
+	return nil
+}
+
+// job sends a command to the running job, which PrusaLink addresses by id.
+func (d *prusaLinkDriver) job(method, action string) error {
+	status, err := d.status()
+	if err != nil {
+		return err
+	}
+	if status.Job == nil {
+		return fmt.Errorf("nothing is printing right now")
+	}
+	path := "/api/v1/job/" + strconv.Itoa(status.Job.ID) + action
+	return d.do(method, path, nil, "", nil)
+}
+
+func (d *prusaLinkDriver) Pause() error { return d.job(http.MethodPut, "/pause") }
+
+func (d *prusaLinkDriver) Resume() error { return d.job(http.MethodPut, "/resume") }
+
+func (d *prusaLinkDriver) Stop() error { return d.job(http.MethodDelete, "") }
+
+func (d *prusaLinkDriver) SetLight(bool) error {
+	return fmt.Errorf("PrusaLink has no light the site can switch")
+}
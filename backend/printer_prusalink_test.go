@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPrusaLinkDriver(t *testing.T) {
+	var calls []string
+	var uploaded, overwrite string
+	printerState := "PRINTING"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"printer":{"state":"`+printerState+`","temp_nozzle":215,"temp_bed":60},
+			"job":{"id":17,"progress":63.0,"time_remaining":1200}}`)
+	}))
+	mux.HandleFunc("/api/v1/job", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":17,"file":{"name":"SRINAT~1.GCO","display_name":"srinath_bracket.gcode"}}`)
+	}))
+	mux.HandleFunc("/api/v1/job/", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodDelete:
+			printerState = "STOPPED"
+		case strings.HasSuffix(r.URL.Path, "/pause"):
+			printerState = "PAUSED"
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("/api/v1/files/usb/", requireKey(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			uploaded = strings.TrimPrefix(r.URL.Path, "/api/v1/files/usb/") + ":" + string(body)
+			overwrite = r.Header.Get("Overwrite-File")
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			calls = append(calls, r.Method+" "+r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			io.WriteString(w, `{"children":[
+				{"name":"SRINAT~1.GCO","display_name":"srinath_bracket.gcode","type":"PRINT_FILE","size":4096,"m_timestamp":1760000000},
+				{"name":"OLD","type":"FOLDER"}]}`)
+		}
+	}))
+
+	p := httpTestPrinter(t, DriverPrusaLink, mux)
+	driver := p.driver.(*prusaLinkDriver)
+
+	state, err := driver.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != "RUNNING" || state.Progress != 63 || state.RemainingMinutes != 20 ||
+		state.FileName != "srinath_bracket.gcode" {
+		t.Errorf("unexpected state: %+v", state)
+	}
+	p.applyState(state)
+	if caps := p.status().Capabilities; caps.Camera != CameraNone {
+		t.Errorf("PrusaLink has no camera, got %+v", caps)
+	}
+
+	if err := p.pause("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.stop("admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.Upload("srinath_clip.gcode", strings.NewReader("G28")); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded != "srinath_clip.gcode:G28" || overwrite != "?1" {
+		t.Errorf("unexpected upload: %q, overwrite %q", uploaded, overwrite)
+	}
+
+	files, err := driver.ListFiles()
+	if err != nil || len(files) != 1 || files[0].Name != "srinath_bracket.gcode" {
+		t.Errorf("unexpected files: %+v (%v)", files, err)
+	}
+	if err := driver.DeleteFile("srinath_bracket.gcode"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "PUT /api/v1/job/17/pause,DELETE /api/v1/job/17,DELETE /api/v1/files/usb/srinath_bracket.gcode"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("unexpected calls:\n got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+// The printer list, kept in the database.
+//
+// PRINTERS used to be the only way to add a printer, which meant editing .env
+// and restarting the site. It is now read once, the first time the site starts
+// with an empty printer table, and after that printers are added, changed and
+// removed from the admin page while everything else keeps running.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Printer is one printer as saved. Slug is the id the rest of the site knows
+// it by; it is set from the first name and kept through a rename, so the print
+// log, maintenance tasks and queued jobs stay attached.
+type Printer struct {
+	gorm.Model
+	Slug       string `json:"id" gorm:"uniqueIndex"`
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	Serial     string `json:"serial"`
+	AccessCode string `json:"-" gorm:"serializer:secret"`
+	// Not Model, which the embedded gorm.Model already is
+	PrinterModel string `json:"model"`
+	Nozzle       string `json:"nozzle"`
+	Driver       string `json:"driver"`
+}
+
+func (r Printer) config() PrinterConfig {
+	return PrinterConfig{
+		ID:         r.Slug,
+		Name:       r.Name,
+		Host:       r.Host,
+		Serial:     r.Serial,
+		AccessCode: r.AccessCode,
+		Model:      r.PrinterModel,
+		Nozzle:     r.Nozzle,
+		Driver:     r.Driver,
+	}
+}
+
+func printerRecord(cfg PrinterConfig) Printer {
+	return Printer{
+		Slug:         cfg.ID,
+		Name:         cfg.Name,
+		Host:         cfg.Host,
+		Serial:       cfg.Serial,
+		AccessCode:   cfg.AccessCode,
+		PrinterModel: cfg.Model,
+		Nozzle:       cfg.Nozzle,
+		Driver:       cfg.Driver,
+	}
+}
+
+// PrinterSettings is a printer as the admin page shows it: everything but the
+// access code.
+type PrinterSettings struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Serial string `json:"serial"`
+	Model  string `json:"model"`
+	Nozzle string `json:"nozzle"`
+	Driver string `json:"driver"`
+}
+
+// PrinterConfigRequest is the admin page's add and edit form.
+type PrinterConfigRequest struct {
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	Serial     string `json:"serial"`
+	AccessCode string `json:"access_code"`
+	Model      string `json:"model"`
+	Nozzle     string `json:"nozzle"`
+	Driver     string `json:"driver"`
+}
+
+func (r PrinterConfigRequest) config() PrinterConfig {
+	return PrinterConfig{
+		Name:       r.Name,
+		Host:       r.Host,
+		Serial:     r.Serial,
+		AccessCode: r.AccessCode,
+		Model:      r.Model,
+		Nozzle:     r.Nozzle,
+		Driver:     r.Driver,
+	}
+}
+
+// normalizePrinterConfig checks and tidies a printer from the admin page,
+// filling in the default nozzle. A blank model is read from the printer.
+func normalizePrinterConfig(cfg *PrinterConfig) error {
+	cfg.Name = strings.TrimSpace(cfg.Name)
+	cfg.Host = strings.TrimSpace(cfg.Host)
+	cfg.Serial = strings.TrimSpace(cfg.Serial)
+	cfg.AccessCode = strings.TrimSpace(cfg.AccessCode)
+	cfg.Model = strings.TrimSpace(cfg.Model)
+	cfg.Nozzle = strings.TrimSpace(cfg.Nozzle)
+	cfg.Driver = strings.ToLower(strings.TrimSpace(cfg.Driver))
+
+	if cfg.Driver == "" {
+		cfg.Driver = DriverBambu
+	}
+	if !printerDrivers[cfg.Driver] {
+		return fmt.Errorf("driver must be bambu, octoprint, moonraker or prusalink")
+	}
+	if cfg.Name == "" || cfg.Host == "" {
+		return fmt.Errorf("a printer needs a name and a host")
+	}
+	// Bambus are addressed by serial on MQTT; the others do not need one
+	if cfg.Driver == DriverBambu && cfg.Serial == "" {
+		return fmt.Errorf("a Bambu printer needs its serial number")
+	}
+	if strings.ContainsAny(cfg.Name, "|,") {
+		return fmt.Errorf("printer names cannot contain | or ,")
+	}
+	// Only Bambu models are known; others are free text, matched against
+	// what the slicer wrote
+	if cfg.Driver == DriverBambu && cfg.Model != "" && !knownModel(cfg.Model) {
+		return fmt.Errorf("unknown model %s - leave it blank to read it from the printer", cfg.Model)
+	}
+	if cfg.Nozzle == "" {
+		cfg.Nozzle = defaultPrinterNozzle
+	}
+	if _, err := strconv.ParseFloat(cfg.Nozzle, 64); err != nil {
+		return fmt.Errorf("the nozzle diameter must be a number, like 0.4")
+	}
+	return nil
+}
+
+// loadPrinters returns the saved printers, first filling an empty table from
+// PRINTERS. Access codes changed from the admin page before printers were
+// saved here come along with them.
+func loadPrinters(db *gorm.DB, seed []PrinterConfig) ([]PrinterConfig, error) {
+	// Deleted rows count: removing every printer must not bring PRINTERS back
+	var count int64
+	if err := db.Unscoped().Model(&Printer{}).Count(&count).Error; err != nil {
+		return nil, err
+	}
+
+	if count == 0 && len(seed) > 0 {
+		overrides := map[string]string{}
+		var saved []PrinterCredential
+		if err := db.Find(&saved).Error; err == nil {
+			for _, credential := range saved {
+				overrides[credential.PrinterID] = credential.AccessCode
+			}
+		}
+
+		for _, cfg := range seed {
+			if code := overrides[cfg.ID]; code != "" {
+				cfg.AccessCode = code
+			}
+			record := printerRecord(cfg)
+			if err := db.Create(&record).Error; err != nil {
+				return nil, fmt.Errorf("could not import %s: %w", cfg.Name, err)
+			}
+		}
+		log.Printf("Imported %d printers from PRINTERS; manage them from the admin page from now on", len(seed))
+	} else if count > 0 && len(seed) > 0 {
+		log.Println("Ignoring PRINTERS: the printer list is managed from the admin page")
+	}
+
+	var records []Printer
+	if err := db.Order("id ASC").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	configs := make([]PrinterConfig, 0, len(records))
+	for _, r := range records {
+		configs = append(configs, r.config())
+	}
+	return configs, nil
+}
+
+// PrinterSettings lists every printer's settings for the admin page.
+func (m *PrinterManager) PrinterSettings() []PrinterSettings {
+	printers := m.list()
+	settings := make([]PrinterSettings, 0, len(printers))
+	for _, p := range printers {
+		p.mu.RLock()
+		cfg := p.cfg
+		p.mu.RUnlock()
+		settings = append(settings, PrinterSettings{
+			ID:     cfg.ID,
+			Name:   cfg.Name,
+			Host:   cfg.Host,
+			Serial: cfg.Serial,
+			Model:  cfg.Model,
+			Nozzle: cfg.Nozzle,
+			Driver: cfg.Driver,
+		})
+	}
+	return settings
+}
+
+// nameTaken reports whether another printer already uses a name, or a name
+// that would give the same id.
+func (m *PrinterManager) nameTaken(name, exceptID string) bool {
+	slug := slugifyPrinterName(name)
+	for _, p := range m.list() {
+		if p.cfg.ID == exceptID {
+			continue
+		}
+		if strings.EqualFold(p.cfg.Name, name) || p.cfg.ID == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePrinter saves a new printer and starts connecting to it.
+func (m *PrinterManager) CreatePrinter(cfg PrinterConfig) (PrinterConfig, error) {
+	if err := normalizePrinterConfig(&cfg); err != nil {
+		return cfg, err
+	}
+	// Moonraker is often left open on the local network
+	if cfg.AccessCode == "" && cfg.Driver != DriverMoonraker {
+		return cfg, fmt.Errorf("access code cannot be empty")
+	}
+	if m.nameTaken(cfg.Name, "") {
+		return cfg, fmt.Errorf("there is already a printer called %s", cfg.Name)
+	}
+	cfg.ID = slugifyPrinterName(cfg.Name)
+
+	if m.db != nil {
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			// A printer removed earlier under the same name leaves its row
+			// behind; the id is reused, so the old row has to go. A live
+			// one stays, and the slug's unique index turns away the second
+			// of two admins adding the same name at once.
+			err := tx.Unscoped().Where("slug = ? AND deleted_at IS NOT NULL", cfg.ID).
+				Delete(&Printer{}).Error
+			if err != nil {
+				return err
+			}
+			record := printerRecord(cfg)
+			return tx.Create(&record).Error
+		})
+		if uniqueViolation(err) {
+			return cfg, fmt.Errorf("there is already a printer called %s", cfg.Name)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("could not save the printer: %w", err)
+		}
+	}
+
+	m.addPrinter(cfg)
+	log.Printf("printer %s: added at %s", cfg.Name, cfg.Host)
+	return cfg, nil
+}
+
+// uniqueViolation reports whether err is postgres refusing a row that a
+// unique index already has.
+func uniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
+
+// UpdatePrinter changes a printer's settings and reconnects it. A blank access
+// code keeps the current one. The id does not change with the name.
+func (m *PrinterManager) UpdatePrinter(id string, cfg PrinterConfig) (PrinterConfig, error) {
+	old, ok := m.lookup(id)
+	if !ok {
+		return cfg, fmt.Errorf("unknown printer")
+	}
+	if err := normalizePrinterConfig(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.AccessCode == "" {
+		cfg.AccessCode = old.accessCode()
+	}
+	if m.nameTaken(cfg.Name, id) {
+		return cfg, fmt.Errorf("there is already a printer called %s", cfg.Name)
+	}
+	cfg.ID = id
+
+	if m.db != nil {
+		record := printerRecord(cfg)
+		err := m.db.Model(&Printer{}).Where("slug = ?", id).
+			Select("Name", "Host", "Serial", "AccessCode", "PrinterModel", "Nozzle", "Driver").
+			Updates(&record).Error
+		if err != nil {
+			return cfg, fmt.Errorf("could not save the printer: %w", err)
+		}
+	}
+
+	m.replacePrinter(old, cfg)
+	log.Printf("printer %s: settings updated, reconnecting", cfg.Name)
+	return cfg, nil
+}
+
+// replacePrinter swaps a printer for one with new settings, in the same place
+// in the list. A print being logged and the maintenance summary carry over,
+// so a rename mid-print does not start a second job.
+func (m *PrinterManager) replacePrinter(old *printer, cfg PrinterConfig) {
+	p := m.newPrinter(cfg)
+
+	// Stopped first, so a last report cannot reach the old printer after
+	// its job has been handed over and open a second one
+	old.shutdown()
+
+	old.mu.Lock()
+	p.currentJob = old.currentJob
+	p.openFaults = make(map[string]*PrinterFault, len(old.openFaults))
+	for code, record := range old.openFaults {
+		p.openFaults[code] = record
+	}
+	p.maintenance = old.maintenance
+	p.maintenanceDue = old.maintenanceDue
+	p.underMaintenance = old.underMaintenance
+	p.maintenanceNote = old.maintenanceNote
+	p.certPin = old.certPin
+	p.certPending = old.certPending
+	p.certPendingSince = old.certPendingSince
+	old.currentJob = nil
+	old.mu.Unlock()
+
+	m.mu.Lock()
+	m.byID[cfg.ID] = p
+	for i, other := range m.printers {
+		if other == old {
+			m.printers[i] = p
+		}
+	}
+	m.mu.Unlock()
+
+	go p.protocol().Run(p.done)
+}
+
+// DeletePrinter disconnects a printer and removes it, forgetting its pinned
+// certificate. Its print log, maintenance history and files on the printer
+// are left alone.
+func (m *PrinterManager) DeletePrinter(id string) error {
+	p, ok := m.lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown printer")
+	}
+
+	if m.db != nil {
+		if err := m.db.Where("slug = ?", id).Delete(&Printer{}).Error; err != nil {
+			return fmt.Errorf("could not remove the printer: %w", err)
+		}
+		// Its print is no longer watched, so it would otherwise stay running
+		p.mu.Lock()
+		p.closeJobLocked("interrupted", time.Now())
+		p.mu.Unlock()
+	}
+
+	m.removePrinter(id)
+	m.forgetCertificate(id)
+	log.Printf("printer %s: removed", p.cfg.Name)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestNormalizePrinterConfig(t *testing.T) {
+	cfg := PrinterConfig{Name: " 3DP-04 ", Host: "10.0.0.4", Serial: "01P00A", AccessCode: "12345678"}
+	if err := normalizePrinterConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "3DP-04" || cfg.Model != "" || cfg.Nozzle != defaultPrinterNozzle {
+		t.Errorf("unexpected result: %+v", cfg)
+	}
+
+	for _, bad := range []PrinterConfig{
+		{Name: "3DP-04", Serial: "01P00A"},
+		{Name: "3DP|04", Host: "10.0.0.4", Serial: "01P00A"},
+		{Name: "3DP-04", Host: "10.0.0.4", Serial: "01P00A", Nozzle: "wide"},
+		{Name: "3DP-04", Host: "10.0.0.4", Serial: "01P00A", Model: "Ender 3"},
+	} {
+		if err := normalizePrinterConfig(&bad); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestManagePrintersAtRuntime(t *testing.T) {
+	m := NewPrinterManager(nil, nil)
+	input := PrinterConfig{Name: "3DP-04", Host: "127.0.0.1", Serial: "01P00A", AccessCode: "12345678"}
+
+	cfg, err := m.CreatePrinter(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ID != "3dp-04" || !m.Configured() {
+		t.Fatalf("unexpected printer: %+v", cfg)
+	}
+	if _, err := m.CreatePrinter(input); err == nil {
+		t.Error("expected an error for a second printer with the same name")
+	}
+
+	// A rename keeps the id and, with no code given, the access code
+	if _, err := m.UpdatePrinter("3dp-04", PrinterConfig{Name: "3DP-05", Host: "127.0.0.1", Serial: "01P00A"}); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := m.lookup("3dp-04")
+	if !ok || p.cfg.Name != "3DP-05" || p.accessCode() != "12345678" {
+		t.Errorf("unexpected printer after the update: %+v", p.cfg)
+	}
+	if settings := m.PrinterSettings(); len(settings) != 1 || settings[0].Name != "3DP-05" {
+		t.Errorf("unexpected settings: %+v", settings)
+	}
+
+	if err := m.DeletePrinter("3dp-04"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.lookup("3dp-04"); ok || m.Configured() {
+		t.Error("the printer should be gone")
+	}
+	if err := m.DeletePrinter("3dp-04"); err == nil {
+		t.Error("expected an error removing an unknown printer")
+	}
+}
+
+func TestShutdownEndsCameraLoop(t *testing.T) {
+	// A port nothing listens on, so every connect fails straight away
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	p := &printer{cfg: PrinterConfig{Name: "3DP-04", Host: "127.0.0.1"}, cameraPort: port, done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		p.runCamera()
+		close(finished)
+	}()
+
+	p.shutdown()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the camera loop kept running after shutdown")
+	}
+	// A second shutdown is harmless
+	p.shutdown()
+}
+
+func TestReplacedPrinterIgnoresLateReports(t *testing.T) {
+	m := NewPrinterManager(nil, nil)
+	if _, err := m.CreatePrinter(PrinterConfig{Name: "3DP-04", Host: "127.0.0.1", Serial: "01P00A", AccessCode: "12345678"}); err != nil {
+		t.Fatal(err)
+	}
+	defer m.DeletePrinter("3dp-04")
+	old, _ := m.lookup("3dp-04")
+	job := &PrintJob{FileName: "bracket.3mf"}
+	old.mu.Lock()
+	old.currentJob = job
+	old.openFaults = map[string]*PrinterFault{"0300_0100": {Code: "0300_0100"}}
+	old.mu.Unlock()
+
+	if _, err := m.UpdatePrinter("3dp-04", PrinterConfig{Name: "3DP-05", Host: "127.0.0.1", Serial: "01P00A"}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := m.lookup("3dp-04")
+	if p.currentJob != job || p.openFaults["0300_0100"] == nil {
+		t.Fatal("the job and open faults should carry over")
+	}
+
+	// A report still in flight for the old printer must not open a job there
+	old.applyReport([]byte(`{"print":{"command":"push_status","gcode_state":"RUNNING","gcode_file":"bracket.3mf"}}`))
+	old.applyState(driverState{State: "RUNNING"})
+	if old.currentJob != nil || !old.lastReport.IsZero() {
+		t.Errorf("the replaced printer took a report: job %+v, last report %v", old.currentJob, old.lastReport)
+	}
+
+	delete(p.openFaults, "0300_0100")
+	if old.openFaults["0300_0100"] == nil {
+		t.Error("the open faults map should be copied, not shared")
+	}
+}
+
+// uniqueError is postgres turning away a second row with the same slug.
+type uniqueError struct{}
+
+func (uniqueError) Error() string    { return "duplicate key value violates unique constraint" }
+func (uniqueError) SQLState() string { return "23505" }
+
+// Two admins adding the same name at once both get past the in-memory check;
+// the unique index has the last word, and only a removed printer's row is
+// cleared out of the way
+func TestCreatePrinterRaceLosesToTheIndex(t *testing.T) {
+	db := dryRunDB(t, nil)
+	var deletes []string
+	db.Callback().Delete().After("gorm:delete").Register("test:deletes", func(tx *gorm.DB) {
+		deletes = append(deletes, tx.Statement.SQL.String())
+	})
+	db.Callback().Create().After("gorm:create").Register("test:unique", func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Dest.(*Printer); ok {
+			tx.AddError(uniqueError{})
+		}
+	})
+	m := &PrinterManager{byID: map[string]*printer{}, db: db}
+
+	_, err := m.CreatePrinter(PrinterConfig{Name: "3DP-04", Host: "10.0.0.4", Serial: "01P00A", AccessCode: "12345678"})
+	if err == nil || err.Error() != "there is already a printer called 3DP-04" {
+		t.Errorf("expected the name to be taken, got %v", err)
+	}
+	if len(m.list()) != 0 {
+		t.Error("the losing printer should not have been started")
+	}
+	if len(deletes) != 1 || !strings.Contains(deletes[0], "deleted_at IS NOT NULL") {
+		t.Errorf("a live printer's row must not be cleared: %q", deletes)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+// Starting a print from a file already on the printer.
+//
+// Uploading stays open to everyone and never starts anything. This is the
+// admin's button for when they are standing at the machine with a phone: they
+// have looked at the plate, confirmed it is clear, and want to start without
+// scrolling through the printer's file browser.
+//
+// Sliced .3mf files start with Bambu's project_file command, naming the plate
+// inside the archive; plain .gcode goes through gcode_file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// startAttributionWindow is how long after a start command a newly running job
+// is credited to the admin who sent it.
+const startAttributionWindow = 5 * time.Minute
+
+// externalSpoolTray is the AMS mapping value for the spool holder on the back.
+const externalSpoolTray = 254
+
+// StartPrintOptions are the choices Bambu Studio offers on its Print dialog
+// that matter for a file that is already sliced.
+type StartPrintOptions struct {
+	// 1-based plate number inside the .3mf
+	Plate int `json:"plate"`
+	// For each filament in the file, the AMS tray to feed it from: 0-15 for
+	// AMS trays (unit*4 + slot), 254 for the external spool. Empty prints
+	// from whatever is loaded without the AMS.
+	AMSMapping   []int `json:"ams_mapping"`
+	BedLevelling bool  `json:"bed_levelling"`
+}
+
+// startableStates are the states a new print may start from. FINISH still has
+// the last print on the plate, which is what the confirmation is for.
+var startableStates = map[string]bool{"IDLE": true, "FINISH": true}
+
+// startPrintPayload builds the command for a file on the printer's storage.
+func startPrintPayload(sequence int, fileName string, opts StartPrintOptions) (string, error) {
+	_, suffix, ok := splitUploadSuffix(fileName)
+	if !ok {
+		return "", fmt.Errorf("only .3mf and .gcode files can be printed")
+	}
+
+	var command map[string]interface{}
+	if strings.EqualFold(suffix, ".gcode") {
+		command = map[string]interface{}{
+			"sequence_id": fmt.Sprint(sequence),
+			"command":     "gcode_file",
+			"param":       "/sdcard/" + fileName,
+		}
+	} else {
+		if opts.Plate < 1 {
+			return "", fmt.Errorf("plate numbers start at 1")
+		}
+		for _, tray := range opts.AMSMapping {
+			if (tray < -1 || tray > 15) && tray != externalSpoolTray {
+				return "", fmt.Errorf("%d is not an AMS tray (0-15, or 254 for the external spool)", tray)
+			}
+		}
+
+		mapping := opts.AMSMapping
+		if mapping == nil {
+			mapping = []int{}
+		}
+		command = map[string]interface{}{
+			"sequence_id":    fmt.Sprint(sequence),
+			"command":        "project_file",
+			"param":          fmt.Sprintf("Metadata/plate_%d.gcode", opts.Plate),
+			"subtask_name":   fileName,
+			"url":            "ftp:///" + fileName,
+			"bed_type":       "auto",
+			"bed_leveling":   opts.BedLevelling,
+			"flow_cali":      false,
+			"vibration_cali": false,
+			"layer_inspect":  false,
+			"timelapse":      false,
+			"use_ams":        len(opts.AMSMapping) > 0,
+			"ams_mapping":    mapping,
+			"project_id":     "0",
+			"profile_id":     "0",
+			"task_id":        "0",
+			"subtask_id":     "0",
+		}
+	}
+
+	encoded, err := json.Marshal(map[string]interface{}{"print": command})
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// startPrint sends the start command. The caller has already checked that the
+// file is on the printer.
+func (p *printer) startPrint(fileName string, opts StartPrintOptions, adminName string) error {
+	p.mu.RLock()
+	state := strings.ToUpper(p.state)
+	p.mu.RUnlock()
+
+	if !startableStates[state] {
+		return fmt.Errorf("the printer is busy (state: %s) - it must be idle or finished", state)
+	}
+
+	payload, err := startPrintPayload(p.nextSequence(), fileName, opts)
+	if err != nil {
+		return err
+	}
+	if err := p.publishCommand(payload); err != nil {
+		return err
+	}
+
+	// Not recordAction: that is how a stop soon after is credited, and a
+	// print cancelled at the screen was not stopped by whoever started it
+	p.mu.Lock()
+	p.startedBy = adminName
+	p.startedAt = time.Now()
+	p.mu.Unlock()
+
+	p.logAction(adminName, "start", fileName)
+	return nil
+}
+
+// StartPrint starts a file that is already on a printer. plateClear is the
+// admin's confirmation that they have checked the build plate.
+func (m *PrinterManager) StartPrint(id, name string, opts StartPrintOptions, adminName string, plateClear bool) (string, error) {
+	p, ok := m.lookup(id)
+	if !ok {
+		return "", fmt.Errorf("unknown printer")
+	}
+
+	if !plateClear {
+		return "", fmt.Errorf("confirm the build plate is clear before starting a print")
+	}
+	if err := p.inService(); err != nil {
+		return "", err
+	}
+	if err := p.supports(CommandPrint); err != nil {
+		return "", err
+	}
+
+	safe, err := sanitizeUploadName(name)
+	if err != nil {
+		return "", err
+	}
+
+	// The printer ignores a start command for a file it does not have, which
+	// would look like success here
+	files, err := p.protocol().ListFiles()
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, f := range files {
+		if f.Name == safe {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("%s is not on the printer - send it first", safe)
+	}
+
+	if err := p.startPrint(safe, opts, adminName); err != nil {
+		return "", err
+	}
+	return safe, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+// The start command is built by hand from what Bambu Studio sends. These tests
+// check its shape and that nothing reaches the printer when it should not.
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestStartPrintPayloadProjectFile(t *testing.T) {
+	payload, err := startPrintPayload(7, "srinath_bracket.gcode.3mf", StartPrintOptions{
+		Plate:        2,
+		AMSMapping:   []int{0, 3, 254},
+		BedLevelling: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var decoded struct {
+		Print struct {
+			SequenceID  string `json:"sequence_id"`
+			Command     string `json:"command"`
+			Param       string `json:"param"`
+			URL         string `json:"url"`
+			BedLeveling bool   `json:"bed_leveling"`
+			UseAMS      bool   `json:"use_ams"`
+			AMSMapping  []int  `json:"ams_mapping"`
+		} `json:"print"`
+	}
+	if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+
+	cmd := decoded.Print
+	if cmd.Command != "project_file" || cmd.SequenceID != "7" {
+		t.Errorf("wrong command: %+v", cmd)
+	}
+	if cmd.Param != "Metadata/plate_2.gcode" {
+		t.Errorf("plate param = %q", cmd.Param)
+	}
+	if cmd.URL != "ftp:///srinath_bracket.gcode.3mf" {
+		t.Errorf("url = %q", cmd.URL)
+	}
+	if !cmd.BedLeveling || !cmd.UseAMS || len(cmd.AMSMapping) != 3 || cmd.AMSMapping[2] != 254 {
+		t.Errorf("options not carried through: %+v", cmd)
+	}
+}
+
+func TestStartPrintPayloadGcodeAndValidation(t *testing.T) {
+	payload, err := startPrintPayload(1, "plate_1.gcode", StartPrintOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var decoded struct {
+		Print struct {
+			Command string `json:"command"`
+			Param   string `json:"param"`
+		} `json:"print"`
+	}
+	json.Unmarshal([]byte(payload), &decoded)
+	if decoded.Print.Command != "gcode_file" || decoded.Print.Param != "/sdcard/plate_1.gcode" {
+		t.Errorf("plain gcode should use gcode_file: %+v", decoded.Print)
+	}
+
+	if _, err := startPrintPayload(1, "bracket.3mf", StartPrintOptions{Plate: 0}); err == nil {
+		t.Error("plate 0 should be refused")
+	}
+	if _, err := startPrintPayload(1, "bracket.3mf", StartPrintOptions{Plate: 1, AMSMapping: []int{16}}); err == nil {
+		t.Error("tray 16 does not exist")
+	}
+	if _, err := startPrintPayload(1, "notes.txt", StartPrintOptions{Plate: 1}); err == nil {
+		t.Error("a non-printable file should be refused")
+	}
+}
+
+// A printer mid-job must never be sent a start, and a refused start must not
+// be credited to anyone.
+func TestStartPrintRefusesBusyPrinter(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{Name: "mock"}}
+	p.applyReport([]byte(`{"print":{"gcode_state":"RUNNING"}}`))
+
+	if err := p.startPrint("bracket.3mf", StartPrintOptions{Plate: 1}, "Srinath"); err == nil {
+		t.Fatal("expected a running printer to refuse a start")
+	}
+	if p.status().LastActionBy != nil || p.startedBy != "" {
+		t.Error("a refused start must not be recorded")
+	}
+
+	// Idle but unreachable is refused by publishCommand
+	p.applyReport([]byte(`{"print":{"gcode_state":"IDLE"}}`))
+	if err := p.startPrint("bracket.3mf", StartPrintOptions{Plate: 1}, "Srinath"); err == nil {
+		t.Error("expected an error with no MQTT connection")
+	}
+}
+
+func TestManagerStartPrintNeedsPlateConfirmation(t *testing.T) {
+	m := &PrinterManager{byID: map[string]*printer{"p1": {cfg: PrinterConfig{Name: "mock"}}}}
+	if _, err := m.StartPrint("p1", "bracket.3mf", StartPrintOptions{Plate: 1}, "Srinath", false); err == nil {
+		t.Error("starting without confirming the plate is clear must be refused")
+	}
+	if _, err := m.StartPrint("nope", "bracket.3mf", StartPrintOptions{Plate: 1}, "Srinath", true); err == nil {
+		t.Error("expected an error for an unknown printer")
+	}
+}
+
+func TestCancellingAtTheScreenIsNotCreditedToTheStarter(t *testing.T) {
+	p := answeringPrinter(func(p *printer, seq, payload string) {
+		p.applyReport([]byte(fmt.Sprintf(
+			`{"print":{"command":"project_file","sequence_id":"%s","result":"success"}}`, seq)))
+	})
+	p.state = "IDLE"
+	p.jobs = dryRunDB(t, nil)
+
+	if err := p.startPrint("bracket.3mf", StartPrintOptions{Plate: 1}, "Srinath"); err != nil {
+		t.Fatal(err)
+	}
+	p.applyReport([]byte(`{"print":{"gcode_state":"RUNNING","subtask_name":"bracket.3mf"}}`))
+	job := p.currentJob
+	if job == nil || job.StartedBy != "Srinath" {
+		t.Fatalf("the start was not credited: %+v", job)
+	}
+
+	// Cancelled on the printer a minute later
+	p.applyReport([]byte(`{"print":{"gcode_state":"IDLE"}}`))
+	if job.Result != "stopped" || job.StoppedBy != "" {
+		t.Errorf("closed as %s by %q", job.Result, job.StoppedBy)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+// Looking after a printer's storage.
+//
+// The file list on the printers page only shows the plates in the top folder,
+// which is all most people need. Admins also need the rest of the card: the
+// cache/ folder where prints sent from Bambu Studio land, the timelapse/
+// videos, how much space it all takes, and a way to clear out months of old
+// plates. Everything here goes over the same FTPS session as uploads, so it is
+// Bambu-only.
+//
+// The printer's FTP service does not report free space, so storage is
+// measured by adding up what is on the card, folder by folder.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"gorm.io/gorm"
+)
+
+// cleanableSuffixes are the files a bulk cleanup may remove: plates and
+// timelapse videos. Anything else on the card - logs, firmware, whatever the
+// printer keeps for itself - is left alone.
+var cleanableSuffixes = append([]string{".mp4", ".avi"}, allowedUploadSuffixes...)
+
+// PrinterEntry is one file or folder on a printer's storage.
+type PrinterEntry struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Folder bool   `json:"folder"`
+	Size   uint64 `json:"size"`
+	Time   string `json:"time"`
+}
+
+// StorageFolder is the space taken by one top-level folder.
+type StorageFolder struct {
+	Name  string `json:"name"`
+	Bytes uint64 `json:"bytes"`
+	Files int    `json:"files"`
+}
+
+// PrinterStorage is what is on a printer's card. The top folder's own files
+// are listed under "/".
+type PrinterStorage struct {
+	UsedBytes uint64          `json:"used_bytes"`
+	Files     int             `json:"files"`
+	Folders   []StorageFolder `json:"folders"`
+}
+
+// CleanupOptions choose what a bulk cleanup removes.
+type CleanupOptions struct {
+	// Which folder to clean; empty is the top folder
+	Folder string
+	// Files older than this many days, and not printed in that time
+	Days int
+	// Only report what would go
+	DryRun bool
+}
+
+// CleanupResult is what a cleanup removed, or would remove on a dry run.
+type CleanupResult struct {
+	Deleted    []string          `json:"deleted"`
+	FreedBytes uint64            `json:"freed_bytes"`
+	Failed     map[string]string `json:"failed,omitempty"`
+	DryRun     bool              `json:"dry_run"`
+	// Set on a dry run made without the print history, which a real cleanup
+	// refuses to go ahead without
+	Warning string `json:"warning,omitempty"`
+}
+
+// cleanPrinterPath reduces a path from the browser to one inside the printer's
+// storage, without a leading slash. The top folder is "". Cleaning it as an
+// absolute path means no amount of ".." can climb out.
+func cleanPrinterPath(raw string) string {
+	cleaned := path.Clean("/" + strings.ReplaceAll(strings.TrimSpace(raw), "\\", "/"))
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+func hasCleanableSuffix(name string) bool {
+	lower := strings.ToLower(name)
+	for _, suffix := range cleanableSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// listDir lists one folder, leaving out macOS sidecars and the "." entries
+// some servers send.
+func listDir(conn *ftp.ServerConn, dir string) ([]*ftp.Entry, error) {
+	entries, err := conn.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s on the printer: %w", describeFolder(dir), err)
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, ".") {
+			continue
+		}
+		if entry.Type == ftp.EntryTypeFile || entry.Type == ftp.EntryTypeFolder {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, nil
+}
+
+func describeFolder(dir string) string {
+	if dir == "" {
+		return "the top folder"
+	}
+	return dir
+}
+
+// Browse lists one folder of the printer's storage, folders first.
+func (p *printer) Browse(dir string) ([]PrinterEntry, error) {
+	conn, err := p.connectFTP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	entries, err := listDir(conn, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := make([]PrinterEntry, 0, len(entries))
+	for _, entry := range entries {
+		listing = append(listing, PrinterEntry{
+			Name:   entry.Name,
+			Path:   path.Join(dir, entry.Name),
+			Folder: entry.Type == ftp.EntryTypeFolder,
+			Size:   entry.Size,
+			Time:   entry.Time.Local().Format("2006-01-02 15:04"),
+		})
+	}
+	sort.SliceStable(listing, func(i, j int) bool {
+		if listing[i].Folder != listing[j].Folder {
+			return listing[i].Folder
+		}
+		return strings.ToLower(listing[i].Name) < strings.ToLower(listing[j].Name)
+	})
+	return listing, nil
+}
+
+// ftpDownload is a file being read off the printer. Closing it ends the
+// session as well as the transfer.
+type ftpDownload struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+}
+
+func (d ftpDownload) Close() error {
+	err := d.Response.Close()
+	d.conn.Quit()
+	return err
+}
+
+// Download opens a file on the printer for reading, with its size.
+func (p *printer) Download(file string) (io.ReadCloser, int64, error) {
+	conn, err := p.connectFTP()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := conn.FileSize(file)
+	if err != nil {
+		conn.Quit()
+		return nil, 0, fmt.Errorf("%s is not on the printer", file)
+	}
+	response, err := conn.Retr(file)
+	if err != nil {
+		conn.Quit()
+		return nil, 0, fmt.Errorf("could not read %s from the printer: %w", file, err)
+	}
+	return ftpDownload{Response: response, conn: conn}, size, nil
+}
+
+// Rename renames a file within its folder, refusing to overwrite another.
+func (p *printer) Rename(from, to string) error {
+	conn, err := p.connectFTP()
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	if _, err := conn.FileSize(from); err != nil {
+		return fmt.Errorf("%s is not on the printer", from)
+	}
+	if _, err := conn.FileSize(to); err == nil {
+		return fmt.Errorf("%s is already on the printer - pick another name", path.Base(to))
+	}
+	if err := conn.Rename(from, to); err != nil {
+		return fmt.Errorf("could not rename %s: %w", from, err)
+	}
+	return nil
+}
+
+// StorageUsage adds up everything on the card.
+func (p *printer) StorageUsage() (PrinterStorage, error) {
+	var usage PrinterStorage
+
+	conn, err := p.connectFTP()
+	if err != nil {
+		return usage, err
+	}
+	defer conn.Quit()
+
+	folders := map[string]*StorageFolder{}
+	walker := conn.Walk("/")
+	for walker.Next() {
+		entry := walker.Stat()
+		if entry.Type != ftp.EntryTypeFile {
+			continue
+		}
+		top := "/"
+		if parts := strings.SplitN(strings.TrimPrefix(walker.Path(), "/"), "/", 2); len(parts) == 2 {
+			top = parts[0]
+		}
+		folder, ok := folders[top]
+		if !ok {
+			folder = &StorageFolder{Name: top}
+			folders[top] = folder
+		}
+		folder.Bytes += entry.Size
+		folder.Files++
+		usage.UsedBytes += entry.Size
+		usage.Files++
+	}
+	if err := walker.Err(); err != nil {
+		return usage, fmt.Errorf("could not read the printer's storage: %w", err)
+	}
+
+	for _, folder := range folders {
+		usage.Folders = append(usage.Folders, *folder)
+	}
+	sort.Slice(usage.Folders, func(i, j int) bool { return usage.Folders[i].Bytes > usage.Folders[j].Bytes })
+	return usage, nil
+}
+
+// cleanupCandidate is a file a cleanup might remove.
+type cleanupCandidate struct {
+	Name     string
+	Size     uint64
+	Modified time.Time
+}
+
+// selectForCleanup picks the files to remove: cleanable, older than the
+// cutoff, not printed since it, and not the one printing now. lastPrinted is
+// keyed by base name, the way the printer reports jobs.
+func selectForCleanup(files []cleanupCandidate, lastPrinted map[string]time.Time, cutoff time.Time, printing func(name string) bool) []cleanupCandidate {
+	var chosen []cleanupCandidate
+	for _, file := range files {
+		if !hasCleanableSuffix(file.Name) || file.Modified.After(cutoff) {
+			continue
+		}
+		base, _, ok := splitUploadSuffix(file.Name)
+		if !ok {
+			base = file.Name
+		}
+		if printed, ok := lastPrinted[strings.ToLower(base)]; ok && printed.After(cutoff) {
+			continue
+		}
+		if printing(file.Name) {
+			continue
+		}
+		chosen = append(chosen, file)
+	}
+	return chosen
+}
+
+// cleanup removes old files from one folder.
+func (p *printer) cleanup(opts CleanupOptions, lastPrinted map[string]time.Time) (CleanupResult, error) {
+	result := CleanupResult{Deleted: []string{}, DryRun: opts.DryRun}
+
+	conn, err := p.connectFTP()
+	if err != nil {
+		return result, err
+	}
+	defer conn.Quit()
+
+	entries, err := listDir(conn, opts.Folder)
+	if err != nil {
+		return result, err
+	}
+	var files []cleanupCandidate
+	for _, entry := range entries {
+		if entry.Type == ftp.EntryTypeFile {
+			files = append(files, cleanupCandidate{Name: entry.Name, Size: entry.Size, Modified: entry.Time})
+		}
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -opts.Days)
+	for _, file := range selectForCleanup(files, lastPrinted, cutoff, p.isPrinting) {
+		target := path.Join(opts.Folder, file.Name)
+		if !opts.DryRun {
+			if err := conn.Delete(target); err != nil {
+				if result.Failed == nil {
+					result.Failed = map[string]string{}
+				}
+				result.Failed[target] = err.Error()
+				continue
+			}
+		}
+		result.Deleted = append(result.Deleted, target)
+		result.FreedBytes += file.Size
+	}
+	return result, nil
+}
+
+// --- manager wrappers ---------------------------------------------------
+
+// fileStore finds a printer whose storage the site can reach.
+func (m *PrinterManager) fileStore(id string) (*printer, error) {
+	p, ok := m.lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown printer")
+	}
+	if _, ok := p.protocol().(bambuDriver); !ok {
+		return nil, fmt.Errorf("%s's storage can only be managed from the printer itself", p.cfg.Name)
+	}
+	return p, nil
+}
+
+func (m *PrinterManager) Browse(id, dir string) ([]PrinterEntry, error) {
+	p, err := m.fileStore(id)
+	if err != nil {
+		return nil, err
+	}
+	return p.Browse(cleanPrinterPath(dir))
+}
+
+// Download opens a file on a printer, returning its name, size and contents.
+func (m *PrinterManager) Download(id, file string) (string, int64, io.ReadCloser, error) {
+	p, err := m.fileStore(id)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	file = cleanPrinterPath(file)
+	if file == "" {
+		return "", 0, nil, fmt.Errorf("choose a file to download")
+	}
+	contents, size, err := p.Download(file)
+	return path.Base(file), size, contents, err
+}
+
+// RenameFile renames a plate on a printer, keeping it in its folder and its
+// sliced details, print history and upload history with it, so cleanup still
+// knows when it was last printed. It returns the new name.
+func (m *PrinterManager) RenameFile(id, file, newName string) (string, error) {
+	p, err := m.fileStore(id)
+	if err != nil {
+		return "", err
+	}
+	from := cleanPrinterPath(file)
+	if _, _, ok := splitUploadSuffix(path.Base(from)); !ok {
+		return "", fmt.Errorf("only .3mf and .gcode files can be renamed")
+	}
+	name, err := sanitizeUploadName(newName)
+	if err != nil {
+		return "", err
+	}
+	to := path.Join(path.Dir(from), name)
+	if to == from {
+		return name, nil
+	}
+	if p.isPrinting(path.Base(from)) {
+		return "", fmt.Errorf("%s is printing right now - rename it once it has finished", path.Base(from))
+	}
+
+	if err := p.Rename(from, to); err != nil {
+		return "", err
+	}
+	if m.db != nil && path.Dir(from) == "." {
+		if err := followRename(m.db, id, from, name); err != nil {
+			log.Printf("printer %s: renamed %s to %s, but its records still have the old name: %v", p.cfg.Name, from, name, err)
+		}
+	}
+	return name, nil
+}
+
+// followRename moves a file's records over to its new name in one step. The
+// printer reports a print by name, with or without the suffix, so print jobs
+// are matched both ways and keep the form they had.
+func followRename(db *gorm.DB, printerID, from, to string) error {
+	fromBase, _, _ := splitUploadSuffix(from)
+	toBase, _, _ := splitUploadSuffix(to)
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&SlicedFile{}).Where("printer_id = ? AND file_name = ?", printerID, from).
+			Update("file_name", to).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&UploadRecord{}).Where("printer_id = ? AND file_name = ?", printerID, from).
+			Update("file_name", to).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&PrintJob{}).Where("printer_id = ? AND LOWER(file_name) = LOWER(?)", printerID, from).
+			Update("file_name", to).Error; err != nil {
+			return err
+		}
+		return tx.Model(&PrintJob{}).Where("printer_id = ? AND LOWER(file_name) = LOWER(?)", printerID, fromBase).
+			Update("file_name", toBase).Error
+	})
+}
+
+func (m *PrinterManager) StorageUsage(id string) (PrinterStorage, error) {
+	p, err := m.fileStore(id)
+	if err != nil {
+		return PrinterStorage{}, err
+	}
+	return p.StorageUsage()
+}
+
+// CleanupFiles removes old, unprinted files from one folder of a printer.
+func (m *PrinterManager) CleanupFiles(id string, opts CleanupOptions) (CleanupResult, error) {
+	p, err := m.fileStore(id)
+	if err != nil {
+		return CleanupResult{}, err
+	}
+	if opts.Days < 1 {
+		return CleanupResult{}, fmt.Errorf("give an age in days of at least 1")
+	}
+	opts.Folder = cleanPrinterPath(opts.Folder)
+
+	// Without the history every old plate looks unprinted, recently
+	// printed ones included
+	printed, err := m.lastPrinted(id)
+	if err != nil && !opts.DryRun {
+		return CleanupResult{}, fmt.Errorf("could not read the print history, so nothing was removed: %w", err)
+	}
+	result, cleanupErr := p.cleanup(opts, printed)
+	if err != nil {
+		result.Warning = "the print history could not be read, so recently printed files are listed too"
+	}
+	return result, cleanupErr
+}
+
+// lastPrinted is when each file was last printed on a printer, by lower-case
+// base name.
+func (m *PrinterManager) lastPrinted(id string) (map[string]time.Time, error) {
+	printed := map[string]time.Time{}
+	if m.db == nil {
+		return printed, nil
+	}
+	var jobs []PrintJob
+	if err := m.db.Select("file_name", "started_at").Where("printer_id = ?", id).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		base, _, ok := splitUploadSuffix(job.FileName)
+		if !ok {
+			base = job.FileName
+		}
+		base = strings.ToLower(base)
+		if job.StartedAt.After(printed[base]) {
+			printed[base] = job.StartedAt
+		}
+	}
+	return printed, nil
+}
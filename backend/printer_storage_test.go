@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestCleanPrinterPath(t *testing.T) {
+	cases := map[string]string{
+		"":                       "",
+		"/":                      "",
+		"cache":                  "cache",
+		"/timelapse/":            "timelapse",
+		"cache/../timelapse":     "timelapse",
+		"../../etc/passwd":       "etc/passwd",
+		"..\\..\\cache\\a.3mf":   "cache/a.3mf",
+		" cache/plate.gcode.3mf": "cache/plate.gcode.3mf",
+	}
+	for raw, want := range cases {
+		if got := cleanPrinterPath(raw); got != want {
+			t.Errorf("cleanPrinterPath(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestSelectForCleanup(t *testing.T) {
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -30)
+	old := now.AddDate(0, 0, -90)
+
+	files := []cleanupCandidate{
+		{Name: "old_unprinted.3mf", Modified: old},
+		{Name: "new_upload.gcode.3mf", Modified: now},
+		{Name: "old_but_printed_last_week.gcode.3mf", Modified: old},
+		{Name: "old_printed_long_ago.gcode", Modified: old},
+		{Name: "printing_now.gcode.3mf", Modified: old},
+		{Name: "timelapse_0001.mp4", Modified: old},
+		{Name: "printer.log", Modified: old},
+	}
+	lastPrinted := map[string]time.Time{
+		"old_but_printed_last_week": now.AddDate(0, 0, -7),
+		"old_printed_long_ago":      old,
+	}
+	printing := func(name string) bool { return name == "printing_now.gcode.3mf" }
+
+	var names []string
+	for _, file := range selectForCleanup(files, lastPrinted, cutoff, printing) {
+		names = append(names, file.Name)
+	}
+	want := "old_unprinted.3mf,old_printed_long_ago.gcode,timelapse_0001.mp4"
+	if strings.Join(names, ",") != want {
+		t.Errorf("chose %v, want %s", names, want)
+	}
+}
+
+func TestStorageNeedsABambu(t *testing.T) {
+	octo := &printer{cfg: PrinterConfig{ID: "octo", Name: "Octo", Driver: DriverOctoPrint}}
+	octo.driver = newPrinterDriver(octo)
+	m := &PrinterManager{printers: []*printer{octo}, byID: map[string]*printer{"octo": octo}}
+
+	if _, err := m.StorageUsage("octo"); err == nil {
+		t.Error("an OctoPrint's storage is not reachable over FTPS")
+	}
+	if _, err := m.Browse("nope", ""); err == nil {
+		t.Error("unknown printers should be refused")
+	}
+
+	bambu := &printer{cfg: PrinterConfig{ID: "p1s", Name: "P1S"}}
+	m = &PrinterManager{printers: []*printer{bambu}, byID: map[string]*printer{"p1s": bambu}}
+	if _, err := m.CleanupFiles("p1s", CleanupOptions{Days: 0}); err == nil {
+		t.Error("a cleanup needs an age")
+	}
+	if _, err := m.RenameFile("p1s", "timelapse/video.mp4", "new.mp4"); err == nil {
+		t.Error("only plates can be renamed")
+	}
+}
+
+// Runs browse, rename, download, usage and cleanup against a live server.
+// Skipped unless RRC_FTP_TEST_ADDR points at one.
+func TestStorageAgainstFTPServer(t *testing.T) {
+	addr := ftpTestAddr(t)
+	host, port := splitHostPort(t, addr)
+
+	p := &printer{
+		cfg:          PrinterConfig{ID: "printer-1", Name: "Printer 1", Host: host, AccessCode: "89a8541a"},
+		ftpPort:      port,
+		ftpPlaintext: true,
+	}
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"printer-1": p}}
+
+	contents := []byte("sliced plate")
+	if err := p.UploadFile("srinath_storage.3mf", bytes.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := m.RenameFile("printer-1", "srinath_storage.3mf", "srinath renamed.3mf")
+	if err != nil || name != "srinath_renamed.3mf" {
+		t.Fatalf("rename gave %q, %v", name, err)
+	}
+
+	_, size, download, err := m.Download("printer-1", "srinath_renamed.3mf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _ := io.ReadAll(download)
+	download.Close()
+	if size != int64(len(contents)) || !bytes.Equal(read, contents) {
+		t.Errorf("downloaded %q (%d bytes)", read, size)
+	}
+
+	entries, err := m.Browse("printer-1", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, entry := range entries {
+		found = found || entry.Path == "srinath_renamed.3mf"
+	}
+	if !found {
+		t.Errorf("renamed file missing: %+v", entries)
+	}
+
+	if usage, err := m.StorageUsage("printer-1"); err != nil || usage.UsedBytes < uint64(len(contents)) {
+		t.Errorf("usage %+v, %v", usage, err)
+	}
+
+	// Just uploaded, so too new for any cleanup
+	result, err := m.CleanupFiles("printer-1", CleanupOptions{Days: 1, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, deleted := range result.Deleted {
+		if deleted == "srinath_renamed.3mf" {
+			t.Error("a new file was chosen for cleanup")
+		}
+	}
+
+	if err := p.DeleteFile("srinath_renamed.3mf"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowRename(t *testing.T) {
+	db := dryRunDB(t, nil)
+	var updates []string
+	db.Callback().Update().After("gorm:update").Register("test:updates", func(tx *gorm.DB) {
+		updates = append(updates, fmt.Sprintf("%s %v", tx.Statement.Table, tx.Statement.Vars))
+	})
+
+	if err := followRename(db, "p1s", "srinath_bracket.gcode.3mf", "srinath_bracket_v2.gcode.3mf"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"sliced_files [srinath_bracket_v2.gcode.3mf",
+		"upload_records [srinath_bracket_v2.gcode.3mf",
+		"print_jobs [srinath_bracket_v2.gcode.3mf",
+		// The printer may report the plate without its suffix
+		"print_jobs [srinath_bracket_v2 ",
+	}
+	if len(updates) != len(want) {
+		t.Fatalf("updates: %v", updates)
+	}
+	for i, update := range updates {
+		if !strings.HasPrefix(update, want[i]) || !strings.Contains(update, "p1s") {
+			t.Errorf("update %d: %s", i, update)
+		}
+	}
+}
+
+func TestCleanupNeedsThePrintHistory(t *testing.T) {
+	db := failingDB(t)
+	p := &printer{cfg: PrinterConfig{ID: "p1s", Name: "P1S", Host: "127.0.0.1"}, ftpPort: closedPort(t)}
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1s": p}, db: db}
+
+	_, err := m.CleanupFiles("p1s", CleanupOptions{Days: 30})
+	if err == nil || !strings.Contains(err.Error(), "print history") {
+		t.Errorf("a cleanup without the history should be refused, got %v", err)
+	}
+	// A dry run deletes nothing, so it goes on as far as the printer
+	if _, err := m.CleanupFiles("p1s", CleanupOptions{Days: 30, DryRun: true}); err == nil || strings.Contains(err.Error(), "print history") {
+		t.Errorf("a dry run should get as far as the printer, got %v", err)
+	}
+}
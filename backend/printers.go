@@ -1,14 +1,16 @@
 package main
 
-// Talks to the lab's Bambu Lab P1S printers over their local network protocol:
+// Talks to the lab's Bambu Lab printers over their local network protocol:
 //
 //   * status - MQTT over TLS on port 8883, user "bblp" + the printer's LAN
 //     access code. The printer publishes JSON on device/<serial>/report.
 //   * camera - a plain TLS socket on port 6000. After an 80 byte auth packet
 //     the printer streams JPEG frames, each preceded by a 16 byte header whose
 //     first 4 bytes are the payload length. Roughly one frame every 2 seconds.
+//     The X1 series streams RTSP instead; see printer_models.go.
 //
-// Everything here is read-only: we never send print commands.
+// Commands - stop, pause, resume, light, and an admin-only start - go out on
+// device/<serial>/request, always through publishCommand.
 
 import (
 	"crypto/tls"
@@ -38,6 +40,8 @@ const (
 	cameraStaleAfter = 30 * time.Second
 	// Reports stop arriving if the printer is switched off or leaves the network
 	statusStaleAfter = 2 * time.Minute
+	// Assumed when PRINTERS does not say
+	defaultPrinterNozzle = "0.4"
 )
 
 // PrinterConfig is one printer, as configured in the PRINTERS env var.
@@ -47,6 +51,13 @@ type PrinterConfig struct {
 	Host       string
 	Serial     string
 	AccessCode string
+	// What uploads are checked against. An empty model is worked out from
+	// the printer; the nozzle defaults to the stock 0.4 mm.
+	Model  string
+	Nozzle string
+	// How to talk to it; empty is a Bambu. For the HTTP drivers Host may be
+	// a full URL and AccessCode is the API key.
+	Driver string
 }
 
 // PrinterStatus is what the frontend sees. Access codes never appear here.
@@ -68,12 +79,24 @@ type PrinterStatus struct {
 	CameraOnline     bool       `json:"camera_online"`
 	// Reachable but rejecting our credentials - almost always a changed
 	// access code, which the printer does when LAN mode is toggled.
-	AccessCodeProblem bool    `json:"access_code_problem"`
-	UpdatedAt         *string `json:"updated_at"`
+	AccessCodeProblem bool `json:"access_code_problem"`
+	// Set while the printer presents a TLS certificate other than the pinned
+	// one and the site refuses to talk to it; see printer_certs.go
+	CertificateWarning string  `json:"certificate_warning,omitempty"`
+	UpdatedAt          *string `json:"updated_at"`
 	// Set when an admin has stopped a job, so the action is visible rather
 	// than silent.
 	LastActionBy *string `json:"last_action_by"`
 	LastActionAt *string `json:"last_action_at"`
+	// ok, due or overdue, with the tasks that are not ok
+	Maintenance    string   `json:"maintenance"`
+	MaintenanceDue []string `json:"maintenance_due"`
+	// Taken out of service by an admin; nothing new is sent to it
+	UnderMaintenance bool   `json:"under_maintenance"`
+	MaintenanceNote  string `json:"maintenance_note,omitempty"`
+	// The model, as configured or detected, and what the site can do with it
+	Model        string              `json:"model"`
+	Capabilities PrinterCapabilities `json:"capabilities"`
 }
 
 // printerReport mirrors the fields we care about from the printer's JSON.
@@ -81,10 +104,14 @@ type PrinterStatus struct {
 // missing field means "unchanged", not "zero".
 type printerReport struct {
 	Print struct {
+		// Set when the report answers one of our commands
+		commandReply
+
 		GcodeState    *string  `json:"gcode_state"`
 		Percent       *int     `json:"mc_percent"`
 		RemainingTime *int     `json:"mc_remaining_time"`
 		SubtaskName   *string  `json:"subtask_name"`
+		GcodeFile     *string  `json:"gcode_file"`
 		NozzleTemper  *float64 `json:"nozzle_temper"`
 		BedTemper     *float64 `json:"bed_temper"`
 		ChamberTemper *float64 `json:"chamber_temper"`
@@ -130,6 +157,16 @@ type printerReport struct {
 			Code uint32 `json:"code"`
 		} `json:"hms"`
 	} `json:"print"`
+
+	// Answers to commands. Print commands are answered in Print above, which
+	// embeds the same fields; the light is answered here.
+	System *commandReply `json:"system"`
+
+	// Answers to get_version, which says what the printer is
+	Info *struct {
+		Command string          `json:"command"`
+		Module  []versionModule `json:"module"`
+	} `json:"info"`
 }
 
 // AMSSlot is one filament position, either in an AMS unit or the external
@@ -169,9 +206,10 @@ func trayMaterial(subBrands, trayType string) string {
 
 // HMSFault is one fault, formatted the way Bambu's own documentation writes it.
 type HMSFault struct {
-	Code     string `json:"code"`
-	Severity string `json:"severity"`
-	URL      string `json:"url"`
+	Code        string `json:"code"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"` // empty when the code table does not know it
+	URL         string `json:"url"`
 }
 
 // hmsSeverity reads the severity out of the top half of the code word.
@@ -206,6 +244,7 @@ type printer struct {
 	progress     int
 	remaining    int
 	fileName     string
+	gcodeFile    string
 	nozzleTemp   float64
 	bedTemp      float64
 	chamberTemp  float64
@@ -217,41 +256,99 @@ type printer struct {
 	lastActionBy string
 	lastActionAt time.Time
 
+	// The admin who last sent a start command, credited on the job it starts
+	startedBy string
+	startedAt time.Time
+
 	lightOn  bool
 	faults   []HMSFault
 	amsUnits []AMSUnit
 	external *AMSSlot
 
+	// History rows for the faults currently showing, by code
+	openFaults map[string]*PrinterFault
+
 	// The job currently being tracked for the print log
 	currentJob *PrintJob
 	jobs       *gorm.DB
 
+	// Where finished prints and new faults are announced
+	events *eventBus
+
+	// Maintenance summary, refreshed from the database by the manager
+	maintenance      string
+	maintenanceDue   []string
+	underMaintenance bool
+	maintenanceNote  string
+
 	// Credential health, derived from the camera handshake: the printer
 	// accepts the TCP connection and then hangs up when the code is wrong.
 	authFailed bool
 
+	// The pinned certificate fingerprint, and a different one the printer has
+	// presented since; see printer_certs.go
+	certPin          string
+	certPending      string
+	certPendingSince time.Time
+
 	// Closed and replaced when the access code changes, to force a reconnect
 	cameraConn net.Conn
 	restart    chan struct{}
+	// Closed when the printer is removed or replaced, to end both loops
+	done chan struct{}
+
+	// What talks to the machine; see printer_driver.go
+	driver PrinterDriver
+
+	// The model the printer gave in answer to get_version
+	reportedModel string
 
 	// Set once the MQTT client is running, so commands can be published
 	client mqtt.Client
 
 	// Overridable so tests can point at a mock printer
 	cameraPort int
+	mqttPort   int
 	// FTP settings, also overridable for tests
 	ftpPort      int
 	ftpPlaintext bool
 
 	// Commands carry an incrementing sequence id
 	sequence int
+	// Commands waiting for the printer's answer, by sequence id
+	pending map[string]chan commandReply
+	// Overridable so tests need not wait for the real timeouts
+	ackTimeout    time.Duration
+	settleTimeout time.Duration
 }
 
-// PrinterManager owns the connections to every configured printer.
+// PrinterManager owns the connections to every configured printer. Printers
+// can be added and removed while it runs, so the list is read through lookup
+// and list rather than directly.
 type PrinterManager struct {
+	mu       sync.RWMutex
 	printers []*printer
 	byID     map[string]*printer
 	db       *gorm.DB
+	events   *eventBus
+	// Jobs left running by the last run and closed at startup
+	orphanedJobs []PrintJob
+}
+
+// lookup finds a printer by id.
+func (m *PrinterManager) lookup(id string) (*printer, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.byID[id]
+	return p, ok
+}
+
+// list returns the printers in order, safe to range over while one is being
+// added or removed.
+func (m *PrinterManager) list() []*printer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*printer(nil), m.printers...)
 }
 
 // PrintJob is one print, recorded automatically from the printer's own state
@@ -259,30 +356,44 @@ type PrinterManager struct {
 // by the naming convention in the printer guidelines.
 type PrintJob struct {
 	gorm.Model
-	PrinterID   string     `json:"printer_id" gorm:"index"`
-	PrinterName string     `json:"printer_name"`
-	FileName    string     `json:"file_name"`
-	StartedAt   time.Time  `json:"started_at"`
-	EndedAt     *time.Time `json:"ended_at"`
-	// finished, failed, stopped, or running while still in progress
+	PrinterID   string `json:"printer_id" gorm:"index"`
+	PrinterName string `json:"printer_name"`
+	FileName    string `json:"file_name"`
+	// Who sent it through the site, or else the file name's owner part
+	Owner     string     `json:"owner" gorm:"index"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+	// finished, failed, stopped, interrupted, or running while still in
+	// progress
 	Result      string `json:"result"`
 	StoppedBy   string `json:"stopped_by"`
 	LastPercent int    `json:"last_percent"`
+	// Set when an admin started it from the site rather than the screen
+	StartedBy string `json:"started_by"`
+	// The slicer's figures for the plate, when the file was uploaded through
+	// the site
+	Plate            int              `json:"plate"`
+	EstimatedMinutes int              `json:"estimated_minutes"`
+	FilamentGrams    float64          `json:"filament_grams"`
+	Filaments        []SlicedFilament `json:"filaments" gorm:"serializer:json"`
 }
 
-// PrinterCredential stores an access code changed from the admin page, so the
-// new code survives a restart without anyone editing .env on the server.
-// It overrides whatever PRINTERS specifies.
+// PrinterCredential stores an access code changed from the admin page, from
+// before printers were saved in the database. It is only read when PRINTERS is
+// first imported; codes now live on the Printer row.
 type PrinterCredential struct {
 	gorm.Model
 	PrinterID  string `gorm:"uniqueIndex"`
-	AccessCode string
+	AccessCode string `gorm:"serializer:secret"`
 }
 
 // parsePrinterConfig reads the PRINTERS environment variable. Format:
 //
 //	PRINTERS="Name|host|serial|accesscode,Name2|host2|serial2|accesscode2"
 //
+// Each entry may add the model and nozzle diameter, "...|accesscode|X1C|0.6";
+// without them the model is read from the printer and a 0.4 mm nozzle assumed.
+//
 // Returns an empty slice when unset, so the feature simply stays switched off.
 func parsePrinterConfig(raw string) ([]PrinterConfig, error) {
 	var configs []PrinterConfig
@@ -294,9 +405,9 @@ func parsePrinterConfig(raw string) ([]PrinterConfig, error) {
 		}
 
 		parts := strings.Split(entry, "|")
-		if len(parts) != 4 {
+		if len(parts) < 4 || len(parts) > 6 {
 			return nil, fmt.Errorf(
-				"printer entry %q must be Name|host|serial|accesscode", entry)
+				"printer entry %q must be Name|host|serial|accesscode[|model[|nozzle]]", entry)
 		}
 
 		for i := range parts {
@@ -306,13 +417,25 @@ func parsePrinterConfig(raw string) ([]PrinterConfig, error) {
 			return nil, fmt.Errorf("printer entry %q has an empty field", entry)
 		}
 
-		configs = append(configs, PrinterConfig{
+		config := PrinterConfig{
 			ID:         slugifyPrinterName(parts[0]),
 			Name:       parts[0],
 			Host:       parts[1],
 			Serial:     parts[2],
 			AccessCode: parts[3],
-		})
+			Nozzle:     defaultPrinterNozzle,
+			Driver:     DriverBambu,
+		}
+		if len(parts) > 4 && parts[4] != "" {
+			config.Model = parts[4]
+		}
+		if len(parts) > 5 && parts[5] != "" {
+			if _, err := strconv.ParseFloat(parts[5], 64); err != nil {
+				return nil, fmt.Errorf("printer entry %q has a nozzle that is not a number", entry)
+			}
+			config.Nozzle = parts[5]
+		}
+		configs = append(configs, config)
 	}
 
 	return configs, nil
@@ -341,43 +464,107 @@ func slugifyPrinterName(name string) string {
 // NewPrinterManager starts background connections to every configured printer.
 // Printers that are switched off simply show as offline and keep retrying.
 func NewPrinterManager(configs []PrinterConfig, db *gorm.DB) *PrinterManager {
-	m := &PrinterManager{byID: make(map[string]*printer), db: db}
+	m := &PrinterManager{byID: make(map[string]*printer), db: db, events: newEventBus()}
 
-	// A code changed from the admin page wins over the one in PRINTERS
 	if db != nil {
-		var saved []PrinterCredential
-		if err := db.Find(&saved).Error; err == nil {
-			overrides := make(map[string]string, len(saved))
-			for _, credential := range saved {
-				overrides[credential.PrinterID] = credential.AccessCode
-			}
-			for i := range configs {
-				if code, ok := overrides[configs[i].ID]; ok && code != "" {
-					configs[i].AccessCode = code
-					log.Printf("Printer %s: using the access code saved from the admin page",
-						configs[i].Name)
-				}
-			}
-		}
+		loadHMSDescriptions(db)
+		m.orphanedJobs = closeOrphanedJobs(db, time.Now())
 	}
 
 	for _, cfg := range configs {
-		p := &printer{
-			cfg:        cfg,
-			cameraPort: printerCameraPort,
-			restart:    make(chan struct{}, 1),
-			jobs:       db,
-		}
-		m.printers = append(m.printers, p)
-		m.byID[cfg.ID] = p
+		m.addPrinter(cfg)
+	}
 
-		go p.runStatus()
-		go p.runCamera()
+	go m.watchAvailability()
+	if db != nil {
+		go m.watchMaintenance()
 	}
 
 	return m
 }
 
+// newPrinter builds a printer that has not been connected yet.
+func (m *PrinterManager) newPrinter(cfg PrinterConfig) *printer {
+	p := &printer{
+		cfg:        cfg,
+		cameraPort: printerCameraPort,
+		restart:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		jobs:       m.db,
+		events:     m.events,
+	}
+	p.driver = newPrinterDriver(p)
+	p.loadCertificate()
+	return p
+}
+
+// addPrinter starts connecting to a printer and adds it to the list.
+func (m *PrinterManager) addPrinter(cfg PrinterConfig) *printer {
+	p := m.newPrinter(cfg)
+
+	m.mu.Lock()
+	m.printers = append(m.printers, p)
+	m.byID[cfg.ID] = p
+	m.mu.Unlock()
+
+	go p.protocol().Run(p.done)
+	return p
+}
+
+// removePrinter takes a printer off the list and closes its connections.
+func (m *PrinterManager) removePrinter(id string) {
+	m.mu.Lock()
+	p, ok := m.byID[id]
+	if ok {
+		delete(m.byID, id)
+		for i, other := range m.printers {
+			if other == p {
+				m.printers = append(m.printers[:i:i], m.printers[i+1:]...)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if ok {
+		p.shutdown()
+	}
+}
+
+// shutdown ends both connection loops for good.
+func (p *printer) shutdown() {
+	p.mu.Lock()
+	if p.done == nil || p.stopped() {
+		p.mu.Unlock()
+		return
+	}
+	close(p.done)
+	conn := p.cameraConn
+	p.cameraConn = nil
+	p.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// stopped reports whether the printer has been shut down.
+func (p *printer) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// lastReportAt is when the printer last reported, zero if it never has.
+func (p *printer) lastReportAt() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.lastReport
+}
+
 // accessCode returns the current code, which an admin can change at runtime.
 func (p *printer) accessCode() string {
 	p.mu.RLock()
@@ -430,6 +617,8 @@ func (p *printer) runStatus() {
 			case <-p.restart:
 				log.Printf("printer %s: reconnecting with the new access code", p.cfg.Name)
 				break inner
+			case <-p.done:
+				break inner
 			}
 		}
 
@@ -439,18 +628,30 @@ func (p *printer) runStatus() {
 		p.mu.Lock()
 		p.client = nil
 		p.mu.Unlock()
+
+		if p.stopped() {
+			return
+		}
+	}
+}
+
+// brokerURL is the printer's MQTT broker.
+func (p *printer) brokerURL() string {
+	port := p.mqttPort
+	if port == 0 {
+		port = printerMQTTPort
 	}
+	return fmt.Sprintf("ssl://%s:%d", p.cfg.Host, port)
 }
 
 func (p *printer) connectStatus() mqtt.Client {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("ssl://%s:%d", p.cfg.Host, printerMQTTPort))
+	opts.AddBroker(p.brokerURL())
 	opts.SetClientID(fmt.Sprintf("rrc-inventory-%s", p.cfg.ID))
 	opts.SetUsername("bblp")
 	opts.SetPassword(p.accessCode())
-	// The printer uses a self-signed certificate; there is no CA to check it
-	// against, and this traffic never leaves the printer network.
-	opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true}) // #nosec G402
+	// The printer uses a self-signed certificate, so it is pinned instead
+	opts.SetTLSConfig(p.tlsConfig())
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(15 * time.Second)
@@ -473,6 +674,12 @@ func (p *printer) connectStatus() mqtt.Client {
 		// push, which can be minutes away on an idle printer.
 		c.Publish(requestTopic, 0, false,
 			`{"pushing":{"command":"pushall"}}`)
+
+		// Unless an admin has said, ask what model this is
+		if p.needsVersion() {
+			c.Publish(requestTopic, 0, false,
+				fmt.Sprintf(`{"info":{"sequence_id":"%d","command":"get_version"}}`, p.nextSequence()))
+		}
 	})
 
 	client := mqtt.NewClient(opts)
@@ -481,8 +688,15 @@ func (p *printer) connectStatus() mqtt.Client {
 	p.client = client
 	p.mu.Unlock()
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Printf("printer %s: initial connect failed: %v", p.cfg.Name, token.Error())
+	// With retries on, the first connect to a switched-off printer never
+	// finishes; a printer removed meanwhile is disconnected by runStatus.
+	token := client.Connect()
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			log.Printf("printer %s: initial connect failed: %v", p.cfg.Name, token.Error())
+		}
+	case <-p.done:
 	}
 
 	return client
@@ -501,6 +715,12 @@ func (p *printer) applyReport(payload []byte) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	// A printer removed or replaced may still be disconnecting; what it
+	// hears now belongs to its replacement
+	if p.stopped() {
+		return
+	}
+
 	// Any well-formed report means the printer is alive and talking
 	p.lastReport = time.Now()
 
@@ -517,6 +737,9 @@ func (p *printer) applyReport(payload []byte) {
 	if info.SubtaskName != nil {
 		p.fileName = *info.SubtaskName
 	}
+	if info.GcodeFile != nil {
+		p.gcodeFile = *info.GcodeFile
+	}
 	if info.NozzleTemper != nil {
 		p.nozzleTemp = *info.NozzleTemper
 	}
@@ -527,9 +750,20 @@ func (p *printer) applyReport(payload []byte) {
 		p.chamberTemp = *info.ChamberTemper
 	}
 
+	p.acknowledgeLocked(&info.commandReply)
+	p.acknowledgeLocked(report.System)
+
+	if report.Info != nil && report.Info.Command == "get_version" {
+		if model := modelFromVersion(report.Info.Module); model != "" && model != p.reportedModel {
+			p.reportedModel = model
+			log.Printf("printer %s: reports itself as a %s", p.cfg.Name, model)
+		}
+	}
+
 	if info.LightsReport != nil {
+		lights := p.capabilitiesLocked().Lights
 		for _, light := range *info.LightsReport {
-			if light.Node == "chamber_light" {
+			if len(lights) > 0 && light.Node == lights[0] {
 				p.lightOn = strings.EqualFold(light.Mode, "on")
 			}
 		}
@@ -583,13 +817,15 @@ func (p *printer) applyReport(payload []byte) {
 			}
 			code := formatHMS(fault.Attr, fault.Code)
 			faults = append(faults, HMSFault{
-				Code:     code,
-				Severity: hmsSeverity(fault.Code),
+				Code:        code,
+				Severity:    hmsSeverity(fault.Code),
+				Description: describeHMS(code),
 				// Bambu documents each code on its wiki under this path
 				URL: "https://wiki.bambulab.com/en/hms/" + code,
 			})
 		}
 		p.faults = faults
+		p.recordFaultsLocked(faults, p.lastReport)
 	}
 
 	p.trackJobLocked(previousState)
@@ -614,12 +850,19 @@ func (p *printer) trackJobLocked(previousState string) {
 			PrinterID:   p.cfg.ID,
 			PrinterName: p.cfg.Name,
 			FileName:    p.fileName,
+			Owner:       fileOwner(p.fileName),
 			StartedAt:   now,
 			Result:      "running",
 			LastPercent: p.progress,
 		}
+		if p.startedBy != "" && now.Sub(p.startedAt) < startAttributionWindow {
+			job.StartedBy = p.startedBy
+			p.startedBy = ""
+		}
+		p.applySliceMetadataLocked(job)
 		if err := p.jobs.Create(job).Error; err == nil {
 			p.currentJob = job
+			p.linkUploadLocked(job)
 		}
 		return
 	}
@@ -654,9 +897,69 @@ func (p *printer) closeJobLocked(result string, at time.Time) {
 		p.currentJob.StoppedBy = p.lastActionBy
 	}
 	p.jobs.Save(p.currentJob)
+	p.emitJobEventLocked(p.currentJob)
 	p.currentJob = nil
 }
 
+// closeOrphanedJobs closes jobs a previous run of the server left running.
+// Nothing saw them end, and left open they would count as printing until now
+// in every report, so each is marked interrupted and taken to have ended when
+// the slicer expected it to, or else when it was last saved. A print that is
+// in fact still going is picked up as a new job by the next report. The jobs
+// closed are returned for AnnounceOrphanedJobs.
+func closeOrphanedJobs(db *gorm.DB, now time.Time) []PrintJob {
+	var orphans []PrintJob
+	if err := db.Where("result = ? AND ended_at IS NULL", "running").Find(&orphans).Error; err != nil {
+		log.Printf("Warning: could not look for unfinished print jobs: %v", err)
+		return nil
+	}
+	for i := range orphans {
+		end := orphanedJobEnd(orphans[i], now)
+		orphans[i].Result = "interrupted"
+		orphans[i].EndedAt = &end
+		db.Model(&orphans[i]).Updates(map[string]interface{}{"result": "interrupted", "ended_at": end})
+	}
+	if len(orphans) > 0 {
+		log.Printf("Closed %d print jobs left running before the restart", len(orphans))
+	}
+	return orphans
+}
+
+// AnnounceOrphanedJobs raises the events for the jobs closed at startup. They
+// are closed before anything can subscribe, so this waits to be called once
+// everything has.
+func (m *PrinterManager) AnnounceOrphanedJobs() {
+	for _, job := range m.orphanedJobs {
+		m.events.publish(PrinterEvent{
+			Type:        jobEventTypes[job.Result],
+			PrinterID:   job.PrinterID,
+			PrinterName: job.PrinterName,
+			FileName:    job.FileName,
+			Owner:       jobOwner(job),
+			JobID:       job.ID,
+			Message:     fmt.Sprintf("%s: %s %s", job.PrinterName, job.FileName, job.Result),
+			At:          *job.EndedAt,
+		})
+	}
+	m.orphanedJobs = nil
+}
+
+// orphanedJobEnd is the best guess at when an unwatched job ended: its
+// estimated end, or its last save, but not past now.
+func orphanedJobEnd(job PrintJob, now time.Time) time.Time {
+	end := job.UpdatedAt
+	if job.EstimatedMinutes > 0 {
+		end = job.StartedAt.Add(time.Duration(job.EstimatedMinutes) * time.Minute)
+	}
+	if end.After(now) {
+		end = now
+	}
+	if end.Before(job.StartedAt) {
+		end = job.StartedAt
+	}
+	return end
+}
+
 // --- camera over TLS ----------------------------------------------------
 
 // cameraAuthPacket builds the 80 byte handshake the printer expects:
@@ -674,23 +977,40 @@ func cameraAuthPacket(username, accessCode string) []byte {
 
 func (p *printer) runCamera() {
 	for {
-		if err := p.streamCamera(); err != nil {
+		// An X1's RTSP stream cannot be shown; check again in case the
+		// model was only a guess
+		if p.capabilities().Camera != CameraJPEG {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		if err := p.streamCamera(); err != nil && !p.stopped() {
 			log.Printf("printer %s: camera: %v", p.cfg.Name, err)
 		}
-		time.Sleep(10 * time.Second)
+		select {
+		case <-p.done:
+			return
+		case <-time.After(10 * time.Second):
+		}
 	}
 }
 
-func (p *printer) streamCamera() error {
+// cameraAddress is where the printer serves its JPEG stream.
+func (p *printer) cameraAddress() string {
 	port := p.cameraPort
 	if port == 0 {
 		port = printerCameraPort
 	}
-	address := net.JoinHostPort(p.cfg.Host, fmt.Sprint(port))
+	return net.JoinHostPort(p.cfg.Host, fmt.Sprint(port))
+}
 
+func (p *printer) streamCamera() error {
 	dialer := &net.Dialer{Timeout: 10 * time.Second}
-	conn, err := tls.DialWithDialer(dialer, "tcp", address,
-		&tls.Config{InsecureSkipVerify: true}) // #nosec G402 - self-signed printer cert
+	conn, err := tls.DialWithDialer(dialer, "tcp", p.cameraAddress(), p.tlsConfig())
 	if err != nil {
 		return fmt.Errorf("connect: %w", err)
 	}
@@ -702,6 +1022,10 @@ func (p *printer) streamCamera() error {
 
 	// Hold the connection so a credential change can drop it immediately
 	p.mu.Lock()
+	if p.stopped() {
+		p.mu.Unlock()
+		return nil
+	}
 	p.cameraConn = conn
 	p.mu.Unlock()
 
@@ -789,11 +1113,14 @@ func (p *printer) status() PrinterStatus {
 	cameraOnline := p.lastFrame != nil && time.Since(p.lastFrameAt) < cameraStaleAfter
 
 	status := PrinterStatus{
-		ID:                p.cfg.ID,
-		Name:              p.cfg.Name,
-		Online:            online,
-		CameraOnline:      cameraOnline,
-		AccessCodeProblem: p.authFailed,
+		ID:                 p.cfg.ID,
+		Name:               p.cfg.Name,
+		Online:             online,
+		CameraOnline:       cameraOnline,
+		AccessCodeProblem:  p.authFailed,
+		CertificateWarning: p.certificateWarningLocked(),
+		Model:              p.modelLocked(),
+		Capabilities:       p.capabilitiesLocked(),
 	}
 
 	if p.lastActionBy != "" {
@@ -803,6 +1130,17 @@ func (p *printer) status() PrinterStatus {
 		status.LastActionAt = &at
 	}
 
+	status.Maintenance = p.maintenance
+	if status.Maintenance == "" {
+		status.Maintenance = MaintenanceOK
+	}
+	status.MaintenanceDue = p.maintenanceDue
+	if status.MaintenanceDue == nil {
+		status.MaintenanceDue = []string{}
+	}
+	status.UnderMaintenance = p.underMaintenance
+	status.MaintenanceNote = p.maintenanceNote
+
 	status.LightOn = p.lightOn
 	status.AMS = p.amsUnits
 	if status.AMS == nil {
@@ -821,7 +1159,9 @@ func (p *printer) status() PrinterStatus {
 		status.FileName = p.fileName
 		status.NozzleTemp = p.nozzleTemp
 		status.BedTemp = p.bedTemp
-		status.ChamberTemp = p.chamberTemp
+		if status.Capabilities.ChamberTemp {
+			status.ChamberTemp = p.chamberTemp
+		}
 
 		updated := p.lastReport.Format(time.RFC3339)
 		status.UpdatedAt = &updated
@@ -832,8 +1172,9 @@ func (p *printer) status() PrinterStatus {
 
 // Statuses returns the current state of every configured printer.
 func (m *PrinterManager) Statuses() []PrinterStatus {
-	statuses := make([]PrinterStatus, 0, len(m.printers))
-	for _, p := range m.printers {
+	printers := m.list()
+	statuses := make([]PrinterStatus, 0, len(printers))
+	for _, p := range printers {
 		statuses = append(statuses, p.status())
 	}
 	return statuses
@@ -841,7 +1182,7 @@ func (m *PrinterManager) Statuses() []PrinterStatus {
 
 // Frame returns the latest camera frame for one printer.
 func (m *PrinterManager) Frame(id string) ([]byte, bool) {
-	p, ok := m.byID[id]
+	p, ok := m.lookup(id)
 	if !ok {
 		return nil, false
 	}
@@ -857,8 +1198,9 @@ var stoppableStates = map[string]bool{
 	"SLICING": true,
 }
 
-// publishCommand sends one command on the printer's request topic. Every
-// write the system can make goes through here.
+// publishCommand sends one command on the printer's request topic and waits
+// for the printer's answer; see printer_acks.go. Every write the system can
+// make goes through here.
 func (p *printer) publishCommand(payload string) error {
 	p.mu.Lock()
 	client := p.client
@@ -869,6 +1211,10 @@ func (p *printer) publishCommand(payload string) error {
 		return fmt.Errorf("printer is not reachable")
 	}
 
+	seq := commandSequence(payload)
+	reply := p.expectReply(seq)
+	defer p.forgetReply(seq)
+
 	topic := fmt.Sprintf("device/%s/request", p.cfg.Serial)
 	token := client.Publish(topic, 0, false, payload)
 	if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
@@ -877,7 +1223,9 @@ func (p *printer) publishCommand(payload string) error {
 		}
 		return fmt.Errorf("timed out sending the command")
 	}
-	return nil
+
+	// Sent is not done: wait for the printer to say so
+	return p.awaitReply(reply)
 }
 
 func (p *printer) nextSequence() int {
@@ -890,6 +1238,17 @@ func (p *printer) nextSequence() int {
 // pauseStates are the states where pausing makes sense.
 var pauseStates = map[string]bool{"RUNNING": true, "PREPARE": true}
 
+// reachable refuses a command for a printer that has gone quiet, rather than
+// sending it into the void and reporting success.
+func (p *printer) reachable() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.lastReport.IsZero() || time.Since(p.lastReport) >= statusStaleAfter {
+		return fmt.Errorf("printer is not reachable")
+	}
+	return nil
+}
+
 // pause halts the current job. Unlike stop this is reversible, though a long
 // pause can still spoil a print.
 func (p *printer) pause(adminName string) error {
@@ -900,14 +1259,18 @@ func (p *printer) pause(adminName string) error {
 	if !pauseStates[state] {
 		return fmt.Errorf("nothing is printing right now (state: %s)", state)
 	}
-
-	payload := fmt.Sprintf(`{"print":{"sequence_id":"%d","command":"pause"}}`, p.nextSequence())
-	if err := p.publishCommand(payload); err != nil {
+	if err := p.reachable(); err != nil {
+		return err
+	}
+	err := p.confirm("pause", p.protocol().Pause(), func(state string) bool {
+		return state == "PAUSE"
+	})
+	if err != nil {
 		return err
 	}
 
 	p.recordAction(adminName)
-	log.Printf("printer %s: pause requested by %s", p.cfg.Name, adminName)
+	p.logAction(adminName, "pause", "")
 	return nil
 }
 
@@ -920,30 +1283,28 @@ func (p *printer) resume(adminName string) error {
 	if state != "PAUSE" {
 		return fmt.Errorf("the printer is not paused (state: %s)", state)
 	}
-
-	payload := fmt.Sprintf(`{"print":{"sequence_id":"%d","command":"resume"}}`, p.nextSequence())
-	if err := p.publishCommand(payload); err != nil {
+	if err := p.reachable(); err != nil {
+		return err
+	}
+	err := p.confirm("resume", p.protocol().Resume(), func(state string) bool {
+		return state == "RUNNING"
+	})
+	if err != nil {
 		return err
 	}
 
 	p.recordAction(adminName)
-	log.Printf("printer %s: resume requested by %s", p.cfg.Name, adminName)
+	p.logAction(adminName, "resume", "")
 	return nil
 }
 
 // setLight switches the chamber light. Harmless, and it makes the camera
 // usable when someone has left the light off.
 func (p *printer) setLight(on bool) error {
-	mode := "off"
-	if on {
-		mode = "on"
+	if err := p.supports(CommandLight); err != nil {
+		return err
 	}
-
-	payload := fmt.Sprintf(
-		`{"system":{"sequence_id":"%d","command":"ledctrl","led_node":"chamber_light","led_mode":"%s","led_on_time":500,"led_off_time":500,"loop_times":0,"interval_time":0}}`,
-		p.nextSequence(), mode)
-
-	if err := p.publishCommand(payload); err != nil {
+	if err := p.protocol().SetLight(on); err != nil {
 		return err
 	}
 
@@ -964,46 +1325,45 @@ func (p *printer) recordAction(adminName string) {
 // stop asks the printer to abort the current job. Read-only everywhere else,
 // this is the single command the system can send, and only admins reach it.
 func (p *printer) stop(adminName string) error {
-	p.mu.Lock()
-	client := p.client
-	online := !p.lastReport.IsZero() && time.Since(p.lastReport) < statusStaleAfter
-	state := p.state
-	p.sequence++
-	sequence := p.sequence
-	p.mu.Unlock()
-
-	if client == nil || !client.IsConnected() || !online {
-		return fmt.Errorf("printer is not reachable")
+	if err := p.reachable(); err != nil {
+		return err
 	}
 
+	p.mu.RLock()
+	state := p.state
+	p.mu.RUnlock()
+
 	if !stoppableStates[strings.ToUpper(state)] {
 		return fmt.Errorf("nothing is printing right now (state: %s)", state)
 	}
 
-	payload := fmt.Sprintf(
-		`{"print":{"sequence_id":"%d","command":"stop"}}`, sequence)
+	// The job closes as soon as the printer reports it stopped, which is
+	// before confirm returns, so who stopped it is noted first
+	jobID := p.currentJobID()
+	p.mu.Lock()
+	previousBy, previousAt := p.lastActionBy, p.lastActionAt
+	p.mu.Unlock()
+	p.recordAction(adminName)
 
-	topic := fmt.Sprintf("device/%s/request", p.cfg.Serial)
-	token := client.Publish(topic, 0, false, payload)
-	if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
-		if token.Error() != nil {
-			return fmt.Errorf("could not send the stop command: %w", token.Error())
+	err := p.confirm("stop", p.protocol().Stop(), func(state string) bool {
+		return !stoppableStates[state]
+	})
+	if err != nil {
+		p.mu.Lock()
+		if p.lastActionBy == adminName {
+			p.lastActionBy, p.lastActionAt = previousBy, previousAt
 		}
-		return fmt.Errorf("timed out sending the stop command")
+		p.mu.Unlock()
+		return err
 	}
 
-	p.mu.Lock()
-	p.lastActionBy = adminName
-	p.lastActionAt = time.Now()
-	p.mu.Unlock()
-
-	log.Printf("printer %s: stop requested by %s", p.cfg.Name, adminName)
+	p.logActionOn(jobID, adminName, "stop", "")
 	return nil
 }
 
 // Stop aborts the current job on one printer.
 func (m *PrinterManager) Stop(id, adminName string) error {
-	p, ok := m.byID[id]
+	p, ok := m.lookup(id)
 	if !ok {
 		return fmt.Errorf("unknown printer")
 	}
@@ -1012,7 +1372,7 @@ func (m *PrinterManager) Stop(id, adminName string) error {
 
 // Pause halts the current job.
 func (m *PrinterManager) Pause(id, adminName string) error {
-	p, ok := m.byID[id]
+	p, ok := m.lookup(id)
 	if !ok {
 		return fmt.Errorf("unknown printer")
 	}
@@ -1021,7 +1381,7 @@ func (m *PrinterManager) Pause(id, adminName string) error {
 
 // Resume continues a paused job.
 func (m *PrinterManager) Resume(id, adminName string) error {
-	p, ok := m.byID[id]
+	p, ok := m.lookup(id)
 	if !ok {
 		return fmt.Errorf("unknown printer")
 	}
@@ -1029,57 +1389,89 @@ func (m *PrinterManager) Resume(id, adminName string) error {
 }
 
 // SetLight switches a printer's chamber light.
-func (m *PrinterManager) SetLight(id string, on bool) error {
-	p, ok := m.byID[id]
+func (m *PrinterManager) SetLight(id, adminName string, on bool) error {
+	p, ok := m.lookup(id)
 	if !ok {
 		return fmt.Errorf("unknown printer")
 	}
-	return p.setLight(on)
+	if err := p.setLight(on); err != nil {
+		return err
+	}
+	if on {
+		p.logAction(adminName, "light", "on")
+	} else {
+		p.logAction(adminName, "light", "off")
+	}
+	return nil
 }
 
-// UpdateAccessCode changes a printer's access code, saves it so it survives a
-// restart, and reconnects. No downtime, no editing files on the server.
-func (m *PrinterManager) UpdateAccessCode(id, code string) error {
-	p, ok := m.byID[id]
+// UpdateAccessCode tests a new access code on the printer, and once it is
+// accepted saves it so it survives a restart and reconnects. No downtime, no
+// editing files on the server. A code the printer rejects is never saved; one
+// that could not be tested because the printer is unreachable is saved only
+// with saveUntested. See printer_access_codes.go.
+func (m *PrinterManager) UpdateAccessCode(id, code string, saveUntested bool) (AccessCodeCheck, error) {
+	p, ok := m.lookup(id)
 	if !ok {
-		return fmt.Errorf("unknown printer")
+		return AccessCodeCheck{}, fmt.Errorf("unknown printer")
 	}
 
 	code = strings.TrimSpace(code)
 	if code == "" {
-		return fmt.Errorf("access code cannot be empty")
+		return AccessCodeCheck{}, fmt.Errorf("access code cannot be empty")
+	}
+
+	check := AccessCodeCheck{Result: AccessCodeNotTested}
+	if p.cfg.Driver == "" || p.cfg.Driver == DriverBambu {
+		check = p.checkAccessCode(code)
+	}
+	switch {
+	case check.Result == AccessCodeRejected:
+		return check, fmt.Errorf("%s rejected that access code, so it was not saved - check it against the printer screen", p.cfg.Name)
+	case check.Result == AccessCodeUnreachable && !saveUntested:
+		return check, fmt.Errorf("%s could not be reached to test the code, so it was not saved (%s)", p.cfg.Name, check.Detail)
 	}
 
 	if m.db != nil {
-		credential := PrinterCredential{PrinterID: id, AccessCode: code}
-		err := m.db.Where(PrinterCredential{PrinterID: id}).
-			Assign(PrinterCredential{AccessCode: code}).
-			FirstOrCreate(&credential).Error
+		// From a struct, so the code is encrypted on the way in
+		err := m.db.Model(&Printer{}).Where("slug = ?", id).Updates(&Printer{AccessCode: code}).Error
 		if err != nil {
-			return fmt.Errorf("could not save the new access code: %w", err)
+			return check, fmt.Errorf("could not save the new access code: %w", err)
 		}
 	}
 
 	p.setAccessCode(code)
-	log.Printf("printer %s: access code updated", p.cfg.Name)
-	return nil
+	log.Printf("printer %s: access code updated (%s)", p.cfg.Name, check.Result)
+	return check, nil
 }
 
 // Configured reports whether any printers are set up at all.
 func (m *PrinterManager) Configured() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.printers) > 0
 }
 
-// loadPrinterManager builds the manager from the environment.
+// loadPrinterManager builds the manager from the saved printers, importing
+// PRINTERS the first time.
 func loadPrinterManager(db *gorm.DB) *PrinterManager {
 	configs, err := parsePrinterConfig(os.Getenv("PRINTERS"))
 	if err != nil {
 		log.Printf("Ignoring PRINTERS setting: %v", err)
-		return NewPrinterManager(nil, db)
+		configs = nil
+	}
+
+	if db != nil {
+		saved, err := loadPrinters(db, configs)
+		if err != nil {
+			log.Printf("Could not load the saved printers: %v", err)
+		} else {
+			configs = saved
+		}
 	}
 
 	if len(configs) == 0 {
-		log.Println("No printers configured (set PRINTERS to enable the printer page)")
+		log.Println("No printers configured (add one from the admin page, or set PRINTERS)")
 	} else {
 		for _, cfg := range configs {
 			log.Printf("Printer configured: %s at %s", cfg.Name, cfg.Host)
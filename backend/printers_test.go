@@ -40,6 +40,27 @@ func TestParsePrinterConfig(t *testing.T) {
 	if configs[1].Host != "192.168.2.102" || configs[1].AccessCode != "abcd1234" {
 		t.Errorf("whitespace not trimmed: %+v", configs[1])
 	}
+	// The model is left to be detected; the nozzle defaults to 0.4 mm
+	if configs[0].Model != "" || configs[0].Nozzle != "0.4" {
+		t.Errorf("unexpected defaults: %+v", configs[0])
+	}
+}
+
+func TestParsePrinterConfigModelAndNozzle(t *testing.T) {
+	configs, err := parsePrinterConfig("X1|192.168.2.103|00M09A1|code|X1C|0.6")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if configs[0].Model != "X1C" || configs[0].Nozzle != "0.6" {
+		t.Errorf("unexpected model/nozzle: %+v", configs[0])
+	}
+
+	if _, err := parsePrinterConfig("X1|host|serial|code|X1C|wide"); err == nil {
+		t.Error("expected an error for a nozzle that is not a number")
+	}
+	if _, err := parsePrinterConfig("X1|host|serial|code|X1C|0.4|extra"); err == nil {
+		t.Error("expected an error for too many fields")
+	}
 }
 
 func TestParsePrinterConfigEmptyAndInvalid(t *testing.T) {
@@ -571,3 +592,22 @@ func TestHMSFormatting(t *testing.T) {
 		}
 	}
 }
+
+func TestOrphanedJobEnd(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	now := start.Add(30 * 24 * time.Hour)
+	saved := PrintJob{StartedAt: start}
+	saved.UpdatedAt = start.Add(time.Minute)
+
+	if end := orphanedJobEnd(saved, now); !end.Equal(saved.UpdatedAt) {
+		t.Errorf("with no estimate it should end when last saved, got %v", end)
+	}
+	estimated := saved
+	estimated.EstimatedMinutes = 90
+	if end := orphanedJobEnd(estimated, now); !end.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("it should end when the slicer expected, got %v", end)
+	}
+	if end := orphanedJobEnd(estimated, start.Add(time.Hour)); !end.Equal(start.Add(time.Hour)) {
+		t.Errorf("it should not end after now, got %v", end)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+// Secrets at rest.
+//
+// Printer access codes and alert webhook URLs used to sit in the database as
+// typed, so every backup.sh archive carried them. Columns tagged `gorm:"serializer:secret"`
+// are now encrypted before they are written and decrypted as they are read,
+// keyed from SECRET_KEY (or a file named by SECRET_KEY_FILE), which lives in
+// .env and so never goes into a backup.
+//
+// Each value is envelope encrypted: it is sealed with AES-256-GCM under a
+// fresh data key, and the data key is sealed under the server key. Rotating
+// the server key therefore only re-seals the small data keys. To rotate, set
+// the new key as SECRET_KEY and the old one in SECRET_KEY_PREVIOUS; the next
+// start re-seals everything under the new key, after which the old one can be
+// dropped. The same pass encrypts values written before there was a key.
+//
+// Without a key, secrets are stored as they are, with a warning at start.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// secretPrefix marks an encrypted value; anything else is plain text from
+// before encryption.
+const secretPrefix = "enc:v1:"
+
+// secretColumns are the encrypted columns, for the migration. A new secret
+// column is tagged serializer:secret and listed here.
+var secretColumns = []struct{ Table, Column string }{
+	{"printers", "access_code"},
+	{"printer_credentials", "access_code"},
+	{"alert_subscriptions", "url"},
+}
+
+// secretKey is one server key, named by the start of its hash so a value
+// records which key sealed it without giving the key away.
+type secretKey struct {
+	ID  string
+	Key []byte
+}
+
+// secretKeyring is the current key and any previous ones still accepted.
+type secretKeyring struct {
+	current  secretKey
+	previous []secretKey
+}
+
+// secretKeys is set at start; nil means no key is configured.
+var secretKeys *secretKeyring
+
+func init() {
+	schema.RegisterSerializer("secret", SecretSerializer{})
+}
+
+// parseSecretKey reads a 32-byte key written as base64 or hex.
+func parseSecretKey(text string) (secretKey, error) {
+	text = strings.TrimSpace(text)
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return secretKey{}, fmt.Errorf("a secret key must be 32 bytes as base64 or hex - make one with openssl rand -base64 32")
+	}
+	sum := sha256.Sum256(key)
+	return secretKey{ID: hex.EncodeToString(sum[:4]), Key: key}, nil
+}
+
+// newSecretKeyring builds the keyring from the current key and previous ones;
+// with no current key there is nothing to encrypt with and it returns nil.
+func newSecretKeyring(current string, previous []string) (*secretKeyring, error) {
+	if strings.TrimSpace(current) == "" {
+		return nil, nil
+	}
+	key, err := parseSecretKey(current)
+	if err != nil {
+		return nil, fmt.Errorf("SECRET_KEY: %w", err)
+	}
+	ring := &secretKeyring{current: key}
+	for _, text := range previous {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		old, err := parseSecretKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET_KEY_PREVIOUS: %w", err)
+		}
+		ring.previous = append(ring.previous, old)
+	}
+	return ring, nil
+}
+
+// loadSecretKeys reads SECRET_KEY or SECRET_KEY_FILE, and SECRET_KEY_PREVIOUS
+// as a comma separated list.
+func loadSecretKeys() (*secretKeyring, error) {
+	current := os.Getenv("SECRET_KEY")
+	if path := os.Getenv("SECRET_KEY_FILE"); current == "" && path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET_KEY_FILE: %w", err)
+		}
+		current = string(contents)
+	}
+	return newSecretKeyring(current, strings.Split(os.Getenv("SECRET_KEY_PREVIOUS"), ","))
+}
+
+// key finds a key by id, current or previous.
+func (r *secretKeyring) key(id string) (secretKey, bool) {
+	if r.current.ID == id {
+		return r.current, true
+	}
+	for _, key := range r.previous {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return secretKey{}, false
+}
+
+// seal encrypts with AES-256-GCM, returning the nonce followed by the
+// ciphertext.
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal opens what seal sealed.
+func unseal(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed value is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// Encrypt seals a value under a new data key, itself sealed under the
+// current server key: enc:v1:<key id>:<sealed data key>:<sealed value>.
+func (r *secretKeyring) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	sealedKey, err := seal(r.current.Key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedValue, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	return secretPrefix + r.current.ID + ":" + encode(sealedKey) + ":" + encode(sealedValue), nil
+}
+
+// splitSecret takes an encrypted value apart.
+func splitSecret(value string) (keyID string, sealedKey, sealedValue []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(value, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value")
+	}
+	if sealedKey, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value")
+	}
+	if sealedValue, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, fmt.Errorf("malformed encrypted value")
+	}
+	return parts[0], sealedKey, sealedValue, nil
+}
+
+// dataKey opens the data key of an encrypted value.
+func (r *secretKeyring) dataKey(keyID string, sealedKey []byte) ([]byte, error) {
+	key, ok := r.key(keyID)
+	if !ok {
+		return nil, fmt.Errorf("encrypted with key %s, which is neither SECRET_KEY nor in SECRET_KEY_PREVIOUS", keyID)
+	}
+	dataKey, err := unseal(key.Key, sealedKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the data key sealed with key %s", keyID)
+	}
+	return dataKey, nil
+}
+
+// Decrypt opens a value from Encrypt. Plain text from before encryption is
+// returned as it is.
+func (r *secretKeyring) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	if r == nil {
+		return "", fmt.Errorf("this value is encrypted but SECRET_KEY is not set")
+	}
+	keyID, sealedKey, sealedValue, err := splitSecret(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := r.dataKey(keyID, sealedKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := unseal(dataKey, sealedValue)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt a value sealed with key %s", keyID)
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap brings a stored value under the current key: plain text is
+// encrypted, and a value sealed with a previous key has its data key
+// re-sealed, leaving the value itself as it was. changed is false when the
+// value is already current.
+func (r *secretKeyring) Rewrap(value string) (rewrapped string, changed bool, err error) {
+	if value == "" {
+		return value, false, nil
+	}
+	if !strings.HasPrefix(value, secretPrefix) {
+		rewrapped, err = r.Encrypt(value)
+		return rewrapped, err == nil, err
+	}
+	keyID, sealedKey, sealedValue, err := splitSecret(value)
+	if err != nil {
+		return "", false, err
+	}
+	if keyID == r.current.ID {
+		return value, false, nil
+	}
+	dataKey, err := r.dataKey(keyID, sealedKey)
+	if err != nil {
+		return "", false, err
+	}
+	resealed, err := seal(r.current.Key, dataKey)
+	if err != nil {
+		return "", false, err
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	return secretPrefix + r.current.ID + ":" + encode(resealed) + ":" + encode(sealedValue), true, nil
+}
+
+// SecretSerializer encrypts a string column for gorm. Updates given as a map
+// skip serializers, so secret columns must be written from a struct.
+type SecretSerializer struct{}
+
+// Scan decrypts a value as it is read.
+func (SecretSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		stored = string(v)
+	case string:
+		stored = v
+	default:
+		return fmt.Errorf("%s: cannot decrypt a %T", field.Name, dbValue)
+	}
+	plaintext, err := secretKeys.Decrypt(stored)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field.Name, err)
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+// Value encrypts a value as it is written. An empty value stays empty, so
+// "not set" can still be queried.
+func (SecretSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, _ := fieldValue.(string)
+	if plaintext == "" || secretKeys == nil {
+		return plaintext, nil
+	}
+	return secretKeys.Encrypt(plaintext)
+}
+
+// migrateSecrets encrypts secret values stored before there was a key, and
+// re-seals those from a previous key under the current one. Without a key it
+// only checks nothing is already encrypted, since that could not be read.
+func migrateSecrets(db *gorm.DB, keys *secretKeyring) error {
+	for _, column := range secretColumns {
+		var rows []struct {
+			ID    uint
+			Value string
+		}
+		err := db.Table(column.Table).Select("id, " + column.Column + " AS value").
+			Where(column.Column + " <> ''").Scan(&rows).Error
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", column.Table, column.Column, err)
+		}
+
+		if keys == nil {
+			for _, row := range rows {
+				if strings.HasPrefix(row.Value, secretPrefix) {
+					return fmt.Errorf("%s.%s is encrypted but SECRET_KEY is not set", column.Table, column.Column)
+				}
+			}
+			if len(rows) > 0 {
+				log.Printf("Warning: SECRET_KEY is not set, so %d values in %s.%s are stored unencrypted",
+					len(rows), column.Table, column.Column)
+			}
+			continue
+		}
+
+		changed := 0
+		for _, row := range rows {
+			value, rewrapped, err := keys.Rewrap(row.Value)
+			if err != nil {
+				return fmt.Errorf("%s.%s row %d: %w", column.Table, column.Column, row.ID, err)
+			}
+			if !rewrapped {
+				continue
+			}
+			if err := db.Table(column.Table).Where("id = ?", row.ID).Update(column.Column, value).Error; err != nil {
+				return fmt.Errorf("%s.%s row %d: %w", column.Table, column.Column, row.ID, err)
+			}
+			changed++
+		}
+		if changed > 0 {
+			log.Printf("Encrypted %d values in %s.%s under key %s", changed, column.Table, column.Column, keys.current.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm/schema"
+)
+
+const (
+	testSecretKey  = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	otherSecretKey = "6162636465666768696a6b6c6d6e6f707172737475767778797a303132333435"
+)
+
+func testKeyring(t *testing.T, current string, previous ...string) *secretKeyring {
+	t.Helper()
+	ring, err := newSecretKeyring(current, previous)
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	return ring
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	ring := testKeyring(t, testSecretKey)
+
+	first, err := ring.Encrypt("89a8541a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ring.Encrypt("89a8541a")
+	if !strings.HasPrefix(first, secretPrefix) || strings.Contains(first, "89a8541a") || first == second {
+		t.Errorf("encrypted as %q and %q", first, second)
+	}
+	if plain, err := ring.Decrypt(first); err != nil || plain != "89a8541a" {
+		t.Errorf("decrypted %q, %v", plain, err)
+	}
+	if plain, err := ring.Decrypt("89a8541a"); err != nil || plain != "89a8541a" {
+		t.Errorf("a value from before encryption gave %q, %v", plain, err)
+	}
+
+	other := testKeyring(t, otherSecretKey)
+	if _, err := other.Decrypt(first); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+	var none *secretKeyring
+	if _, err := none.Decrypt(first); err == nil {
+		t.Error("decrypted without a key")
+	}
+
+	flip, swap := len(first)-10, "A"
+	if first[flip] == 'A' {
+		swap = "B"
+	}
+	tampered := first[:flip] + swap + first[flip+1:]
+	if _, err := ring.Decrypt(tampered); err == nil {
+		t.Error("a tampered value should not decrypt")
+	}
+}
+
+func TestSecretKeyRotation(t *testing.T) {
+	old := testKeyring(t, testSecretKey)
+	sealed, _ := old.Encrypt("89a8541a")
+
+	rotated := testKeyring(t, otherSecretKey, testSecretKey)
+	if plain, err := rotated.Decrypt(sealed); err != nil || plain != "89a8541a" {
+		t.Fatalf("a previous key's value gave %q, %v", plain, err)
+	}
+
+	rewrapped, changed, err := rotated.Rewrap(sealed)
+	if err != nil || !changed {
+		t.Fatalf("rewrap: %v, %v", changed, err)
+	}
+	// Only the data key is re-sealed; the value itself is untouched
+	if rewrapped[strings.LastIndex(rewrapped, ":"):] != sealed[strings.LastIndex(sealed, ":"):] {
+		t.Error("the sealed value should carry over")
+	}
+	if _, err := testKeyring(t, otherSecretKey).Decrypt(rewrapped); err != nil {
+		t.Errorf("the new key alone should open it: %v", err)
+	}
+	if _, changed, _ := rotated.Rewrap(rewrapped); changed {
+		t.Error("a current value should be left alone")
+	}
+
+	plain, changed, err := rotated.Rewrap("89a8541a")
+	if err != nil || !changed || !strings.HasPrefix(plain, secretPrefix) {
+		t.Errorf("plain text should be encrypted: %q, %v, %v", plain, changed, err)
+	}
+	if _, changed, _ := rotated.Rewrap(""); changed {
+		t.Error("an empty value should stay empty")
+	}
+}
+
+func TestParseSecretKey(t *testing.T) {
+	for _, bad := range []string{"short", "MDEyMzQ1Njc4OWFiY2RlZg==", strings.Repeat("z", 64)} {
+		if _, err := parseSecretKey(bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+	a, _ := parseSecretKey(testSecretKey)
+	b, _ := parseSecretKey(" " + testSecretKey + "\n")
+	if a.ID == "" || a.ID != b.ID {
+		t.Errorf("ids %q and %q", a.ID, b.ID)
+	}
+	if ring, err := newSecretKeyring("", nil); ring != nil || err != nil {
+		t.Errorf("no key gave %v, %v", ring, err)
+	}
+}
+
+func TestSecretSerializer(t *testing.T) {
+	saved := secretKeys
+	secretKeys = testKeyring(t, testSecretKey)
+	defer func() { secretKeys = saved }()
+
+	s, err := schema.Parse(&Printer{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := s.LookUpField("access_code")
+	ctx := context.Background()
+
+	stored, err := field.Serializer.Value(ctx, field, reflect.Value{}, "89a8541a")
+	if err != nil || !strings.HasPrefix(stored.(string), secretPrefix) {
+		t.Fatalf("stored %v, %v", stored, err)
+	}
+
+	var record Printer
+	if err := field.Serializer.Scan(ctx, field, reflect.ValueOf(&record).Elem(), []byte(stored.(string))); err != nil {
+		t.Fatal(err)
+	}
+	if record.AccessCode != "89a8541a" {
+		t.Errorf("read back %q", record.AccessCode)
+	}
+	if empty, _ := field.Serializer.Value(ctx, field, reflect.Value{}, ""); empty != "" {
+		t.Errorf("an empty code was stored as %v", empty)
+	}
+
+	// Every listed column is one the serializer handles
+	for _, model := range []interface{}{&Printer{}, &PrinterCredential{}, &AlertSubscription{}} {
+		s, err := schema.Parse(model, &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range secretColumns {
+			if column.Table != s.Table {
+				continue
+			}
+			if field := s.LookUpField(column.Column); field == nil || field.Serializer == nil {
+				t.Errorf("%s.%s is not encrypted", column.Table, column.Column)
+			}
+		}
+	}
+}
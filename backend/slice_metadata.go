@@ -0,0 +1,406 @@
+package main
+
+// What is inside a sliced file.
+//
+// A .gcode.3mf is a zip. Bambu Studio writes Metadata/slice_info.config next to
+// the G-code: one <plate> per sliced plate, with the predicted time, the
+// printer model and nozzle it was sliced for, and a <filament> line per slot
+// used with its type, colour and grams. Each plate also has a PNG preview.
+//
+// Reading it lets an upload be refused before it lands on a printer it cannot
+// run on, and gives the file list and print log real numbers instead of a bare
+// file name. Plain .gcode and unsliced projects carry none of this and simply
+// go without.
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	sliceInfoPath = "Metadata/slice_info.config"
+	// Previews are small; anything bigger than this is not a preview
+	maxThumbnailBytes = 2 * 1024 * 1024
+	maxSliceInfoBytes = 4 * 1024 * 1024
+)
+
+// bambuModelIDs maps the printer_model_id Bambu Studio writes to the name on
+// the printer.
+var bambuModelIDs = map[string]string{
+	"C11":     "P1P",
+	"C12":     "P1S",
+	"C13":     "X1E",
+	"BL-P001": "X1C",
+	"BL-P002": "X1",
+	"N1":      "A1 mini",
+	"N2S":     "A1",
+}
+
+// normalizeModel makes "A1 mini", "a1mini" and "A1-MINI" compare equal.
+func normalizeModel(model string) string {
+	model = strings.ToUpper(model)
+	model = strings.ReplaceAll(model, " ", "")
+	return strings.ReplaceAll(model, "-", "")
+}
+
+// SlicedFilament is one filament slot a plate uses.
+type SlicedFilament struct {
+	Slot   int     `json:"slot"` // 1-based, as numbered in the slicer
+	Type   string  `json:"type"`
+	Color  string  `json:"color"` // #RRGGBB
+	Grams  float64 `json:"grams"`
+	Meters float64 `json:"meters"`
+}
+
+// SlicedPlate is one plate of a sliced file.
+type SlicedPlate struct {
+	Index            int              `json:"index"`
+	EstimatedSeconds int              `json:"estimated_seconds"`
+	Grams            float64          `json:"grams"`
+	Filaments        []SlicedFilament `json:"filaments"`
+}
+
+// SliceMetadata is everything read from one file.
+type SliceMetadata struct {
+	PrinterModelID string        `json:"printer_model_id"`
+	PrinterModel   string        `json:"printer_model"`
+	NozzleDiameter string        `json:"nozzle_diameter"`
+	Plates         []SlicedPlate `json:"plates"`
+}
+
+// plate returns one plate by its 1-based index.
+func (m *SliceMetadata) plate(index int) (SlicedPlate, bool) {
+	for _, plate := range m.Plates {
+		if plate.Index == index {
+			return plate, true
+		}
+	}
+	return SlicedPlate{}, false
+}
+
+// totals adds up every plate.
+func (m *SliceMetadata) totals() (seconds int, grams float64) {
+	for _, plate := range m.Plates {
+		seconds += plate.EstimatedSeconds
+		grams += plate.Grams
+	}
+	return seconds, grams
+}
+
+type sliceInfoXML struct {
+	Plates []struct {
+		Metadata []struct {
+			Key   string `xml:"key,attr"`
+			Value string `xml:"value,attr"`
+		} `xml:"metadata"`
+		Filaments []struct {
+			ID    string `xml:"id,attr"`
+			Type  string `xml:"type,attr"`
+			Color string `xml:"color,attr"`
+			UsedM string `xml:"used_m,attr"`
+			UsedG string `xml:"used_g,attr"`
+		} `xml:"filament"`
+	} `xml:"plate"`
+}
+
+// readZipEntry reads one file out of the archive, refusing anything larger
+// than limit so a crafted archive cannot balloon in memory.
+func readZipEntry(archive *zip.Reader, name string, limit int64) ([]byte, bool, error) {
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, true, err
+		}
+		defer rc.Close()
+
+		data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+		if err != nil {
+			return nil, true, err
+		}
+		if int64(len(data)) > limit {
+			return nil, true, fmt.Errorf("%s is implausibly large", name)
+		}
+		return data, true, nil
+	}
+	return nil, false, nil
+}
+
+// readSliceMetadata reads the slice info and the first plate's preview from a
+// .3mf. It returns nil metadata, and no error, for anything that is not a
+// sliced Bambu archive - plain G-code, or a project that was never sliced.
+func readSliceMetadata(r io.ReaderAt, size int64) (*SliceMetadata, []byte, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	raw, found, err := readZipEntry(archive, sliceInfoPath, maxSliceInfoBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("the file's slice information is unreadable: %w", err)
+	}
+	if !found {
+		return nil, nil, nil
+	}
+
+	var info sliceInfoXML
+	if err := xml.Unmarshal(raw, &info); err != nil {
+		return nil, nil, fmt.Errorf("the file's slice information is unreadable: %w", err)
+	}
+
+	meta := &SliceMetadata{}
+	for i, rawPlate := range info.Plates {
+		plate := SlicedPlate{Index: i + 1}
+		for _, item := range rawPlate.Metadata {
+			switch item.Key {
+			case "index":
+				if n, err := strconv.Atoi(item.Value); err == nil {
+					plate.Index = n
+				}
+			case "prediction":
+				plate.EstimatedSeconds, _ = strconv.Atoi(item.Value)
+			case "weight":
+				plate.Grams, _ = strconv.ParseFloat(item.Value, 64)
+			case "printer_model_id":
+				meta.PrinterModelID = item.Value
+			case "nozzle_diameters":
+				meta.NozzleDiameter = item.Value
+			}
+		}
+		for _, rawFilament := range rawPlate.Filaments {
+			filament := SlicedFilament{
+				Type:  strings.TrimSpace(rawFilament.Type),
+				Color: normalizeColor(rawFilament.Color),
+			}
+			filament.Slot, _ = strconv.Atoi(rawFilament.ID)
+			filament.Grams, _ = strconv.ParseFloat(rawFilament.UsedG, 64)
+			filament.Meters, _ = strconv.ParseFloat(rawFilament.UsedM, 64)
+			plate.Filaments = append(plate.Filaments, filament)
+		}
+		meta.Plates = append(meta.Plates, plate)
+	}
+
+	meta.PrinterModel = bambuModelIDs[meta.PrinterModelID]
+	if meta.PrinterModel == "" {
+		meta.PrinterModel = meta.PrinterModelID
+	}
+
+	var thumbnail []byte
+	if len(meta.Plates) > 0 {
+		name := fmt.Sprintf("Metadata/plate_%d.png", meta.Plates[0].Index)
+		thumbnail, _, _ = readZipEntry(archive, name, maxThumbnailBytes)
+	}
+
+	return meta, thumbnail, nil
+}
+
+// inspectUpload reads the metadata from an upload when the reader allows it,
+// leaving the reader positioned at the start so the upload can go ahead.
+// Multipart files and staged queue files are both seekable.
+func inspectUpload(contents io.Reader) (*SliceMetadata, []byte, error) {
+	seeker, ok := contents.(io.ReadSeeker)
+	if !ok {
+		return nil, nil, nil
+	}
+	readerAt, ok := contents.(io.ReaderAt)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, nil
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	return readSliceMetadata(readerAt, size)
+}
+
+// checkSliceCompatibility refuses a file sliced for a different printer model
+// or nozzle than the printer it is going to. A file that does not say is let
+// through.
+func checkSliceCompatibility(cfg PrinterConfig, meta *SliceMetadata) error {
+	if meta == nil {
+		return nil
+	}
+
+	if meta.PrinterModel != "" && cfg.Model != "" &&
+		normalizeModel(meta.PrinterModel) != normalizeModel(cfg.Model) {
+		return fmt.Errorf("this file was sliced for a %s, but %s is a %s - slice it again for the right printer",
+			meta.PrinterModel, cfg.Name, cfg.Model)
+	}
+
+	if meta.NozzleDiameter != "" && cfg.Nozzle != "" {
+		// Multi-extruder files list one diameter per nozzle
+		for _, raw := range strings.Fields(strings.ReplaceAll(meta.NozzleDiameter, ",", " ")) {
+			sliced, errSliced := strconv.ParseFloat(raw, 64)
+			fitted, errFitted := strconv.ParseFloat(cfg.Nozzle, 64)
+			if errSliced == nil && errFitted == nil && sliced != fitted {
+				return fmt.Errorf("this file was sliced for a %s mm nozzle, but %s has a %s mm nozzle fitted",
+					raw, cfg.Name, cfg.Nozzle)
+			}
+		}
+	}
+
+	return nil
+}
+
+// --- stored metadata ----------------------------------------------------
+
+// SlicedFile is a file uploaded through the site: who sent it and what the
+// slicer said about it, kept so the file list and print log can show it. Plain
+// G-code has only the first part.
+type SlicedFile struct {
+	gorm.Model
+	PrinterID        string           `json:"printer_id" gorm:"index"`
+	FileName         string           `json:"file_name" gorm:"index"`
+	Owner            string           `json:"owner"`
+	PrinterModel     string           `json:"printer_model"`
+	NozzleDiameter   string           `json:"nozzle_diameter"`
+	EstimatedSeconds int              `json:"estimated_seconds"`
+	TotalGrams       float64          `json:"total_grams"`
+	Plates           []SlicedPlate    `json:"plates" gorm:"serializer:json"`
+	Filaments        []SlicedFilament `json:"filaments" gorm:"serializer:json"`
+	Thumbnail        []byte           `json:"-"`
+	HasThumbnail     bool             `json:"has_thumbnail"`
+}
+
+// newSlicedFile flattens metadata into the stored form. The filament list is
+// the first plate's, which is what a single-plate file - nearly all of them -
+// prints. meta may be nil for a file that carries none.
+func newSlicedFile(printerID, name, owner string, meta *SliceMetadata, thumbnail []byte) SlicedFile {
+	if meta == nil {
+		return SlicedFile{PrinterID: printerID, FileName: name, Owner: owner}
+	}
+	seconds, grams := meta.totals()
+	record := SlicedFile{
+		PrinterID:        printerID,
+		FileName:         name,
+		Owner:            owner,
+		PrinterModel:     meta.PrinterModel,
+		NozzleDiameter:   meta.NozzleDiameter,
+		EstimatedSeconds: seconds,
+		TotalGrams:       grams,
+		Plates:           meta.Plates,
+		Thumbnail:        thumbnail,
+		HasThumbnail:     len(thumbnail) > 0,
+	}
+	if len(meta.Plates) > 0 {
+		record.Filaments = meta.Plates[0].Filaments
+	}
+	return record
+}
+
+// saveSlicedFile stores metadata for a file that has reached a printer,
+// replacing whatever an earlier upload of the same name left.
+func (m *PrinterManager) saveSlicedFile(record SlicedFile) {
+	if m.db == nil {
+		return
+	}
+	var existing SlicedFile
+	err := m.db.Where("printer_id = ? AND file_name = ?", record.PrinterID, record.FileName).
+		First(&existing).Error
+	if err == nil {
+		record.ID = existing.ID
+		record.CreatedAt = existing.CreatedAt
+	}
+	m.db.Save(&record)
+}
+
+// slicedFiles returns the stored metadata for a printer's files, by name.
+func (m *PrinterManager) slicedFiles(printerID string) map[string]SlicedFile {
+	byName := map[string]SlicedFile{}
+	if m.db == nil {
+		return byName
+	}
+	var records []SlicedFile
+	m.db.Omit("thumbnail").Where("printer_id = ?", printerID).Find(&records)
+	for _, record := range records {
+		byName[record.FileName] = record
+	}
+	return byName
+}
+
+// Thumbnail returns the stored plate preview of a file uploaded through the
+// site.
+func (m *PrinterManager) Thumbnail(printerID, name string) ([]byte, bool) {
+	if m.db == nil {
+		return nil, false
+	}
+	var record SlicedFile
+	if err := m.db.Where("printer_id = ? AND file_name = ?", printerID, name).
+		First(&record).Error; err != nil || len(record.Thumbnail) == 0 {
+		return nil, false
+	}
+	return record.Thumbnail, true
+}
+
+// plateFromGcodeFile reads the plate number out of the path the printer
+// reports for the running job, "Metadata/plate_2.gcode". Defaults to 1.
+var plateFilePattern = regexp.MustCompile(`plate_(\d+)\.gcode`)
+
+func plateFromGcodeFile(path string) int {
+	if match := plateFilePattern.FindStringSubmatch(path); match != nil {
+		if n, err := strconv.Atoi(match[1]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// jobFileCandidates are the names a job's file may have been uploaded as. The
+// printer reports the subtask name, usually without the suffix.
+func jobFileCandidates(fileName string) []string {
+	base, _, ok := splitUploadSuffix(fileName)
+	if !ok {
+		base = fileName
+	}
+	candidates := []string{fileName}
+	for _, suffix := range allowedUploadSuffixes {
+		if base+suffix != fileName {
+			candidates = append(candidates, base+suffix)
+		}
+	}
+	return candidates
+}
+
+// applySliceMetadataLocked copies the sender and the slicer's estimate for the
+// running plate onto a new job. Called with the lock held, when the job opens.
+func (p *printer) applySliceMetadataLocked(job *PrintJob) {
+	if p.jobs == nil {
+		return
+	}
+
+	var record SlicedFile
+	err := p.jobs.Omit("thumbnail").
+		Where("printer_id = ? AND file_name IN ?", p.cfg.ID, jobFileCandidates(job.FileName)).
+		Order("updated_at DESC").First(&record).Error
+	if err != nil {
+		return
+	}
+
+	if record.Owner != "" {
+		job.Owner = record.Owner
+	}
+	job.Plate = plateFromGcodeFile(p.gcodeFile)
+	meta := SliceMetadata{Plates: record.Plates}
+	plate, ok := meta.plate(job.Plate)
+	if !ok {
+		return
+	}
+	job.EstimatedMinutes = int((time.Duration(plate.EstimatedSeconds) * time.Second).Minutes())
+	job.FilamentGrams = plate.Grams
+	job.Filaments = plate.Filaments
+}
@@ -0,0 +1,177 @@
+package main
+
+// Sliced files are built in memory the way Bambu Studio lays them out, so the
+// parser is tested without a real .3mf in the repo.
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testSliceInfo = `<?xml version="1.0" encoding="UTF-8"?>
+<config>
+  <header>
+    <header_item key="X-BBL-Client-Type" value="slicer"/>
+  </header>
+  <plate>
+    <metadata key="index" value="1"/>
+    <metadata key="printer_model_id" value="C12"/>
+    <metadata key="nozzle_diameters" value="0.4"/>
+    <metadata key="prediction" value="3720"/>
+    <metadata key="weight" value="21.35"/>
+    <object identify_id="97" name="bracket.stl" skipped="false"/>
+    <filament id="1" tray_info_idx="GFA00" type="PLA" color="#FFFFFF" used_m="4.10" used_g="12.20"/>
+    <filament id="3" tray_info_idx="GFA00" type="PLA" color="#000000" used_m="3.07" used_g="9.15"/>
+  </plate>
+  <plate>
+    <metadata key="index" value="2"/>
+    <metadata key="printer_model_id" value="C12"/>
+    <metadata key="nozzle_diameters" value="0.4"/>
+    <metadata key="prediction" value="600"/>
+    <metadata key="weight" value="3.5"/>
+    <filament id="2" type="PETG" color="#FF0000" used_m="1.1" used_g="3.5"/>
+  </plate>
+</config>`
+
+// buildSlicedFile zips the given entries.
+func buildSlicedFile(t *testing.T, entries map[string]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, body := range entries {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadSliceMetadata(t *testing.T) {
+	file := buildSlicedFile(t, map[string]string{
+		"Metadata/slice_info.config": testSliceInfo,
+		"Metadata/plate_1.png":       "\x89PNG fake",
+		"Metadata/plate_1.gcode":     "G28",
+	})
+
+	meta, thumbnail, err := readSliceMetadata(file, file.Size())
+	if err != nil || meta == nil {
+		t.Fatalf("expected metadata, got %v / %v", meta, err)
+	}
+	if meta.PrinterModel != "P1S" || meta.NozzleDiameter != "0.4" {
+		t.Errorf("unexpected printer: %+v", meta)
+	}
+	if len(meta.Plates) != 2 {
+		t.Fatalf("expected 2 plates, got %d", len(meta.Plates))
+	}
+
+	first := meta.Plates[0]
+	if first.Index != 1 || first.EstimatedSeconds != 3720 || first.Grams != 21.35 {
+		t.Errorf("unexpected first plate: %+v", first)
+	}
+	if len(first.Filaments) != 2 || first.Filaments[1].Slot != 3 ||
+		first.Filaments[1].Color != "#000000" || first.Filaments[1].Grams != 9.15 {
+		t.Errorf("unexpected filaments: %+v", first.Filaments)
+	}
+
+	seconds, grams := meta.totals()
+	if seconds != 4320 || grams < 24.84 || grams > 24.86 {
+		t.Errorf("unexpected totals: %d s, %.2f g", seconds, grams)
+	}
+	if string(thumbnail) != "\x89PNG fake" {
+		t.Errorf("unexpected thumbnail: %q", thumbnail)
+	}
+}
+
+func TestReadSliceMetadataSkipsOtherFiles(t *testing.T) {
+	// Plain G-code is not a zip at all
+	gcode := strings.NewReader("G28\nG1 X10\n")
+	if meta, _, err := readSliceMetadata(gcode, gcode.Size()); meta != nil || err != nil {
+		t.Errorf("plain G-code should carry no metadata, got %v / %v", meta, err)
+	}
+
+	// A project saved but never sliced
+	project := buildSlicedFile(t, map[string]string{"3D/3dmodel.model": "<model/>"})
+	if meta, _, err := readSliceMetadata(project, project.Size()); meta != nil || err != nil {
+		t.Errorf("an unsliced project should carry no metadata, got %v / %v", meta, err)
+	}
+
+	broken := buildSlicedFile(t, map[string]string{"Metadata/slice_info.config": "<config><plate>"})
+	if _, _, err := readSliceMetadata(broken, broken.Size()); err == nil {
+		t.Error("expected an error for unreadable slice information")
+	}
+}
+
+func TestInspectUploadRewinds(t *testing.T) {
+	file := buildSlicedFile(t, map[string]string{"Metadata/slice_info.config": testSliceInfo})
+
+	meta, _, err := inspectUpload(file)
+	if err != nil || meta == nil {
+		t.Fatalf("expected metadata, got %v / %v", meta, err)
+	}
+	if file.Len() != int(file.Size()) {
+		t.Error("the upload should be left at its start so it can still be sent")
+	}
+}
+
+func TestCheckSliceCompatibility(t *testing.T) {
+	meta := &SliceMetadata{PrinterModel: "P1S", NozzleDiameter: "0.4"}
+
+	p1s := PrinterConfig{Name: "3DP-01", Model: "P1S", Nozzle: "0.4"}
+	if err := checkSliceCompatibility(p1s, meta); err != nil {
+		t.Errorf("a matching printer was refused: %v", err)
+	}
+
+	x1c := PrinterConfig{Name: "3DP-02", Model: "X1C", Nozzle: "0.4"}
+	if err := checkSliceCompatibility(x1c, meta); err == nil || !strings.Contains(err.Error(), "X1C") {
+		t.Errorf("expected a model mismatch, got %v", err)
+	}
+
+	wide := PrinterConfig{Name: "3DP-03", Model: "P1S", Nozzle: "0.6"}
+	if err := checkSliceCompatibility(wide, meta); err == nil || !strings.Contains(err.Error(), "nozzle") {
+		t.Errorf("expected a nozzle mismatch, got %v", err)
+	}
+
+	// "A1 mini" as the slicer names it, "a1-mini" as someone typed it
+	mini := &SliceMetadata{PrinterModel: "A1 mini"}
+	if err := checkSliceCompatibility(PrinterConfig{Model: "a1-mini", Nozzle: "0.4"}, mini); err != nil {
+		t.Errorf("model names should compare loosely: %v", err)
+	}
+
+	if err := checkSliceCompatibility(x1c, nil); err != nil {
+		t.Errorf("files without metadata should pass: %v", err)
+	}
+}
+
+func TestPlateFromGcodeFile(t *testing.T) {
+	cases := map[string]int{
+		"/data/Metadata/plate_2.gcode": 2,
+		"Metadata/plate_11.gcode":      11,
+		"":                             1,
+		"/sdcard/bracket.gcode":        1,
+	}
+	for path, want := range cases {
+		if got := plateFromGcodeFile(path); got != want {
+			t.Errorf("plateFromGcodeFile(%q) = %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestJobFileCandidates(t *testing.T) {
+	got := jobFileCandidates("srinath_bracket")
+	want := []string{"srinath_bracket", "srinath_bracket.gcode.3mf", "srinath_bracket.3mf", "srinath_bracket.gcode"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got = jobFileCandidates("srinath_bracket.3mf")
+	if len(got) != 3 || got[0] != "srinath_bracket.3mf" {
+		t.Errorf("unexpected candidates: %v", got)
+	}
+}
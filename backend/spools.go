@@ -0,0 +1,333 @@
+package main
+
+// Filament spools.
+//
+// Filament is the lab's biggest consumable but it is not lent out, so it lives
+// here rather than in the Item catalogue. Each spool is weighed in once; an
+// admin puts it in an AMS tray; every print that ends on that printer takes the
+// slicer's estimate off it. The printer can only measure Bambu's own spools
+// (third-party ones show "? left"), so this is the only running count the lab
+// has for the rest.
+//
+// When the total left of a material drops below the threshold, a
+// filament_low event goes out through the same alerts as the printers'.
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// defaultLowStockGrams is a little more than one spool.
+const defaultLowStockGrams = 1200
+
+// Spool is one roll of filament.
+type Spool struct {
+	gorm.Model
+	Brand          string  `json:"brand"`
+	Material       string  `json:"material" gorm:"index"` // "PLA Basic", "PETG HF"
+	Color          string  `json:"color"`                 // #RRGGBB
+	InitialGrams   float64 `json:"initial_grams"`
+	RemainingGrams float64 `json:"remaining_grams"`
+	Cost           float64 `json:"cost"` // what the whole spool cost
+	Location       string  `json:"location"`
+	// Where it is loaded, if anywhere. Tray is 0-15 for AMS trays
+	// (unit*4 + slot) and 254 for the external spool holder.
+	PrinterID string `json:"printer_id" gorm:"index"`
+	Tray      *int   `json:"tray"`
+}
+
+// costPerGram is what a gram off this spool is worth.
+func (s Spool) costPerGram() float64 {
+	if s.InitialGrams <= 0 {
+		return 0
+	}
+	return s.Cost / s.InitialGrams
+}
+
+// SpoolUsage is one print's draw on one spool, kept so a job is never taken
+// off twice and so the count can be checked by hand.
+type SpoolUsage struct {
+	gorm.Model
+	SpoolID    uint    `json:"spool_id" gorm:"index"`
+	PrintJobID uint    `json:"print_job_id" gorm:"index"`
+	Grams      float64 `json:"grams"`
+}
+
+// MaterialStock is the total of one material across every spool.
+type MaterialStock struct {
+	Material       string  `json:"material"`
+	Spools         int     `json:"spools"`
+	RemainingGrams float64 `json:"remaining_grams"`
+	Value          float64 `json:"value"`
+	Low            bool    `json:"low"`
+}
+
+// normalizeSpool checks and tidies a spool from the admin page.
+func normalizeSpool(s *Spool) error {
+	s.Brand = strings.TrimSpace(s.Brand)
+	s.Material = strings.TrimSpace(s.Material)
+	s.Location = strings.TrimSpace(s.Location)
+	if s.Material == "" {
+		return fmt.Errorf("say what material the spool is")
+	}
+	if s.Color != "" {
+		s.Color = normalizeColor(s.Color)
+		if _, err := strconv.ParseUint(strings.TrimPrefix(s.Color, "#"), 16, 32); err != nil {
+			return fmt.Errorf("colour must be a hex colour like #FF6A13")
+		}
+	}
+	if s.InitialGrams <= 0 {
+		return fmt.Errorf("give the spool's starting weight in grams")
+	}
+	if s.RemainingGrams < 0 || s.RemainingGrams > s.InitialGrams {
+		return fmt.Errorf("remaining grams must be between 0 and the starting weight")
+	}
+	if s.Cost < 0 {
+		return fmt.Errorf("cost cannot be negative")
+	}
+	return nil
+}
+
+// validTray reports whether tray names a place a spool can be loaded.
+func validTray(tray int) bool {
+	return (tray >= 0 && tray <= 15) || tray == externalSpoolTray
+}
+
+// pickSpool chooses which loaded spool a filament was drawn from: the slicer
+// numbers filaments by its own slots, not by AMS tray, so the spool is matched
+// by material and, where possible, colour.
+func pickSpool(loaded []Spool, filament SlicedFilament) (int, bool) {
+	fallback := -1
+	for i, spool := range loaded {
+		if !materialMatches(spool.Material, filament.Type) {
+			continue
+		}
+		if filament.Color == "" || strings.EqualFold(spool.Color, filament.Color) {
+			return i, true
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+	return fallback, fallback >= 0
+}
+
+// jobUsage is how many grams of each filament a closed job actually used:
+// everything for a finished print, and the share it got through otherwise.
+func jobUsage(job PrintJob) []SlicedFilament {
+	share := 1.0
+	if job.Result != "finished" {
+		share = math.Max(0, math.Min(100, float64(job.LastPercent))) / 100
+	}
+	used := make([]SlicedFilament, 0, len(job.Filaments))
+	for _, filament := range job.Filaments {
+		filament.Grams *= share
+		if filament.Grams > 0 {
+			used = append(used, filament)
+		}
+	}
+	return used
+}
+
+// SpoolInventory keeps the spool counts up to date as prints end.
+type SpoolInventory struct {
+	db       *gorm.DB
+	printers *PrinterManager
+	// Below this many grams of a material, raise filament_low
+	lowGrams float64
+	// Deductions are one at a time, so the low-stock check sees a settled total
+	mu sync.Mutex
+}
+
+// NewSpoolInventory reads the low-stock threshold from FILAMENT_LOW_GRAMS.
+func NewSpoolInventory(db *gorm.DB, printers *PrinterManager) *SpoolInventory {
+	lowGrams := float64(defaultLowStockGrams)
+	if raw := os.Getenv("FILAMENT_LOW_GRAMS"); raw != "" {
+		if v, err := strconv.ParseFloat(raw, 64); err == nil && v >= 0 {
+			lowGrams = v
+		} else {
+			log.Printf("Ignoring FILAMENT_LOW_GRAMS=%q: not a number of grams", raw)
+		}
+	}
+	return &SpoolInventory{db: db, printers: printers, lowGrams: lowGrams}
+}
+
+// handle takes a print off the spools it used, however it ended.
+func (s *SpoolInventory) handle(event PrinterEvent) {
+	if event.JobID == 0 || jobResultFor(event.Type) == "" {
+		return
+	}
+
+	var job PrintJob
+	if err := s.db.First(&job, event.JobID).Error; err != nil {
+		return
+	}
+	s.deduct(job)
+}
+
+// jobResultFor maps a job event back to the result that raised it.
+func jobResultFor(eventType string) string {
+	for result, t := range jobEventTypes {
+		if t == eventType {
+			return result
+		}
+	}
+	return ""
+}
+
+// deduct takes one job's filament off the spools loaded in its printer.
+func (s *SpoolInventory) deduct(job PrintJob) {
+	used := jobUsage(job)
+	if len(used) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var already int64
+	s.db.Model(&SpoolUsage{}).Where("print_job_id = ?", job.ID).Count(&already)
+	if already > 0 {
+		return
+	}
+
+	var loaded []Spool
+	if err := s.db.Where("printer_id = ? AND tray IS NOT NULL", job.PrinterID).
+		Order("tray ASC").Find(&loaded).Error; err != nil {
+		log.Printf("spools: could not load spools for %s: %v", job.PrinterName, err)
+		return
+	}
+
+	// Totals before this job, so an alert goes out only on crossing the line
+	before := map[string]float64{}
+	for _, filament := range used {
+		i, ok := pickSpool(loaded, filament)
+		if !ok {
+			log.Printf("spools: %s used %.0f g of %s, but no such spool is assigned to %s",
+				job.FileName, filament.Grams, filament.Type, job.PrinterName)
+			continue
+		}
+
+		spool := &loaded[i]
+		if _, ok := before[spool.Material]; !ok {
+			before[spool.Material] = s.materialTotal(spool.Material)
+		}
+		spool.RemainingGrams = math.Max(0, spool.RemainingGrams-filament.Grams)
+
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(spool).Update("remaining_grams", spool.RemainingGrams).Error; err != nil {
+				return err
+			}
+			return tx.Create(&SpoolUsage{SpoolID: spool.ID, PrintJobID: job.ID, Grams: filament.Grams}).Error
+		})
+		if err != nil {
+			log.Printf("spools: could not record %s on spool %d: %v", job.FileName, spool.ID, err)
+			continue
+		}
+	}
+
+	for material, total := range before {
+		s.checkLowStock(material, total)
+	}
+}
+
+// materialTotal is the grams left of a material across every spool.
+func (s *SpoolInventory) materialTotal(material string) float64 {
+	var total float64
+	s.db.Model(&Spool{}).Where("LOWER(material) = LOWER(?)", material).
+		Select("COALESCE(SUM(remaining_grams), 0)").Scan(&total)
+	return total
+}
+
+// checkLowStock raises filament_low when a material has just crossed the
+// threshold, so the alert goes out once rather than after every print.
+func (s *SpoolInventory) checkLowStock(material string, before float64) {
+	after := s.materialTotal(material)
+	if before < s.lowGrams || after >= s.lowGrams {
+		return
+	}
+	s.printers.events.publish(PrinterEvent{
+		Type: EventFilamentLow,
+		Message: fmt.Sprintf("%s is running low: %.0f g left across all spools (threshold %.0f g)",
+			material, after, s.lowGrams),
+		At: time.Now(),
+	})
+}
+
+// Stock totals every material, for the admin page.
+func (s *SpoolInventory) Stock() ([]MaterialStock, error) {
+	var spools []Spool
+	if err := s.db.Order("material ASC").Find(&spools).Error; err != nil {
+		return nil, err
+	}
+
+	var stock []MaterialStock
+	byMaterial := map[string]int{}
+	for _, spool := range spools {
+		key := strings.ToLower(spool.Material)
+		i, ok := byMaterial[key]
+		if !ok {
+			i = len(stock)
+			byMaterial[key] = i
+			stock = append(stock, MaterialStock{Material: spool.Material})
+		}
+		stock[i].Spools++
+		stock[i].RemainingGrams += spool.RemainingGrams
+		stock[i].Value += spool.RemainingGrams * spool.costPerGram()
+	}
+	for i := range stock {
+		stock[i].Low = stock[i].RemainingGrams < s.lowGrams
+	}
+	return stock, nil
+}
+
+// Assign puts a spool in a printer's tray, taking out whatever spool was there
+// before. An empty printerID unloads it.
+func (s *SpoolInventory) Assign(id uint, printerID string, tray int) (Spool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var spool Spool
+	if err := s.db.First(&spool, id).Error; err != nil {
+		return spool, fmt.Errorf("spool not found")
+	}
+
+	if printerID == "" {
+		spool.PrinterID = ""
+		spool.Tray = nil
+		if err := s.db.Model(&spool).Select("printer_id", "tray").Updates(&spool).Error; err != nil {
+			return spool, fmt.Errorf("could not unload the spool")
+		}
+		return spool, nil
+	}
+
+	if _, ok := s.printers.lookup(printerID); !ok {
+		return spool, fmt.Errorf("unknown printer")
+	}
+	if !validTray(tray) {
+		return spool, fmt.Errorf("%d is not an AMS tray (0-15, or 254 for the external spool)", tray)
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Spool{}).
+			Where("printer_id = ? AND tray = ? AND id <> ?", printerID, tray, spool.ID).
+			Updates(map[string]interface{}{"printer_id": "", "tray": nil}).Error; err != nil {
+			return err
+		}
+		spool.PrinterID = printerID
+		spool.Tray = &tray
+		return tx.Model(&spool).Select("printer_id", "tray").Updates(&spool).Error
+	})
+	if err != nil {
+		return spool, fmt.Errorf("could not assign the spool")
+	}
+	return spool, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestPickSpoolPrefersMatchingColour(t *testing.T) {
+	loaded := []Spool{
+		{Material: "PETG HF", Color: "#FFFFFF"},
+		{Material: "PLA Basic", Color: "#FFFFFF"},
+		{Material: "PLA Basic", Color: "#000000"},
+	}
+
+	if i, ok := pickSpool(loaded, SlicedFilament{Type: "PLA", Color: "#000000"}); !ok || i != 2 {
+		t.Errorf("expected the black PLA spool, got %d / %v", i, ok)
+	}
+	// No red PLA is loaded, so the first PLA takes the draw
+	if i, ok := pickSpool(loaded, SlicedFilament{Type: "PLA", Color: "#FF0000"}); !ok || i != 1 {
+		t.Errorf("expected the first PLA spool, got %d / %v", i, ok)
+	}
+	if _, ok := pickSpool(loaded, SlicedFilament{Type: "ABS"}); ok {
+		t.Error("no ABS spool is loaded")
+	}
+}
+
+func TestJobUsageScalesUnfinishedJobs(t *testing.T) {
+	filaments := []SlicedFilament{{Type: "PLA", Grams: 40}, {Type: "PETG", Grams: 10}}
+
+	finished := jobUsage(PrintJob{Result: "finished", LastPercent: 99, Filaments: filaments})
+	if finished[0].Grams != 40 || finished[1].Grams != 10 {
+		t.Errorf("a finished job uses the whole estimate: %+v", finished)
+	}
+
+	failed := jobUsage(PrintJob{Result: "failed", LastPercent: 25, Filaments: filaments})
+	if failed[0].Grams != 10 || failed[1].Grams != 2.5 {
+		t.Errorf("a failed job uses its share: %+v", failed)
+	}
+
+	interrupted := jobUsage(PrintJob{Result: "interrupted", LastPercent: 50, Filaments: filaments})
+	if interrupted[0].Grams != 20 || interrupted[1].Grams != 5 {
+		t.Errorf("an interrupted job uses its share: %+v", interrupted)
+	}
+
+	if stopped := jobUsage(PrintJob{Result: "stopped", Filaments: filaments}); len(stopped) != 0 {
+		t.Errorf("a job stopped before starting used nothing: %+v", stopped)
+	}
+
+	// The caller's slice is left alone
+	if filaments[0].Grams != 40 {
+		t.Error("jobUsage changed the job's own estimate")
+	}
+}
+
+func TestNormalizeSpool(t *testing.T) {
+	spool := Spool{Material: " PLA Basic ", Color: "ff6a13", InitialGrams: 1000, RemainingGrams: 800, Cost: 1800}
+	if err := normalizeSpool(&spool); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spool.Material != "PLA Basic" || spool.Color != "#FF6A13" {
+		t.Errorf("spool not tidied: %+v", spool)
+	}
+	if got := spool.costPerGram(); got != 1.8 {
+		t.Errorf("cost per gram = %v, want 1.8", got)
+	}
+
+	for _, bad := range []Spool{
+		{Material: "", InitialGrams: 1000},
+		{Material: "PLA", InitialGrams: 0},
+		{Material: "PLA", InitialGrams: 1000, RemainingGrams: 1200},
+		{Material: "PLA", InitialGrams: 1000, Color: "orange"},
+		{Material: "PLA", InitialGrams: 1000, Cost: -1},
+	} {
+		if err := normalizeSpool(&bad); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestValidTray(t *testing.T) {
+	for tray, want := range map[int]bool{0: true, 15: true, 254: true, 16: false, -1: false, 255: false} {
+		if got := validTray(tray); got != want {
+			t.Errorf("validTray(%d) = %v, want %v", tray, got, want)
+		}
+	}
+}
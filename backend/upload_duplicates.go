@@ -0,0 +1,136 @@
+package main
+
+// Duplicate and clashing uploads.
+//
+// Upload names are made safe only by their text, so two people sending
+// bracket.3mf would land on the same file and the second would silently
+// replace the first; and the same plate gets sent again and again. Before a
+// transfer, the file's SHA-256 and the printer's own file list decide where it
+// goes:
+//
+//   - the same bytes, sent through the site, are still on the printer: nothing
+//     is sent, and the name they are already under is reported back;
+//   - somebody else's file of that name is there: the new one is stored as
+//     bracket-2.3mf, or with on_conflict=refuse the upload is refused;
+//   - the sender's own older file of that name is there: it is replaced, as an
+//     updated slice of the same plate should be.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What to do when a different file of the same name belongs to somebody else.
+const (
+	ConflictSuffix = "suffix" // the default
+	ConflictRefuse = "refuse"
+)
+
+// placement is where a file goes on the printer.
+type placement struct {
+	Name string
+	// The same bytes are already on the printer as Name
+	Duplicate bool
+	// Renamed to stay clear of somebody else's file
+	Renamed bool
+}
+
+// placeUpload works out where a file should go among the files already on
+// the printer.
+func (m *PrinterManager) placeUpload(p *printer, files []PrinterFile, safe, owner, digest string, size int64, onConflict string) (placement, error) {
+	onPrinter := map[string]uint64{}
+	for _, file := range files {
+		onPrinter[strings.ToLower(file.Name)] = file.Size
+	}
+
+	if digest != "" {
+		if name, ok := findDuplicate(onPrinter, m.sentCopies(p.cfg.ID, digest), size); ok {
+			return placement{Name: name, Duplicate: true}, nil
+		}
+	}
+
+	if _, taken := onPrinter[strings.ToLower(safe)]; !taken {
+		return placement{Name: safe}, nil
+	}
+	name, err := resolveClash(safe, owner, m.storedOwner(p.cfg.ID, safe), onPrinter, onConflict, p.cfg.Name)
+	return placement{Name: name, Renamed: name != safe}, err
+}
+
+// sentCopies are earlier uploads of exactly this file to the printer, newest
+// first.
+func (m *PrinterManager) sentCopies(printerID, digest string) []UploadRecord {
+	var records []UploadRecord
+	if m.db == nil {
+		return records
+	}
+	m.db.Where("printer_id = ? AND sha256 = ? AND outcome = ?", printerID, digest, UploadSent).
+		Order("at DESC").Limit(20).Find(&records)
+	return records
+}
+
+// storedOwner is whose a file on the printer is: the owner of the last upload
+// that put it there, or else the owner part of its name.
+func (m *PrinterManager) storedOwner(printerID, name string) string {
+	if m.db != nil {
+		var record UploadRecord
+		err := m.db.Where("printer_id = ? AND LOWER(file_name) = ? AND outcome = ?",
+			printerID, strings.ToLower(name), UploadSent).
+			Order("at DESC").First(&record).Error
+		if err == nil && record.Owner != "" {
+			return record.Owner
+		}
+	}
+	return fileOwner(name)
+}
+
+// findDuplicate picks the earlier copy that is still on the printer, judged
+// by its name and size: a file replaced since under the same name will almost
+// never keep the size.
+func findDuplicate(onPrinter map[string]uint64, copies []UploadRecord, size int64) (string, bool) {
+	for _, record := range copies {
+		if record.FileName == "" || record.Size != size {
+			continue
+		}
+		if stored, ok := onPrinter[strings.ToLower(record.FileName)]; ok && int64(stored) == size {
+			return record.FileName, true
+		}
+	}
+	return "", false
+}
+
+// resolveClash decides what happens to a name that is already taken on the
+// printer. The owner's own file is replaced; anybody else's is kept, and the
+// new file is refused or numbered.
+func resolveClash(safe, owner, storedOwner string, onPrinter map[string]uint64, onConflict, printerName string) (string, error) {
+	if owner != "" && owner == storedOwner {
+		return safe, nil
+	}
+
+	if onConflict == ConflictRefuse {
+		whose := "somebody else's"
+		if storedOwner != "" {
+			whose = storedOwner + "'s"
+		}
+		return "", fmt.Errorf("%s already has %s %s - rename your file and send it again",
+			printerName, whose, safe)
+	}
+
+	for n := 2; n < 1000; n++ {
+		candidate := numberedName(safe, n)
+		if _, taken := onPrinter[strings.ToLower(candidate)]; !taken {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s has too many files called %s - rename your file and send it again", printerName, safe)
+}
+
+// numberedName is bracket.3mf as bracket-2.3mf, kept within the length the
+// printer copes with.
+func numberedName(safe string, n int) string {
+	base, suffix, _ := splitUploadSuffix(safe)
+	number := fmt.Sprintf("-%d", n)
+	if over := len(base) + len(number) + len(suffix) - maxUploadNameLength; over > 0 {
+		base = base[:len(base)-over]
+	}
+	return base + number + suffix
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFindDuplicate(t *testing.T) {
+	onPrinter := map[string]uint64{
+		"srinath_bracket.3mf":   5,
+		"srinath_bracket-2.3mf": 9,
+	}
+	copies := []UploadRecord{
+		// Since replaced by a different file of the same name
+		{FileName: "srinath_bracket-2.3mf", Size: 5},
+		// Deleted from the printer
+		{FileName: "srinath_old.3mf", Size: 5},
+		{FileName: "SRINATH_BRACKET.3mf", Size: 5},
+	}
+	name, ok := findDuplicate(onPrinter, copies, 5)
+	if !ok || name != "SRINATH_BRACKET.3mf" {
+		t.Errorf("found %q, %v", name, ok)
+	}
+	if _, ok := findDuplicate(onPrinter, copies[:2], 5); ok {
+		t.Error("neither copy is still on the printer")
+	}
+}
+
+func TestResolveClash(t *testing.T) {
+	onPrinter := map[string]uint64{"bracket.3mf": 1, "bracket-2.3mf": 1}
+
+	if name, err := resolveClash("bracket.3mf", "srinath", "srinath", onPrinter, "", "P1S"); err != nil || name != "bracket.3mf" {
+		t.Errorf("the owner's own file should be replaced: %q, %v", name, err)
+	}
+	if name, err := resolveClash("bracket.3mf", "srinath", "asha", onPrinter, ConflictSuffix, "P1S"); err != nil || name != "bracket-3.3mf" {
+		t.Errorf("somebody else's file should be kept: %q, %v", name, err)
+	}
+	// Nobody can say whose either file is, so neither is assumed to be the same
+	if name, _ := resolveClash("bracket.3mf", "", "", onPrinter, "", "P1S"); name != "bracket-3.3mf" {
+		t.Errorf("an unowned clash gave %q", name)
+	}
+	_, err := resolveClash("bracket.3mf", "srinath", "asha", onPrinter, ConflictRefuse, "P1S")
+	if err == nil || !strings.Contains(err.Error(), "asha's bracket.3mf") {
+		t.Errorf("refuse gave %v", err)
+	}
+}
+
+func TestNumberedName(t *testing.T) {
+	if got := numberedName("srinath_plate.gcode.3mf", 2); got != "srinath_plate-2.gcode.3mf" {
+		t.Errorf("got %q", got)
+	}
+	long := strings.Repeat("a", maxUploadNameLength-len(".3mf")) + ".3mf"
+	if got := numberedName(long, 12); len(got) != maxUploadNameLength || !strings.HasSuffix(got, "-12.3mf") {
+		t.Errorf("a long name became %q", got)
+	}
+}
+
+func TestUploadKeepsSomebodyElsesFile(t *testing.T) {
+	var uploaded []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/server/files/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, header, _ := r.FormFile("file")
+		uploaded = append(uploaded, header.Filename)
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/server/files/list", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"result":[{"path":"asha_bracket.gcode","modified":1760000000.5,"size":2048}]}`)
+	})
+	p := httpTestPrinter(t, DriverMoonraker, mux)
+	p.cfg.AccessCode = ""
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"mock": p}}
+
+	result, err := m.UploadFile("mock", "asha_bracket.gcode", strings.NewReader("G28"), UploadOptions{Owner: "srinath"})
+	if err != nil || result.FileName != "asha_bracket-2.gcode" || len(result.Warnings) != 1 {
+		t.Errorf("sent as %+v (%v)", result, err)
+	}
+
+	_, err = m.UploadFile("mock", "asha_bracket.gcode", strings.NewReader("G28"),
+		UploadOptions{Owner: "srinath", OnConflict: ConflictRefuse})
+	if err == nil {
+		t.Error("refuse should have kept the file from being sent")
+	}
+
+	// Asha's own new slice replaces her old one
+	result, err = m.UploadFile("mock", "asha_bracket.gcode", strings.NewReader("G28"), UploadOptions{})
+	if err != nil || result.FileName != "asha_bracket.gcode" {
+		t.Errorf("sent as %+v (%v)", result, err)
+	}
+
+	if strings.Join(uploaded, ",") != "asha_bracket-2.gcode,asha_bracket.gcode" {
+		t.Errorf("uploaded %v", uploaded)
+	}
+}
+
+// A printer that will not list its files might be holding somebody else's
+// file of that name, so nothing is sent
+func TestUploadNeedsTheFileList(t *testing.T) {
+	uploaded := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/server/files/upload", func(w http.ResponseWriter, r *http.Request) {
+		uploaded = true
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/server/files/list", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	})
+	p := httpTestPrinter(t, DriverMoonraker, mux)
+	p.cfg.AccessCode = ""
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"mock": p}}
+
+	_, err := m.UploadFile("mock", "asha_bracket.gcode", strings.NewReader("G28"),
+		UploadOptions{Owner: "srinath", OnConflict: ConflictRefuse})
+	if err == nil || uploaded {
+		t.Errorf("sent without the file list (%v)", err)
+	}
+}
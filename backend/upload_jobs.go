@@ -0,0 +1,478 @@
+package main
+
+// Upload jobs.
+//
+// Sending a file to a printer used to happen inside the request, so a printer
+// that was off or asleep just meant an error and trying again later. Every
+// upload - one request from the printers page, or chunked - is now staged on
+// the server and handed to a job that sends it in the background:
+//
+//	queued → transferring → verifying → done
+//	                                  ↘ failed
+//
+// The checks that can refuse a file (the name, the slice, the filament) still
+// run while the sender is waiting, so those answers come back at once. A job
+// for a printer that is offline stays queued and goes as soon as status()
+// says the printer is back; a send that fails because the printer dropped
+// off part way, or the connection broke, is queued again, with a growing wait
+// between tries and a limit on how many. Anything else fails the job, which
+// can be retried. A job still waiting when UPLOAD_JOB_EXPIRY runs out (a day
+// unless set) is given up on.
+//
+// Uploads need no login, so what may wait on the server is capped, in all by
+// UPLOAD_STAGING_LIMIT_MB and by count for each printer.
+//
+// GET /api/uploads/:token reports where a job is, with the percentage sent.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultUploadJobExpiry = 24 * time.Hour
+	// How often queued jobs are checked against their printers
+	uploadJobPoll = 5 * time.Second
+	// How often finished and abandoned uploads are cleared away
+	uploadPruneInterval = time.Hour
+	// Sends tried before a job is failed, and the wait after the first
+	// failed one, doubling each time up to the most
+	maxUploadAttempts = 5
+	uploadRetryDelay  = 30 * time.Second
+	maxUploadRetry    = 15 * time.Minute
+	// What the staging directory may hold in all, unless set, and how many
+	// uploads may wait for one printer
+	defaultUploadStagingLimit = 2048 * 1024 * 1024
+	maxStagedPerPrinter       = 10
+)
+
+// Upload phases.
+const (
+	UploadReceiving    = "receiving" // chunks still arriving
+	UploadQueued       = "queued"    // waiting for the printer
+	UploadTransferring = "transferring"
+	UploadVerifying    = "verifying" // all sent; checking what the printer kept
+	UploadDone         = "done"
+	UploadFailedAt     = "failed" // may be retried
+)
+
+// UploadJobs keeps the staged uploads and sends them to their printers.
+type UploadJobs struct {
+	db       *gorm.DB
+	printers *PrinterManager
+	dir      string
+	expiry   time.Duration
+	// Bytes the staging directory may hold
+	stagingLimit int64
+
+	// Chunks are written one at a time, so two retries of the same chunk
+	// cannot interleave; also guards sending and busy
+	mu sync.Mutex
+	// How far each send to a printer has got, by token
+	sending map[string]*atomic.Int64
+	// Printers with a send under way; one at a time each, as the printers
+	// do not take kindly to parallel FTPS sessions
+	busy map[string]bool
+	// Nudges the worker when a job is queued, rather than waiting for the poll
+	wake chan struct{}
+}
+
+// NewUploadJobs stages files under dir, and reads how long a job may wait for
+// its printer from UPLOAD_JOB_EXPIRY.
+func NewUploadJobs(db *gorm.DB, printers *PrinterManager, dir string) *UploadJobs {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Printf("Warning: could not create the upload staging directory: %v", err)
+	}
+	return &UploadJobs{
+		db:           db,
+		printers:     printers,
+		dir:          dir,
+		expiry:       uploadJobExpiry(),
+		stagingLimit: uploadStagingLimit(),
+		sending:      map[string]*atomic.Int64{},
+		busy:         map[string]bool{},
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+func uploadJobExpiry() time.Duration {
+	raw := os.Getenv("UPLOAD_JOB_EXPIRY")
+	if raw == "" {
+		return defaultUploadJobExpiry
+	}
+	expiry, err := time.ParseDuration(raw)
+	if err != nil || expiry <= 0 {
+		log.Printf("Ignoring UPLOAD_JOB_EXPIRY=%q: not a duration like 12h", raw)
+		return defaultUploadJobExpiry
+	}
+	return expiry
+}
+
+// uploadStagingLimit reads UPLOAD_STAGING_LIMIT_MB.
+func uploadStagingLimit() int64 {
+	raw := os.Getenv("UPLOAD_STAGING_LIMIT_MB")
+	if raw == "" {
+		return defaultUploadStagingLimit
+	}
+	mb, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || mb <= 0 {
+		log.Printf("Ignoring UPLOAD_STAGING_LIMIT_MB=%q: not a number of megabytes", raw)
+		return defaultUploadStagingLimit
+	}
+	return mb * 1024 * 1024
+}
+
+// checkRoom refuses an upload the staging directory has no room for. Uploads
+// need no login, so without this anyone could fill the server's disk with
+// files for a printer that is switched off.
+func (u *UploadJobs) checkRoom(printerID string, size int64) error {
+	var staged struct {
+		Total int64
+		Count int64
+	}
+	if err := u.db.Model(&UploadSession{}).Where("phase <> ?", UploadDone).
+		Select("COALESCE(SUM(size), 0) AS total, COUNT(*) AS count").Scan(&staged).Error; err != nil {
+		return fmt.Errorf("could not check the space for uploads")
+	}
+	var waiting int64
+	if err := u.db.Model(&UploadSession{}).Where("printer_id = ? AND phase <> ?", printerID, UploadDone).
+		Count(&waiting).Error; err != nil {
+		return fmt.Errorf("could not check the space for uploads")
+	}
+	return stagingRoom(staged.Total, waiting, size, u.stagingLimit)
+}
+
+// stagingRoom is checkRoom's decision, given what is staged already.
+func stagingRoom(stagedBytes, waitingForPrinter, size, limit int64) error {
+	if waitingForPrinter >= maxStagedPerPrinter {
+		return fmt.Errorf("%d uploads are already waiting for this printer - wait for them to go, or cancel one", waitingForPrinter)
+	}
+	if stagedBytes+size > limit {
+		return fmt.Errorf("the server is holding as many uploads as it has room for - try again once some have reached their printers")
+	}
+	return nil
+}
+
+// Submit stages a file sent in one request and queues it, as Complete does
+// for a chunked upload. A file that is refused leaves nothing behind.
+func (u *UploadJobs) Submit(printerID string, req StartUpload, contents io.Reader) (UploadProgress, error) {
+	if err := u.checkStart(printerID, req); err != nil {
+		return UploadProgress{}, err
+	}
+	if err := u.checkRoom(printerID, req.Size); err != nil {
+		return UploadProgress{}, err
+	}
+	return u.submit(printerID, req, contents, "upload")
+}
+
+// SubmitFromQueue hands a file an admin dispatched from the print queue to a
+// job. It already waited on the server, so it does not count against what
+// uploads may stage.
+func (u *UploadJobs) SubmitFromQueue(printerID string, req StartUpload, contents io.Reader) (UploadProgress, error) {
+	if err := u.checkStart(printerID, req); err != nil {
+		return UploadProgress{}, err
+	}
+	return u.submit(printerID, req, contents, "queue")
+}
+
+func (u *UploadJobs) submit(printerID string, req StartUpload, contents io.Reader, via string) (UploadProgress, error) {
+	token, staged, file, err := u.stage()
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	sum := sha256.New()
+	size, err := io.Copy(file, io.TeeReader(contents, sum))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(staged)
+		return UploadProgress{}, fmt.Errorf("could not read the uploaded file")
+	}
+	req.Size = size
+	req.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	session, err := u.create(token, printerID, req, via, staged)
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	progress, err := u.Complete(token)
+	if err != nil {
+		os.Remove(staged)
+		u.db.Unscoped().Delete(&session)
+	}
+	return progress, err
+}
+
+// Complete checks a staged file is whole and would be accepted, then queues
+// it. A file that is refused stays staged as failed, so a chunked upload can
+// be completed again once the problem is fixed without sending it to the
+// server again; completing a failed job is also how it is retried.
+func (u *UploadJobs) Complete(token string) (UploadProgress, error) {
+	session, err := u.session(token)
+	if err != nil {
+		return UploadProgress{}, err
+	}
+
+	u.mu.Lock()
+	_, running := u.sending[token]
+	u.mu.Unlock()
+	switch {
+	case running || session.Phase == UploadTransferring:
+		return UploadProgress{}, fmt.Errorf("this upload is already being sent to the printer")
+	case session.Phase == UploadDone:
+		return UploadProgress{}, fmt.Errorf("this upload has already been sent")
+	case session.Phase == UploadQueued:
+		return u.progress(session), nil
+	}
+
+	if err := verifyStagedFile(session); err != nil {
+		return UploadProgress{}, err
+	}
+
+	file, err := os.Open(session.StagedFile)
+	if err != nil {
+		return UploadProgress{}, fmt.Errorf("the staged file is missing from the server - start the upload again")
+	}
+	warnings, err := u.printers.PrecheckUpload(session.PrinterID, session.FileName, file, session.options())
+	file.Close()
+	if err != nil {
+		u.db.Model(&session).Updates(map[string]interface{}{"phase": UploadFailedAt, "error": err.Error()})
+		return UploadProgress{}, err
+	}
+
+	// A retry starts the count of sends afresh
+	expires := time.Now().Add(u.expiry)
+	session.Phase = UploadQueued
+	session.Error = ""
+	session.ExpiresAt = &expires
+	session.RetryAt = nil
+	session.Attempts = 0
+	session.Warnings = warnings
+	if err := u.db.Select("phase", "error", "expires_at", "retry_at", "attempts", "warnings", "updated_at").Save(&session).Error; err != nil {
+		return UploadProgress{}, fmt.Errorf("could not queue the upload")
+	}
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+	return u.progress(session), nil
+}
+
+func (s UploadSession) options() UploadOptions {
+	return UploadOptions{
+		Owner:          s.Owner,
+		IgnoreFilament: s.IgnoreFilament,
+		OnConflict:     s.OnConflict,
+		ClientIP:       s.ClientIP,
+		SentBy:         s.SentBy,
+		Via:            s.Via,
+		Size:           s.Size,
+		SHA256:         s.SHA256,
+	}
+}
+
+// Cancel drops an upload that is not being sent right now, and its staged
+// file.
+func (u *UploadJobs) Cancel(token string) error {
+	session, err := u.session(token)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	_, busy := u.sending[token]
+	u.mu.Unlock()
+	if busy {
+		return fmt.Errorf("this upload is being sent to the printer and cannot be cancelled now")
+	}
+	os.Remove(session.StagedFile)
+	return u.db.Unscoped().Delete(&session).Error
+}
+
+// Run sends queued jobs as their printers come online, until the process
+// exits. Jobs left transferring by a restart are queued again first.
+func (u *UploadJobs) Run() {
+	u.db.Model(&UploadSession{}).Where("phase = ?", UploadTransferring).
+		Updates(map[string]interface{}{"phase": UploadQueued, "error": "interrupted by a server restart"})
+
+	lastPrune := time.Time{}
+	for {
+		if time.Since(lastPrune) > uploadPruneInterval {
+			u.prune(time.Now().Add(-u.expiry))
+			lastPrune = time.Now()
+		}
+		u.sendQueued()
+
+		select {
+		case <-u.wake:
+		case <-time.After(uploadJobPoll):
+		}
+	}
+}
+
+// sendQueued starts a send for each queued job whose printer is online and
+// not already taking a file, and fails those that have waited too long.
+func (u *UploadJobs) sendQueued() {
+	var queued []UploadSession
+	u.db.Where("phase = ?", UploadQueued).Order("id").Find(&queued)
+
+	for _, job := range queued {
+		if job.ExpiresAt != nil && time.Now().After(*job.ExpiresAt) {
+			u.fail(job, fmt.Sprintf("the printer did not come online within %s - send the file again", u.expiry))
+			continue
+		}
+		if job.RetryAt != nil && time.Now().Before(*job.RetryAt) {
+			continue
+		}
+		p, ok := u.printers.lookup(job.PrinterID)
+		if !ok {
+			u.fail(job, "that printer has been removed")
+			continue
+		}
+		if !p.status().Online {
+			if waiting := fmt.Sprintf("waiting for %s to come online", p.cfg.Name); job.Error != waiting {
+				u.db.Model(&job).Update("error", waiting)
+			}
+			continue
+		}
+
+		u.mu.Lock()
+		if u.busy[job.PrinterID] {
+			u.mu.Unlock()
+			continue
+		}
+		u.busy[job.PrinterID] = true
+		position := &atomic.Int64{}
+		u.sending[job.Token] = position
+		u.mu.Unlock()
+
+		go u.send(job, p, position)
+	}
+}
+
+func (u *UploadJobs) fail(job UploadSession, reason string) {
+	u.db.Model(&job).Updates(map[string]interface{}{"phase": UploadFailedAt, "error": reason})
+}
+
+// send runs one attempt at a job.
+func (u *UploadJobs) send(job UploadSession, p *printer, position *atomic.Int64) {
+	defer func() {
+		u.mu.Lock()
+		delete(u.sending, job.Token)
+		delete(u.busy, job.PrinterID)
+		u.mu.Unlock()
+	}()
+
+	file, err := os.Open(job.StagedFile)
+	if err != nil {
+		u.fail(job, "the staged file is missing from the server - start the upload again")
+		return
+	}
+	defer file.Close()
+
+	u.db.Model(&job).Updates(map[string]interface{}{
+		"phase": UploadTransferring, "error": "", "attempts": gorm.Expr("attempts + 1")})
+
+	result, err := u.printers.UploadFile(job.PrinterID, job.FileName,
+		progressFile{File: file, position: position}, job.options())
+	if err != nil {
+		attempts := job.Attempts + 1
+		if phase, reason := afterFailedSend(p.cfg.Name, p.status().Online, attempts, err); phase == UploadQueued {
+			retryAt := time.Now().Add(retryDelay(attempts))
+			u.db.Model(&job).Updates(map[string]interface{}{"phase": UploadQueued, "error": reason, "retry_at": retryAt})
+		} else {
+			u.fail(job, reason)
+		}
+		log.Printf("printer %s: upload job %s: %v", job.PrinterID, job.FileName, err)
+		return
+	}
+
+	job.Phase = UploadDone
+	job.Error = ""
+	job.SentName = result.FileName
+	job.Duplicate = result.Duplicate
+	job.Warnings = result.Warnings
+	u.db.Select("phase", "error", "sent_name", "duplicate", "warnings", "updated_at").Save(&job)
+	os.Remove(job.StagedFile)
+	if result.Duplicate {
+		log.Printf("printer %s: %s was already there, nothing sent", job.PrinterID, result.FileName)
+	} else {
+		log.Printf("printer %s: received upload %s", job.PrinterID, result.FileName)
+	}
+}
+
+// afterFailedSend decides what a failed send leads to: a printer that has
+// gone offline, or whose connection dropped, is waited for again; anything
+// else fails the job, as does the last of maxUploadAttempts. online alone is
+// not enough, as status() only notices a printer has gone quiet a couple of
+// minutes after it has.
+func afterFailedSend(printerName string, online bool, attempts int, err error) (phase, reason string) {
+	if online && !connectionDropped(err) {
+		return UploadFailedAt, err.Error()
+	}
+	if attempts >= maxUploadAttempts {
+		return UploadFailedAt, fmt.Sprintf("gave up after %d tries: %v", attempts, err)
+	}
+	if !online {
+		return UploadQueued, fmt.Sprintf("%s went offline during the send - it will be sent again when the printer is back", printerName)
+	}
+	return UploadQueued, fmt.Sprintf("the connection to %s dropped during the send - it will be sent again", printerName)
+}
+
+// retryDelay is how long a job waits after its attempts-th failed send. A
+// full card makes every send partial, and each one writes the file over again.
+func retryDelay(attempts int) time.Duration {
+	delay := uploadRetryDelay
+	for i := 1; i < attempts && delay < maxUploadRetry; i++ {
+		delay *= 2
+	}
+	if delay > maxUploadRetry {
+		delay = maxUploadRetry
+	}
+	return delay
+}
+
+// connectionDropped reports whether a send failed on the way rather than being
+// refused: the printer could not be reached, the session broke off, or only
+// part of the file arrived. A changed certificate is not retried, as it will
+// not change back on its own.
+func connectionDropped(err error) bool {
+	var changed *CertificateChangedError
+	if errors.As(err, &changed) {
+		return false
+	}
+	var partial *PartialUploadError
+	var netErr net.Error
+	return errors.As(err, &partial) || errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// prune clears out uploads nobody has touched since before, with their
+// staged files.
+func (u *UploadJobs) prune(before time.Time) {
+	var stale []UploadSession
+	u.db.Where("updated_at < ? AND phase <> ?", before, UploadQueued).Find(&stale)
+	for _, session := range stale {
+		u.mu.Lock()
+		_, busy := u.sending[session.Token]
+		u.mu.Unlock()
+		if busy {
+			continue
+		}
+		os.Remove(session.StagedFile)
+		u.db.Unscoped().Delete(&session)
+	}
+}
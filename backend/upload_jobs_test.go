@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadJobProgress(t *testing.T) {
+	u := &UploadJobs{sending: map[string]*atomic.Int64{}}
+	position := &atomic.Int64{}
+	u.sending["abc"] = position
+	job := UploadSession{Token: "abc", Size: 200, Phase: UploadTransferring}
+
+	position.Store(50)
+	if view := u.progress(job); view.Phase != UploadTransferring || view.Percent != 25 {
+		t.Errorf("part way: %s at %d%%", view.Phase, view.Percent)
+	}
+
+	// Everything has gone and the printer is being asked what it kept
+	position.Store(200)
+	if view := u.progress(job); view.Phase != UploadVerifying || view.Percent != 100 {
+		t.Errorf("all sent: %s at %d%%", view.Phase, view.Percent)
+	}
+
+	delete(u.sending, "abc")
+	job.Phase = UploadDone
+	if view := u.progress(job); view.Phase != UploadDone || view.Percent != 100 {
+		t.Errorf("done: %s at %d%%", view.Phase, view.Percent)
+	}
+
+	job.Phase = UploadQueued
+	if view := u.progress(job); view.Percent != 0 {
+		t.Errorf("a queued job has sent nothing, got %d%%", view.Percent)
+	}
+}
+
+// A file dispatched from the queue is recorded as the admin's, not as an
+// anonymous upload
+func TestQueuedUploadKeepsItsSender(t *testing.T) {
+	job := UploadSession{Owner: "ada", SentBy: "grace", Via: "queue"}
+	if opts := job.options(); opts.SentBy != "grace" || opts.Via != "queue" || opts.Owner != "ada" {
+		t.Errorf("options lost who sent it: %+v", opts)
+	}
+}
+
+func TestAfterFailedSend(t *testing.T) {
+	refused := errors.New("the printer refused the file: 552")
+
+	phase, reason := afterFailedSend("P1S", false, 1, refused)
+	if phase != UploadQueued || !strings.Contains(reason, "P1S went offline") {
+		t.Errorf("a printer that dropped off should be waited for: %s, %q", phase, reason)
+	}
+	phase, reason = afterFailedSend("P1S", true, 1, refused)
+	if phase != UploadFailedAt || reason != refused.Error() {
+		t.Errorf("a printer that is up and refused should fail the job: %s, %q", phase, reason)
+	}
+
+	// status() still says online for a while after the printer drops off
+	for _, dropped := range []error{
+		fmt.Errorf("could not connect to the printer's file service: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+		fmt.Errorf("the printer refused the file: %w", io.ErrUnexpectedEOF),
+		&PartialUploadError{Name: "a.3mf", Stored: 10, Sent: 20},
+	} {
+		if phase, _ := afterFailedSend("P1S", true, 1, dropped); phase != UploadQueued {
+			t.Errorf("%v should be sent again, got %s", dropped, phase)
+		}
+	}
+	changed := fmt.Errorf("could not connect: %w", &net.OpError{Op: "remote error", Err: &CertificateChangedError{PrinterName: "P1S"}})
+	if phase, _ := afterFailedSend("P1S", true, 1, changed); phase != UploadFailedAt {
+		t.Errorf("a changed certificate should fail the job, got %s", phase)
+	}
+
+	// A card that is full makes every send partial, so it is not tried forever
+	full := &PartialUploadError{Name: "a.3mf", Stored: 10, Sent: 20}
+	phase, reason = afterFailedSend("P1S", true, maxUploadAttempts, full)
+	if phase != UploadFailedAt || !strings.Contains(reason, "gave up after 5 tries") {
+		t.Errorf("the last attempt should fail the job: %s, %q", phase, reason)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1: 30 * time.Second, 2: time.Minute, 3: 2 * time.Minute, 6: 15 * time.Minute, 40: 15 * time.Minute,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("after %d tries: %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestStagingRoom(t *testing.T) {
+	const mb = 1024 * 1024
+	if err := stagingRoom(100*mb, 2, 50*mb, 200*mb); err != nil {
+		t.Errorf("there is room: %v", err)
+	}
+	if err := stagingRoom(180*mb, 2, 50*mb, 200*mb); err == nil {
+		t.Error("a file that would overfill staging should be refused")
+	}
+	if err := stagingRoom(0, maxStagedPerPrinter, mb, 200*mb); err == nil {
+		t.Error("one printer cannot have more than its share waiting")
+	}
+}
+
+func TestUploadJobExpiry(t *testing.T) {
+	t.Setenv("UPLOAD_JOB_EXPIRY", "")
+	if got := uploadJobExpiry(); got != defaultUploadJobExpiry {
+		t.Errorf("unset gave %s", got)
+	}
+	t.Setenv("UPLOAD_JOB_EXPIRY", "90m")
+	if got := uploadJobExpiry(); got != 90*time.Minute {
+		t.Errorf("90m gave %s", got)
+	}
+	for _, bad := range []string{"a day", "-1h", "0s"} {
+		t.Setenv("UPLOAD_JOB_EXPIRY", bad)
+		if got := uploadJobExpiry(); got != defaultUploadJobExpiry {
+			t.Errorf("%q gave %s", bad, got)
+		}
+	}
+}
+
+func TestPrecheckUpload(t *testing.T) {
+	p := &printer{cfg: PrinterConfig{ID: "p1s", Name: "P1S"}}
+	m := &PrinterManager{printers: []*printer{p}, byID: map[string]*printer{"p1s": p}}
+
+	if _, err := m.PrecheckUpload("nope", "a.gcode", bytes.NewReader(nil), UploadOptions{}); err == nil {
+		t.Error("unknown printers should be refused")
+	}
+	if _, err := m.PrecheckUpload("p1s", "notes.txt", bytes.NewReader(nil), UploadOptions{}); err == nil {
+		t.Error("a file that is not sliced should be refused")
+	}
+
+	contents := bytes.NewReader([]byte("G28\n"))
+	if _, err := m.PrecheckUpload("p1s", "srinath_bracket.gcode", contents, UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if read, _ := io.ReadAll(contents); string(read) != "G28\n" {
+		t.Errorf("the file was not rewound for the send: %q", read)
+	}
+
+	p.underMaintenance = true
+	if _, err := m.PrecheckUpload("p1s", "srinath_bracket.gcode", contents, UploadOptions{}); err == nil {
+		t.Error("a printer under maintenance should refuse files up front")
+	}
+}
+
+func TestUploadRecordKeepsAKnownHash(t *testing.T) {
+	record := newUploadRecord("p1s", "hello.gcode", UploadOptions{Size: 5, SHA256: helloSHA256})
+	contents := strings.NewReader("hello")
+	if sent := record.hash(contents); sent != io.Reader(contents) {
+		t.Error("a staged file's hash is already known, so it should go through untouched")
+	}
+	if contents.Len() != 5 {
+		t.Error("the file was read again")
+	}
+	if record.SHA256 != helloSHA256 || record.Size != 5 || record.Outcome != UploadFailed {
+		t.Errorf("unexpected record: %+v", record)
+	}
+}
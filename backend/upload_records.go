@@ -0,0 +1,209 @@
+package main
+
+// Upload history.
+//
+// Every file sent to a printer through the site - from the page or from the
+// queue - leaves an UploadRecord: what it was called before and after
+// cleaning, its size and SHA-256, whose it is, who sent it and from where, and
+// how it went, down to a transfer that only partly arrived. When a printer
+// later starts a file, the record is linked to the PrintJob, so admins can see
+// who sent what and whether it was ever printed.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Upload outcomes.
+const (
+	UploadSent    = "sent"
+	UploadRefused = "refused" // turned away before anything was sent
+	UploadFailed  = "failed"  // the transfer itself went wrong
+	// Nothing sent, because the same file was already on the printer
+	UploadDuplicate = "duplicate"
+	// A transfer that only partly arrived, and whether the partial file was
+	// removed from the printer or is still there
+	UploadPartialRemoved = "partial_removed"
+	UploadPartialLeft    = "partial_left"
+)
+
+// UploadRecord is one attempt to send a file to a printer.
+type UploadRecord struct {
+	gorm.Model
+	PrinterID string `json:"printer_id" gorm:"index"`
+	// As stored on the printer; empty when the name itself was refused
+	FileName     string `json:"file_name" gorm:"index"`
+	OriginalName string `json:"original_name"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256" gorm:"index"`
+	Owner        string `json:"owner" gorm:"index"`
+	// The admin, for files sent from the queue
+	SentBy   string `json:"sent_by"`
+	ClientIP string `json:"client_ip"`
+	// "upload" from the printers page, "queue" from the print queue
+	Via     string    `json:"via"`
+	At      time.Time `json:"at"`
+	Outcome string    `json:"outcome" gorm:"index"`
+	Detail  string    `json:"detail"`
+
+	// The first job that printed the file, and how many have since
+	PrintJobID *uint      `json:"print_job_id" gorm:"index"`
+	PrintedAt  *time.Time `json:"printed_at"`
+	PrintCount int        `json:"print_count"`
+}
+
+func newUploadRecord(printerID, originalName string, opts UploadOptions) *UploadRecord {
+	via := opts.Via
+	if via == "" {
+		via = "upload"
+	}
+	return &UploadRecord{
+		PrinterID:    printerID,
+		OriginalName: originalName,
+		SentBy:       opts.SentBy,
+		ClientIP:     opts.ClientIP,
+		Via:          via,
+		Size:         opts.Size,
+		SHA256:       opts.SHA256,
+		At:           time.Now(),
+		Outcome:      UploadRefused,
+	}
+}
+
+// hashingReader hashes a file as it goes to the printer, for uploads that
+// cannot be read twice.
+type hashingReader struct {
+	inner io.Reader
+	hash  hash.Hash
+	n     int64
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	read, err := h.inner.Read(p)
+	h.hash.Write(p[:read])
+	h.n += int64(read)
+	return read, err
+}
+
+// hash fills in the size and SHA-256, and marks the record as past the
+// checks. A file that can be rewound - which every upload from the page is -
+// is hashed up front and handed back unchanged; anything else is hashed on its
+// way through, and finishHash completes the record. A hash the sender already
+// had is kept as it is.
+func (r *UploadRecord) hash(contents io.Reader) io.Reader {
+	r.Outcome = UploadFailed
+	if r.SHA256 != "" {
+		return contents
+	}
+
+	if seeker, ok := contents.(io.ReadSeeker); ok {
+		sum := sha256.New()
+		size, err := io.Copy(sum, seeker)
+		if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr == nil {
+			if err == nil {
+				r.Size = size
+				r.SHA256 = hex.EncodeToString(sum.Sum(nil))
+				return contents
+			}
+		}
+	}
+	return &hashingReader{inner: contents, hash: sha256.New()}
+}
+
+func (r *UploadRecord) finishHash(sent io.Reader) {
+	if hashed, ok := sent.(*hashingReader); ok {
+		r.Size = hashed.n
+		r.SHA256 = hex.EncodeToString(hashed.hash.Sum(nil))
+	}
+}
+
+// saveUploadRecord writes the record with the outcome err gives it.
+func (m *PrinterManager) saveUploadRecord(record *UploadRecord, err error) {
+	var partial *PartialUploadError
+	switch {
+	case err == nil && record.Outcome != UploadDuplicate:
+		record.Outcome = UploadSent
+	case errors.As(err, &partial):
+		record.Outcome = UploadPartialRemoved
+		if partial.DeleteErr != nil {
+			record.Outcome = UploadPartialLeft
+		}
+	}
+	if err != nil {
+		record.Detail = err.Error()
+	}
+
+	if m.db == nil {
+		return
+	}
+	if dbErr := m.db.Create(record).Error; dbErr != nil {
+		log.Printf("printer %s: could not record the upload of %s: %v", record.PrinterID, record.OriginalName, dbErr)
+	}
+}
+
+// linkUploadLocked ties a newly started job to the upload of its file: the
+// most recent successful one. Called with the lock held, once the job is
+// saved.
+func (p *printer) linkUploadLocked(job *PrintJob) {
+	if p.jobs == nil || job.ID == 0 {
+		return
+	}
+
+	var record UploadRecord
+	err := p.jobs.Where("printer_id = ? AND outcome = ? AND file_name IN ?",
+		p.cfg.ID, UploadSent, jobFileCandidates(job.FileName)).
+		Order("at DESC").First(&record).Error
+	if err != nil {
+		return
+	}
+
+	updates := map[string]interface{}{"print_count": gorm.Expr("print_count + 1")}
+	if record.PrintJobID == nil {
+		updates["print_job_id"] = job.ID
+		updates["printed_at"] = job.StartedAt
+	}
+	p.jobs.Model(&record).Updates(updates)
+}
+
+// UploadFilter narrows the upload history.
+type UploadFilter struct {
+	PrinterID string
+	Owner     string
+	Outcome   string
+	// "true" or "false" to show only files that were, or were never, printed
+	Printed string
+}
+
+// Uploads lists the upload history, newest first.
+func (m *PrinterManager) Uploads(filter UploadFilter) ([]UploadRecord, error) {
+	records := []UploadRecord{}
+	if m.db == nil {
+		return records, nil
+	}
+
+	query := m.db.Order("at DESC").Limit(500)
+	if filter.PrinterID != "" {
+		query = query.Where("printer_id = ?", filter.PrinterID)
+	}
+	if owner := normalizeOwner(filter.Owner); owner != "" {
+		query = query.Where("owner = ?", owner)
+	}
+	if filter.Outcome != "" {
+		query = query.Where("outcome = ?", filter.Outcome)
+	}
+	switch filter.Printed {
+	case "true":
+		query = query.Where("print_job_id IS NOT NULL")
+	case "false":
+		query = query.Where("print_job_id IS NULL AND outcome = ?", UploadSent)
+	}
+	err := query.Find(&records).Error
+	return records, err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestUploadRecordHash(t *testing.T) {
+	// A rewindable file is hashed first and handed back as it was
+	record := newUploadRecord("p1s", "hello.gcode", UploadOptions{})
+	contents := bytes.NewReader([]byte("hello"))
+	sent := record.hash(contents)
+	if sent != io.Reader(contents) {
+		t.Error("a rewindable file should go through unwrapped")
+	}
+	if record.SHA256 != helloSHA256 || record.Size != 5 {
+		t.Errorf("hash %s, size %d", record.SHA256, record.Size)
+	}
+	if read, _ := io.ReadAll(sent); string(read) != "hello" {
+		t.Errorf("the file was not rewound: %q", read)
+	}
+}
+
+func TestUploadRecordHashStreaming(t *testing.T) {
+	record := newUploadRecord("p1s", "hello.gcode", UploadOptions{})
+	sent := record.hash(io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")))
+	if record.SHA256 != "" {
+		t.Error("a stream cannot be hashed before it is sent")
+	}
+	io.Copy(io.Discard, sent)
+	record.finishHash(sent)
+	if record.SHA256 != helloSHA256 || record.Size != 5 {
+		t.Errorf("hash %s, size %d", record.SHA256, record.Size)
+	}
+}
+
+func TestUploadRecordOutcome(t *testing.T) {
+	m := &PrinterManager{}
+	cases := []struct {
+		hashed bool
+		err    error
+		want   string
+	}{
+		{true, nil, UploadSent},
+		{false, errors.New("that file name is not usable"), UploadRefused},
+		{true, errors.New("could not connect"), UploadFailed},
+		{true, &PartialUploadError{Name: "a.3mf", Stored: 10, Sent: 20}, UploadPartialRemoved},
+		{true, &PartialUploadError{Name: "a.3mf", Stored: 10, Sent: 20, DeleteErr: errors.New("550")}, UploadPartialLeft},
+	}
+	for _, c := range cases {
+		record := newUploadRecord("p1s", "a.3mf", UploadOptions{ClientIP: "10.0.0.5"})
+		if c.hashed {
+			record.hash(bytes.NewReader(nil))
+		}
+		m.saveUploadRecord(record, c.err)
+		if record.Outcome != c.want {
+			t.Errorf("%v gave %s, want %s", c.err, record.Outcome, c.want)
+		}
+		if c.err != nil && record.Detail != c.err.Error() {
+			t.Errorf("detail %q", record.Detail)
+		}
+		if record.Via != "upload" || record.ClientIP != "10.0.0.5" {
+			t.Errorf("unexpected record: %+v", record)
+		}
+	}
+}
+
+func TestPartialUploadErrorMessages(t *testing.T) {
+	removed := &PartialUploadError{Name: "a.3mf", Stored: 10, Sent: 20}
+	if !strings.Contains(removed.Error(), "so the file was removed") {
+		t.Error(removed.Error())
+	}
+	left := &PartialUploadError{Name: "a.3mf", Stored: 10, Sent: 20, DeleteErr: errors.New("550")}
+	if !strings.Contains(left.Error(), "delete a.3mf from the printer") {
+		t.Error(left.Error())
+	}
+}
@@ -90,3 +90,7 @@ echo "   Photos: $PHOTO_COUNT"
 echo ""
 echo "   Copy this single file anywhere to move or archive the system."
 echo "   Restore it with: ./restore.sh $ARCHIVE"
+if [ -n "$(read_env_value SECRET_KEY)" ]; then
+    echo "   Printer access codes and alert URLs in it are encrypted with SECRET_KEY from .env,"
+    echo "   which is not in the archive - keep a copy of .env to read them."
+fi
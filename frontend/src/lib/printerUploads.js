@@ -0,0 +1,103 @@
+// Sending a sliced file to a printer.
+//
+// Small files go in one request. Bigger ones go through the resumable upload
+// protocol (see backend/chunked_uploads.go), because on the campus wifi a
+// 150 MB plate in one request often dies part way and starts again from
+// nothing. Each chunk that fails is picked up from wherever the server says
+// it got to, so a dropped connection only costs the chunk in flight.
+//
+// Either way the answer is the background job that sends the file on to the
+// printer: 202 with its token, or the error that refused it.
+
+// Files bigger than this go in chunks
+const CHUNKED_ABOVE = 16 * 1024 * 1024;
+// Chunks tried in a row before giving up on the connection
+const MAX_CHUNK_RETRIES = 8;
+
+// request is an XHR rather than fetch, because these files are big enough
+// that a progress bar matters. It resolves with the status (0 when the
+// connection dropped) and the JSON body.
+function request(method, url, body, headers = {}, onProgress) {
+    return new Promise((resolve) => {
+        const xhr = new XMLHttpRequest();
+        xhr.open(method, url);
+        for (const [name, value] of Object.entries(headers)) {
+            xhr.setRequestHeader(name, value);
+        }
+        if (onProgress) {
+            xhr.upload.onprogress = (e) => onProgress(e.loaded);
+        }
+        xhr.onload = () => {
+            let parsed = {};
+            try {
+                parsed = JSON.parse(xhr.responseText);
+            } catch (e) {
+                parsed = {};
+            }
+            resolve({ status: xhr.status, body: parsed });
+        };
+        xhr.onerror = () => resolve({ status: 0, body: {} });
+        xhr.send(body);
+    });
+}
+
+async function sha256(file) {
+    const digest = await crypto.subtle.digest('SHA-256', await file.arrayBuffer());
+    return Array.from(new Uint8Array(digest), (b) => b.toString(16).padStart(2, '0')).join('');
+}
+
+function sendWhole(printerId, file, headers, onProgress) {
+    const form = new FormData();
+    form.append('file', file);
+    return request('POST', `/api/printers/${printerId}/files`, form, headers,
+        (loaded) => onProgress(Math.round((loaded / file.size) * 100)));
+}
+
+async function sendInChunks(printerId, file, headers, onProgress) {
+    const started = await request('POST', `/api/printers/${printerId}/uploads`,
+        JSON.stringify({ file_name: file.name, size: file.size, sha256: await sha256(file) }),
+        { ...headers, 'Content-Type': 'application/json' });
+    if (started.status !== 201) return started;
+
+    const { token, chunk_size: chunkSize } = started.body;
+    let received = started.body.received || 0;
+    let failures = 0;
+
+    while (received < file.size) {
+        const offset = received;
+        const sent = await request('PUT', `/api/uploads/${token}`, file.slice(offset, offset + chunkSize),
+            { ...headers, 'Upload-Offset': String(offset), 'Content-Type': 'application/octet-stream' },
+            (loaded) => onProgress(Math.round(((offset + loaded) / file.size) * 100)));
+
+        if (sent.status === 200 || (sent.status === 409 && typeof sent.body.received === 'number')) {
+            // A 409 is the server saying where it actually is
+            received = sent.body.received;
+            failures = 0;
+            continue;
+        }
+        if (sent.status !== 0 && sent.status < 500) return sent;
+
+        // Dropped: wait a little, ask how far the server got, carry on
+        failures++;
+        if (failures > MAX_CHUNK_RETRIES) {
+            return { status: 0, body: { error: 'The connection kept dropping - try again when the wifi is steadier' } };
+        }
+        await new Promise((resolve) => setTimeout(resolve, Math.min(2000 * failures, 15000)));
+        const asked = await request('GET', `/api/uploads/${token}`, null, headers);
+        if (asked.status === 200) received = asked.body.received;
+    }
+
+    onProgress(100);
+    return request('POST', `/api/uploads/${token}/complete`, null, headers);
+}
+
+// sendToPrinter uploads a file for a printer, reporting the percentage that
+// has reached the server. headers are added to every request, for an admin's
+// token.
+export function sendToPrinter(printerId, file, { headers = {}, onProgress = () => {} } = {}) {
+    // Hashing needs a secure context; without one the file goes whole
+    if (file.size > CHUNKED_ABOVE && globalThis.crypto?.subtle) {
+        return sendInChunks(printerId, file, headers, onProgress);
+    }
+    return sendWhole(printerId, file, headers, onProgress);
+}